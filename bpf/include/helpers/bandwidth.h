@@ -0,0 +1,130 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+#pragma once
+
+#include <linux/if_ether.h>
+#include <linux/ip.h>
+
+#include "helpers.h"
+#include "maps.h"
+
+#define NSEC_PER_SEC 1000000000ULL
+
+// How far in the future egress packets may be scheduled when the limit has
+// no burst.
+#define BANDWIDTH_DEFAULT_HORIZON_NS (2 * NSEC_PER_SEC)
+
+// The shaping state is updated without locking. Concurrent updates from
+// several CPUs may let a few packets through early, which is fine for
+// shaping.
+
+static inline __u64 egress_horizon(struct pod_bandwidth *bw) {
+  if (!bw->egress_burst) {
+    return BANDWIDTH_DEFAULT_HORIZON_NS;
+  }
+  return bw->egress_burst * NSEC_PER_SEC / bw->egress_rate;
+}
+
+// Assigns the departure time of an egress packet of len bytes. Returns 0 if
+// the packet is past the horizon and must be dropped.
+static inline int egress_schedule(struct pod_bandwidth *bw, __u32 len,
+                                  __u64 now, __u64 *departure) {
+  __u64 delay = (__u64)len * NSEC_PER_SEC / bw->egress_rate;
+  __u64 next = bw->egress_next_ns;
+  if (next <= now) {
+    bw->egress_next_ns = now + delay;
+    *departure = now;
+    return 1;
+  }
+  if (next - now >= egress_horizon(bw)) {
+    return 0;
+  }
+  bw->egress_next_ns = next + delay;
+  *departure = next;
+  return 1;
+}
+
+// Takes len bytes from the ingress token bucket. Returns 0 if there are not
+// enough tokens left.
+static inline int ingress_take(struct pod_bandwidth *bw, __u32 len,
+                               __u64 now) {
+  __u64 burst = bw->ingress_burst ? bw->ingress_burst : bw->ingress_rate;
+  __u64 tokens = burst;
+  __u64 elapsed = now - bw->ingress_last_ns;
+  if (elapsed < NSEC_PER_SEC) {
+    tokens = bw->ingress_tokens + elapsed * bw->ingress_rate / NSEC_PER_SEC;
+    if (tokens > burst) {
+      tokens = burst;
+    }
+  }
+  bw->ingress_last_ns = now;
+  if (tokens < len) {
+    bw->ingress_tokens = tokens;
+    return 0;
+  }
+  bw->ingress_tokens = tokens - len;
+  return 1;
+}
+
+// Reads the addresses of an IPv4 packet. Returns 0 for other packets.
+static inline int ipv4_addrs(struct __sk_buff *skb, __u32 *saddr,
+                             __u32 *daddr) {
+  void *data = (void *)(long)skb->data;
+  void *data_end = (void *)(long)skb->data_end;
+  struct ethhdr *eth = data;
+  if ((void *)(eth + 1) > data_end || eth->h_proto != bpf_htons(ETH_P_IP)) {
+    return 0;
+  }
+  struct iphdr *ip = (void *)(eth + 1);
+  if ((void *)(ip + 1) > data_end) {
+    return 0;
+  }
+  *saddr = ip->saddr;
+  *daddr = ip->daddr;
+  return 1;
+}
+
+static inline struct pod_bandwidth *lookup_pod_bandwidth(__u32 ip) {
+  __u32 *ifindex = map_lookup_elem(&bandwidth_pod_map, &ip);
+  if (!ifindex) {
+    return 0;
+  }
+  return map_lookup_elem(&bandwidth_map, ifindex);
+}
+
+// Reports whether either end of a local connection has bandwidth limits.
+static inline int bandwidth_limited(__u32 src_ip, __u32 dst_ip) {
+  return lookup_pod_bandwidth(src_ip) || lookup_pod_bandwidth(dst_ip);
+}
+
+// Charges a message redirected by sk_msg to the egress limit of the sending
+// pod and the ingress limit of the receiving one, as the TC programs never
+// see it. Returns 0 once a limit is exceeded.
+static inline int bandwidth_budget(__u32 src_ip, __u32 dst_ip, __u32 len) {
+  __u64 now = ktime_get_ns();
+  struct pod_bandwidth *src = lookup_pod_bandwidth(src_ip);
+  if (src && src->egress_rate) {
+    __u64 departure;
+    if (!egress_schedule(src, len, now, &departure)) {
+      return 0;
+    }
+  }
+  struct pod_bandwidth *dst = lookup_pod_bandwidth(dst_ip);
+  if (dst && dst->ingress_rate && !ingress_take(dst, len, now)) {
+    return 0;
+  }
+  return 1;
+}
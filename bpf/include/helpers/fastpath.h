@@ -0,0 +1,68 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+#pragma once
+
+#include "helpers.h"
+#include "maps.h"
+#include "policy.h"
+#include "tuple.h"
+
+#define ETH_DST_OFF 0
+#define ETH_SRC_OFF ETH_ALEN
+
+static inline void reverse_tuple(struct ipv4_tuple *tuple,
+                                 struct ipv4_tuple *rev) {
+  rev->saddr = tuple->daddr;
+  rev->daddr = tuple->saddr;
+  rev->sport = tuple->dport;
+  rev->dport = tuple->sport;
+  rev->proto = tuple->proto;
+}
+
+// Records that the replies to the packet go through the stack.
+static inline void fastpath_track_stack(struct ipv4_tuple *tuple) {
+  struct ipv4_tuple rev = {};
+  reverse_tuple(tuple, &rev);
+  if (!map_lookup_elem(&fastpath_stack_map, &rev)) {
+    __u8 stack = 1;
+    map_update_elem(&fastpath_stack_map, &rev, &stack, BPF_ANY);
+  }
+}
+
+// Returns the local pod a packet of a pod can be handed to directly, or 0 if
+// it must go through the stack.
+static inline struct endpoint *fastpath_lookup(struct __sk_buff *skb,
+                                               struct ipv4_tuple *tuple) {
+  struct endpoint *ep = map_lookup_elem(&endpoint_map, &tuple->daddr);
+  if (!ep || ep->ifindex == skb->ifindex) {
+    return 0;
+  }
+  // The ingress limit of the pod is enforced on the TC egress of its host
+  // veth, which a redirected packet skips.
+  struct pod_bandwidth *bw = map_lookup_elem(&bandwidth_map, &ep->ifindex);
+  if (bw && bw->ingress_rate) {
+    return 0;
+  }
+  // So are its ingress policies, for the packets the connect4 and sockops
+  // hooks don't see, e.g. UDP or sockets older than the policy.
+  if (policy_ingress_isolated(tuple->daddr)) {
+    return 0;
+  }
+  if (map_lookup_elem(&fastpath_stack_map, tuple)) {
+    return 0;
+  }
+  return ep;
+}
@@ -63,7 +63,70 @@ struct socket_key {
   __u32 dst_port;
 } __attribute__((packed));
 
-enum cni_config_key { SUBNET_IP, CIDR, DEBUG };
+enum cni_config_key { SUBNET_IP, CIDR, DEBUG, FLOW_RECORDS, TCP_TELEMETRY };
+
+// Identities below POD_IDENTITY_MIN are reserved. Any address that patud has
+// not assigned an identity to (hosts, outside world) is WORLD.
+#define IDENTITY_ANY 0
+#define IDENTITY_WORLD 1
+#define POD_IDENTITY_MIN 256
+
+enum policy_direction { POLICY_INGRESS = 1, POLICY_EGRESS = 2 };
+
+// The policy keys are LPM trie keys. The fields before the port are matched
+// in full and the port, in network order, by prefix, so a range of ports is
+// stored as the few prefixes covering it. A port prefix of 0 bits matches any
+// port.
+struct policy_key {
+  __u32 prefixlen;
+  __u32 identity;
+  __u32 peer_identity;
+  __u8 direction;
+  __u8 pad;
+  __u16 port;
+} __attribute__((packed));
+
+#define POLICY_KEY_PREFIXLEN 96
+
+struct policy_value {
+  __u32 policy_id;
+};
+
+struct policy_port_key {
+  __u32 prefixlen;
+  __u32 identity;
+  __u16 port;
+} __attribute__((packed));
+
+#define POLICY_PORT_KEY_PREFIXLEN 48
+
+// Non zero policy id means the pod is selected by at least one policy of that
+// direction and only explicitly allowed connections are accepted. In audit
+// mode denials are only reported to patud, the connection is allowed.
+struct policy_isolation {
+  __u32 ingress_policy_id;
+  __u32 egress_policy_id;
+  __u32 audit;
+};
+
+struct policy_verdict {
+  __u32 policy_id;
+  __u8 direction;
+  __u8 audit;
+};
+
+// The source is always the client and the destination the server side of the
+// connection.
+struct policy_audit_event {
+  __u32 src_ip;
+  __u32 dst_ip;
+  __u16 src_port; // network order
+  __u16 dst_port; // network order
+  __u32 policy_id;
+  __u8 direction;
+  __u8 pad1;
+  __u16 pad2;
+};
 
 union cni_config_value {
   struct {
@@ -84,6 +147,120 @@ union cni_config_value {
     __u32 nil3;
     __u32 debug;
   };
+  struct {
+    __u32 nil4;
+    __u32 nil5;
+    __u32 nil6;
+    __u32 enabled;
+  };
+};
+
+struct flow_stats {
+  __u64 start_ns;
+  __u64 bytes;
+  __u64 msgs;
+};
+
+// Bucket i counts smoothed RTT samples below 2^i usecs, the last bucket counts
+// everything above.
+#define TCP_RTT_BUCKETS 24
+
+struct tcp_stats_key {
+  __u32 local_ip;
+  __u32 remote_ip;
+};
+
+struct tcp_stats {
+  __u64 rtt_buckets[TCP_RTT_BUCKETS];
+  __u64 rtt_sum_us;
+  __u64 rtt_count;
+  __u64 retrans;
+};
+
+#define TCP_CA_NAME_MAX 16
+
+// Per pod TCP settings applied by patu_sockops, 0 or an empty name leaves the
+// kernel default in place.
+struct tcp_tuning {
+  char congestion[TCP_CA_NAME_MAX];
+  __u32 init_cwnd;
+  __u32 rto_min_us;
+  __u32 keepalive_idle;  // seconds
+  __u32 keepalive_intvl; // seconds
+  __u32 keepalive_cnt;
+};
+
+// Flushed to patud when the socket closes. Times are CLOCK_MONOTONIC.
+struct flow_record {
+  struct socket_key key;
+  __u64 start_ns;
+  __u64 end_ns;
+  __u64 bytes;
+  __u64 msgs;
+};
+
+// A host port, or the pod endpoint it is forwarded to. ip and port are in
+// network order.
+struct hostport_endpoint {
+  __u32 ip;
+  __u16 port;
+  __u8 proto;
+  __u8 pad;
+};
+
+// Per pod limits from the bandwidth capability and the shaping state shared by
+// the TC programs on the pod's host veth and the uplink, and sk_msg. Rates are in bytes per
+// second and bursts in bytes, a zero rate is unlimited.
+struct pod_bandwidth {
+  __u64 egress_rate;
+  __u64 egress_burst;
+  __u64 ingress_rate;
+  __u64 ingress_burst;
+  __u64 egress_next_ns; // departure time of the next egress packet
+  __u64 ingress_tokens;
+  __u64 ingress_last_ns;
+  // Subnet of the pod when netfilter masquerades it, its egress to other
+  // networks leaves the node from the node address. Zero otherwise.
+  __u32 masq_net;
+  __u32 masq_mask;
+};
+
+// A local pod, written by the CNI plugin. ifindex is the host veth of the pod,
+// mac the address of the pod interface and host_mac the one of the host veth.
+struct endpoint {
+  __u32 ifindex;
+  __u8 mac[6];
+  __u8 host_mac[6];
+};
+
+// Configuration of the eBPF SNAT on the uplink, written by patud. Pod
+// traffic leaving the cluster network is masqueraded to the node address.
+// Addresses are in network order, ports in host order.
+struct snat_config {
+  __u32 node_ip;
+  __u32 pod_net;
+  __u32 pod_mask;
+  __u32 cluster_net;
+  __u32 cluster_mask;
+  __u16 port_min;
+  __u16 port_max;
+};
+
+// A packet's addresses and ports, or ICMP echo id, in network order.
+struct ipv4_tuple {
+  __u32 saddr;
+  __u32 daddr;
+  __u16 sport;
+  __u16 dport;
+  __u8 proto;
+  __u8 pad1;
+  __u16 pad2;
+};
+
+struct snat_endpoint {
+  __u32 addr;
+  __u16 port;
+  __u16 pad;
 };
 
 static __u64 BPF_FUNC(get_current_pid_tgid);
@@ -96,3 +273,23 @@ static long BPF_FUNC(sk_redirect_hash, struct __sk_buff *skb, void *map,
                      void *key, __u64 flag);
 static long BPF_FUNC(msg_redirect_hash, struct sk_msg_md *msg, void *map,
                      void *key, __u64 flags);
+static long BPF_FUNC(map_update_elem, void *map, const void *key,
+                     const void *value, __u64 flags);
+static long BPF_FUNC(map_delete_elem, void *map, const void *key);
+static long BPF_FUNC(ringbuf_output, void *ringbuf, void *data, __u64 size,
+                     __u64 flags);
+static __u64 BPF_FUNC(ktime_get_ns);
+static long BPF_FUNC(sock_ops_cb_flags_set, struct bpf_sock_ops *skops,
+                     int argval);
+static long BPF_FUNC(setsockopt, void *ctx, int level, int optname,
+                     void *optval, int optlen);
+static __u64 BPF_FUNC(get_socket_cookie, void *ctx);
+static __u32 BPF_FUNC(get_prandom_u32);
+static long BPF_FUNC(skb_store_bytes, struct __sk_buff *skb, __u32 offset,
+                     const void *from, __u32 len, __u64 flags);
+static long BPF_FUNC(l3_csum_replace, struct __sk_buff *skb, __u32 offset,
+                     __u64 from, __u64 to, __u64 size);
+static long BPF_FUNC(l4_csum_replace, struct __sk_buff *skb, __u32 offset,
+                     __u64 from, __u64 to, __u64 flags);
+static long BPF_FUNC(redirect_peer, __u32 ifindex, __u64 flags);
+static long BPF_FUNC(redirect, __u32 ifindex, __u64 flags);
@@ -38,3 +38,191 @@ struct {
   __type(value, union cni_config_value);
   __uint(max_entries, 1024);
 } cni_config_map SEC(".maps");
+
+// Pod IP (network order) to the identity assigned by patud, for the pods of
+// all nodes.
+struct {
+  __uint(type, BPF_MAP_TYPE_HASH);
+  __type(key, __u32);
+  __type(value, __u32);
+  __uint(max_entries, MAX_ENTRIES);
+} pod_identity_map SEC(".maps");
+
+struct {
+  __uint(type, BPF_MAP_TYPE_HASH);
+  __type(key, __u32);
+  __type(value, struct policy_isolation);
+  __uint(max_entries, MAX_ENTRIES);
+} policy_isolation_map SEC(".maps");
+
+struct {
+  __uint(type, BPF_MAP_TYPE_LPM_TRIE);
+  __type(key, struct policy_key);
+  __type(value, struct policy_value);
+  __uint(max_entries, MAX_ENTRIES);
+  __uint(map_flags, BPF_F_NO_PREALLOC);
+} policy_map SEC(".maps");
+
+// Ports of an ingress isolated pod that at least one peer may connect to. It
+// lets connect4 refuse a connection without knowing the source identity.
+struct {
+  __uint(type, BPF_MAP_TYPE_LPM_TRIE);
+  __type(key, struct policy_port_key);
+  __type(value, struct policy_value);
+  __uint(max_entries, MAX_ENTRIES);
+  __uint(map_flags, BPF_F_NO_PREALLOC);
+} policy_port_map SEC(".maps");
+
+// Sockets that were established against policy. sk_msg drops their data.
+// Entries are removed when the socket closes.
+struct {
+  __uint(type, BPF_MAP_TYPE_LRU_HASH);
+  __type(key, struct socket_key);
+  __type(value, __u32);
+  __uint(max_entries, MAX_ENTRIES);
+} policy_deny_map SEC(".maps");
+
+// Would-be denials of pods in policy audit mode, consumed by patud.
+struct {
+  __uint(type, BPF_MAP_TYPE_RINGBUF);
+  __uint(max_entries, 256 * 1024);
+} policy_audit_events SEC(".maps");
+
+// Accounting of the data sent by each pod socket, keyed by the socket's own
+// 4-tuple. Entries are removed when the socket closes.
+struct {
+  __uint(type, BPF_MAP_TYPE_LRU_HASH);
+  __type(key, struct socket_key);
+  __type(value, struct flow_stats);
+  __uint(max_entries, MAX_ENTRIES);
+} flow_map SEC(".maps");
+
+struct {
+  __uint(type, BPF_MAP_TYPE_RINGBUF);
+  __uint(max_entries, 1024 * 1024);
+} flow_events SEC(".maps");
+
+// RTT histogram and retransmissions of the TCP connections between two
+// addresses, aggregated over all their sockets. The CNI plugin removes the
+// entries of a pod's addresses when the pod is deleted.
+struct {
+  __uint(type, BPF_MAP_TYPE_LRU_HASH);
+  __type(key, struct tcp_stats_key);
+  __type(value, struct tcp_stats);
+  __uint(max_entries, 4096);
+} tcp_stats_map SEC(".maps");
+
+// Local pod IP (network order) to the TCP settings from its annotations.
+struct {
+  __uint(type, BPF_MAP_TYPE_HASH);
+  __type(key, __u32);
+  __type(value, struct tcp_tuning);
+  __uint(max_entries, MAX_ENTRIES);
+} tcp_tuning_map SEC(".maps");
+
+// Host address and port to the pod endpoint they are forwarded to, written by
+// the CNI plugin for the portMappings capability.
+struct {
+  __uint(type, BPF_MAP_TYPE_HASH);
+  __type(key, struct hostport_endpoint);
+  __type(value, struct hostport_endpoint);
+  __uint(max_entries, 4096);
+} hostport_map SEC(".maps");
+
+// Host port a socket connected to before patu_connect4 sent it to the pod,
+// keyed by socket cookie, so getpeername reports what the client asked for.
+struct {
+  __uint(type, BPF_MAP_TYPE_LRU_HASH);
+  __type(key, __u64);
+  __type(value, struct hostport_endpoint);
+  __uint(max_entries, MAX_ENTRIES);
+} hostport_sock_map SEC(".maps");
+
+// IPv4 addresses (network order) of the node, kept up to date by patud. Host
+// ports mapped without a host IP are forwarded on all of them.
+struct {
+  __uint(type, BPF_MAP_TYPE_HASH);
+  __type(key, __u32);
+  __type(value, __u8);
+  __uint(max_entries, 1024);
+} local_addr_map SEC(".maps");
+
+// Local pod IP (network order) to the pod's endpoint, written by the CNI
+// plugin.
+struct {
+  __uint(type, BPF_MAP_TYPE_HASH);
+  __type(key, __u32);
+  __type(value, struct endpoint);
+  __uint(max_entries, MAX_ENTRIES);
+} endpoint_map SEC(".maps");
+
+// Host veth ifindex to the bandwidth limits of its pod.
+struct {
+  __uint(type, BPF_MAP_TYPE_HASH);
+  __type(key, __u32);
+  __type(value, struct pod_bandwidth);
+  __uint(max_entries, MAX_ENTRIES);
+} bandwidth_map SEC(".maps");
+
+// Local pod IP (network order) to the host veth ifindex its bandwidth limits
+// are keyed by, written by the CNI plugin for the pods with limits.
+struct {
+  __uint(type, BPF_MAP_TYPE_HASH);
+  __type(key, __u32);
+  __type(value, __u32);
+  __uint(max_entries, MAX_ENTRIES);
+} bandwidth_pod_map SEC(".maps");
+
+// Sockets that exceeded the bandwidth of one of their pods. sk_msg stops
+// redirecting their data, which is then shaped by the TC programs. Entries are
+// removed by patu_sockops when the socket closes.
+struct {
+  __uint(type, BPF_MAP_TYPE_LRU_HASH);
+  __type(key, struct socket_key);
+  __type(value, __u32);
+  __uint(max_entries, MAX_ENTRIES);
+} bandwidth_fallback_map SEC(".maps");
+
+struct {
+  __uint(type, BPF_MAP_TYPE_ARRAY);
+  __type(key, __u32);
+  __type(value, struct snat_config);
+  __uint(max_entries, 1);
+} snat_config_map SEC(".maps");
+
+// Egress connections of pods to the node endpoint they are masqueraded to.
+struct {
+  __uint(type, BPF_MAP_TYPE_LRU_HASH);
+  __type(key, struct ipv4_tuple);
+  __type(value, struct snat_endpoint);
+  __uint(max_entries, MAX_ENTRIES);
+} snat_map SEC(".maps");
+
+// Replies to masqueraded connections, as received on the uplink, to the pod
+// endpoint they are translated back to. It also tells which node ports are
+// in use.
+struct {
+  __uint(type, BPF_MAP_TYPE_LRU_HASH);
+  __type(key, struct ipv4_tuple);
+  __type(value, struct snat_endpoint);
+  __uint(max_entries, MAX_ENTRIES);
+} snat_rev_map SEC(".maps");
+
+// Flows of local pods that went through the stack, keyed by the tuple of their
+// replies. The replies are left to the stack too, so conntrack sees both
+// directions of NATed flows, e.g. to a Service.
+struct {
+  __uint(type, BPF_MAP_TYPE_LRU_HASH);
+  __type(key, struct ipv4_tuple);
+  __type(value, __u8);
+  __uint(max_entries, MAX_ENTRIES);
+} fastpath_stack_map SEC(".maps");
+
+// Namespace ids of the local pods, by pod IP, for pods attached to a bridge
+// per namespace. Sockets are only redirected within a namespace.
+struct {
+  __uint(type, BPF_MAP_TYPE_HASH);
+  __type(key, __u32);
+  __type(value, __u32);
+  __uint(max_entries, MAX_ENTRIES);
+} pod_namespace_map SEC(".maps");
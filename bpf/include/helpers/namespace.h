@@ -0,0 +1,41 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+#pragma once
+
+#include "helpers.h"
+#include "maps.h"
+#include "policy.h"
+
+// Tells whether a client to server connection may bypass the stack. Pods of
+// different namespaces are only redirected when a network policy explicitly
+// allows the connection, either as ingress of the server or as egress of the
+// client. The port is the server port in network order.
+static inline int namespace_redirect_allowed(__u32 client_ip, __u32 server_ip,
+                                             __u16 port) {
+  __u32 *client_ns = map_lookup_elem(&pod_namespace_map, &client_ip);
+  __u32 *server_ns = map_lookup_elem(&pod_namespace_map, &server_ip);
+  if (!client_ns || !server_ns || *client_ns == *server_ns) {
+    return 1;
+  }
+  __u32 client = lookup_identity(client_ip);
+  __u32 server = lookup_identity(server_ip);
+  if (server >= POD_IDENTITY_MIN &&
+      policy_rule_exists(server, client, port, POLICY_INGRESS)) {
+    return 1;
+  }
+  return client >= POD_IDENTITY_MIN &&
+         policy_rule_exists(client, server, port, POLICY_EGRESS);
+}
@@ -0,0 +1,143 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+#pragma once
+
+#include "helpers.h"
+#include "maps.h"
+
+static inline __u32 lookup_identity(__u32 ip) {
+  __u32 *identity = map_lookup_elem(&pod_identity_map, &ip);
+  if (identity) {
+    return *identity;
+  }
+  return IDENTITY_WORLD;
+}
+
+static inline int policy_rule_exists(__u32 identity, __u32 peer, __u16 port,
+                                     __u8 direction) {
+  struct policy_key key = {};
+  key.prefixlen = POLICY_KEY_PREFIXLEN;
+  key.identity = identity;
+  key.peer_identity = peer;
+  key.direction = direction;
+  key.port = port;
+  if (map_lookup_elem(&policy_map, &key)) {
+    return 1;
+  }
+  key.peer_identity = IDENTITY_ANY;
+  if (map_lookup_elem(&policy_map, &key)) {
+    return 1;
+  }
+  return 0;
+}
+
+// Fills verdict with the id of the policy that isolates the pod in the given
+// direction and has no rule allowing the peer. The policy id stays 0 if the
+// connection is allowed.
+static inline void policy_check(__u32 identity, __u32 peer, __u16 port,
+                                __u8 direction,
+                                struct policy_verdict *verdict) {
+  if (identity < POD_IDENTITY_MIN) {
+    return;
+  }
+  struct policy_isolation *isolation =
+      map_lookup_elem(&policy_isolation_map, &identity);
+  if (!isolation) {
+    return;
+  }
+  __u32 policy_id = direction == POLICY_INGRESS ? isolation->ingress_policy_id
+                                                : isolation->egress_policy_id;
+  if (!policy_id) {
+    return;
+  }
+  if (policy_rule_exists(identity, peer, port, direction)) {
+    return;
+  }
+  verdict->policy_id = policy_id;
+  verdict->direction = direction;
+  verdict->audit = isolation->audit != 0;
+}
+
+// Checks a client to server connection against both the egress policies of
+// the client and the ingress policies of the server. The port is the server
+// port in network order.
+static inline void policy_check_connection(__u32 client_ip, __u32 server_ip,
+                                           __u16 port,
+                                           struct policy_verdict *verdict) {
+  __u32 client = lookup_identity(client_ip);
+  __u32 server = lookup_identity(server_ip);
+  policy_check(client, server, port, POLICY_EGRESS, verdict);
+  if (verdict->policy_id && !verdict->audit) {
+    return;
+  }
+  // An enforced ingress denial takes precedence over an audited egress one.
+  struct policy_verdict ingress = {};
+  policy_check(server, client, port, POLICY_INGRESS, &ingress);
+  if (ingress.policy_id && (!ingress.audit || !verdict->policy_id)) {
+    *verdict = ingress;
+  }
+}
+
+// Tells whether the ingress policies of a pod isolate it, enforced or in
+// audit mode.
+static inline int policy_ingress_isolated(__u32 ip) {
+  __u32 identity = lookup_identity(ip);
+  if (identity < POD_IDENTITY_MIN) {
+    return 0;
+  }
+  struct policy_isolation *isolation =
+      map_lookup_elem(&policy_isolation_map, &identity);
+  return isolation && isolation->ingress_policy_id;
+}
+
+// Without the source identity only the ports of an ingress isolated pod can
+// be checked, which is what connect4 relies on.
+static inline void policy_check_port(__u32 server_ip, __u16 port,
+                                     struct policy_verdict *verdict) {
+  __u32 server = lookup_identity(server_ip);
+  if (server < POD_IDENTITY_MIN) {
+    return;
+  }
+  struct policy_isolation *isolation =
+      map_lookup_elem(&policy_isolation_map, &server);
+  if (!isolation || !isolation->ingress_policy_id) {
+    return;
+  }
+  struct policy_port_key key = {};
+  key.prefixlen = POLICY_PORT_KEY_PREFIXLEN;
+  key.identity = server;
+  key.port = port;
+  if (map_lookup_elem(&policy_port_map, &key)) {
+    return;
+  }
+  verdict->policy_id = isolation->ingress_policy_id;
+  verdict->direction = POLICY_INGRESS;
+  verdict->audit = isolation->audit != 0;
+}
+
+// Reports a would-be denial of a client to server connection to patud.
+static inline void policy_audit(__u32 client_ip, __u32 server_ip,
+                                __u16 client_port, __u16 server_port,
+                                struct policy_verdict *verdict) {
+  struct policy_audit_event event = {};
+  event.src_ip = client_ip;
+  event.dst_ip = server_ip;
+  event.src_port = client_port;
+  event.dst_port = server_port;
+  event.policy_id = verdict->policy_id;
+  event.direction = verdict->direction;
+  ringbuf_output(&policy_audit_events, &event, sizeof(event), 0);
+}
@@ -0,0 +1,41 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+#pragma once
+
+#include "helpers.h"
+#include "maps.h"
+#include "policy.h"
+#include "tuple.h"
+
+// Tells whether a frame to a local pod opens a TCP connection the ingress
+// policies of the pod deny. Only the SYN is checked, so the connection fails
+// the same way whether the client runs on this node or not. Denials in audit
+// mode are let through for patu_sockops to report.
+static inline int policy_deny_syn(void *data, void *data_end) {
+  struct ipv4_tuple tuple = {};
+  if (!parse_ipv4_frame(data, data_end, &tuple) ||
+      tuple.proto != IPPROTO_TCP) {
+    return 0;
+  }
+  struct tcphdr *tcp = data + L4_OFF;
+  if ((void *)(tcp + 1) > data_end || !tcp->syn || tcp->ack) {
+    return 0;
+  }
+  struct policy_verdict verdict = {};
+  policy_check(lookup_identity(tuple.daddr), lookup_identity(tuple.saddr),
+               tuple.dport, POLICY_INGRESS, &verdict);
+  return verdict.policy_id && !verdict.audit;
+}
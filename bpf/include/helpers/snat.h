@@ -0,0 +1,70 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+#pragma once
+
+#include "helpers.h"
+#include "maps.h"
+#include "tuple.h"
+
+// Random node ports tried before a new connection is left untranslated.
+#define SNAT_PORT_TRIES 8
+
+static inline struct snat_config *snat_config() {
+  __u32 key = 0;
+  struct snat_config *cfg = map_lookup_elem(&snat_config_map, &key);
+  if (!cfg || !cfg->node_ip) {
+    return 0;
+  }
+  return cfg;
+}
+
+// Rewrites an address and a port of the packet along with the checksums.
+// The offsets select the source or the destination.
+static inline int snat_rewrite(struct __sk_buff *skb, __u8 proto,
+                               __u32 addr_off, __u32 old_addr, __u32 new_addr,
+                               __u32 port_off, __u16 old_port,
+                               __u16 new_port) {
+  __u32 csum_off;
+  __u64 flags = 0;
+  switch (proto) {
+  case IPPROTO_TCP:
+    csum_off = L4_OFF + __builtin_offsetof(struct tcphdr, check);
+    flags = BPF_F_PSEUDO_HDR;
+    break;
+  case IPPROTO_UDP:
+    csum_off = L4_OFF + __builtin_offsetof(struct udphdr, check);
+    flags = BPF_F_PSEUDO_HDR | BPF_F_MARK_MANGLED_0;
+    break;
+  default:
+    csum_off = L4_OFF + __builtin_offsetof(struct icmphdr, checksum);
+    break;
+  }
+
+  // The ICMP checksum does not cover the IP header.
+  if (proto != IPPROTO_ICMP &&
+      l4_csum_replace(skb, csum_off, old_addr, new_addr, flags | 4)) {
+    return 0;
+  }
+  if (l4_csum_replace(skb, csum_off, old_port, new_port, flags | 2) ||
+      skb_store_bytes(skb, port_off, &new_port, 2, 0)) {
+    return 0;
+  }
+  if (l3_csum_replace(skb, IP_CSUM_OFF, old_addr, new_addr, 4) ||
+      skb_store_bytes(skb, addr_off, &new_addr, 4, 0)) {
+    return 0;
+  }
+  return 1;
+}
@@ -0,0 +1,155 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+#pragma once
+
+#include <linux/icmp.h>
+#include <linux/if_ether.h>
+#include <linux/in.h>
+#include <linux/ip.h>
+#include <linux/tcp.h>
+#include <linux/udp.h>
+
+#include "helpers.h"
+
+// IP options are not supported, packets carrying them are left alone.
+#define IP_OFF ETH_HLEN
+#define L4_OFF (ETH_HLEN + sizeof(struct iphdr))
+#define IP_CSUM_OFF (IP_OFF + __builtin_offsetof(struct iphdr, check))
+#define IP_SRC_OFF (IP_OFF + __builtin_offsetof(struct iphdr, saddr))
+#define IP_DST_OFF (IP_OFF + __builtin_offsetof(struct iphdr, daddr))
+#define ICMP_ID_OFF (L4_OFF + __builtin_offsetof(struct icmphdr, un.echo.id))
+#define ICMP_CSUM_OFF (L4_OFF + __builtin_offsetof(struct icmphdr, checksum))
+
+// Offsets of the packet embedded in an ICMP error, without IP options either.
+#define ICMP_INNER_IP_OFF (L4_OFF + sizeof(struct icmphdr))
+#define ICMP_INNER_L4_OFF (ICMP_INNER_IP_OFF + sizeof(struct iphdr))
+
+#define IP_MF 0x2000
+#define IP_OFFSET 0x1fff
+
+// Fills the tuple of an IPv4 TCP, UDP or ICMP echo frame. The ICMP echo id
+// is the source port of requests and the destination port of replies.
+// Returns 0 for any other frame.
+static inline int parse_ipv4_frame(void *data, void *data_end,
+                                   struct ipv4_tuple *tuple) {
+  struct ethhdr *eth = data;
+  if ((void *)(eth + 1) > data_end || eth->h_proto != bpf_htons(ETH_P_IP)) {
+    return 0;
+  }
+  struct iphdr *ip = (void *)(eth + 1);
+  if ((void *)(ip + 1) > data_end || ip->ihl != 5 ||
+      (ip->frag_off & bpf_htons(IP_MF | IP_OFFSET))) {
+    return 0;
+  }
+  tuple->saddr = ip->saddr;
+  tuple->daddr = ip->daddr;
+  tuple->proto = ip->protocol;
+
+  void *l4 = (void *)(ip + 1);
+  switch (ip->protocol) {
+  case IPPROTO_TCP:
+  case IPPROTO_UDP: {
+    __u16 *ports = l4;
+    if ((void *)(ports + 2) > data_end) {
+      return 0;
+    }
+    tuple->sport = ports[0];
+    tuple->dport = ports[1];
+    return 1;
+  }
+  case IPPROTO_ICMP: {
+    struct icmphdr *icmp = l4;
+    if ((void *)(icmp + 1) > data_end) {
+      return 0;
+    }
+    if (icmp->type == ICMP_ECHO) {
+      tuple->sport = icmp->un.echo.id;
+      return 1;
+    }
+    if (icmp->type == ICMP_ECHOREPLY) {
+      tuple->dport = icmp->un.echo.id;
+      return 1;
+    }
+    return 0;
+  }
+  }
+  return 0;
+}
+
+// Fills the tuple of the packet embedded in an IPv4 ICMP error, destination
+// unreachable, time exceeded or parameter problem, and the destination of the
+// error itself. The embedded packet is one sent by the receiver of the error,
+// a TCP or UDP one or an ICMP echo request. Returns 0 for any other frame.
+static inline int parse_ipv4_icmp_error(void *data, void *data_end,
+                                        __u32 *daddr,
+                                        struct ipv4_tuple *inner) {
+  struct ethhdr *eth = data;
+  if ((void *)(eth + 1) > data_end || eth->h_proto != bpf_htons(ETH_P_IP)) {
+    return 0;
+  }
+  struct iphdr *ip = (void *)(eth + 1);
+  if ((void *)(ip + 1) > data_end || ip->ihl != 5 ||
+      ip->protocol != IPPROTO_ICMP ||
+      (ip->frag_off & bpf_htons(IP_MF | IP_OFFSET))) {
+    return 0;
+  }
+  struct icmphdr *icmp = (void *)(ip + 1);
+  if ((void *)(icmp + 1) > data_end) {
+    return 0;
+  }
+  if (icmp->type != ICMP_DEST_UNREACH && icmp->type != ICMP_TIME_EXCEEDED &&
+      icmp->type != ICMP_PARAMETERPROB) {
+    return 0;
+  }
+  struct iphdr *inner_ip = (void *)(icmp + 1);
+  if ((void *)(inner_ip + 1) > data_end || inner_ip->ihl != 5) {
+    return 0;
+  }
+  *daddr = ip->daddr;
+  inner->saddr = inner_ip->saddr;
+  inner->daddr = inner_ip->daddr;
+  inner->proto = inner_ip->protocol;
+
+  void *l4 = (void *)(inner_ip + 1);
+  switch (inner_ip->protocol) {
+  case IPPROTO_TCP:
+  case IPPROTO_UDP: {
+    __u16 *ports = l4;
+    if ((void *)(ports + 2) > data_end) {
+      return 0;
+    }
+    inner->sport = ports[0];
+    inner->dport = ports[1];
+    return 1;
+  }
+  case IPPROTO_ICMP: {
+    struct icmphdr *inner_icmp = l4;
+    if ((void *)(inner_icmp + 1) > data_end ||
+        inner_icmp->type != ICMP_ECHO) {
+      return 0;
+    }
+    inner->sport = inner_icmp->un.echo.id;
+    return 1;
+  }
+  }
+  return 0;
+}
+
+static inline int parse_ipv4_tuple(struct __sk_buff *skb,
+                                   struct ipv4_tuple *tuple) {
+  return parse_ipv4_frame((void *)(long)skb->data,
+                          (void *)(long)skb->data_end, tuple);
+}
@@ -0,0 +1,54 @@
+/*
+Copyright © 2022 Authors of Patu
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+#include <linux/bpf.h>
+#include <linux/pkt_cls.h>
+
+#include "include/helpers/bandwidth.h"
+#include "include/helpers/helpers.h"
+#include "include/helpers/maps.h"
+
+// Attached to the TC ingress of the host veth, i.e. the egress of the pod.
+// Packets leaving the node from the pod address are paced on the uplink.
+// The ones which never get there with it, to other local pods known to the
+// datapath or masqueraded by netfilter, are policed here: packets scheduled
+// past the horizon are dropped.
+// Other packets are passed on with TC_ACT_UNSPEC, so the fast path filter
+// attached after it still sees them.
+__section("classifier") int patu_bw_egress(struct __sk_buff *skb) {
+  __u32 ifindex = skb->ifindex;
+  struct pod_bandwidth *bw = map_lookup_elem(&bandwidth_map, &ifindex);
+  if (!bw || !bw->egress_rate) {
+    return TC_ACT_UNSPEC;
+  }
+  __u32 saddr, daddr;
+  if (!ipv4_addrs(skb, &saddr, &daddr)) {
+    return TC_ACT_UNSPEC;
+  }
+  int masqueraded = bw->masq_mask && (daddr & bw->masq_mask) != bw->masq_net;
+  if (!masqueraded && !map_lookup_elem(&endpoint_map, &daddr) &&
+      !map_lookup_elem(&bandwidth_pod_map, &daddr)) {
+    return TC_ACT_UNSPEC;
+  }
+  __u64 departure;
+  if (!egress_schedule(bw, skb->len, ktime_get_ns(), &departure)) {
+    return TC_ACT_SHOT;
+  }
+  return TC_ACT_UNSPEC;
+}
+
+char ____license[] __section("license") = "GPL";
+int _version __section("version") = 1;
@@ -0,0 +1,41 @@
+/*
+Copyright © 2022 Authors of Patu
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+#include <linux/bpf.h>
+#include <linux/pkt_cls.h>
+
+#include "include/helpers/bandwidth.h"
+#include "include/helpers/helpers.h"
+#include "include/helpers/maps.h"
+
+// Attached to the TC egress of the host veth, i.e. the ingress of the pod.
+// Packets above the token bucket rate are dropped.
+// Other packets are passed on with TC_ACT_UNSPEC, so the fast path filter
+// attached after it still sees them.
+__section("classifier") int patu_bw_ingress(struct __sk_buff *skb) {
+  __u32 ifindex = skb->ifindex;
+  struct pod_bandwidth *bw = map_lookup_elem(&bandwidth_map, &ifindex);
+  if (!bw || !bw->ingress_rate) {
+    return TC_ACT_UNSPEC;
+  }
+  if (!ingress_take(bw, skb->len, ktime_get_ns())) {
+    return TC_ACT_SHOT;
+  }
+  return TC_ACT_UNSPEC;
+}
+
+char ____license[] __section("license") = "GPL";
+int _version __section("version") = 1;
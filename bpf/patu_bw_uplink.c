@@ -0,0 +1,47 @@
+/*
+Copyright © 2022 Authors of Patu
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+#include <linux/bpf.h>
+#include <linux/pkt_cls.h>
+
+#include "include/helpers/bandwidth.h"
+#include "include/helpers/helpers.h"
+#include "include/helpers/maps.h"
+
+// Attached to the TC egress of the uplink, ahead of the SNAT programs, as the
+// departure time set on the host veth is cleared when the packet is
+// forwarded. Packets of limited pods get an earliest departure time honored
+// by the fq qdisc of the uplink, packets scheduled past the horizon are
+// dropped. Other packets are passed on with TC_ACT_UNSPEC.
+__section("classifier") int patu_bw_uplink(struct __sk_buff *skb) {
+  __u32 saddr, daddr;
+  if (!ipv4_addrs(skb, &saddr, &daddr)) {
+    return TC_ACT_UNSPEC;
+  }
+  struct pod_bandwidth *bw = lookup_pod_bandwidth(saddr);
+  if (!bw || !bw->egress_rate) {
+    return TC_ACT_UNSPEC;
+  }
+  __u64 departure;
+  if (!egress_schedule(bw, skb->len, ktime_get_ns(), &departure)) {
+    return TC_ACT_SHOT;
+  }
+  skb->tstamp = departure;
+  return TC_ACT_UNSPEC;
+}
+
+char ____license[] __section("license") = "GPL";
+int _version __section("version") = 1;
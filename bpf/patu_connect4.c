@@ -0,0 +1,77 @@
+/*
+Copyright © 2022 Authors of Patu
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+#include <linux/bpf.h>
+
+#include "include/helpers/helpers.h"
+#include "include/helpers/maps.h"
+#include "include/helpers/policy.h"
+
+#define SOCK_STREAM 1
+#define IPPROTO_TCP 6
+#define IPPROTO_UDP 17
+
+#define CONNECT_REFUSE 0
+#define CONNECT_ALLOW 1
+
+// Connections to a host port are sent to the pod right away, instead of being
+// translated by the nftables DNAT rules for every packet. Host ports mapped
+// without a host IP are stored with address 0 and match any node address.
+static inline void translate_hostport(struct bpf_sock_addr *ctx) {
+  struct hostport_endpoint key = {};
+  key.ip = ctx->user_ip4;
+  key.port = (__u16)ctx->user_port;
+  key.proto = (__u8)ctx->protocol;
+  struct hostport_endpoint *backend = map_lookup_elem(&hostport_map, &key);
+  if (!backend && map_lookup_elem(&local_addr_map, &key.ip)) {
+    struct hostport_endpoint any = key;
+    any.ip = 0;
+    backend = map_lookup_elem(&hostport_map, &any);
+  }
+  if (!backend) {
+    return;
+  }
+  __u64 cookie = get_socket_cookie(ctx);
+  map_update_elem(&hostport_sock_map, &cookie, &key, BPF_ANY);
+  ctx->user_ip4 = backend->ip;
+  ctx->user_port = backend->port;
+}
+
+__section("cgroup/connect4") int patu_connect4(struct bpf_sock_addr *ctx) {
+  if (ctx->protocol == IPPROTO_TCP || ctx->protocol == IPPROTO_UDP) {
+    translate_hostport(ctx);
+  }
+  if (ctx->type != SOCK_STREAM) {
+    return CONNECT_ALLOW;
+  }
+
+  // The source address is not bound yet, so only the destination pod's
+  // ingress ports can be checked here. Peer selectors are enforced by
+  // patu_sockops once the connection is established.
+  struct policy_verdict verdict = {};
+  policy_check_port(ctx->user_ip4, (__u16)ctx->user_port, &verdict);
+  // A connection refused here is always denied by patu_sockops too, so in
+  // audit mode it is left to sockops to report it with the full 4-tuple.
+  if (verdict.policy_id && !verdict.audit) {
+    print_info("[connect4] connection refused by policy %d\n",
+               verdict.policy_id);
+    return CONNECT_REFUSE;
+  }
+  return CONNECT_ALLOW;
+}
+
+char ____license[] __section("license") = "GPL";
+int _version __section("version") = 1;
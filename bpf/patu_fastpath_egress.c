@@ -0,0 +1,52 @@
+/*
+Copyright © 2022 Authors of Patu
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+#include <linux/bpf.h>
+#include <linux/pkt_cls.h>
+
+#include "include/helpers/fastpath.h"
+#include "include/helpers/helpers.h"
+#include "include/helpers/maps.h"
+
+// Attached to the TC ingress of the host veth, i.e. the egress of the pod.
+// Packets to another local pod are handed to the interface of that pod,
+// skipping the bridge or the routing of the node. The flows of the other
+// packets are recorded, so their replies from outside the node are left to
+// the stack by the XDP program of the uplink. Packets left to the stack are
+// passed on with TC_ACT_UNSPEC, so the filters attached after it still see
+// them.
+__section("classifier") int patu_fastpath_egress(struct __sk_buff *skb) {
+  struct ipv4_tuple tuple = {};
+  if (!parse_ipv4_tuple(skb, &tuple)) {
+    return TC_ACT_UNSPEC;
+  }
+  struct endpoint *ep = fastpath_lookup(skb, &tuple);
+  if (!ep) {
+    fastpath_track_stack(&tuple);
+    return TC_ACT_UNSPEC;
+  }
+  // In ptp mode the packet is addressed to the gateway, in bridge mode to
+  // the pod already. It is made to look like it comes from the host veth of
+  // the pod either way.
+  if (skb_store_bytes(skb, ETH_DST_OFF, ep->mac, ETH_ALEN, 0) ||
+      skb_store_bytes(skb, ETH_SRC_OFF, ep->host_mac, ETH_ALEN, 0)) {
+    return TC_ACT_SHOT;
+  }
+  return redirect_peer(ep->ifindex, 0);
+}
+
+char ____license[] __section("license") = "GPL";
+int _version __section("version") = 1;
@@ -0,0 +1,37 @@
+/*
+Copyright © 2022 Authors of Patu
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+#include <linux/bpf.h>
+#include <linux/pkt_cls.h>
+
+#include "include/helpers/fastpath.h"
+#include "include/helpers/helpers.h"
+#include "include/helpers/maps.h"
+
+// Attached to the TC egress of the host veth, i.e. the ingress of the pod.
+// Only packets that went through the stack get here, their flow is recorded so
+// the pod's replies take the stack too.
+__section("classifier") int patu_fastpath_ingress(struct __sk_buff *skb) {
+  struct ipv4_tuple tuple = {};
+  if (!parse_ipv4_tuple(skb, &tuple)) {
+    return TC_ACT_OK;
+  }
+  fastpath_track_stack(&tuple);
+  return TC_ACT_OK;
+}
+
+char ____license[] __section("license") = "GPL";
+int _version __section("version") = 1;
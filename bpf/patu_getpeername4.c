@@ -0,0 +1,37 @@
+/*
+Copyright © 2022 Authors of Patu
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+#include <linux/bpf.h>
+
+#include "include/helpers/helpers.h"
+#include "include/helpers/maps.h"
+
+// Sockets patu_connect4 sent from a host port to a pod report the host port
+// as their peer, as if the connection had been translated by DNAT.
+__section("cgroup/getpeername4") int
+patu_getpeername4(struct bpf_sock_addr *ctx) {
+  __u64 cookie = get_socket_cookie(ctx);
+  struct hostport_endpoint *hostport =
+      map_lookup_elem(&hostport_sock_map, &cookie);
+  if (hostport) {
+    ctx->user_ip4 = hostport->ip;
+    ctx->user_port = hostport->port;
+  }
+  return 1;
+}
+
+char ____license[] __section("license") = "GPL";
+int _version __section("version") = 1;
@@ -16,6 +16,7 @@ limitations under the License.
 
 #include <linux/bpf.h>
 
+#include "include/helpers/bandwidth.h"
 #include "include/helpers/helpers.h"
 #include "include/helpers/maps.h"
 
@@ -45,8 +46,45 @@ static inline int in_subnet_range(__u32 ip) {
   return 0;
 }
 
+// The key the sending socket itself was added with by patu_sockops, as
+// opposed to the peer's key used for the redirect.
+static inline void extract_local_socket_key_v4(struct sk_msg_md *msg,
+                                               struct socket_key *sockkey) {
+  sockkey->src_ip = msg->local_ip4;
+  sockkey->dst_ip = msg->remote_ip4;
+  sockkey->src_port = bpf_htonl(msg->local_port) >> 16;
+  sockkey->dst_port = FORCE_READ(msg->remote_port) >> 16;
+}
+
+static inline void account_flow(struct socket_key *localkey, __u32 size) {
+  struct flow_stats *stats = map_lookup_elem(&flow_map, localkey);
+  if (stats) {
+    __sync_fetch_and_add(&stats->bytes, size);
+    __sync_fetch_and_add(&stats->msgs, 1);
+  }
+}
+
 __section("sk_msg") int patu_skmsg(struct sk_msg_md *msg) {
 
+  struct socket_key localkey = {};
+  extract_local_socket_key_v4(msg, &localkey);
+  if (map_lookup_elem(&policy_deny_map, &localkey)) {
+    return SK_DROP;
+  }
+  account_flow(&localkey, msg->size);
+
+  if (map_lookup_elem(&bandwidth_fallback_map, &localkey)) {
+    return SK_PASS;
+  }
+  if (!bandwidth_budget(localkey.src_ip, localkey.dst_ip, msg->size)) {
+    // The data is sent through the stack to be shaped on the host veths from
+    // now on. The socket never returns to the fast path, data redirected
+    // later would overtake what is still in flight.
+    __u32 exceeded = 1;
+    map_update_elem(&bandwidth_fallback_map, &localkey, &exceeded, BPF_ANY);
+    return SK_PASS;
+  }
+
   struct socket_key sockkey = {};
   extract_socket_key_v4(msg, &sockkey);
   long result =
@@ -0,0 +1,96 @@
+/*
+Copyright © 2022 Authors of Patu
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+#include <linux/bpf.h>
+#include <linux/pkt_cls.h>
+
+#include "include/helpers/helpers.h"
+#include "include/helpers/maps.h"
+#include "include/helpers/snat.h"
+
+// Picks a free node port for a new connection and records both directions.
+static inline int snat_allocate(struct snat_config *cfg,
+                                struct ipv4_tuple *tuple,
+                                struct snat_endpoint *nat) {
+  struct ipv4_tuple rev = {};
+  rev.saddr = tuple->daddr;
+  rev.daddr = cfg->node_ip;
+  rev.sport = tuple->dport;
+  rev.proto = tuple->proto;
+  struct snat_endpoint orig = {};
+  orig.addr = tuple->saddr;
+  orig.port = tuple->sport;
+
+  __u32 range = cfg->port_max - cfg->port_min + 1;
+#pragma unroll
+  for (int i = 0; i < SNAT_PORT_TRIES; i++) {
+    rev.dport = bpf_htons(cfg->port_min + get_prandom_u32() % range);
+    if (map_update_elem(&snat_rev_map, &rev, &orig, BPF_NOEXIST) == 0) {
+      nat->addr = cfg->node_ip;
+      nat->port = rev.dport;
+      map_update_elem(&snat_map, tuple, nat, BPF_ANY);
+      return 1;
+    }
+  }
+  return 0;
+}
+
+// Attached to the TC egress of the uplink. Masquerades the pod traffic
+// leaving the cluster network to the node address.
+__section("classifier") int patu_snat_egress(struct __sk_buff *skb) {
+  struct snat_config *cfg = snat_config();
+  if (!cfg) {
+    return TC_ACT_OK;
+  }
+  struct ipv4_tuple tuple = {};
+  if (!parse_ipv4_tuple(skb, &tuple)) {
+    return TC_ACT_OK;
+  }
+  if ((tuple.saddr & cfg->pod_mask) != cfg->pod_net ||
+      (tuple.daddr & cfg->cluster_mask) == cfg->cluster_net) {
+    return TC_ACT_OK;
+  }
+
+  struct snat_endpoint nat = {};
+  struct snat_endpoint *found = map_lookup_elem(&snat_map, &tuple);
+  if (found) {
+    nat = *found;
+    // The reverse entry may have been evicted on its own.
+    struct ipv4_tuple rev = {};
+    rev.saddr = tuple.daddr;
+    rev.daddr = nat.addr;
+    rev.sport = tuple.dport;
+    rev.dport = nat.port;
+    rev.proto = tuple.proto;
+    struct snat_endpoint orig = {};
+    orig.addr = tuple.saddr;
+    orig.port = tuple.sport;
+    map_update_elem(&snat_rev_map, &rev, &orig, BPF_ANY);
+  } else if (!snat_allocate(cfg, &tuple, &nat)) {
+    print_info("[snat] no free node port\n");
+    return TC_ACT_SHOT;
+  }
+
+  __u32 port_off = tuple.proto == IPPROTO_ICMP ? ICMP_ID_OFF : L4_OFF;
+  if (!snat_rewrite(skb, tuple.proto, IP_SRC_OFF, tuple.saddr, nat.addr,
+                    port_off, tuple.sport, nat.port)) {
+    return TC_ACT_SHOT;
+  }
+  return TC_ACT_OK;
+}
+
+char ____license[] __section("license") = "GPL";
+int _version __section("version") = 1;
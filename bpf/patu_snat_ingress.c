@@ -0,0 +1,103 @@
+/*
+Copyright © 2022 Authors of Patu
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+#include <linux/bpf.h>
+#include <linux/pkt_cls.h>
+
+#include "include/helpers/helpers.h"
+#include "include/helpers/maps.h"
+#include "include/helpers/snat.h"
+
+// Translates an ICMP error about a masqueraded connection, such as
+// fragmentation needed or port unreachable, back to the pod: the destination
+// of the error and the source of the packet it embeds.
+static inline int snat_icmp_error(struct __sk_buff *skb,
+                                  struct snat_config *cfg) {
+  __u32 daddr;
+  struct ipv4_tuple inner = {};
+  if (!parse_ipv4_icmp_error((void *)(long)skb->data,
+                             (void *)(long)skb->data_end, &daddr, &inner) ||
+      daddr != cfg->node_ip || inner.saddr != cfg->node_ip) {
+    return TC_ACT_OK;
+  }
+  struct ipv4_tuple rev = {};
+  rev.saddr = inner.daddr;
+  rev.daddr = inner.saddr;
+  rev.sport = inner.dport;
+  rev.dport = inner.sport;
+  rev.proto = inner.proto;
+  struct snat_endpoint *orig = map_lookup_elem(&snat_rev_map, &rev);
+  if (!orig) {
+    return TC_ACT_OK;
+  }
+  struct snat_endpoint pod = *orig;
+
+  // The embedded port is only covered by the ICMP checksum. The embedded
+  // address is covered by its own header checksum as well, updating both
+  // leaves the ICMP checksum as is.
+  __u32 port_off =
+      inner.proto == IPPROTO_ICMP
+          ? ICMP_INNER_L4_OFF + __builtin_offsetof(struct icmphdr, un.echo.id)
+          : ICMP_INNER_L4_OFF;
+  if (l4_csum_replace(skb, ICMP_CSUM_OFF, inner.sport, pod.port, 2) ||
+      skb_store_bytes(skb, port_off, &pod.port, 2, 0)) {
+    return TC_ACT_SHOT;
+  }
+  if (l3_csum_replace(skb,
+                      ICMP_INNER_IP_OFF + __builtin_offsetof(struct iphdr, check),
+                      inner.saddr, pod.addr, 4) ||
+      skb_store_bytes(skb,
+                      ICMP_INNER_IP_OFF + __builtin_offsetof(struct iphdr, saddr),
+                      &pod.addr, 4, 0)) {
+    return TC_ACT_SHOT;
+  }
+  if (l3_csum_replace(skb, IP_CSUM_OFF, daddr, pod.addr, 4) ||
+      skb_store_bytes(skb, IP_DST_OFF, &pod.addr, 4, 0)) {
+    return TC_ACT_SHOT;
+  }
+  return TC_ACT_OK;
+}
+
+// Attached to the TC ingress of the uplink. Translates the replies to
+// masqueraded connections back to the pod, before conntrack sees them.
+__section("classifier") int patu_snat_ingress(struct __sk_buff *skb) {
+  struct snat_config *cfg = snat_config();
+  if (!cfg) {
+    return TC_ACT_OK;
+  }
+  struct ipv4_tuple tuple = {};
+  if (!parse_ipv4_tuple(skb, &tuple)) {
+    return snat_icmp_error(skb, cfg);
+  }
+  if (tuple.daddr != cfg->node_ip) {
+    return TC_ACT_OK;
+  }
+  struct snat_endpoint *orig = map_lookup_elem(&snat_rev_map, &tuple);
+  if (!orig) {
+    return TC_ACT_OK;
+  }
+  struct snat_endpoint pod = *orig;
+
+  __u32 port_off = tuple.proto == IPPROTO_ICMP ? ICMP_ID_OFF : L4_OFF + 2;
+  if (!snat_rewrite(skb, tuple.proto, IP_DST_OFF, tuple.daddr, pod.addr,
+                    port_off, tuple.dport, pod.port)) {
+    return TC_ACT_SHOT;
+  }
+  return TC_ACT_OK;
+}
+
+char ____license[] __section("license") = "GPL";
+int _version __section("version") = 1;
@@ -16,11 +16,23 @@ limitations under the License.
 
 #include <linux/bpf.h>
 
+#include "include/helpers/bandwidth.h"
 #include "include/helpers/helpers.h"
 #include "include/helpers/maps.h"
+#include "include/helpers/namespace.h"
+#include "include/helpers/policy.h"
 
 static int subnetIP = 0;
 
+// From linux/socket.h and linux/tcp.h
+#define SOL_SOCKET 1
+#define SOL_TCP 6
+#define SO_KEEPALIVE 9
+#define TCP_KEEPIDLE 4
+#define TCP_KEEPINTVL 5
+#define TCP_KEEPCNT 6
+#define TCP_CONGESTION 13
+
 static inline void extract_socket_key_v4(struct bpf_sock_ops *sockops,
                                          struct socket_key *sockkey) {
 
@@ -45,10 +57,217 @@ static inline int in_subnet_range(__u32 ip) {
   return 0;
 }
 
-static inline int process_sockops_ipv4(struct bpf_sock_ops *skops) {
+static inline void check_policy(struct socket_key *sockkey, __u32 op,
+                                struct policy_verdict *verdict) {
+  if (op == BPF_SOCK_OPS_ACTIVE_ESTABLISHED_CB) {
+    policy_check_connection(sockkey->src_ip, sockkey->dst_ip,
+                            sockkey->dst_port, verdict);
+  } else {
+    policy_check_connection(sockkey->dst_ip, sockkey->src_ip,
+                            sockkey->src_port, verdict);
+  }
+}
+
+// Both ends of a local connection see the same verdict. Egress denials are
+// reported by the client socket and ingress denials by the server socket, so
+// every would-be denial is reported once.
+static inline void audit_policy(struct socket_key *sockkey, __u32 op,
+                                struct policy_verdict *verdict) {
+  if (op == BPF_SOCK_OPS_ACTIVE_ESTABLISHED_CB) {
+    if (verdict->direction == POLICY_EGRESS) {
+      policy_audit(sockkey->src_ip, sockkey->dst_ip, sockkey->src_port,
+                   sockkey->dst_port, verdict);
+    }
+  } else if (verdict->direction == POLICY_INGRESS) {
+    policy_audit(sockkey->dst_ip, sockkey->src_ip, sockkey->dst_port,
+                 sockkey->src_port, verdict);
+  }
+}
+
+static inline int redirect_allowed(struct socket_key *sockkey, __u32 op) {
+  if (op == BPF_SOCK_OPS_ACTIVE_ESTABLISHED_CB) {
+    return namespace_redirect_allowed(sockkey->src_ip, sockkey->dst_ip,
+                                      sockkey->dst_port);
+  }
+  return namespace_redirect_allowed(sockkey->dst_ip, sockkey->src_ip,
+                                    sockkey->src_port);
+}
+
+static inline int flow_records_enabled() {
+  enum cni_config_key key = FLOW_RECORDS;
+  union cni_config_value *value = map_lookup_elem(&cni_config_map, &key);
+  return value && value->enabled;
+}
+
+static inline void start_flow(struct bpf_sock_ops *skops,
+                              struct socket_key *sockkey) {
+  struct flow_stats stats = {};
+  stats.start_ns = ktime_get_ns();
+  map_update_elem(&flow_map, sockkey, &stats, BPF_ANY);
+  // The state change callback flushes the record when the socket closes.
+  sock_ops_cb_flags_set(skops, skops->bpf_sock_ops_cb_flags |
+                                   BPF_SOCK_OPS_STATE_CB_FLAG);
+}
+
+static inline void end_flow(struct socket_key *sockkey) {
+  struct flow_stats *stats = map_lookup_elem(&flow_map, sockkey);
+  if (!stats) {
+    return;
+  }
+  struct flow_record record = {};
+  record.key = *sockkey;
+  record.start_ns = stats->start_ns;
+  record.end_ns = ktime_get_ns();
+  record.bytes = stats->bytes;
+  record.msgs = stats->msgs;
+  ringbuf_output(&flow_events, &record, sizeof(record), 0);
+  map_delete_elem(&flow_map, sockkey);
+}
+
+// Drops the state kept for a socket once it is closed, so a later connection
+// reusing its 4-tuple starts afresh.
+static inline void end_socket(struct bpf_sock_ops *skops) {
+  struct socket_key sockkey = {};
+  extract_socket_key_v4(skops, &sockkey);
+  end_flow(&sockkey);
+  map_delete_elem(&policy_deny_map, &sockkey);
+  map_delete_elem(&bandwidth_fallback_map, &sockkey);
+}
+
+static inline int tcp_telemetry_enabled() {
+  enum cni_config_key key = TCP_TELEMETRY;
+  union cni_config_value *value = map_lookup_elem(&cni_config_map, &key);
+  return value && value->enabled;
+}
+
+static inline struct tcp_stats *lookup_tcp_stats(struct bpf_sock_ops *skops) {
+  struct tcp_stats_key key = {};
+  key.local_ip = skops->local_ip4;
+  key.remote_ip = skops->remote_ip4;
+  struct tcp_stats *stats = map_lookup_elem(&tcp_stats_map, &key);
+  if (stats) {
+    return stats;
+  }
+  struct tcp_stats empty = {};
+  map_update_elem(&tcp_stats_map, &key, &empty, BPF_NOEXIST);
+  return map_lookup_elem(&tcp_stats_map, &key);
+}
+
+static inline __u32 rtt_bucket(__u32 rtt_us) {
+  __u32 bucket = 0;
+#pragma unroll
+  for (int i = 0; i < TCP_RTT_BUCKETS - 1; i++) {
+    if (rtt_us >> i) {
+      bucket = i + 1;
+    }
+  }
+  return bucket;
+}
+
+static inline void record_rtt(struct bpf_sock_ops *skops) {
+  struct tcp_stats *stats = lookup_tcp_stats(skops);
+  if (!stats) {
+    return;
+  }
+  __u32 rtt_us = skops->srtt_us >> 3;
+  __u32 bucket = rtt_bucket(rtt_us);
+  if (bucket < TCP_RTT_BUCKETS) {
+    __sync_fetch_and_add(&stats->rtt_buckets[bucket], 1);
+  }
+  __sync_fetch_and_add(&stats->rtt_sum_us, rtt_us);
+  __sync_fetch_and_add(&stats->rtt_count, 1);
+}
+
+static inline void record_retrans(struct bpf_sock_ops *skops) {
+  struct tcp_stats *stats = lookup_tcp_stats(skops);
+  if (stats) {
+    __sync_fetch_and_add(&stats->retrans, 1);
+  }
+}
+
+static inline void set_tcp_opt(struct bpf_sock_ops *skops, int level,
+                               int optname, int value) {
+  if (value) {
+    setsockopt(skops, level, optname, &value, sizeof(value));
+  }
+}
+
+// Applies the settings of the pod owning the socket. Called before any data
+// is sent, which the initial congestion window requires.
+static inline void apply_tcp_tuning(struct bpf_sock_ops *skops) {
+  __u32 ip = skops->local_ip4;
+  struct tcp_tuning *tuning = map_lookup_elem(&tcp_tuning_map, &ip);
+  if (!tuning) {
+    return;
+  }
+  if (tuning->congestion[0]) {
+    char congestion[TCP_CA_NAME_MAX];
+    __builtin_memcpy(congestion, tuning->congestion, TCP_CA_NAME_MAX);
+    int ret =
+        setsockopt(skops, SOL_TCP, TCP_CONGESTION, congestion, TCP_CA_NAME_MAX);
+    if (ret != 0) {
+      print_info("[sockops] ERROR: failed to set congestion control, ret: %d\n",
+                 ret);
+    }
+  }
+  set_tcp_opt(skops, SOL_TCP, TCP_BPF_IW, tuning->init_cwnd);
+  set_tcp_opt(skops, SOL_TCP, TCP_BPF_RTO_MIN, tuning->rto_min_us);
+  if (tuning->keepalive_idle || tuning->keepalive_intvl ||
+      tuning->keepalive_cnt) {
+    set_tcp_opt(skops, SOL_SOCKET, SO_KEEPALIVE, 1);
+    set_tcp_opt(skops, SOL_TCP, TCP_KEEPIDLE, tuning->keepalive_idle);
+    set_tcp_opt(skops, SOL_TCP, TCP_KEEPINTVL, tuning->keepalive_intvl);
+    set_tcp_opt(skops, SOL_TCP, TCP_KEEPCNT, tuning->keepalive_cnt);
+  }
+}
+
+static inline int process_sockops_ipv4(struct bpf_sock_ops *skops, __u32 op) {
   if (in_subnet_range(skops->local_ip4)) {
     struct socket_key sockkey = {};
     extract_socket_key_v4(skops, &sockkey);
+    struct policy_verdict verdict = {};
+    check_policy(&sockkey, op, &verdict);
+    if (!verdict.policy_id || verdict.audit) {
+      // An entry left over from a denied connection with the same 4-tuple
+      // must not outlive a policy change.
+      map_delete_elem(&policy_deny_map, &sockkey);
+    }
+    if (verdict.policy_id && verdict.audit) {
+      audit_policy(&sockkey, op, &verdict);
+    } else if (verdict.policy_id) {
+      // The socket is still added to the sock hash below, sk_msg has to see
+      // it to drop its data instead of redirecting it. The state change
+      // callback removes the entry when the socket closes.
+      map_update_elem(&policy_deny_map, &sockkey, &verdict.policy_id, BPF_ANY);
+      sock_ops_cb_flags_set(skops, skops->bpf_sock_ops_cb_flags |
+                                       BPF_SOCK_OPS_STATE_CB_FLAG);
+      print_info("[sockops] connection denied by policy %d\n",
+                 verdict.policy_id);
+    }
+    if (flow_records_enabled()) {
+      start_flow(skops, &sockkey);
+    }
+    if (tcp_telemetry_enabled()) {
+      sock_ops_cb_flags_set(skops, skops->bpf_sock_ops_cb_flags |
+                                       BPF_SOCK_OPS_RTT_CB_FLAG |
+                                       BPF_SOCK_OPS_RETRANS_CB_FLAG);
+    }
+    // Connections across namespace bridges are left to the stack, where the
+    // traffic between the bridges is routed and filtered. Denied ones are
+    // still added to the sock hash for sk_msg to drop their data, which it
+    // does before redirecting anything.
+    int denied = verdict.policy_id && !verdict.audit;
+    if (!denied && !redirect_allowed(&sockkey, op)) {
+      return 0;
+    }
+    // sk_msg records the sockets exceeding a bandwidth limit, which it can't
+    // ask to be called back for. The state change callback removes them when
+    // the socket closes.
+    map_delete_elem(&bandwidth_fallback_map, &sockkey);
+    if (bandwidth_limited(sockkey.src_ip, sockkey.dst_ip)) {
+      sock_ops_cb_flags_set(skops, skops->bpf_sock_ops_cb_flags |
+                                       BPF_SOCK_OPS_STATE_CB_FLAG);
+    }
     int ret =
         sock_hash_update(skops, &sockops_redir_map, &sockkey, BPF_NOEXIST);
     if (ret != 0) {
@@ -67,10 +286,34 @@ __section("sockops") int patu_sockops(struct bpf_sock_ops *skops) {
   operator= skops->op;
 
   switch (operator) {
+  case BPF_SOCK_OPS_TCP_CONNECT_CB:
+    if (family == 2) {
+      apply_tcp_tuning(skops);
+    }
+    break;
   case BPF_SOCK_OPS_PASSIVE_ESTABLISHED_CB:
+    if (family == 2) {
+      apply_tcp_tuning(skops);
+    }
+    // fall through
   case BPF_SOCK_OPS_ACTIVE_ESTABLISHED_CB:
     if (family == 2) { // AF_INET,refer socket.h
-      process_sockops_ipv4(skops);
+      process_sockops_ipv4(skops, operator);
+    }
+    break;
+  case BPF_SOCK_OPS_RTT_CB:
+    if (family == 2) {
+      record_rtt(skops);
+    }
+    break;
+  case BPF_SOCK_OPS_RETRANS_CB:
+    if (family == 2) {
+      record_retrans(skops);
+    }
+    break;
+  case BPF_SOCK_OPS_STATE_CB:
+    if (family == 2 && skops->args[1] == BPF_TCP_CLOSE) {
+      end_socket(skops);
     }
     break;
   default:
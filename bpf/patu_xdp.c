@@ -0,0 +1,73 @@
+/*
+Copyright © 2022 Authors of Patu
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+#include <linux/bpf.h>
+
+#include "include/helpers/helpers.h"
+#include "include/helpers/maps.h"
+#include "include/helpers/policy_skb.h"
+#include "include/helpers/tuple.h"
+
+// Same as the kernel's, the checksum is updated incrementally.
+static inline void ip_decrease_ttl(struct iphdr *ip) {
+  __u32 check = (__u32)ip->check;
+  check += (__u32)bpf_htons(0x0100);
+  ip->check = (__u16)(check + (check >= 0xFFFF));
+  ip->ttl--;
+}
+
+// Attached to the uplink by patud. Packets from outside the node to a local
+// pod are sent to its host veth right away, everything else is passed to the
+// stack.
+__section("xdp") int patu_xdp(struct xdp_md *ctx) {
+  void *data = (void *)(long)ctx->data;
+  void *data_end = (void *)(long)ctx->data_end;
+  struct ipv4_tuple tuple = {};
+  if (!parse_ipv4_frame(data, data_end, &tuple)) {
+    return XDP_PASS;
+  }
+  struct endpoint *ep = map_lookup_elem(&endpoint_map, &tuple.daddr);
+  if (!ep) {
+    return XDP_PASS;
+  }
+  // Replies to flows of the pod are left to the stack, which may have NATed
+  // them, and so are packets to pods with an ingress bandwidth limit,
+  // enforced on the TC egress of the host veth.
+  if (map_lookup_elem(&fastpath_stack_map, &tuple)) {
+    return XDP_PASS;
+  }
+  struct pod_bandwidth *bw = map_lookup_elem(&bandwidth_map, &ep->ifindex);
+  if (bw && bw->ingress_rate) {
+    return XDP_PASS;
+  }
+  // A redirected frame skips the policy program on the host veth.
+  if (policy_deny_syn(data, data_end)) {
+    return XDP_DROP;
+  }
+
+  struct ethhdr *eth = data;
+  struct iphdr *ip = (void *)(eth + 1);
+  if ((void *)(ip + 1) > data_end || ip->ttl <= 1) {
+    return XDP_PASS;
+  }
+  ip_decrease_ttl(ip);
+  __builtin_memcpy(eth->h_dest, ep->mac, ETH_ALEN);
+  __builtin_memcpy(eth->h_source, ep->host_mac, ETH_ALEN);
+  return redirect(ep->ifindex, 0);
+}
+
+char ____license[] __section("license") = "GPL";
+int _version __section("version") = 1;
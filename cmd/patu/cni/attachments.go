@@ -0,0 +1,142 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// attachment is what cmdAdd records about a container attachment, so GC can
+// clean it up after a runtime lost track of it.
+type attachment struct {
+	ContainerID   string   `json:"containerID"`
+	IfName        string   `json:"ifName"`
+	Mode          string   `json:"mode,omitempty"`
+	Chained       bool     `json:"chained,omitempty"`
+	HostVeth      string   `json:"hostVeth"`
+	HostVethMac   string   `json:"hostVethMac"`
+	HostVethIndex int      `json:"hostVethIndex,omitempty"`
+	IPs           []string `json:"ips,omitempty"`
+	IPMasq        bool     `json:"ipMasq,omitempty"`
+	IPMasqBackend string   `json:"ipMasqBackend,omitempty"`
+	IPAMType      string   `json:"ipamType,omitempty"`
+	HostPorts     bool     `json:"hostPorts,omitempty"`
+	Bandwidth     bool     `json:"bandwidth,omitempty"`
+	FastPath      bool     `json:"fastPath,omitempty"`
+	Policy        bool     `json:"policy,omitempty"`
+	Vlan          int      `json:"vlan,omitempty"`
+	VlanTrunk     []int    `json:"vlanTrunk,omitempty"`
+	SpoofCheck    bool     `json:"spoofCheck,omitempty"`
+}
+
+func attachmentDir(n *NetConf) string {
+	return filepath.Join(n.DataDir, n.Name)
+}
+
+func attachmentPath(n *NetConf, containerID, ifName string) string {
+	return filepath.Join(attachmentDir(n), containerID+"_"+ifName+".json")
+}
+
+// lockAttachments serializes GC, which takes the lock exclusively, with ADD
+// and DEL, which take it shared. The returned function releases the lock.
+func lockAttachments(n *NetConf, how int) (func(), error) {
+	if err := os.MkdirAll(attachmentDir(n), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create %q: %v", attachmentDir(n), err)
+	}
+	lockPath := filepath.Join(attachmentDir(n), "lock")
+	f, err := os.OpenFile(lockPath, os.O_RDONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %q: %v", lockPath, err)
+	}
+	if err := syscall.Flock(int(f.Fd()), how); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to lock %q: %v", lockPath, err)
+	}
+	return func() {
+		_ = syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+func saveAttachment(n *NetConf, a *attachment) error {
+	data, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	path := attachmentPath(n, a.ContainerID, a.IfName)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to record attachment: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to record attachment: %v", err)
+	}
+	return nil
+}
+
+func removeAttachment(n *NetConf, containerID, ifName string) error {
+	err := os.Remove(attachmentPath(n, containerID, ifName))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove attachment record: %v", err)
+	}
+	return nil
+}
+
+// loadAttachment returns the record of an attachment, or nil if there is none.
+func loadAttachment(n *NetConf, containerID, ifName string) (*attachment, error) {
+	data, err := os.ReadFile(attachmentPath(n, containerID, ifName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read attachment record: %v", err)
+	}
+	a := &attachment{}
+	if err := json.Unmarshal(data, a); err != nil {
+		return nil, fmt.Errorf("failed to decode attachment record: %v", err)
+	}
+	return a, nil
+}
+
+func listAttachments(n *NetConf) ([]*attachment, error) {
+	entries, err := os.ReadDir(attachmentDir(n))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list attachments: %v", err)
+	}
+	var attachments []*attachment
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(attachmentDir(n), entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read attachment %q: %v", entry.Name(), err)
+		}
+		a := &attachment{}
+		if err := json.Unmarshal(data, a); err != nil {
+			return nil, fmt.Errorf("failed to decode attachment %q: %v", entry.Name(), err)
+		}
+		attachments = append(attachments, a)
+	}
+	return attachments, nil
+}
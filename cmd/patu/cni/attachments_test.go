@@ -0,0 +1,106 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+func TestAttachments(t *testing.T) {
+	n := &NetConf{NetConf: types.NetConf{Name: "patu"}, DataDir: t.TempDir()}
+	unlock, err := lockAttachments(n, syscall.LOCK_EX)
+	if err != nil {
+		t.Fatalf("lockAttachments() error = %v", err)
+	}
+	defer unlock()
+
+	web := &attachment{ContainerID: "web", IfName: "eth0", HostVeth: "veth0123456789a", IPs: []string{"10.200.0.5/24"}, IPAMType: "patu"}
+	db := &attachment{ContainerID: "db", IfName: "eth0", HostVeth: "veth0123456789b", Chained: true}
+	for _, a := range []*attachment{web, db} {
+		if err := saveAttachment(n, a); err != nil {
+			t.Fatalf("saveAttachment(%s) error = %v", a.ContainerID, err)
+		}
+	}
+
+	got, err := loadAttachment(n, "web", "eth0")
+	if err != nil || !reflect.DeepEqual(got, web) {
+		t.Errorf("loadAttachment(web) = %+v, %v, want %+v", got, err, web)
+	}
+	if got, err := loadAttachment(n, "web", "net1"); got != nil || err != nil {
+		t.Errorf("loadAttachment() of an unknown interface = %+v, %v, want nil", got, err)
+	}
+
+	// The lock file and leftovers of an interrupted save are not records.
+	if err := os.WriteFile(attachmentPath(n, "cache", "eth0")+".tmp", []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	list, err := listAttachments(n)
+	if err != nil {
+		t.Fatalf("listAttachments() error = %v", err)
+	}
+	if want := []*attachment{db, web}; !reflect.DeepEqual(list, want) {
+		t.Errorf("listAttachments() = %+v, want %+v", list, want)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := removeAttachment(n, "web", "eth0"); err != nil {
+			t.Fatalf("removeAttachment() #%d error = %v", i, err)
+		}
+	}
+	if got, err := loadAttachment(n, "web", "eth0"); got != nil || err != nil {
+		t.Errorf("loadAttachment() of a removed attachment = %+v, %v, want nil", got, err)
+	}
+
+	if err := os.WriteFile(attachmentPath(n, "db", "eth0"), []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadAttachment(n, "db", "eth0"); err == nil || !strings.Contains(err.Error(), "failed to decode attachment record") {
+		t.Errorf("loadAttachment() of a corrupt record error = %v", err)
+	}
+	if _, err := listAttachments(n); err == nil || !strings.Contains(err.Error(), "failed to decode attachment") {
+		t.Errorf("listAttachments() with a corrupt record error = %v", err)
+	}
+}
+
+func TestDelegateUnsupported(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "plugin without GC", err: types.NewError(types.ErrInvalidEnvironmentVariables, "unknown CNI_COMMAND: GC", ""), want: true},
+		{name: "plugin without CNI 1.1", err: types.NewError(types.ErrIncompatibleCNIVersion, "incompatible CNI versions", ""), want: true},
+		{name: "wrapped", err: fmt.Errorf("delegate: %w", types.NewError(types.ErrIncompatibleCNIVersion, "", "")), want: true},
+		{name: "plugin error", err: types.NewError(types.ErrInternal, "failed to release", "")},
+		{name: "plugin not found", err: errors.New("failed to find plugin \"host-local\"")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := delegateUnsupported(tt.err); got != tt.want {
+				t.Errorf("delegateUnsupported(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,300 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/redhat-et/patu/internal/bpf"
+)
+
+// bandwidthEntry is the bandwidth capability, set by the runtime from the
+// kubernetes.io/ingress-bandwidth and egress-bandwidth annotations. Rates are
+// in bits per second and bursts in bits.
+type bandwidthEntry struct {
+	IngressRate  uint64 `json:"ingressRate"`
+	IngressBurst uint64 `json:"ingressBurst"`
+	EgressRate   uint64 `json:"egressRate"`
+	EgressBurst  uint64 `json:"egressBurst"`
+}
+
+func (b *bandwidthEntry) limits() bpf.PodBandwidth {
+	return bpf.PodBandwidth{
+		EgressRate:   b.EgressRate / 8,
+		EgressBurst:  b.EgressBurst / 8,
+		IngressRate:  b.IngressRate / 8,
+		IngressBurst: b.IngressBurst / 8,
+	}
+}
+
+func (b *bandwidthEntry) isSet() bool {
+	return b != nil && (b.IngressRate > 0 || b.EgressRate > 0)
+}
+
+func podIPv4Keys(ips []string) ([][4]byte, error) {
+	var keys [][4]byte
+	for _, addr := range ips {
+		ipn, err := types.ParseCIDR(addr)
+		if err != nil {
+			return nil, err
+		}
+		if key, ok := bpf.IPv4Key(ipn.IP); ok {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func ipConfigStrings(ips []*current.IPConfig) []string {
+	var addrs []string
+	for _, ipc := range ips {
+		addrs = append(addrs, ipc.Address.String())
+	}
+	return addrs
+}
+
+// bandwidthLimits returns the limits of the pod. Netfilter masquerades the
+// egress of the pod leaving its subnet to the node address, so it can't be
+// found on the uplink and is policed on the host veth instead.
+func bandwidthLimits(n *NetConf, masqBackendName string, ips []string) (bpf.PodBandwidth, error) {
+	limits := n.RuntimeConfig.Bandwidth.limits()
+	if masqBackendName == "" || masqBackendName == masqBackendEBPF {
+		return limits, nil
+	}
+	for _, addr := range ips {
+		ipn, err := types.ParseCIDR(addr)
+		if err != nil {
+			return limits, err
+		}
+		ip4 := ipn.IP.To4()
+		if ip4 == nil {
+			continue
+		}
+		mask := net.IP(ipn.Mask).To4()
+		copy(limits.MasqNet[:], ip4.Mask(ipn.Mask))
+		copy(limits.MasqMask[:], mask)
+		break
+	}
+	return limits, nil
+}
+
+// setupBandwidth shapes the traffic of the pod. The limits are keyed by the
+// host veth, the uplink shaper and sk_msg find them by the pod addresses.
+// Egress leaving the node is paced by fq on the uplinks, set up with the first
+// egress limit.
+func setupBandwidth(n *NetConf, hostVeth netlink.Link, masqBackendName string, ips []string) error {
+	limits, err := bandwidthLimits(n, masqBackendName, ips)
+	if err != nil {
+		return err
+	}
+	podIPs, err := podIPv4Keys(ips)
+	if err != nil {
+		return err
+	}
+	if err := bpf.SetPodBandwidth(uint32(hostVeth.Attrs().Index), podIPs, limits); err != nil {
+		return err
+	}
+	if err := bpf.AttachBandwidth(hostVeth); err != nil {
+		return err
+	}
+	if limits.EgressRate == 0 {
+		return nil
+	}
+	links, err := uplinks()
+	if err != nil {
+		return err
+	}
+	for _, link := range links {
+		if err := ensureFQ(link); err != nil {
+			return err
+		}
+		if err := bpf.AttachBandwidthUplink(link); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uplinks returns the interfaces of the default routes.
+func uplinks() ([]netlink.Link, error) {
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list routes: %v", err)
+	}
+	var links []netlink.Link
+	seen := make(map[int]bool)
+	for _, route := range routes {
+		if route.Dst != nil {
+			continue
+		}
+		linkIndexes := []int{route.LinkIndex}
+		if route.LinkIndex == 0 {
+			linkIndexes = nil
+			for _, nh := range route.MultiPath {
+				linkIndexes = append(linkIndexes, nh.LinkIndex)
+			}
+		}
+		for _, index := range linkIndexes {
+			if seen[index] {
+				continue
+			}
+			seen[index] = true
+			link, err := netlink.LinkByIndex(index)
+			if err != nil {
+				return nil, fmt.Errorf("failed to lookup the uplink %d: %v", index, err)
+			}
+			links = append(links, link)
+		}
+	}
+	return links, nil
+}
+
+// Qdiscs the kernel sets up by default, the only ones ensureFQ replaces.
+var defaultQdiscs = map[string]bool{"pfifo_fast": true, "fq_codel": true, "noqueue": true}
+
+// ensureFQ makes fq the root qdisc of the uplink, or the qdisc of each of its
+// transmit queues under mq, as it honors the departure times. This applies to
+// all the traffic of the node, and stays after the last pod with an egress
+// limit is gone.
+func ensureFQ(link netlink.Link) error {
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return fmt.Errorf("failed to list the qdiscs of %s: %v", link.Attrs().Name, err)
+	}
+	parents, err := fqParents(qdiscs)
+	if err != nil {
+		return fmt.Errorf("can't shape pod egress on %s: %v", link.Attrs().Name, err)
+	}
+	for _, parent := range parents {
+		fq := netlink.NewFq(netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Parent:    parent,
+		})
+		if parent == netlink.HANDLE_ROOT {
+			fq.Handle = netlink.MakeHandle(1, 0)
+		}
+		if err := netlink.QdiscReplace(fq); err != nil {
+			return fmt.Errorf("failed to set the fq qdisc on %s: %v", link.Attrs().Name, err)
+		}
+	}
+	return nil
+}
+
+// fqParents returns where fq must be set among the qdiscs of an interface. It
+// fails if a qdisc to replace was configured by the administrator rather than
+// the kernel.
+func fqParents(qdiscs []netlink.Qdisc) ([]uint32, error) {
+	replace := func(qdisc netlink.Qdisc) error {
+		if !defaultQdiscs[qdisc.Type()] {
+			return fmt.Errorf("the %s qdisc would be replaced by fq", qdisc.Type())
+		}
+		return nil
+	}
+	var parents []uint32
+	for _, qdisc := range qdiscs {
+		if qdisc.Attrs().Parent != netlink.HANDLE_ROOT {
+			continue
+		}
+		switch qdisc.Type() {
+		case "fq":
+		case "mq":
+			major, _ := netlink.MajorMinor(qdisc.Attrs().Handle)
+			for _, child := range qdiscs {
+				parentMajor, _ := netlink.MajorMinor(child.Attrs().Parent)
+				if child.Attrs().Parent == netlink.HANDLE_ROOT || parentMajor != major || child.Type() == "fq" {
+					continue
+				}
+				if err := replace(child); err != nil {
+					return nil, err
+				}
+				parents = append(parents, child.Attrs().Parent)
+			}
+		default:
+			if err := replace(qdisc); err != nil {
+				return nil, err
+			}
+			parents = append(parents, netlink.HANDLE_ROOT)
+		}
+	}
+	if len(qdiscs) == 0 {
+		parents = append(parents, netlink.HANDLE_ROOT)
+	}
+	return parents, nil
+}
+
+// teardownBandwidth removes the limits of the pod. The programs go away with
+// the host veth.
+func teardownBandwidth(hostVethIndex int, ips []string) error {
+	podIPs, err := podIPv4Keys(ips)
+	if err != nil {
+		return err
+	}
+	return bpf.DelPodBandwidth(uint32(hostVethIndex), podIPs)
+}
+
+// checkBandwidth verifies the limits of the pod are in place on its host veth
+// and, for an egress limit, on the uplinks.
+func checkBandwidth(n *NetConf, hostVethName, masqBackendName string, ips []string) error {
+	hostVeth, err := netlink.LinkByName(hostVethName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", hostVethName, err)
+	}
+	attached, err := bpf.BandwidthAttached(hostVeth)
+	if err != nil {
+		return err
+	}
+	if !attached {
+		return fmt.Errorf("bandwidth programs are not attached to %s", hostVethName)
+	}
+	want, err := bandwidthLimits(n, masqBackendName, ips)
+	if err != nil {
+		return err
+	}
+	podIPs, err := podIPv4Keys(ips)
+	if err != nil {
+		return err
+	}
+	limits, err := bpf.LookupPodBandwidth(uint32(hostVeth.Attrs().Index), podIPs)
+	if err != nil {
+		return err
+	}
+	if limits != want {
+		return fmt.Errorf("bandwidth limits of %s don't match: %+v", hostVethName, limits)
+	}
+	if limits.EgressRate == 0 {
+		return nil
+	}
+	links, err := uplinks()
+	if err != nil {
+		return err
+	}
+	for _, link := range links {
+		attached, err := bpf.BandwidthUplinkAttached(link)
+		if err != nil {
+			return err
+		}
+		if !attached {
+			return fmt.Errorf("egress shaper is not attached to the uplink %s", link.Attrs().Name)
+		}
+	}
+	return nil
+}
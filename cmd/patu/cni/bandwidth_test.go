@@ -0,0 +1,151 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/redhat-et/patu/internal/bpf"
+)
+
+func TestBandwidthLimits(t *testing.T) {
+	entry := &bandwidthEntry{IngressRate: 8000000, IngressBurst: 80000, EgressRate: 16000000, EgressBurst: 160000}
+	limits := bpf.PodBandwidth{IngressRate: 1000000, IngressBurst: 10000, EgressRate: 2000000, EgressBurst: 20000}
+	masqueraded := func(net, mask [4]byte) bpf.PodBandwidth {
+		l := limits
+		l.MasqNet, l.MasqMask = net, mask
+		return l
+	}
+	tests := []struct {
+		name    string
+		backend string
+		ips     []string
+		want    bpf.PodBandwidth
+		wantErr string
+	}{
+		{name: "no masquerade", ips: []string{"10.200.0.5/24"}, want: limits},
+		{name: "eBPF SNAT keeps the pod address", backend: masqBackendEBPF, ips: []string{"10.200.0.5/24"}, want: limits},
+		{
+			name: "nftables masquerade", backend: masqBackendNftables, ips: []string{"10.200.0.5/24"},
+			want: masqueraded([4]byte{10, 200, 0, 0}, [4]byte{255, 255, 255, 0}),
+		},
+		{
+			name: "iptables masquerade of a dual stack pod", backend: masqBackendIptables, ips: []string{"fd00::5/64", "10.200.1.5/23"},
+			want: masqueraded([4]byte{10, 200, 0, 0}, [4]byte{255, 255, 254, 0}),
+		},
+		{name: "IPv6 only pod", backend: masqBackendNftables, ips: []string{"fd00::5/64"}, want: limits},
+		{name: "invalid address", backend: masqBackendNftables, ips: []string{"10.200.0.5"}, wantErr: "invalid CIDR address"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := &NetConf{}
+			n.RuntimeConfig.Bandwidth = entry
+			got, err := bandwidthLimits(n, tt.backend, tt.ips)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("bandwidthLimits() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("bandwidthLimits() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("bandwidthLimits() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBandwidthIsSet(t *testing.T) {
+	tests := []struct {
+		name  string
+		entry *bandwidthEntry
+		want  bool
+	}{
+		{name: "no capability"},
+		{name: "no limits", entry: &bandwidthEntry{}},
+		{name: "burst without a rate", entry: &bandwidthEntry{EgressBurst: 8000}},
+		{name: "ingress limit", entry: &bandwidthEntry{IngressRate: 8000}, want: true},
+		{name: "egress limit", entry: &bandwidthEntry{EgressRate: 8000}, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.entry.isSet(); got != tt.want {
+				t.Errorf("isSet() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFQParents(t *testing.T) {
+	root := func(qdiscType string) netlink.Qdisc {
+		return &netlink.GenericQdisc{
+			QdiscAttrs: netlink.QdiscAttrs{Handle: netlink.MakeHandle(1, 0), Parent: netlink.HANDLE_ROOT},
+			QdiscType:  qdiscType,
+		}
+	}
+	queue := func(minor uint16, qdiscType string) netlink.Qdisc {
+		return &netlink.GenericQdisc{
+			QdiscAttrs: netlink.QdiscAttrs{Parent: netlink.MakeHandle(1, minor)},
+			QdiscType:  qdiscType,
+		}
+	}
+	tests := []struct {
+		name    string
+		qdiscs  []netlink.Qdisc
+		want    []uint32
+		wantErr string
+	}{
+		{name: "no qdisc", want: []uint32{netlink.HANDLE_ROOT}},
+		{name: "noqueue", qdiscs: []netlink.Qdisc{root("noqueue")}, want: []uint32{netlink.HANDLE_ROOT}},
+		{name: "fq_codel", qdiscs: []netlink.Qdisc{root("fq_codel")}, want: []uint32{netlink.HANDLE_ROOT}},
+		{name: "fq already", qdiscs: []netlink.Qdisc{root("fq")}},
+		{
+			name:   "mq",
+			qdiscs: []netlink.Qdisc{root("mq"), queue(1, "fq"), queue(2, "pfifo_fast")},
+			want:   []uint32{netlink.MakeHandle(1, 2)},
+		},
+		{name: "administrator's shaper", qdiscs: []netlink.Qdisc{root("htb")}, wantErr: "the htb qdisc would be replaced"},
+		{
+			name:    "administrator's queue under mq",
+			qdiscs:  []netlink.Qdisc{root("mq"), queue(1, "cake"), queue(2, "pfifo_fast")},
+			wantErr: "the cake qdisc would be replaced",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := fqParents(tt.qdiscs)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("fqParents() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("fqParents() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("fqParents() = %x, want %x", got, tt.want)
+			}
+		})
+	}
+}
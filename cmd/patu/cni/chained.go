@@ -0,0 +1,179 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+)
+
+// chainedPrevResult returns the result of the previous plugins of the chain,
+// which chained mode works from.
+func chainedPrevResult(n *NetConf) (*current.Result, error) {
+	if n.NetConf.RawPrevResult == nil {
+		return nil, fmt.Errorf("chained mode requires a prevResult")
+	}
+	if err := version.ParsePrevResult(&n.NetConf); err != nil {
+		return nil, err
+	}
+	return current.NewResultFromResult(n.PrevResult)
+}
+
+// chainedIPs returns the addresses of the container interface in result.
+func chainedIPs(result *current.Result, args *skel.CmdArgs) []*current.IPConfig {
+	var ips []*current.IPConfig
+	for _, ipc := range result.IPs {
+		if ipc.Interface != nil {
+			idx := *ipc.Interface
+			if idx < 0 || idx >= len(result.Interfaces) {
+				continue
+			}
+			intf := result.Interfaces[idx]
+			if intf.Name != args.IfName || intf.Sandbox != args.Netns {
+				continue
+			}
+		}
+		ips = append(ips, ipc)
+	}
+	return ips
+}
+
+// chainedHostVeth finds the host side of the container interface, which
+// patud resolves the pod by. It returns nil if the container interface is not
+// a veth, e.g. a macvlan.
+func chainedHostVeth(args *skel.CmdArgs) (netlink.Link, error) {
+	var peerIndex int
+	err := ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(args.IfName)
+		if err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", args.IfName, err)
+		}
+		if _, isVeth := link.(*netlink.Veth); !isVeth {
+			return nil
+		}
+		_, peerIndex, err = ip.GetVethPeerIfindex(args.IfName)
+		return err
+	})
+	if err != nil || peerIndex == 0 {
+		return nil, err
+	}
+	hostVeth, err := netlink.LinkByIndex(peerIndex)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup the peer of %q: %v", args.IfName, err)
+	}
+	return hostVeth, nil
+}
+
+// chainedAdd registers a pod set up by the previous plugins of the chain with
+// the datapath, leaving its interfaces, addresses and routes alone. The
+// result of the chain is passed through. The pod gets no local fast path,
+// which would hand its packets to other pods ahead of the bridge, routes or
+// filters of the primary plugin.
+func chainedAdd(args *skel.CmdArgs, n *NetConf, cniVersion string) error {
+	result, err := chainedPrevResult(n)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := lockAttachments(n, syscall.LOCK_SH)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	ips := ipConfigStrings(chainedIPs(result, args))
+	hostVeth, err := chainedHostVeth(args)
+	if err != nil {
+		return err
+	}
+	record := &attachment{
+		ContainerID: args.ContainerID,
+		IfName:      args.IfName,
+		Chained:     true,
+		IPs:         ips,
+	}
+	if hostVeth != nil {
+		record.HostVeth = hostVeth.Attrs().Name
+		record.HostVethMac = hostVeth.Attrs().HardwareAddr.String()
+		record.HostVethIndex = hostVeth.Attrs().Index
+	}
+
+	if err := saveAttachment(n, record); err != nil {
+		return err
+	}
+	notifyAttached(n, args, record.HostVeth, ips)
+	return types.PrintResult(result, cniVersion)
+}
+
+// chainedDel unregisters the pod from the datapath. Its interfaces and
+// addresses belong to the previous plugins of the chain.
+func chainedDel(args *skel.CmdArgs, n *NetConf) error {
+	unlock, err := lockAttachments(n, syscall.LOCK_SH)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	record, err := loadAttachment(n, args.ContainerID, args.IfName)
+	if err != nil {
+		return err
+	}
+	if record == nil {
+		notifyDetached(n, args, "", nil)
+		return nil
+	}
+	if err := teardownTCPStats(record.IPs); err != nil {
+		return err
+	}
+	notifyDetached(n, args, record.HostVeth, record.IPs)
+	return removeAttachment(n, args.ContainerID, args.IfName)
+}
+
+// chainedCheck verifies the container interface still has the addresses of
+// the chain's result and the datapath accelerates the pod.
+func chainedCheck(args *skel.CmdArgs, n *NetConf) error {
+	result, err := chainedPrevResult(n)
+	if err != nil {
+		return err
+	}
+	ips := chainedIPs(result, args)
+	if err := ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+		return ip.ValidateExpectedInterfaceIPs(args.IfName, ips)
+	}); err != nil {
+		return err
+	}
+	if err := checkDatapath(ips); err != nil {
+		return err
+	}
+
+	record, err := loadAttachment(n, args.ContainerID, args.IfName)
+	if err != nil {
+		return err
+	}
+	if record == nil {
+		return fmt.Errorf("container %s is not registered with the datapath", args.ContainerID)
+	}
+	return nil
+}
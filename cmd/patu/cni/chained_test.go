@@ -0,0 +1,83 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/skel"
+)
+
+func TestChainedIPs(t *testing.T) {
+	args := &skel.CmdArgs{ContainerID: "c1", Netns: "/var/run/netns/c1", IfName: "eth0"}
+	tests := []struct {
+		name       string
+		prevResult string
+		want       []string
+		wantErr    string
+	}{
+		{name: "no prevResult", wantErr: "chained mode requires a prevResult"},
+		{
+			name: "container interface",
+			prevResult: `{"cniVersion": "1.0.0",
+				"interfaces": [{"name": "veth1"}, {"name": "eth0", "sandbox": "/var/run/netns/c1"}],
+				"ips": [{"address": "10.200.0.5/24", "interface": 1}, {"address": "fd00::5/64", "interface": 1}]}`,
+			want: []string{"10.200.0.5/24", "fd00::5/64"},
+		},
+		{
+			name:       "no interface index",
+			prevResult: `{"cniVersion": "1.0.0", "ips": [{"address": "10.200.0.5/24"}]}`,
+			want:       []string{"10.200.0.5/24"},
+		},
+		{
+			name: "other interfaces",
+			prevResult: `{"cniVersion": "1.0.0",
+				"interfaces": [{"name": "veth1"}, {"name": "eth0", "sandbox": "/var/run/netns/c1"}, {"name": "eth0", "sandbox": "/var/run/netns/c2"}],
+				"ips": [{"address": "10.200.0.4/24", "interface": 0}, {"address": "10.200.0.5/24", "interface": 1},
+					{"address": "10.200.0.6/24", "interface": 2}, {"address": "10.200.0.7/24", "interface": 3}]}`,
+			want: []string{"10.200.0.5/24"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := `{"cniVersion": "1.0.0", "name": "patu", "type": "patu", "chained": true`
+			if tt.prevResult != "" {
+				conf += `, "prevResult": ` + tt.prevResult
+			}
+			n := &NetConf{}
+			if err := json.Unmarshal([]byte(conf+"}"), n); err != nil {
+				t.Fatalf("Failed to parse the network configuration: %v", err)
+			}
+			result, err := chainedPrevResult(n)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("chainedPrevResult() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("chainedPrevResult() error = %v", err)
+			}
+			if got := ipConfigStrings(chainedIPs(result, args)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("chainedIPs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+
+	current "github.com/containernetworking/cni/pkg/types/100"
+
+	"github.com/redhat-et/patu/internal/bpf"
+)
+
+// The datapath lookups are replaced by the tests of CHECK.
+var (
+	checkSockopsAttached = bpf.CheckSockopsAttached
+	checkSkMsgAttached   = bpf.CheckSkMsgAttached
+	podSubnet            = bpf.PodSubnet
+)
+
+// checkDatapath verifies the acceleration patud provides to every pod is in
+// place: sockops in effect on the cgroup hierarchy, sk_msg attached to the
+// socket map and a pod subnet covering the IPv4 addresses of the pod.
+func checkDatapath(ips []*current.IPConfig) error {
+	if err := checkSockopsAttached(); err != nil {
+		return err
+	}
+	if err := checkSkMsgAttached(); err != nil {
+		return err
+	}
+	subnet, err := podSubnet()
+	if err != nil {
+		return err
+	}
+	for _, ipc := range ips {
+		// The socket acceleration is IPv4 only
+		if ipc.Address.IP.To4() == nil {
+			continue
+		}
+		if !subnet.Contains(ipc.Address.IP) {
+			return fmt.Errorf("pod address %s is not in the accelerated subnet %s", ipc.Address.IP, subnet)
+		}
+	}
+	return nil
+}
+
+// teardownTCPStats removes the TCP telemetry of the pod's connections, which
+// patu_sockops keeps per pair of addresses.
+func teardownTCPStats(ips []string) error {
+	podIPs, err := podIPv4Keys(ips)
+	if err != nil {
+		return err
+	}
+	return bpf.DelTCPStats(podIPs)
+}
@@ -0,0 +1,83 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	current "github.com/containernetworking/cni/pkg/types/100"
+)
+
+func TestCheckDatapath(t *testing.T) {
+	defer func(saved func() error) { checkSockopsAttached = saved }(checkSockopsAttached)
+	defer func(saved func() error) { checkSkMsgAttached = saved }(checkSkMsgAttached)
+	defer func(saved func() (*net.IPNet, error)) { podSubnet = saved }(podSubnet)
+
+	ipConfig := func(cidr string) *current.IPConfig {
+		ip, ipn, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %v", cidr, err)
+		}
+		ipn.IP = ip
+		return &current.IPConfig{Address: *ipn}
+	}
+	_, subnet, _ := net.ParseCIDR("10.200.0.0/16")
+	tests := []struct {
+		name       string
+		ips        []*current.IPConfig
+		sockopsErr error
+		skMsgErr   error
+		subnetErr  error
+		wantErr    string
+	}{
+		{name: "pod in the subnet", ips: []*current.IPConfig{ipConfig("10.200.0.5/24")}},
+		{name: "IPv6 is not accelerated", ips: []*current.IPConfig{ipConfig("10.200.0.5/24"), ipConfig("fd00::5/64")}},
+		{name: "pod outside of the subnet", ips: []*current.IPConfig{ipConfig("10.100.0.5/24")},
+			wantErr: "pod address 10.100.0.5 is not in the accelerated subnet 10.200.0.0/16"},
+		{name: "sockops detached", ips: []*current.IPConfig{ipConfig("10.200.0.5/24")},
+			sockopsErr: errors.New("sockops is not attached"), wantErr: "sockops is not attached"},
+		{name: "sk_msg detached", ips: []*current.IPConfig{ipConfig("10.200.0.5/24")},
+			skMsgErr: errors.New("sk_msg is not attached"), wantErr: "sk_msg is not attached"},
+		{name: "missing subnet", ips: []*current.IPConfig{ipConfig("10.200.0.5/24")},
+			subnetErr: errors.New("no pod subnet configured"), wantErr: "no pod subnet configured"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkSockopsAttached = func() error { return tt.sockopsErr }
+			checkSkMsgAttached = func() error { return tt.skMsgErr }
+			podSubnet = func() (*net.IPNet, error) {
+				if tt.subnetErr != nil {
+					return nil, tt.subnetErr
+				}
+				return subnet, nil
+			}
+			err := checkDatapath(tt.ips)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("checkDatapath() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("checkDatapath() error = %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/safchain/ethtool"
+	"github.com/vishvananda/netlink"
+
+	"github.com/redhat-et/patu/internal/bpf"
+)
+
+// setupFastPath makes the pod known to the datapath and attaches the fast
+// path programs to its host veth, so packets between local pods skip the
+// bridge or the routing of the node. It returns false if patud has not loaded
+// the fast path, the pod then goes through the stack only.
+func setupFastPath(netns ns.NetNS, ifName string, hostVeth netlink.Link, podMAC string, ips []string) (bool, error) {
+	if !bpf.FastPathLoaded() {
+		return false, nil
+	}
+	mac, err := net.ParseMAC(podMAC)
+	if err != nil {
+		return false, fmt.Errorf("invalid MAC address %q: %v", podMAC, err)
+	}
+	podIPs, err := podIPv4Keys(ips)
+	if err != nil {
+		return false, err
+	}
+	if err := bpf.AttachFastPath(hostVeth); err != nil {
+		return false, err
+	}
+	if err := enableGRO(netns, ifName); err != nil {
+		return false, err
+	}
+	if err := bpf.SetEndpoint(podIPs, bpf.NewEndpoint(hostVeth, mac)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// enableGRO turns GRO on for the pod interface. The pod end of the veth then
+// receives through NAPI, which frames redirected to the host veth by native
+// XDP require, they would be dropped otherwise.
+func enableGRO(netns ns.NetNS, ifName string) error {
+	return netns.Do(func(_ ns.NetNS) error {
+		e, err := ethtool.NewEthtool()
+		if err != nil {
+			return fmt.Errorf("failed to open ethtool: %v", err)
+		}
+		defer e.Close()
+		if err := e.Change(ifName, map[string]bool{"rx-gro": true}); err != nil {
+			return fmt.Errorf("failed to enable GRO on %q: %v", ifName, err)
+		}
+		return nil
+	})
+}
+
+// teardownFastPath removes the pod from the datapath. The programs go away
+// with the host veth.
+func teardownFastPath(hostVethIndex int, ips []string) error {
+	podIPs, err := podIPv4Keys(ips)
+	if err != nil {
+		return err
+	}
+	return bpf.DelEndpoint(uint32(hostVethIndex), podIPs)
+}
+
+// checkFastPath verifies the fast path programs are attached to the host veth
+// and the pod addresses lead to it.
+func checkFastPath(hostVethName string, ips []string) error {
+	hostVeth, err := netlink.LinkByName(hostVethName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", hostVethName, err)
+	}
+	attached, err := bpf.FastPathAttached(hostVeth)
+	if err != nil {
+		return err
+	}
+	if !attached {
+		return fmt.Errorf("fast path programs are not attached to %s", hostVethName)
+	}
+	return checkEndpoints(hostVeth, ips)
+}
+
+// lookupEndpoint is replaced by the tests of CHECK.
+var lookupEndpoint = bpf.LookupEndpoint
+
+// checkEndpoints verifies the pod addresses lead to the host veth.
+func checkEndpoints(hostVeth netlink.Link, ips []string) error {
+	podIPs, err := podIPv4Keys(ips)
+	if err != nil {
+		return err
+	}
+	for _, ip := range podIPs {
+		ep, err := lookupEndpoint(ip)
+		if err != nil {
+			return err
+		}
+		if ep.Ifindex != uint32(hostVeth.Attrs().Index) {
+			return fmt.Errorf("endpoint of %s is not %s", net.IP(ip[:]), hostVeth.Attrs().Name)
+		}
+	}
+	return nil
+}
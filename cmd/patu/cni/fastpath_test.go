@@ -0,0 +1,83 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/redhat-et/patu/internal/bpf"
+)
+
+func TestCheckEndpoints(t *testing.T) {
+	hostVeth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "veth0123456789a", Index: 7}}
+	endpoints := map[[4]byte]bpf.Endpoint{
+		{10, 200, 0, 5}: {Ifindex: 7},
+		{10, 200, 0, 6}: {Ifindex: 8},
+	}
+	defer func(saved func([4]byte) (bpf.Endpoint, error)) { lookupEndpoint = saved }(lookupEndpoint)
+	lookupEndpoint = func(ip [4]byte) (bpf.Endpoint, error) {
+		ep, ok := endpoints[ip]
+		if !ok {
+			return ep, fmt.Errorf("pod %v has no endpoint", net.IP(ip[:]))
+		}
+		return ep, nil
+	}
+	tests := []struct {
+		name    string
+		ips     []string
+		wantErr string
+	}{
+		{name: "pod endpoint", ips: []string{"10.200.0.5/24"}},
+		{name: "IPv6 has no endpoint", ips: []string{"10.200.0.5/24", "fd00::5/64"}},
+		{name: "endpoint of another pod", ips: []string{"10.200.0.6/24"}, wantErr: "endpoint of 10.200.0.6 is not veth0123456789a"},
+		{name: "missing endpoint", ips: []string{"10.200.0.5/24", "10.200.0.7/24"}, wantErr: "pod 10.200.0.7 has no endpoint"},
+		{name: "invalid address", ips: []string{"10.200.0.5"}, wantErr: "invalid CIDR address"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkEndpoints(hostVeth, tt.ips)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("checkEndpoints() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("checkEndpoints() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestNewEndpoint(t *testing.T) {
+	hostMAC, _ := net.ParseMAC("02:00:00:00:00:01")
+	podMAC, _ := net.ParseMAC("0a:58:0a:c8:00:05")
+	hostVeth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Index: 7, HardwareAddr: hostMAC}}
+	want := bpf.Endpoint{
+		Ifindex: 7,
+		MAC:     [6]byte{0x0a, 0x58, 0x0a, 0xc8, 0x00, 0x05},
+		HostMAC: [6]byte{0x02, 0, 0, 0, 0, 0x01},
+	}
+	if got := bpf.NewEndpoint(hostVeth, podMAC); got != want {
+		t.Errorf("NewEndpoint() = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,192 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/containernetworking/cni/pkg/invoke"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	patuipam "github.com/redhat-et/patu/internal/ipam"
+)
+
+// cmdGC removes the attachments recorded by cmdAdd that are missing from the
+// runtime's list of valid attachments, then lets the IPAM plugin release any
+// allocation it still holds for them.
+func cmdGC(args *skel.CmdArgs) error {
+	n, _, err := loadNetConf(args.StdinData, args.Args)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := lockAttachments(n, syscall.LOCK_EX)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	valid := make(map[types.GCAttachment]bool, len(n.ValidAttachments))
+	for _, a := range n.ValidAttachments {
+		valid[a] = true
+	}
+
+	attachments, err := listAttachments(n)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, a := range attachments {
+		if valid[types.GCAttachment{ContainerID: a.ContainerID, IfName: a.IfName}] {
+			continue
+		}
+		if err := gcAttachment(n, args.StdinData, a); err != nil {
+			errs = append(errs, fmt.Errorf("failed to clean up container %s: %v", a.ContainerID, err))
+			continue
+		}
+		if err := removeAttachment(n, a.ContainerID, a.IfName); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if n.IPAM.Type == patuipam.Type {
+		if err := gcIPs(n, valid); err != nil {
+			errs = append(errs, err)
+		}
+		if n.BridgePerNamespace {
+			if err := gcNamespaceBridges(n); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	} else if n.IPAM.Type != "" {
+		err := invoke.DelegateGC(context.TODO(), n.IPAM.Type, args.StdinData, nil)
+		if err != nil && !delegateUnsupported(err) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func gcAttachment(n *NetConf, stdinData []byte, a *attachment) error {
+	// The veth is normally gone with the container's netns. Check the MAC
+	// too, the kernel may have handed out the name to another pod since.
+	// Chained attachments only own their datapath state, the veth belongs
+	// to the previous plugins of the chain.
+	if link, err := netlink.LinkByName(a.HostVeth); err == nil && !a.Chained {
+		_, isVeth := link.(*netlink.Veth)
+		if isVeth && link.Attrs().HardwareAddr.String() == a.HostVethMac {
+			if err := netlink.LinkDel(link); err != nil {
+				return fmt.Errorf("failed to delete %q: %v", a.HostVeth, err)
+			}
+		}
+	}
+
+	if a.IPMasq {
+		// Records predating the nftables backend were masqueraded by iptables.
+		backend := a.IPMasqBackend
+		if backend == "" {
+			backend = masqBackendIptables
+		}
+		var ipnets []*net.IPNet
+		for _, addr := range a.IPs {
+			ipn, err := types.ParseCIDR(addr)
+			if err != nil {
+				return err
+			}
+			ipnets = append(ipnets, ipn)
+		}
+		if err := teardownIPMasq(n, a.ContainerID, backend, ipnets); err != nil {
+			return err
+		}
+	}
+
+	if a.HostPorts {
+		if err := teardownPortMappings(n, a.ContainerID, a.IfName, a.IPs); err != nil {
+			return err
+		}
+	}
+
+	if a.SpoofCheck {
+		if err := teardownSpoofCheck(n, a.ContainerID, a.IfName); err != nil {
+			return err
+		}
+	}
+
+	if a.Bandwidth {
+		if err := teardownBandwidth(a.HostVethIndex, a.IPs); err != nil {
+			return err
+		}
+	}
+
+	if a.FastPath {
+		if err := teardownFastPath(a.HostVethIndex, a.IPs); err != nil {
+			return err
+		}
+	}
+	if err := teardownTCPStats(a.IPs); err != nil {
+		return err
+	}
+	// The veth is gone, or was another pod's whose VLAN membership counts.
+	if a.Vlan != 0 {
+		if err := releaseGatewayVlan(n.BrName, a.Vlan, ""); err != nil {
+			return err
+		}
+	}
+
+	if a.IPAMType == patuipam.Type {
+		return releaseOwnerIPs(n, a.ContainerID, a.IfName)
+	} else if a.IPAMType != "" {
+		return execIPAMDel(a.IPAMType, stdinData, a.ContainerID, a.IfName)
+	}
+	return nil
+}
+
+// execIPAMDel releases the allocation of another container than the one the
+// plugin was invoked for.
+func execIPAMDel(plugin string, netconf []byte, containerID, ifName string) error {
+	cniPath := os.Getenv("CNI_PATH")
+	pluginPath, err := invoke.FindInPath(plugin, filepath.SplitList(cniPath))
+	if err != nil {
+		return err
+	}
+	return invoke.ExecPluginWithoutResult(context.TODO(), pluginPath, netconf, &invoke.Args{
+		Command:     "DEL",
+		ContainerID: containerID,
+		IfName:      ifName,
+		Path:        cniPath,
+	}, nil)
+}
+
+// delegateUnsupported reports whether a delegated plugin failed because it
+// predates the CNI 1.1 verbs.
+func delegateUnsupported(err error) bool {
+	var cniErr *types.Error
+	if !errors.As(err, &cniErr) {
+		return false
+	}
+	return cniErr.Code == types.ErrInvalidEnvironmentVariables ||
+		cniErr.Code == types.ErrIncompatibleCNIVersion
+}
@@ -0,0 +1,140 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/ipam"
+	patuipam "github.com/redhat-et/patu/internal/ipam"
+)
+
+// ipamConf holds the settings of the built-in IPAM, the other IPAM types are
+// configured by their own plugin.
+type ipamConf struct {
+	IPAM struct {
+		Routes []*types.Route `json:"routes"`
+	} `json:"ipam"`
+}
+
+// allocateIPs runs IPAM for the container interface, either with the
+// built-in IPAM or by delegating to the configured IPAM plugin.
+func allocateIPs(n *NetConf, args *skel.CmdArgs) (types.Result, error) {
+	if n.IPAM.Type != patuipam.Type {
+		return ipam.ExecAdd(n.IPAM.Type, args.StdinData)
+	}
+
+	conf := &ipamConf{}
+	if err := json.Unmarshal(args.StdinData, conf); err != nil {
+		return nil, fmt.Errorf("failed to load IPAM config: %v", err)
+	}
+	cidrs, err := patuipam.ReadPodCIDRs(n.DataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := patuipam.OpenStore(n.DataDir)
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close()
+	if n.BridgePerNamespace {
+		if cidrs, err = store.NamespaceSlices(cidrs, n.podNamespace, n.NamespaceSubnetPrefix); err != nil {
+			return nil, err
+		}
+	}
+	ips, err := store.Allocate(cidrs, n.Name, args.ContainerID, args.IfName, n.ips)
+	if err != nil {
+		return nil, err
+	}
+	return &current.Result{
+		CNIVersion: current.ImplementedSpecVersion,
+		IPs:        ips,
+		Routes:     conf.IPAM.Routes,
+	}, nil
+}
+
+// releaseIPs releases the addresses of the container interface the plugin
+// was invoked for.
+func releaseIPs(n *NetConf, args *skel.CmdArgs) error {
+	if n.IPAM.Type != patuipam.Type {
+		return ipam.ExecDel(n.IPAM.Type, args.StdinData)
+	}
+	return releaseOwnerIPs(n, args.ContainerID, args.IfName)
+}
+
+func releaseOwnerIPs(n *NetConf, containerID, ifName string) error {
+	store, err := patuipam.OpenStore(n.DataDir)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	return store.ReleaseOwner(n.Name, containerID, ifName)
+}
+
+// gcIPs releases the built-in IPAM allocations of the attachments the runtime
+// no longer considers valid. The valid attachments only cover the network GC
+// was invoked for, the allocations of other networks sharing the store are
+// left alone.
+func gcIPs(n *NetConf, valid map[types.GCAttachment]bool) error {
+	store, err := patuipam.OpenStore(n.DataDir)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	allocations, err := store.Allocations()
+	if err != nil {
+		return err
+	}
+	for ip, a := range allocations {
+		if a.Network != n.Name {
+			continue
+		}
+		if !valid[types.GCAttachment{ContainerID: a.ContainerID, IfName: a.IfName}] {
+			if err := store.Release(ip); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkIPs verifies that IPAM still assigns addresses to the container
+// interface.
+func checkIPs(n *NetConf, args *skel.CmdArgs) error {
+	if n.IPAM.Type != patuipam.Type {
+		return ipam.ExecCheck(n.IPAM.Type, args.StdinData)
+	}
+
+	store, err := patuipam.OpenStore(n.DataDir)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	ips, err := store.Owned(n.Name, args.ContainerID, args.IfName)
+	if err != nil {
+		return err
+	}
+	if len(ips) == 0 {
+		return fmt.Errorf("no address is allocated to container %s interface %s", args.ContainerID, args.IfName)
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+
+	"github.com/coreos/go-iptables/iptables"
+
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/utils"
+	"github.com/redhat-et/patu/internal/bpf"
+	"github.com/redhat-et/patu/internal/nft"
+)
+
+// Backends of ipMasq, selected with ipMasqBackend. In auto mode, the default,
+// iptables is used when installed, nftables otherwise. With ebpf, patud
+// masquerades the pod subnet on the uplink, pods created before it did fall
+// back to auto.
+const (
+	masqBackendAuto     = "auto"
+	masqBackendIptables = "iptables"
+	masqBackendNftables = "nftables"
+	masqBackendEBPF     = "ebpf"
+)
+
+func masqBackend(n *NetConf) (string, error) {
+	switch n.IPMasqBackend {
+	case masqBackendEBPF:
+		if bpf.SNATEnabled() {
+			return masqBackendEBPF, nil
+		}
+		fallthrough
+	case "", masqBackendAuto:
+		if _, err := exec.LookPath("iptables"); err == nil {
+			return masqBackendIptables, nil
+		}
+		return masqBackendNftables, nil
+	case masqBackendIptables, masqBackendNftables:
+		return n.IPMasqBackend, nil
+	}
+	return "", fmt.Errorf("unknown ipMasqBackend %q", n.IPMasqBackend)
+}
+
+func setupIPMasq(n *NetConf, containerID, backend string, ips []*current.IPConfig) error {
+	if backend == masqBackendEBPF {
+		return nil
+	}
+	for _, ipc := range ips {
+		var err error
+		if backend == masqBackendNftables {
+			err = nft.AddMasquerade(n.Name, &ipc.Address)
+		} else {
+			err = ip.SetupIPMasq(&ipc.Address, utils.FormatChainName(n.Name, containerID),
+				utils.FormatComment(n.Name, containerID))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func teardownIPMasq(n *NetConf, containerID, backend string, ipnets []*net.IPNet) error {
+	if backend == masqBackendEBPF {
+		return nil
+	}
+	for _, ipn := range ipnets {
+		var err error
+		if backend == masqBackendNftables {
+			err = nft.DelMasquerade(ipn.IP)
+		} else {
+			err = ip.TeardownIPMasq(ipn, utils.FormatChainName(n.Name, containerID),
+				utils.FormatComment(n.Name, containerID))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkIPMasq verifies that the traffic of the pod addresses is masqueraded.
+func checkIPMasq(n *NetConf, containerID, backend string, ips []*current.IPConfig) error {
+	if backend == masqBackendEBPF {
+		if !bpf.SNATEnabled() {
+			return fmt.Errorf("eBPF SNAT is not enabled")
+		}
+		return nil
+	}
+	for _, ipc := range ips {
+		if backend == masqBackendNftables {
+			if err := nft.CheckMasquerade(n.Name, &ipc.Address); err != nil {
+				return err
+			}
+			continue
+		}
+		protocol := iptables.ProtocolIPv4
+		if ipc.Address.IP.To4() == nil {
+			protocol = iptables.ProtocolIPv6
+		}
+		ipt, err := iptables.NewWithProtocol(protocol)
+		if err != nil {
+			return fmt.Errorf("failed to locate iptables: %v", err)
+		}
+		chain := utils.FormatChainName(n.Name, containerID)
+		exists, err := ipt.Exists("nat", "POSTROUTING", "-s", ipc.Address.IP.String(), "-j", chain,
+			"-m", "comment", "--comment", utils.FormatComment(n.Name, containerID))
+		if err != nil {
+			return fmt.Errorf("failed to check masquerade rule of %s: %v", ipc.Address.IP, err)
+		}
+		if !exists {
+			return fmt.Errorf("masquerade rule of %s is missing", ipc.Address.IP)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMasqBackend(t *testing.T) {
+	tests := []struct {
+		name     string
+		backend  string
+		iptables bool
+		want     string
+		wantErr  string
+	}{
+		{name: "default with iptables", iptables: true, want: masqBackendIptables},
+		{name: "default without iptables", want: masqBackendNftables},
+		{name: "auto with iptables", backend: masqBackendAuto, iptables: true, want: masqBackendIptables},
+		{name: "auto without iptables", backend: masqBackendAuto, want: masqBackendNftables},
+		{name: "nftables with iptables", backend: masqBackendNftables, iptables: true, want: masqBackendNftables},
+		{name: "iptables", backend: masqBackendIptables, want: masqBackendIptables},
+		{name: "unknown backend", backend: "ipfw", wantErr: `unknown ipMasqBackend "ipfw"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if tt.iptables {
+				if err := os.WriteFile(filepath.Join(dir, "iptables"), []byte("#!/bin/sh\n"), 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			t.Setenv("PATH", dir)
+
+			got, err := masqBackend(&NetConf{IPMasqBackend: tt.backend})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("masqBackend() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("masqBackend() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("masqBackend() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
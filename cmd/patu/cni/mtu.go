@@ -0,0 +1,100 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+)
+
+// The smallest MTU the kernel accepts for IPv4 interfaces.
+const minMTU = 68
+
+// detectMTU returns the MTU of the node uplink, the interface of the IPv4
+// default route or else of the IPv6 one, less the encapsulation overhead.
+// A smaller MTU set on the route itself is used instead of the interface's.
+// It returns 0, leaving the kernel default, when the node has no default
+// route.
+func detectMTU(overhead int) (int, error) {
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		uplinkMTU, err := defaultRouteMTU(family)
+		if err != nil {
+			return 0, err
+		}
+		if uplinkMTU == 0 {
+			continue
+		}
+		return podMTU(uplinkMTU, overhead)
+	}
+	return 0, nil
+}
+
+// podMTU returns the uplink MTU less the encapsulation overhead.
+func podMTU(uplinkMTU, overhead int) (int, error) {
+	if uplinkMTU-overhead < minMTU {
+		return 0, fmt.Errorf("uplink MTU %d is too small for an encapsulation overhead of %d", uplinkMTU, overhead)
+	}
+	return uplinkMTU - overhead, nil
+}
+
+// defaultRouteMTU returns the smallest MTU of the next hops of the family's
+// default routes, 0 if there is none.
+func defaultRouteMTU(family int) (int, error) {
+	routes, err := netlink.RouteList(nil, family)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list routes: %v", err)
+	}
+	return routesMTU(routes, func(index int) (int, error) {
+		link, err := netlink.LinkByIndex(index)
+		if err != nil {
+			return 0, err
+		}
+		return link.Attrs().MTU, nil
+	})
+}
+
+// routesMTU returns the smallest MTU of the next hops of the default routes,
+// linkMTU looking up the MTU of an interface by index.
+func routesMTU(routes []netlink.Route, linkMTU func(index int) (int, error)) (int, error) {
+	mtu := 0
+	for _, route := range routes {
+		if route.Dst != nil {
+			continue
+		}
+		linkIndexes := []int{route.LinkIndex}
+		if route.LinkIndex == 0 {
+			linkIndexes = nil
+			for _, nh := range route.MultiPath {
+				linkIndexes = append(linkIndexes, nh.LinkIndex)
+			}
+		}
+		for _, index := range linkIndexes {
+			hopMTU, err := linkMTU(index)
+			if err != nil {
+				return 0, fmt.Errorf("failed to lookup the uplink %d: %v", index, err)
+			}
+			if route.MTU > 0 && route.MTU < hopMTU {
+				hopMTU = route.MTU
+			}
+			if mtu == 0 || hopMTU < mtu {
+				mtu = hopMTU
+			}
+		}
+	}
+	return mtu, nil
+}
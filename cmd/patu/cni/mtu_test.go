@@ -0,0 +1,129 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+func TestRoutesMTU(t *testing.T) {
+	_, dst, _ := net.ParseCIDR("10.0.0.0/24")
+	linkMTUs := map[int]int{1: 1500, 2: 9000, 3: 1450}
+	linkMTU := func(index int) (int, error) {
+		mtu, ok := linkMTUs[index]
+		if !ok {
+			return 0, fmt.Errorf("link not found")
+		}
+		return mtu, nil
+	}
+	tests := []struct {
+		name    string
+		routes  []netlink.Route
+		want    int
+		wantErr string
+	}{
+		{
+			name:   "no default route",
+			routes: []netlink.Route{{Dst: dst, LinkIndex: 3}},
+			want:   0,
+		},
+		{
+			name:   "uplink MTU",
+			routes: []netlink.Route{{Dst: dst, LinkIndex: 3}, {LinkIndex: 2}},
+			want:   9000,
+		},
+		{
+			name:   "smaller route MTU",
+			routes: []netlink.Route{{LinkIndex: 2, MTU: 1400}},
+			want:   1400,
+		},
+		{
+			name:   "larger route MTU",
+			routes: []netlink.Route{{LinkIndex: 1, MTU: 9000}},
+			want:   1500,
+		},
+		{
+			name:   "smallest next hop",
+			routes: []netlink.Route{{MultiPath: []*netlink.NexthopInfo{{LinkIndex: 2}, {LinkIndex: 3}}}},
+			want:   1450,
+		},
+		{
+			name:   "smallest default route",
+			routes: []netlink.Route{{LinkIndex: 2}, {LinkIndex: 1, Priority: 100}},
+			want:   1500,
+		},
+		{
+			name:    "missing uplink",
+			routes:  []netlink.Route{{LinkIndex: 4}},
+			wantErr: "failed to lookup the uplink 4",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := routesMTU(tt.routes, linkMTU)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("routesMTU() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("routesMTU() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("routesMTU() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPodMTU(t *testing.T) {
+	tests := []struct {
+		name      string
+		uplinkMTU int
+		overhead  int
+		want      int
+		wantErr   string
+	}{
+		{name: "no overhead", uplinkMTU: 1500, want: 1500},
+		{name: "vxlan overhead", uplinkMTU: 1500, overhead: 50, want: 1450},
+		{name: "smallest MTU", uplinkMTU: 118, overhead: 50, want: minMTU},
+		{name: "overhead too large", uplinkMTU: 1500, overhead: 1450, wantErr: "too small for an encapsulation overhead"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := podMTU(tt.uplinkMTU, tt.overhead)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("podMTU() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("podMTU() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("podMTU() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
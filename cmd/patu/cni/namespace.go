@@ -0,0 +1,110 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+
+	"github.com/vishvananda/netlink"
+
+	patuipam "github.com/redhat-et/patu/internal/ipam"
+)
+
+const (
+	// defaultNamespaceSubnetPrefix leaves room for 61 pods per namespace.
+	defaultNamespaceSubnetPrefix = 26
+	// The bridge name is used as the prefix of the namespace bridges, which
+	// add 8 hex digits within the 15 bytes of an interface name.
+	maxNamespaceBridgePrefix = 7
+)
+
+// namespaceBridgeName derives the bridge of a namespace from the bridge name
+// of the config. Interface names are too short for namespace names, so the
+// namespace is hashed.
+func namespaceBridgeName(prefix, namespace string) string {
+	h := fnv.New32a()
+	h.Write([]byte(namespace))
+	return fmt.Sprintf("%s%08x", prefix, h.Sum32())
+}
+
+// claimNamespaceBridge marks the bridge as the namespace's through its alias,
+// and fails if it belongs to another namespace whose name hashes the same.
+func claimNamespaceBridge(br *netlink.Bridge, namespace string) error {
+	switch br.Attrs().Alias {
+	case namespace:
+		return nil
+	case "":
+		if err := netlink.LinkSetAlias(br, namespace); err != nil {
+			return fmt.Errorf("failed to set the alias of %q: %v", br.Attrs().Name, err)
+		}
+		return nil
+	default:
+		return fmt.Errorf("bridge %q of namespace %s is already used by namespace %s",
+			br.Attrs().Name, namespace, br.Attrs().Alias)
+	}
+}
+
+// gcNamespaceBridges deletes the bridges of the namespaces that have no pod
+// left on the node and releases their subnet slices. It runs under the
+// exclusive attachments lock, no ADD can be attaching a pod meanwhile.
+func gcNamespaceBridges(n *NetConf) error {
+	store, err := patuipam.OpenStore(n.DataDir)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	namespaces, err := store.SliceNamespaces()
+	if err != nil {
+		return err
+	}
+	links, err := netlink.LinkList()
+	if err != nil {
+		return fmt.Errorf("failed to list links: %v", err)
+	}
+
+	for _, namespace := range namespaces {
+		name := namespaceBridgeName(n.BrName, namespace)
+		br, err := netlink.LinkByName(name)
+		if err == nil {
+			if br.Attrs().Alias != namespace {
+				continue
+			}
+			inUse := false
+			for _, link := range links {
+				if link.Attrs().MasterIndex == br.Attrs().Index {
+					inUse = true
+					break
+				}
+			}
+			if inUse {
+				continue
+			}
+		}
+		// The addresses of a namespace outlive its bridge only if their
+		// containers weren't cleaned up yet, the slices are kept then.
+		if err := store.ReleaseNamespaceSlices(namespace); err != nil {
+			continue
+		}
+		if br != nil {
+			if err := netlink.LinkDel(br); err != nil {
+				return fmt.Errorf("failed to delete %q: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+
+	"github.com/redhat-et/patu/internal/notify"
+)
+
+// notifyTimeout bounds how long ADD and DEL wait for patud, the pod is never
+// held up by a busy or absent daemon.
+const notifyTimeout = time.Second
+
+// notifyAttached tells patud about a new attachment, so it updates the per-pod
+// state of the datapath without waiting for the pod status to be published.
+// It is best effort, patud catches up from the pod status anyway.
+func notifyAttached(n *NetConf, args *skel.CmdArgs, hostVeth string, ips []string) {
+	if n.NotifySocket == "" {
+		return
+	}
+	if err := notify.Attached(n.NotifySocket, notifyTimeout, podAttachment(n, args, hostVeth, ips)); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+	}
+}
+
+// notifyDetached tells patud an attachment is gone. Like notifyAttached it is
+// best effort.
+func notifyDetached(n *NetConf, args *skel.CmdArgs, hostVeth string, ips []string) {
+	if n.NotifySocket == "" {
+		return
+	}
+	if err := notify.Detached(n.NotifySocket, notifyTimeout, podAttachment(n, args, hostVeth, ips)); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+	}
+}
+
+func podAttachment(n *NetConf, args *skel.CmdArgs, hostVeth string, ips []string) *notify.PodAttachment {
+	a := &notify.PodAttachment{
+		ContainerId:  args.ContainerID,
+		Netns:        args.Netns,
+		IfName:       args.IfName,
+		HostVeth:     hostVeth,
+		PodNamespace: n.podNamespace,
+		PodName:      n.podName,
+	}
+	for _, addr := range ips {
+		if ipAddr, _, err := net.ParseCIDR(addr); err == nil {
+			a.Ips = append(a.Ips, ipAddr.String())
+		}
+	}
+	return a
+}
@@ -0,0 +1,54 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/skel"
+
+	"github.com/redhat-et/patu/internal/notify"
+)
+
+func TestPodAttachment(t *testing.T) {
+	n := &NetConf{podNamespace: "default", podName: "web"}
+	args := &skel.CmdArgs{ContainerID: "c1", Netns: "/var/run/netns/c1", IfName: "eth0"}
+	tests := []struct {
+		name string
+		ips  []string
+		want []string
+	}{
+		{name: "no addresses"},
+		{name: "dual stack", ips: []string{"10.200.0.5/24", "fd00::5/64"}, want: []string{"10.200.0.5", "fd00::5"}},
+		{name: "invalid address", ips: []string{"10.200.0.5", "10.200.0.6/24"}, want: []string{"10.200.0.6"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := podAttachment(n, args, "veth0123456789a", tt.ips)
+			want := &notify.PodAttachment{
+				ContainerId: "c1", Netns: "/var/run/netns/c1", IfName: "eth0", HostVeth: "veth0123456789a",
+				PodNamespace: "default", PodName: "web", Ips: tt.want,
+			}
+			if got.ContainerId != want.ContainerId || got.Netns != want.Netns || got.IfName != want.IfName ||
+				got.HostVeth != want.HostVeth || got.PodNamespace != want.PodNamespace || got.PodName != want.PodName ||
+				!reflect.DeepEqual(got.Ips, want.Ips) {
+				t.Errorf("podAttachment() = %v, want %v", got, want)
+			}
+		})
+	}
+}
@@ -21,9 +21,8 @@ import (
 	"errors"
 	"fmt"
 	"net"
-	"os"
+	"strings"
 	"syscall"
-	"time"
 
 	"github.com/vishvananda/netlink"
 
@@ -34,22 +33,74 @@ import (
 	"github.com/containernetworking/plugins/pkg/ip"
 	"github.com/containernetworking/plugins/pkg/ipam"
 	"github.com/containernetworking/plugins/pkg/ns"
-	"github.com/containernetworking/plugins/pkg/utils"
 	bv "github.com/containernetworking/plugins/pkg/utils/buildversion"
 	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+	"github.com/redhat-et/patu/configs"
+	"github.com/redhat-et/patu/internal/hostveth"
+	patuipam "github.com/redhat-et/patu/internal/ipam"
 )
  
  const defaultBrName = "patux"
  
  type NetConf struct {
 	 types.NetConf
-	BrName       string `json:"bridge"`
-	IsGW         bool   `json:"isGateway"`
-	IsDefaultGW  bool   `json:"isDefaultGateway"`
-	ForceAddress bool   `json:"forceAddress"`
-	IPMasq       bool   `json:"ipMasq"`
-	MTU          int    `json:"mtu"`
-	HairpinMode  bool   `json:"hairpinMode"`
+	Mode          string `json:"mode"`
+	Chained       bool   `json:"chained"`
+	BrName        string `json:"bridge"`
+	IsGW          bool   `json:"isGateway"`
+	IsDefaultGW   bool   `json:"isDefaultGateway"`
+	ForceAddress  bool   `json:"forceAddress"`
+	IPMasq        bool   `json:"ipMasq"`
+	IPMasqBackend string `json:"ipMasqBackend"`
+	MTU           int    `json:"mtu"`
+	HairpinMode   bool   `json:"hairpinMode"`
+	DataDir       string `json:"dataDir"`
+	NotifySocket  string `json:"notifySocket"`
+	// Milliseconds ADD waits for the host veth to be ready
+	PortReadyTimeout int `json:"portReadyTimeout"`
+	// A bridge and a subnet slice of the pod CIDRs per namespace
+	BridgePerNamespace    bool `json:"bridgePerNamespace"`
+	NamespaceSubnetPrefix int  `json:"namespaceSubnetPrefix"`
+	// The access VLAN and the tagged VLANs of the pod's bridge port
+	Vlan      int          `json:"vlan"`
+	VlanTrunk []*vlanTrunk `json:"vlanTrunk,omitempty"`
+	// Drop what the pod sends from other addresses than its own
+	SpoofCheck bool `json:"spoofCheck"`
+	// Bytes subtracted from the uplink MTU when the MTU is detected
+	EncapOverhead int `json:"encapOverhead"`
+
+	Args *struct {
+		Cni staticArgs `json:"cni,omitempty"`
+	} `json:"args,omitempty"`
+	RuntimeConfig struct {
+		IPs       []string        `json:"ips,omitempty"`
+		Mac       string          `json:"mac,omitempty"`
+		PortMaps  []portMapEntry  `json:"portMappings,omitempty"`
+		Bandwidth *bandwidthEntry `json:"bandwidth,omitempty"`
+	} `json:"runtimeConfig,omitempty"`
+
+	mac          string
+	ips          []net.IP
+	podNamespace string
+	podName      string
+	vlanTrunk    []int
+}
+
+// staticArgs request a fixed MAC and IP addresses for the container interface
+// in the args of the network config.
+type staticArgs struct {
+	Mac string   `json:"mac,omitempty"`
+	IPs []string `json:"ips,omitempty"`
+}
+
+// cniArgs are the CNI_ARGS the plugin uses, IP takes a comma separated list.
+// The pod is passed by the kubelet.
+type cniArgs struct {
+	types.CommonArgs
+	IP                types.UnmarshallableString `json:"ip,omitempty"`
+	MAC               types.UnmarshallableString `json:"mac,omitempty"`
+	K8S_POD_NAMESPACE types.UnmarshallableString `json:"k8s_pod_namespace,omitempty"`
+	K8S_POD_NAME      types.UnmarshallableString `json:"k8s_pod_name,omitempty"`
 }
  
 type gwInfo struct {
@@ -60,11 +111,108 @@ type gwInfo struct {
 
  func loadNetConf(bytes []byte, envArgs string) (*NetConf, string, error) {
 	 n := &NetConf{
+		 Mode: modeBridge,
 		 BrName: defaultBrName,
+		 NamespaceSubnetPrefix: defaultNamespaceSubnetPrefix,
+		 DataDir: configs.CNIDataDir,
+		 NotifySocket: configs.NotifySocket,
 	 }
 	 if err := json.Unmarshal(bytes, n); err != nil {
 		 return nil, "", fmt.Errorf("failed to load netconf: %v", err)
 	 }
+	if n.Mode != modeBridge && n.Mode != modePtp {
+		return nil, "", fmt.Errorf("unknown mode %q", n.Mode)
+	}
+	if n.PortReadyTimeout < 0 {
+		return nil, "", fmt.Errorf("invalid portReadyTimeout %d", n.PortReadyTimeout)
+	}
+	if n.MTU < 0 || n.EncapOverhead < 0 {
+		return nil, "", fmt.Errorf("invalid mtu %d or encapOverhead %d", n.MTU, n.EncapOverhead)
+	}
+	if n.BridgePerNamespace {
+		switch {
+		case n.Mode != modeBridge || n.Chained:
+			return nil, "", fmt.Errorf("bridgePerNamespace is only supported in bridge mode")
+		case n.IPAM.Type != patuipam.Type:
+			return nil, "", fmt.Errorf("bridgePerNamespace requires the %s IPAM", patuipam.Type)
+		case len(n.BrName) > maxNamespaceBridgePrefix:
+			return nil, "", fmt.Errorf("bridge name %q is too long to prefix namespace bridges", n.BrName)
+		case n.NamespaceSubnetPrefix < 1 || n.NamespaceSubnetPrefix > 30:
+			return nil, "", fmt.Errorf("invalid namespaceSubnetPrefix %d", n.NamespaceSubnetPrefix)
+		}
+		// Pods reach the other namespaces through their bridge
+		n.IsGW = true
+	}
+	if n.Vlan != 0 || len(n.VlanTrunk) > 0 {
+		switch {
+		case n.Mode != modeBridge || n.Chained:
+			return nil, "", fmt.Errorf("vlan is only supported in bridge mode")
+		case n.BridgePerNamespace:
+			return nil, "", fmt.Errorf("vlan is not supported with bridgePerNamespace")
+		case n.Vlan != 0 && (n.IsGW || n.IsDefaultGW) && len(gatewayVlanName(n.BrName, n.Vlan)) > maxIfNameLen:
+			return nil, "", fmt.Errorf("bridge name %q is too long for the gateway of VLAN %d", n.BrName, n.Vlan)
+		}
+		var err error
+		if n.vlanTrunk, err = trunkVlans(n.Vlan, n.VlanTrunk); err != nil {
+			return nil, "", err
+		}
+	}
+	if n.SpoofCheck && (n.Mode != modeBridge || n.Chained) {
+		return nil, "", fmt.Errorf("spoofCheck is only supported in bridge mode")
+	}
+
+	// A static MAC or IP can be requested in CNI_ARGS, in the args of the
+	// network config or through the runtimeConfig capabilities, the latter
+	// taking precedence.
+	var ips []string
+	if envArgs != "" {
+		e := cniArgs{}
+		if err := types.LoadArgs(envArgs, &e); err != nil {
+			return nil, "", fmt.Errorf("failed to parse CNI_ARGS: %v", err)
+		}
+		n.mac = string(e.MAC)
+		n.podNamespace = string(e.K8S_POD_NAMESPACE)
+		n.podName = string(e.K8S_POD_NAME)
+		// GC and STATUS are not invoked for a pod and keep the prefix
+		if n.BridgePerNamespace && n.podNamespace != "" {
+			n.BrName = namespaceBridgeName(n.BrName, n.podNamespace)
+		}
+		if e.IP != "" {
+			ips = strings.Split(string(e.IP), ",")
+		}
+	}
+	if n.Args != nil {
+		if n.Args.Cni.Mac != "" {
+			n.mac = n.Args.Cni.Mac
+		}
+		if len(n.Args.Cni.IPs) > 0 {
+			ips = n.Args.Cni.IPs
+		}
+	}
+	if n.RuntimeConfig.Mac != "" {
+		n.mac = n.RuntimeConfig.Mac
+	}
+	if len(n.RuntimeConfig.IPs) > 0 {
+		ips = n.RuntimeConfig.IPs
+	}
+
+	if n.mac != "" {
+		if _, err := net.ParseMAC(n.mac); err != nil {
+			return nil, "", fmt.Errorf("invalid MAC address %q: %v", n.mac, err)
+		}
+	}
+	for _, addr := range ips {
+		addr = strings.TrimSpace(addr)
+		// The prefix length is given by IPAM, only the address is used.
+		ipAddr, _, err := net.ParseCIDR(addr)
+		if err != nil {
+			ipAddr = net.ParseIP(addr)
+		}
+		if ipAddr == nil {
+			return nil, "", fmt.Errorf("invalid IP address %q", addr)
+		}
+		n.ips = append(n.ips, ipAddr)
+	}
 	 return n, n.CNIVersion, nil
  }
  
@@ -96,8 +244,9 @@ func calcGateways(result *current.Result, n *NetConf) (*gwInfo, *gwInfo, error)
 		}
 		defaultNet.Mask = net.IPMask(defaultNet.IP)
 
-		// All IPs currently refer to the container interface
-		ipc.Interface = current.Int(2)
+		// All IPs currently refer to the container interface, the last
+		// one of the result
+		ipc.Interface = current.Int(len(result.Interfaces) - 1)
 
 		// If not provided, calculate the gateway address corresponding
 		// to the selected IP address
@@ -135,10 +284,11 @@ func calcGateways(result *current.Result, n *NetConf) (*gwInfo, *gwInfo, error)
 	return gwsV4, gwsV6, nil
 }
 
-func ensureAddr(br netlink.Link, family int, ipn *net.IPNet, forceAddress bool) error {
+// ensureAddr sets ipn on the bridge and reports whether it was added.
+func ensureAddr(br netlink.Link, family int, ipn *net.IPNet, forceAddress bool) (bool, error) {
 	addrs, err := netlink.AddrList(br, family)
 	if err != nil && err != syscall.ENOENT {
-		return fmt.Errorf("could not get list of IP addresses: %v", err)
+		return false, fmt.Errorf("could not get list of IP addresses: %v", err)
 	}
 
 	ipnStr := ipn.String()
@@ -146,7 +296,7 @@ func ensureAddr(br netlink.Link, family int, ipn *net.IPNet, forceAddress bool)
 
 		// string comp is actually easiest for doing IPNet comps
 		if a.IPNet.String() == ipnStr {
-			return nil
+			return false, nil
 		}
 
 		// Multiple IPv6 addresses are allowed on the bridge if the
@@ -156,26 +306,29 @@ func ensureAddr(br netlink.Link, family int, ipn *net.IPNet, forceAddress bool)
 		if family == netlink.FAMILY_V4 || a.IPNet.Contains(ipn.IP) || ipn.Contains(a.IPNet.IP) {
 			if forceAddress {
 				if err = deleteAddr(br, a.IPNet); err != nil {
-					return err
+					return false, err
 				}
 			} else {
-				return fmt.Errorf("%q already has an IP address different from %v", br.Attrs().Name, ipnStr)
+				return false, fmt.Errorf("%q already has an IP address different from %v", br.Attrs().Name, ipnStr)
 			}
 		}
 	}
 
+	added := true
 	addr := &netlink.Addr{IPNet: ipn, Label: ""}
-	if err := netlink.AddrAdd(br, addr); err != nil && err != syscall.EEXIST {
-		return fmt.Errorf("could not add IP address to %q: %v", br.Attrs().Name, err)
+	if err := netlink.AddrAdd(br, addr); err == syscall.EEXIST {
+		added = false
+	} else if err != nil {
+		return false, fmt.Errorf("could not add IP address to %q: %v", br.Attrs().Name, err)
 	}
 
 	// Set the bridge's MAC to itself. Otherwise, the bridge will take the
 	// lowest-numbered mac on the bridge, and will change as ifs churn
 	if err := netlink.LinkSetHardwareAddr(br, br.Attrs().HardwareAddr); err != nil {
-		return fmt.Errorf("could not set bridge's mac: %v", err)
+		return added, fmt.Errorf("could not set bridge's mac: %v", err)
 	}
 
-	return nil
+	return added, nil
 }
 
 func deleteAddr(br netlink.Link, ipn *net.IPNet) error {
@@ -228,6 +381,14 @@ func ensureBridge(brName string, mtu int) (*netlink.Bridge, error) {
 	// we want to own the routes for this interface
 	_, _ = sysctl.Sysctl(fmt.Sprintf("net/ipv6/conf/%s/accept_ra", brName), "0")
 
+	// The MTU may have been detected differently when the bridge was added
+	if mtu != 0 && br.Attrs().MTU != mtu {
+		if err := netlink.LinkSetMTU(br, mtu); err != nil {
+			return nil, fmt.Errorf("failed to set the MTU of %q: %v", brName, err)
+		}
+		br.Attrs().MTU = mtu
+	}
+
 	if err := netlink.LinkSetUp(br); err != nil {
 		return nil, err
 	}
@@ -235,18 +396,36 @@ func ensureBridge(brName string, mtu int) (*netlink.Bridge, error) {
 	return br, nil
 }
 
-func setupVeth(netns ns.NetNS, br *netlink.Bridge, ifName string, mtu int, hairpinMode bool) (*current.Interface, *current.Interface, error) {
+func setupVeth(netns ns.NetNS, br *netlink.Bridge, ifName, hostName, alias string, mtu int, hairpinMode bool, mac string, vlan int, trunk []int) (*current.Interface, *current.Interface, error) {
 	 contIface := &current.Interface{}
 	 hostIface := &current.Interface{}
+
+	// The name is derived from the container, a host veth of the same name
+	// is a leftover of a previous ADD of the container unless labeled for
+	// another one.
+	if link, err := netlink.LinkByName(hostName); err == nil {
+		_, _, containerID, _ := hostveth.ParseAlias(alias)
+		namespace, pod, owner, ok := hostveth.ParseAlias(link.Attrs().Alias)
+		if !ok {
+			return nil, nil, fmt.Errorf("host veth %q already exists and wasn't created by patu", hostName)
+		}
+		if owner != containerID {
+			return nil, nil, fmt.Errorf("host veth %q already exists for container %s of pod %s/%s", hostName, owner, namespace, pod)
+		}
+		if err := netlink.LinkDel(link); err != nil {
+			return nil, nil, fmt.Errorf("failed to delete %q: %v", hostName, err)
+		}
+	}
  
 	 err := netns.Do(func(hostNS ns.NetNS) error {
 		 // create the veth pair in the container and move host end into host netns
-		 hostVeth, containerVeth, err := ip.SetupVeth(ifName, mtu, "", hostNS)
+		 hostVeth, containerVeth, err := ip.SetupVethWithName(ifName, hostName, mtu, mac, hostNS)
 		 if err != nil {
 			 return err
 		 }
 		 contIface.Name = containerVeth.Name
 		 contIface.Mac = containerVeth.HardwareAddr.String()
+		contIface.Mtu = containerVeth.MTU
 		 contIface.Sandbox = netns.Path()
 		 hostIface.Name = hostVeth.Name
 		 return nil
@@ -261,19 +440,47 @@ func setupVeth(netns ns.NetNS, br *netlink.Bridge, ifName string, mtu int, hairp
 		 return nil, nil, fmt.Errorf("failed to lookup %q: %v", hostIface.Name, err)
 	 }
 	 hostIface.Mac = hostVeth.Attrs().HardwareAddr.String()
- 
-	 // connect host veth end to the bridge
-	 if err := netlink.LinkSetMaster(hostVeth, br); err != nil {
-		 return nil, nil, fmt.Errorf("failed to connect %q to bridge %v: %v", hostVeth.Attrs().Name, br.Attrs().Name, err)
-	 }
- 
-	// set hairpin mode
-	if err = netlink.LinkSetHairpin(hostVeth, hairpinMode); err != nil {
-		return nil, nil, fmt.Errorf("failed to setup hairpin mode for %v: %v", hostVeth.Attrs().Name, err)
+	hostIface.Mtu = hostVeth.Attrs().MTU
+	// The rollback of ADD only covers the veth once it is returned, deleting
+	// the host end takes the pod end along.
+	if err := setupHostVeth(hostVeth, br, alias, hairpinMode, vlan, trunk); err != nil {
+		if delErr := netlink.LinkDel(hostVeth); delErr != nil {
+			return nil, nil, fmt.Errorf("%v, and failed to delete %q: %v", err, hostIface.Name, delErr)
+		}
+		return nil, nil, err
 	}
-
 	 return hostIface, contIface, nil
  }
+
+// setupHostVeth labels the host veth and, in bridge mode, connects it to the
+// bridge.
+func setupHostVeth(hostVeth netlink.Link, br *netlink.Bridge, alias string, hairpinMode bool, vlan int, trunk []int) error {
+	if err := netlink.LinkSetAlias(hostVeth, alias); err != nil {
+		return fmt.Errorf("failed to set the alias of %q: %v", hostVeth.Attrs().Name, err)
+	}
+
+	// In ptp mode there is no bridge, the host veth is routed
+	if br == nil {
+		return nil
+	}
+
+	// connect host veth end to the bridge
+	if err := netlink.LinkSetMaster(hostVeth, br); err != nil {
+		return fmt.Errorf("failed to connect %q to bridge %v: %v", hostVeth.Attrs().Name, br.Attrs().Name, err)
+	}
+
+	// set hairpin mode
+	if err := netlink.LinkSetHairpin(hostVeth, hairpinMode); err != nil {
+		return fmt.Errorf("failed to setup hairpin mode for %v: %v", hostVeth.Attrs().Name, err)
+	}
+
+	if vlan != 0 || len(trunk) > 0 {
+		if err := setupPortVlans(hostVeth, vlan, trunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
  
 func calcGatewayIP(ipn *net.IPNet) net.IP {
 	nid := ipn.IP.Mask(ipn.Mask)
@@ -286,10 +493,21 @@ func setupBridge(n *NetConf) (*netlink.Bridge, *current.Interface, error) {
 	 if err != nil {
 		return nil, nil, fmt.Errorf("failed to create bridge %q: %v", n.BrName, err)
 	 }
+	if n.BridgePerNamespace {
+		if err := claimNamespaceBridge(br, n.podNamespace); err != nil {
+			return nil, nil, err
+		}
+	}
+	if n.vlanEnabled() {
+		if err := ensureVlanFiltering(br); err != nil {
+			return nil, nil, err
+		}
+	}
  
 	 return br, &current.Interface{
 		 Name: br.Attrs().Name,
 		 Mac:  br.Attrs().HardwareAddr.String(),
+		Mtu:  br.Attrs().MTU,
 	 }, nil
  }
  
@@ -307,16 +525,48 @@ func enableIPForward(family int) error {
 	 if err != nil {
 		 return err
 	 }
+	if n.Chained {
+		return chainedAdd(args, n, cniVersion)
+	}
+	if n.BridgePerNamespace && n.podNamespace == "" {
+		return fmt.Errorf("bridgePerNamespace requires K8S_POD_NAMESPACE in CNI_ARGS")
+	}
+	// The bridge and both veth ends get the MTU of the uplink by default
+	if n.MTU == 0 {
+		if n.MTU, err = detectMTU(n.EncapOverhead); err != nil {
+			return err
+		}
+	}
+
+	// Every step below that creates something records how to undo it
+	var steps rollback
+	defer func() {
+		if !success {
+			steps.run()
+		}
+	}()
  
 	 isLayer3 := n.IPAM.Type != ""
+	var masqBackendName string
 
  	if n.IsDefaultGW {
 		n.IsGW = true
 	}
-	br, brInterface, err := setupBridge(n)
-	 if err != nil {
-		 return err
-	 }
+
+	unlock, err := lockAttachments(n, syscall.LOCK_SH)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	var br *netlink.Bridge
+	var brInterface *current.Interface
+	if n.Mode == modeBridge {
+		br, brInterface, err = setupBridge(n)
+		if err != nil {
+			return err
+		}
+	}
  
 	 netns, err := ns.GetNS(args.Netns)
 	 if err != nil {
@@ -324,36 +574,42 @@ func enableIPForward(family int) error {
 	 }
 	 defer netns.Close()
  
-	hostInterface, containerInterface, err := setupVeth(netns, br, args.IfName, n.MTU, n.HairpinMode)
+	hostInterface, containerInterface, err := setupVeth(netns, br, args.IfName,
+		hostveth.Name(args.ContainerID, args.IfName), hostveth.Alias(n.podNamespace, n.podName, args.ContainerID),
+		n.MTU, n.HairpinMode, n.mac, n.Vlan, n.vlanTrunk)
 	 if err != nil {
 		 return err
 	 }
+	// Deleting the host veth deletes its peer, and with them the addresses
+	// and routes of both ends
+	steps.add(func() error {
+		if err := ip.DelLinkByName(hostInterface.Name); err != nil && err != ip.ErrLinkNotFound {
+			return fmt.Errorf("failed to delete %q: %v", hostInterface.Name, err)
+		}
+		return nil
+	})
  
 	 // Assume L2 interface only
 	 result := &current.Result{
 		 CNIVersion: current.ImplementedSpecVersion,
 		 Interfaces: []*current.Interface{
-			 brInterface,
 			 hostInterface,
 			 containerInterface,
 		 },
 	 }
+	if brInterface != nil {
+		result.Interfaces = append([]*current.Interface{brInterface}, result.Interfaces...)
+	}
  
 	 if isLayer3 {
 		 // run the IPAM plugin and get back the config to apply
-		 r, err := ipam.ExecAdd(n.IPAM.Type, args.StdinData)
+		 r, err := allocateIPs(n, args)
 		 if err != nil {
 			 return err
 		 }
- 
-		 // release IP in case of failure
-		 defer func() {
-			 if !success {
-				if err := ipam.ExecDel(n.IPAM.Type, args.StdinData); err != nil {
-					fmt.Fprintf(os.Stderr, "%v", err)
-				}
-			 }
-		 }()
+		steps.add(func() error {
+			return releaseIPs(n, args)
+		})
  
 		 // Convert whatever the IPAM result was into the current Result type
 		 ipamResult, err := current.NewResultFromResult(r)
@@ -368,7 +624,23 @@ func enableIPForward(family int) error {
 		 if len(result.IPs) == 0 {
 			 return errors.New("IPAM plugin returned missing IP config")
 		 }
+		for _, requested := range n.ips {
+			found := false
+			for _, ipc := range result.IPs {
+				if ipc.Address.IP.Equal(requested) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return fmt.Errorf("IPAM plugin did not assign the requested IP %s", requested)
+			}
+		}
  
+		if n.Mode == modePtp {
+			setPtpGateways(result)
+		}
+
 		// Gather gateway information for each IP family
 		gwsV4, gwsV6, err := calcGateways(result, n)
 		if err != nil {
@@ -380,6 +652,10 @@ func enableIPForward(family int) error {
 			_, _ = sysctl.Sysctl(fmt.Sprintf("net/ipv6/conf/%s/accept_dad", args.IfName), "0")
 			_, _ = sysctl.Sysctl(fmt.Sprintf("net/ipv4/conf/%s/arp_notify", args.IfName), "1")
  
+			if n.Mode == modePtp {
+				return configurePtpIface(args.IfName, result)
+			}
+
 			 // Add the IP to the interface
 			 if err := ipam.ConfigureIface(args.IfName, result); err != nil {
 				 return err
@@ -389,25 +665,32 @@ func enableIPForward(family int) error {
 			 return err
 		 }
  
-		 // check bridge port state
-		 retries := []int{0, 50, 500, 1000, 1000}
-		 for idx, sleep := range retries {
-			 time.Sleep(time.Duration(sleep) * time.Millisecond)
- 
-			 hostVeth, err := netlink.LinkByName(hostInterface.Name)
-			 if err != nil {
-				 return err
-			 }
-			 if hostVeth.Attrs().OperState == netlink.OperUp {
-				 break
-			 }
- 
-			 if idx == len(retries)-1 {
-				 return fmt.Errorf("bridge port in error state: %s", hostVeth.Attrs().OperState)
-			 }
-		 }
+		if err := waitForPortReady(hostInterface.Name, n.portReadyTimeout()); err != nil {
+			return err
+		}
 
-		if n.IsGW {
+		if n.Mode == modePtp {
+			hostVeth, err := netlink.LinkByName(hostInterface.Name)
+			if err != nil {
+				return fmt.Errorf("failed to lookup %q: %v", hostInterface.Name, err)
+			}
+			steps.add(func() error {
+				return teardownPtpHost(hostVeth.Attrs().Index, ipConfigStrings(result.IPs))
+			})
+			if err := setupPtpHost(hostVeth, result.IPs); err != nil {
+				return err
+			}
+		} else if n.IsGW {
+			// The gateway of an access VLAN is a VLAN interface of the bridge
+			var gwLink netlink.Link = br
+			if n.Vlan != 0 {
+				steps.add(func() error {
+					return releaseGatewayVlan(n.BrName, n.Vlan, hostInterface.Name)
+				})
+				if gwLink, err = ensureGatewayVlan(br, n.Vlan); err != nil {
+					return err
+				}
+			}
 			var firstV4Addr net.IP
 			// Set the IP address(es) on the bridge and enable forwarding
 			for _, gws := range []*gwInfo{gwsV4, gwsV6} {
@@ -415,7 +698,14 @@ func enableIPForward(family int) error {
 					if gw.IP.To4() != nil && firstV4Addr == nil {
 						firstV4Addr = gw.IP
 					}
-					err = ensureAddr(br, gws.family, &gw, n.ForceAddress)
+					added, err := ensureAddr(gwLink, gws.family, &gw, n.ForceAddress)
+					// The gateway VLAN interface is released with its addresses
+					if added && n.Vlan == 0 {
+						gwAddr := gw
+						steps.add(func() error {
+							return removeBridgeAddr(n.BrName, hostInterface.Name, &gwAddr)
+						})
+					}
 					if err != nil {
 						return fmt.Errorf("failed to set bridge addr: %v", err)
 					}
@@ -430,12 +720,28 @@ func enableIPForward(family int) error {
 		}
 
 		if n.IPMasq {
-			chain := utils.FormatChainName(n.Name, args.ContainerID)
-			comment := utils.FormatComment(n.Name, args.ContainerID)
-			for _, ipc := range result.IPs {
-				if err = ip.SetupIPMasq(&ipc.Address, chain, comment); err != nil {
-					return err
+			if masqBackendName, err = masqBackend(n); err != nil {
+				return err
+			}
+			backend := masqBackendName
+			steps.add(func() error {
+				var ipnets []*net.IPNet
+				for _, ipc := range result.IPs {
+					ipnets = append(ipnets, &ipc.Address)
 				}
+				return teardownIPMasq(n, args.ContainerID, backend, ipnets)
+			})
+			if err = setupIPMasq(n, args.ContainerID, masqBackendName, result.IPs); err != nil {
+				return err
+			}
+		}
+
+		if len(n.RuntimeConfig.PortMaps) > 0 {
+			steps.add(func() error {
+				return teardownPortMappings(n, args.ContainerID, args.IfName, ipConfigStrings(result.IPs))
+			})
+			if err := setupPortMappings(n, args.ContainerID, args.IfName, result.IPs); err != nil {
+				return fmt.Errorf("failed to set up host ports: %v", err)
 			}
 		}
 	} else {
@@ -454,13 +760,56 @@ func enableIPForward(family int) error {
 		 }
 	 }
  
+	hostVeth, err := netlink.LinkByName(hostInterface.Name)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", hostInterface.Name, err)
+	}
+	if n.SpoofCheck {
+		steps.add(func() error {
+			return teardownSpoofCheck(n, args.ContainerID, args.IfName)
+		})
+		if err := setupSpoofCheck(n, args.ContainerID, args.IfName, hostInterface.Name, containerInterface.Mac, result.IPs); err != nil {
+			return fmt.Errorf("failed to set up the spoof check: %v", err)
+		}
+	}
+	policy, err := setupPolicy(hostVeth)
+	if err != nil {
+		return fmt.Errorf("failed to set up network policy enforcement: %v", err)
+	}
+	ips := ipConfigStrings(result.IPs)
+	// The fast path would carry traffic between pods across VLANs, and
+	// hand what the pod sends to the other pods ahead of the spoof check
+	fastPath := false
+	if !n.vlanEnabled() && !n.SpoofCheck {
+		fastPath, err = setupFastPath(netns, args.IfName, hostVeth, containerInterface.Mac, ips)
+	}
+	if fastPath {
+		steps.add(func() error {
+			return teardownFastPath(hostVeth.Attrs().Index, ips)
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to set up the fast path: %v", err)
+	}
+	if n.RuntimeConfig.Bandwidth.isSet() {
+		steps.add(func() error {
+			return teardownBandwidth(hostVeth.Attrs().Index, ips)
+		})
+		if err := setupBandwidth(n, hostVeth, masqBackendName, ips); err != nil {
+			return fmt.Errorf("failed to set up bandwidth limits: %v", err)
+		}
+	}
+
 	 // Refetch the bridge since its MAC address may change when the first
 	 // veth is added or after its IP address is set
-	 br, err = bridgeByName(n.BrName)
-	 if err != nil {
-		 return err
-	 }
-	 brInterface.Mac = br.Attrs().HardwareAddr.String()
+	if brInterface != nil {
+		br, err = bridgeByName(n.BrName)
+		if err != nil {
+			return err
+		}
+		brInterface.Mac = br.Attrs().HardwareAddr.String()
+		brInterface.Mtu = br.Attrs().MTU
+	}
  
 	// Use incoming DNS settings if provided, otherwise use the
 	// settings that were already configured by the IPAM plugin
@@ -468,6 +817,34 @@ func enableIPForward(family int) error {
 		result.DNS = n.DNS
 	}
 
+	record := &attachment{
+		ContainerID:   args.ContainerID,
+		IfName:        args.IfName,
+		Mode:          n.Mode,
+		HostVeth:      hostInterface.Name,
+		HostVethMac:   hostInterface.Mac,
+		HostVethIndex: hostVeth.Attrs().Index,
+		IPMasq:        isLayer3 && n.IPMasq,
+		IPMasqBackend: masqBackendName,
+		HostPorts:     isLayer3 && len(n.RuntimeConfig.PortMaps) > 0,
+		Bandwidth:     n.RuntimeConfig.Bandwidth.isSet(),
+		FastPath:      fastPath,
+		Policy:        policy,
+		Vlan:          n.Vlan,
+		VlanTrunk:     n.vlanTrunk,
+		SpoofCheck:    n.SpoofCheck,
+	}
+	if isLayer3 {
+		record.IPAMType = n.IPAM.Type
+	}
+	for _, ipc := range result.IPs {
+		record.IPs = append(record.IPs, ipc.Address.String())
+	}
+	if err := saveAttachment(n, record); err != nil {
+		return err
+	}
+	notifyAttached(n, args, hostInterface.Name, record.IPs)
+
 	 success = true
  
 	 return types.PrintResult(result, cniVersion)
@@ -481,16 +858,101 @@ func dnsConfSet(dnsConf types.DNS) bool {
 }
 
  func cmdDel(args *skel.CmdArgs) error {
-	 n, _, err := loadNetConf(args.StdinData, args.Args)
-	 if err != nil {
-		 return err
-	 }
- 
+	n, _, err := loadNetConf(args.StdinData, args.Args)
+	if err != nil {
+		return err
+	}
+	if n.Chained {
+		return chainedDel(args, n)
+	}
+
+	unlock, err := lockAttachments(n, syscall.LOCK_SH)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// The record tells which pod IPs to clean up the host ports of, the
+	// container interface may already be gone.
+	record, err := loadAttachment(n, args.ContainerID, args.IfName)
+	if err != nil {
+		return err
+	}
+	var ips []string
+	var hostVethIndex int
+	if record != nil {
+		ips = record.IPs
+		hostVethIndex = record.HostVethIndex
+	}
+	if len(n.RuntimeConfig.PortMaps) > 0 || (record != nil && record.HostPorts) {
+		if err := teardownPortMappings(n, args.ContainerID, args.IfName, ips); err != nil {
+			return err
+		}
+	}
+	if n.RuntimeConfig.Bandwidth.isSet() || (record != nil && record.Bandwidth) {
+		if err := teardownBandwidth(hostVethIndex, ips); err != nil {
+			return err
+		}
+	}
+	if record != nil && record.FastPath {
+		if err := teardownFastPath(hostVethIndex, ips); err != nil {
+			return err
+		}
+	}
+	if err := teardownTCPStats(ips); err != nil {
+		return err
+	}
+	if record != nil && record.Mode == modePtp {
+		if err := teardownPtpHost(hostVethIndex, ips); err != nil {
+			return err
+		}
+	}
+	if n.SpoofCheck || (record != nil && record.SpoofCheck) {
+		if err := teardownSpoofCheck(n, args.ContainerID, args.IfName); err != nil {
+			return err
+		}
+	}
+	if record != nil && (record.Vlan != 0 || len(record.VlanTrunk) > 0) {
+		if err := teardownPortVlans(hostVethIndex, record.Vlan, record.VlanTrunk); err != nil {
+			return err
+		}
+	}
+
+	masqBackendName := masqBackendIptables
+	if record != nil && record.IPMasqBackend != "" {
+		masqBackendName = record.IPMasqBackend
+	} else if record == nil && n.IPMasq {
+		if masqBackendName, err = masqBackend(n); err != nil {
+			return err
+		}
+	}
+	if err := delAttachment(args, n, masqBackendName); err != nil {
+		return err
+	}
+	// Without the record, the pod is assumed to be on the VLAN of the
+	// config.
+	var hostVeth string
+	vlan := n.Vlan
+	if record != nil {
+		hostVeth = record.HostVeth
+		vlan = record.Vlan
+	}
+	if vlan != 0 {
+		if err := releaseGatewayVlan(n.BrName, vlan, hostVeth); err != nil {
+			return err
+		}
+	}
+	notifyDetached(n, args, hostVeth, ips)
+	return removeAttachment(n, args.ContainerID, args.IfName)
+}
+
+func delAttachment(args *skel.CmdArgs, n *NetConf, masqBackendName string) error {
+	 var err error
 	 isLayer3 := n.IPAM.Type != ""
  
 	 ipamDel := func() error {
 		 if isLayer3 {
-			 if err := ipam.ExecDel(n.IPAM.Type, args.StdinData); err != nil {
+			 if err := releaseIPs(n, args); err != nil {
 				 return err
 			 }
 		 }
@@ -525,18 +987,14 @@ func dnsConfSet(dnsConf types.DNS) bool {
 		 return err
 	 }
  
-	 // call ipam.ExecDel after clean up device in netns
+	 // release the IPs after clean up device in netns
 	 if err := ipamDel(); err != nil {
 		 return err
 	 }
  
 	if isLayer3 && n.IPMasq {
-		chain := utils.FormatChainName(n.Name, args.ContainerID)
-		comment := utils.FormatComment(n.Name, args.ContainerID)
-		for _, ipn := range ipnets {
-			if err := ip.TeardownIPMasq(ipn, chain, comment); err != nil {
-				return err
-			}
+		if err := teardownIPMasq(n, args.ContainerID, masqBackendName, ipnets); err != nil {
+			return err
 		}
 	}
 
@@ -681,6 +1139,9 @@ func dnsConfSet(dnsConf types.DNS) bool {
 	 if err != nil {
 		 return err
 	 }
+	if n.Chained {
+		return chainedCheck(args, n)
+	}
 	 netns, err := ns.GetNS(args.Netns)
 	 if err != nil {
 		 return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
@@ -688,7 +1149,7 @@ func dnsConfSet(dnsConf types.DNS) bool {
 	 defer netns.Close()
  
 	 // run the IPAM plugin and get back the config to apply
-	 err = ipam.ExecCheck(n.IPAM.Type, args.StdinData)
+	 err = checkIPs(n, args)
 	 if err != nil {
 		 return err
 	 }
@@ -724,10 +1185,15 @@ func dnsConfSet(dnsConf types.DNS) bool {
 		 }
 	 }
  
-	 brCNI, err := validateCniBrInterface(brMap, n)
-	 if err != nil {
-		 return err
-	 }
+	// In ptp mode there is no bridge and the host veth has no master,
+	// which is what validateCniVethInterface expects of a zero brCNI
+	var brCNI cniBridgeIf
+	if n.Mode == modeBridge {
+		brCNI, err = validateCniBrInterface(brMap, n)
+		if err != nil {
+			return err
+		}
+	}
  
 	 // The namespace must be the same as what was configured
 	 if args.Netns != contMap.Sandbox {
@@ -772,16 +1238,69 @@ func dnsConfSet(dnsConf types.DNS) bool {
 		 }
 	 }
  
-	 if !brCNI.found {
+	 if n.Mode == modeBridge && !brCNI.found {
 		 return fmt.Errorf("CNI created bridge %s in host namespace was not found", n.BrName)
 	 }
 	 if !contCNI.found {
 		 return fmt.Errorf("CNI created interface in container %s not found", args.IfName)
 	 }
-	 if !vethCNI.found {
-		 return fmt.Errorf("CNI veth created for bridge %s was not found", n.BrName)
-	 }
+	if !vethCNI.found {
+		if n.Mode == modePtp {
+			return fmt.Errorf("CNI veth peer of %s was not found", args.IfName)
+		}
+		return fmt.Errorf("CNI veth created for bridge %s was not found", n.BrName)
+	}
+	if n.Mode == modePtp && n.IPAM.Type != "" {
+		if err := checkPtpHost(vethCNI.Name, result.IPs); err != nil {
+			return err
+		}
+	}
+	if n.SpoofCheck {
+		if err := checkSpoofCheck(n, args.ContainerID, args.IfName, contMap.Mac, result.IPs); err != nil {
+			return err
+		}
+	}
+	if n.vlanEnabled() {
+		br, err := bridgeByName(n.BrName)
+		if err != nil {
+			return err
+		}
+		if err := checkPortVlans(br, vethCNI.Name, n.Vlan, n.vlanTrunk); err != nil {
+			return err
+		}
+	}
  
+	if err := checkDatapath(result.IPs); err != nil {
+		return err
+	}
+
+	// The per-pod maps the attachment was recorded with
+	record, err := loadAttachment(n, args.ContainerID, args.IfName)
+	if err != nil {
+		return err
+	}
+	if record != nil && record.FastPath {
+		if err := checkFastPath(vethCNI.Name, record.IPs); err != nil {
+			return err
+		}
+	}
+	if record != nil && record.Policy {
+		if err := checkPolicy(vethCNI.Name); err != nil {
+			return err
+		}
+	}
+
+	if n.RuntimeConfig.Bandwidth.isSet() {
+		var masqBackendName string
+		var ips []string
+		if record != nil {
+			masqBackendName, ips = record.IPMasqBackend, record.IPs
+		}
+		if err := checkBandwidth(n, vethCNI.Name, masqBackendName, ips); err != nil {
+			return err
+		}
+	}
+
 	 // Check prevResults for ips, routes and dns against values found in the container
 	 if err := netns.Do(func(_ ns.NetNS) error {
 		 err = ip.ValidateExpectedInterfaceIPs(args.IfName, result.IPs)
@@ -797,10 +1316,35 @@ func dnsConfSet(dnsConf types.DNS) bool {
 	 }); err != nil {
 		 return err
 	 }
+
+	if n.IPAM.Type != "" && n.IPMasq {
+		masqBackendName, err := masqBackend(n)
+		if err != nil {
+			return err
+		}
+		if record != nil && record.IPMasqBackend != "" {
+			masqBackendName = record.IPMasqBackend
+		}
+		if err := checkIPMasq(n, args.ContainerID, masqBackendName, result.IPs); err != nil {
+			return err
+		}
+	}
+
+	if len(n.RuntimeConfig.PortMaps) > 0 {
+		if err := checkPortMappings(n, args.ContainerID, args.IfName, result.IPs); err != nil {
+			return err
+		}
+	}
  
 	 return nil
  }
 
  func main() {
-	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, bv.BuildString("patu"))
+	skel.PluginMainFuncs(skel.CNIFuncs{
+		Add:    cmdAdd,
+		Check:  cmdCheck,
+		Del:    cmdDel,
+		GC:     cmdGC,
+		Status: cmdStatus,
+	}, version.All, bv.BuildString("patu"))
 }
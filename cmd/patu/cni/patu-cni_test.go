@@ -0,0 +1,235 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// netConf returns a network config with the given extra fields.
+func netConf(fields string) []byte {
+	if fields != "" {
+		fields = "," + fields
+	}
+	return []byte(fmt.Sprintf(`{"cniVersion":"1.0.0","name":"patu","type":"patu"%s}`, fields))
+}
+
+func TestLoadNetConf(t *testing.T) {
+	tests := []struct {
+		name    string
+		fields  string
+		envArgs string
+		check   func(t *testing.T, n *NetConf)
+		wantErr string
+	}{
+		{
+			name: "defaults",
+			check: func(t *testing.T, n *NetConf) {
+				if n.Mode != modeBridge || n.BrName != defaultBrName {
+					t.Errorf("mode = %q, bridge = %q, want %q, %q", n.Mode, n.BrName, modeBridge, defaultBrName)
+				}
+			},
+		},
+		{
+			name:    "static MAC and IP from CNI_ARGS",
+			envArgs: "IgnoreUnknown=1;MAC=0a:58:0a:00:00:02;IP=10.0.0.2,fd00::2",
+			check:   checkStatic("0a:58:0a:00:00:02", "10.0.0.2", "fd00::2"),
+		},
+		{
+			name:    "args override CNI_ARGS",
+			fields:  `"args":{"cni":{"mac":"0a:58:0a:00:00:03","ips":["10.0.0.3/24"]}}`,
+			envArgs: "IgnoreUnknown=1;MAC=0a:58:0a:00:00:02;IP=10.0.0.2",
+			check:   checkStatic("0a:58:0a:00:00:03", "10.0.0.3"),
+		},
+		{
+			name:    "runtimeConfig overrides args and CNI_ARGS",
+			fields:  `"args":{"cni":{"mac":"0a:58:0a:00:00:03","ips":["10.0.0.3"]}},"runtimeConfig":{"mac":"0a:58:0a:00:00:04","ips":["10.0.0.4/24"]}`,
+			envArgs: "IgnoreUnknown=1;MAC=0a:58:0a:00:00:02;IP=10.0.0.2",
+			check:   checkStatic("0a:58:0a:00:00:04", "10.0.0.4"),
+		},
+		{
+			name:    "invalid MAC",
+			fields:  `"runtimeConfig":{"mac":"0a:58"}`,
+			wantErr: "invalid MAC address",
+		},
+		{
+			name:    "invalid IP",
+			envArgs: "IgnoreUnknown=1;IP=10.0.0.256",
+			wantErr: "invalid IP address",
+		},
+		{
+			name:    "invalid CNI_ARGS",
+			envArgs: "IP",
+			wantErr: "failed to parse CNI_ARGS",
+		},
+		{
+			name:   "ptp mode",
+			fields: `"mode":"ptp"`,
+			check: func(t *testing.T, n *NetConf) {
+				if n.Mode != modePtp {
+					t.Errorf("mode = %q, want %q", n.Mode, modePtp)
+				}
+			},
+		},
+		{
+			name:    "unknown mode",
+			fields:  `"mode":"macvlan"`,
+			wantErr: "unknown mode",
+		},
+		{
+			name:    "negative portReadyTimeout",
+			fields:  `"portReadyTimeout":-1`,
+			wantErr: "invalid portReadyTimeout",
+		},
+		{
+			name:    "bridgePerNamespace",
+			fields:  `"bridgePerNamespace":true,"ipam":{"type":"patu"}`,
+			envArgs: "IgnoreUnknown=1;K8S_POD_NAMESPACE=default;K8S_POD_NAME=web",
+			check: func(t *testing.T, n *NetConf) {
+				if want := namespaceBridgeName(defaultBrName, "default"); n.BrName != want || !n.IsGW {
+					t.Errorf("bridge = %q, isGateway = %v, want %q, true", n.BrName, n.IsGW, want)
+				}
+			},
+		},
+		{
+			name:   "bridgePerNamespace keeps the prefix without a pod",
+			fields: `"bridgePerNamespace":true,"ipam":{"type":"patu"}`,
+			check: func(t *testing.T, n *NetConf) {
+				if n.BrName != defaultBrName {
+					t.Errorf("bridge = %q, want %q", n.BrName, defaultBrName)
+				}
+			},
+		},
+		{
+			name:    "bridgePerNamespace in ptp mode",
+			fields:  `"bridgePerNamespace":true,"mode":"ptp","ipam":{"type":"patu"}`,
+			wantErr: "only supported in bridge mode",
+		},
+		{
+			name:    "bridgePerNamespace chained",
+			fields:  `"bridgePerNamespace":true,"chained":true,"ipam":{"type":"patu"}`,
+			wantErr: "only supported in bridge mode",
+		},
+		{
+			name:    "bridgePerNamespace without the patu IPAM",
+			fields:  `"bridgePerNamespace":true,"ipam":{"type":"host-local"}`,
+			wantErr: "requires the patu IPAM",
+		},
+		{
+			name:    "bridgePerNamespace with a long bridge name",
+			fields:  `"bridgePerNamespace":true,"bridge":"patubridge","ipam":{"type":"patu"}`,
+			wantErr: "too long to prefix namespace bridges",
+		},
+		{
+			name:    "bridgePerNamespace with an invalid subnet prefix",
+			fields:  `"bridgePerNamespace":true,"namespaceSubnetPrefix":31,"ipam":{"type":"patu"}`,
+			wantErr: "invalid namespaceSubnetPrefix",
+		},
+		{
+			name:   "vlan",
+			fields: `"vlan":10,"vlanTrunk":[{"id":20},{"minID":30,"maxID":32}]`,
+			check: func(t *testing.T, n *NetConf) {
+				if want := []int{20, 30, 31, 32}; !reflect.DeepEqual(n.vlanTrunk, want) {
+					t.Errorf("vlanTrunk = %v, want %v", n.vlanTrunk, want)
+				}
+			},
+		},
+		{
+			name:    "vlan in ptp mode",
+			fields:  `"vlan":10,"mode":"ptp"`,
+			wantErr: "vlan is only supported in bridge mode",
+		},
+		{
+			name:    "vlan with bridgePerNamespace",
+			fields:  `"vlan":10,"bridgePerNamespace":true,"ipam":{"type":"patu"}`,
+			wantErr: "not supported with bridgePerNamespace",
+		},
+		{
+			name:    "vlan gateway name too long",
+			fields:  `"vlan":4000,"isGateway":true,"bridge":"patubridge0"`,
+			wantErr: "too long for the gateway of VLAN",
+		},
+		{
+			name:    "vlan out of range",
+			fields:  `"vlan":4095`,
+			wantErr: "invalid vlan",
+		},
+		{
+			name:    "trunk contains the access vlan",
+			fields:  `"vlan":10,"vlanTrunk":[{"minID":5,"maxID":15}]`,
+			wantErr: "contains the access VLAN",
+		},
+		{
+			name:    "trunk range without maxID",
+			fields:  `"vlanTrunk":[{"minID":5}]`,
+			wantErr: "invalid vlanTrunk range",
+		},
+		{
+			name:    "spoofCheck in ptp mode",
+			fields:  `"spoofCheck":true,"mode":"ptp"`,
+			wantErr: "spoofCheck is only supported in bridge mode",
+		},
+		{
+			name:    "spoofCheck chained",
+			fields:  `"spoofCheck":true,"chained":true`,
+			wantErr: "spoofCheck is only supported in bridge mode",
+		},
+		{
+			name:    "negative mtu",
+			fields:  `"mtu":-1`,
+			wantErr: "invalid mtu",
+		},
+		{
+			name:    "negative encapOverhead",
+			fields:  `"encapOverhead":-1`,
+			wantErr: "invalid mtu",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n, _, err := loadNetConf(netConf(tt.fields), tt.envArgs)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("loadNetConf() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadNetConf() error = %v", err)
+			}
+			if tt.check != nil {
+				tt.check(t, n)
+			}
+		})
+	}
+}
+
+func checkStatic(mac string, ips ...string) func(t *testing.T, n *NetConf) {
+	return func(t *testing.T, n *NetConf) {
+		var want []net.IP
+		for _, ip := range ips {
+			want = append(want, net.ParseIP(ip))
+		}
+		if n.mac != mac || !reflect.DeepEqual(n.ips, want) {
+			t.Errorf("mac = %q, ips = %v, want %q, %v", n.mac, n.ips, mac, want)
+		}
+	}
+}
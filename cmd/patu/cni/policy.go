@@ -0,0 +1,55 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/redhat-et/patu/internal/bpf"
+)
+
+// setupPolicy attaches the program enforcing the ingress network policies of
+// the pod to its host veth, so connections from clients outside of the node
+// are denied too. It returns false if patud has not loaded the program.
+func setupPolicy(hostVeth netlink.Link) (bool, error) {
+	if !bpf.PolicyIngressLoaded() {
+		return false, nil
+	}
+	if err := bpf.AttachPolicyIngress(hostVeth); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// checkPolicy verifies the ingress policy program is attached to the host
+// veth.
+func checkPolicy(hostVethName string) error {
+	hostVeth, err := netlink.LinkByName(hostVethName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", hostVethName, err)
+	}
+	attached, err := bpf.PolicyIngressAttached(hostVeth)
+	if err != nil {
+		return err
+	}
+	if !attached {
+		return fmt.Errorf("network policy program is not attached to %s", hostVethName)
+	}
+	return nil
+}
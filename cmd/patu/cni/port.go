@@ -0,0 +1,119 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+// defaultPortReadyTimeout is how long ADD waits for the host veth to come up
+// by default, the longest the former sleep and retry loop waited.
+const defaultPortReadyTimeout = 2500 * time.Millisecond
+
+// Bridge port states, indexed by their BR_STATE_* value.
+var brPortStates = []string{"disabled", "listening", "learning", "forwarding", "blocking"}
+
+const brStateForwarding = "3"
+
+// waitForPortReady waits until the host veth is operationally up and, if it
+// is a bridge port, forwarding. It is driven by netlink link notifications,
+// the bridge sends one on every port state change, so ADD proceeds as soon as
+// the port is ready.
+func waitForPortReady(name string, timeout time.Duration) error {
+	updates := make(chan netlink.LinkUpdate, 16)
+	done := make(chan struct{})
+	defer close(done)
+	// Subscribing before the first check makes sure no change is missed
+	if err := netlink.LinkSubscribe(updates, done); err != nil {
+		return fmt.Errorf("failed to subscribe to link updates: %v", err)
+	}
+
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", name, err)
+	}
+	index := link.Attrs().Index
+	ready, state, err := portReady(link)
+	if err != nil || ready {
+		return err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case update, ok := <-updates:
+			if !ok {
+				return fmt.Errorf("link updates of %q stopped", name)
+			}
+			if int(update.Index) != index {
+				continue
+			}
+			// Port state notifications from the bridge only carry part of
+			// the link attributes, the link is looked up again
+			if link, err = netlink.LinkByIndex(index); err != nil {
+				return fmt.Errorf("failed to lookup %q: %v", name, err)
+			}
+			if ready, state, err = portReady(link); err != nil || ready {
+				return err
+			}
+		case <-timer.C:
+			return fmt.Errorf("%s not ready after %v: %s", name, timeout, state)
+		}
+	}
+}
+
+// portReady reports whether link can carry traffic, and its state if not.
+func portReady(link netlink.Link) (bool, string, error) {
+	if link.Attrs().OperState != netlink.OperUp {
+		return false, fmt.Sprintf("oper state %s", link.Attrs().OperState), nil
+	}
+	if link.Attrs().MasterIndex == 0 {
+		return true, "", nil
+	}
+	path := filepath.Join("/sys/class/net", link.Attrs().Name, "brport/state")
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		// The master is not a bridge
+		return true, "", nil
+	}
+	if err != nil {
+		return false, "", fmt.Errorf("failed to read bridge port state of %q: %v", link.Attrs().Name, err)
+	}
+	state := strings.TrimSpace(string(data))
+	if state != brStateForwarding {
+		if i, err := strconv.Atoi(state); err == nil && i >= 0 && i < len(brPortStates) {
+			state = brPortStates[i]
+		}
+		return false, fmt.Sprintf("bridge port state %s", state), nil
+	}
+	return true, "", nil
+}
+
+func (n *NetConf) portReadyTimeout() time.Duration {
+	if n.PortReadyTimeout == 0 {
+		return defaultPortReadyTimeout
+	}
+	return time.Duration(n.PortReadyTimeout) * time.Millisecond
+}
@@ -0,0 +1,173 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/sys/unix"
+
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/redhat-et/patu/internal/bpf"
+	"github.com/redhat-et/patu/internal/nft"
+)
+
+// portMapEntry is an entry of the portMappings capability, as sent by the
+// runtime for the hostPort of a container.
+type portMapEntry struct {
+	HostPort      int    `json:"hostPort"`
+	ContainerPort int    `json:"containerPort"`
+	Protocol      string `json:"protocol"`
+	HostIP        string `json:"hostIP,omitempty"`
+}
+
+// hostPortOwner tags the host port rules of an attachment.
+func hostPortOwner(n *NetConf, containerID, ifName string) string {
+	return fmt.Sprintf("%s/%s/%s", n.Name, containerID, ifName)
+}
+
+func parseProtocol(protocol string) (uint8, error) {
+	switch strings.ToLower(protocol) {
+	case "", "tcp":
+		return unix.IPPROTO_TCP, nil
+	case "udp":
+		return unix.IPPROTO_UDP, nil
+	case "sctp":
+		return unix.IPPROTO_SCTP, nil
+	}
+	return 0, fmt.Errorf("unsupported host port protocol %q", protocol)
+}
+
+// portMappings expands the portMappings capability to the container IPs of
+// the same family as the host IP, or of every family if it has none.
+func portMappings(entries []portMapEntry, ips []*current.IPConfig) ([]nft.PortMapping, error) {
+	var mappings []nft.PortMapping
+	for _, e := range entries {
+		if e.HostPort <= 0 || e.HostPort > 65535 || e.ContainerPort <= 0 || e.ContainerPort > 65535 {
+			return nil, fmt.Errorf("invalid port mapping %d:%d", e.HostPort, e.ContainerPort)
+		}
+		proto, err := parseProtocol(e.Protocol)
+		if err != nil {
+			return nil, err
+		}
+		var hostIP net.IP
+		if e.HostIP != "" {
+			if hostIP = net.ParseIP(e.HostIP); hostIP == nil {
+				return nil, fmt.Errorf("invalid host port IP %q", e.HostIP)
+			}
+		}
+		for _, ipc := range ips {
+			if hostIP != nil && !hostIP.IsUnspecified() && (hostIP.To4() == nil) != (ipc.Address.IP.To4() == nil) {
+				continue
+			}
+			mappings = append(mappings, nft.PortMapping{
+				HostIP:        hostIP,
+				HostPort:      uint16(e.HostPort),
+				ContainerIP:   ipc.Address.IP,
+				ContainerNet:  &net.IPNet{IP: ipc.Address.IP.Mask(ipc.Address.Mask), Mask: ipc.Address.Mask},
+				ContainerPort: uint16(e.ContainerPort),
+				Protocol:      proto,
+			})
+		}
+	}
+	return mappings, nil
+}
+
+// hostPortEndpoints returns the socket level translations of the IPv4
+// mappings. A mapping without a host IP is translated for address 0, which
+// the datapath matches against the node addresses patud keeps track of.
+func hostPortEndpoints(mappings []nft.PortMapping) map[bpf.HostPortEndpoint]bpf.HostPortEndpoint {
+	endpoints := make(map[bpf.HostPortEndpoint]bpf.HostPortEndpoint)
+	for _, m := range mappings {
+		podIP, ok := bpf.IPv4Key(m.ContainerIP)
+		if !ok {
+			continue
+		}
+		backend := bpf.NewHostPortEndpoint(podIP, m.ContainerPort, m.Protocol)
+
+		var hostIP [4]byte
+		if m.HostIP != nil && !m.HostIP.IsUnspecified() {
+			if hostIP, ok = bpf.IPv4Key(m.HostIP); !ok {
+				continue
+			}
+		}
+		endpoints[bpf.NewHostPortEndpoint(hostIP, m.HostPort, m.Protocol)] = backend
+	}
+	return endpoints
+}
+
+// setupPortMappings forwards the host ports of the container. The nftables
+// DNAT rules handle the traffic reaching the node, the datapath translates
+// the connections of local sockets when patud loaded it.
+func setupPortMappings(n *NetConf, containerID, ifName string, ips []*current.IPConfig) error {
+	mappings, err := portMappings(n.RuntimeConfig.PortMaps, ips)
+	if err != nil {
+		return err
+	}
+	if err := nft.AddHostPorts(hostPortOwner(n, containerID, ifName), mappings); err != nil {
+		return err
+	}
+	if !bpf.HostPortsAvailable() {
+		return nil
+	}
+	return bpf.AddHostPorts(hostPortEndpoints(mappings))
+}
+
+// teardownPortMappings removes the host ports forwarded to the container.
+func teardownPortMappings(n *NetConf, containerID, ifName string, ips []string) error {
+	var errs []error
+	if err := nft.DelHostPorts(hostPortOwner(n, containerID, ifName)); err != nil {
+		errs = append(errs, err)
+	}
+	if bpf.HostPortsAvailable() {
+		podIPs, err := podIPv4Keys(ips)
+		if err != nil {
+			return err
+		}
+		if err := bpf.DelHostPorts(podIPs); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// checkPortMappings verifies the host ports of the container are forwarded.
+func checkPortMappings(n *NetConf, containerID, ifName string, ips []*current.IPConfig) error {
+	mappings, err := portMappings(n.RuntimeConfig.PortMaps, ips)
+	if err != nil {
+		return err
+	}
+	if err := nft.CheckHostPorts(hostPortOwner(n, containerID, ifName), mappings); err != nil {
+		return err
+	}
+	if !bpf.HostPortsAvailable() {
+		return nil
+	}
+	for hostPort, backend := range hostPortEndpoints(mappings) {
+		found, err := bpf.LookupHostPort(hostPort)
+		if err != nil {
+			return err
+		}
+		if found != backend {
+			return fmt.Errorf("host port %d is forwarded to another pod", bpf.HostPort(hostPort.Port))
+		}
+	}
+	return nil
+}
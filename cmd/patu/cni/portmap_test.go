@@ -0,0 +1,184 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"golang.org/x/sys/unix"
+
+	"github.com/redhat-et/patu/internal/bpf"
+	"github.com/redhat-et/patu/internal/nft"
+)
+
+func ipConfigs(t *testing.T, addrs ...string) []*current.IPConfig {
+	t.Helper()
+	var ips []*current.IPConfig
+	for _, addr := range addrs {
+		ip, ipn, err := net.ParseCIDR(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ips = append(ips, &current.IPConfig{Address: net.IPNet{IP: ip, Mask: ipn.Mask}})
+	}
+	return ips
+}
+
+func TestPortMappings(t *testing.T) {
+	dualStack := []string{"10.0.0.2/24", "fd00::2/64"}
+	tests := []struct {
+		name    string
+		entries []portMapEntry
+		ips     []string
+		want    []string
+		wantErr string
+	}{
+		{
+			name:    "every family without a host IP",
+			entries: []portMapEntry{{HostPort: 8080, ContainerPort: 80}},
+			ips:     dualStack,
+			want:    []string{"<nil>:8080 -> 10.0.0.2:80/6 in 10.0.0.0/24", "<nil>:8080 -> fd00::2:80/6 in fd00::/64"},
+		},
+		{
+			name:    "family of the host IP",
+			entries: []portMapEntry{{HostPort: 8080, ContainerPort: 80, HostIP: "192.168.1.1"}},
+			ips:     dualStack,
+			want:    []string{"192.168.1.1:8080 -> 10.0.0.2:80/6 in 10.0.0.0/24"},
+		},
+		{
+			name:    "every family for an unspecified host IP",
+			entries: []portMapEntry{{HostPort: 53, ContainerPort: 5353, Protocol: "UDP", HostIP: "0.0.0.0"}},
+			ips:     dualStack,
+			want:    []string{"0.0.0.0:53 -> 10.0.0.2:5353/17 in 10.0.0.0/24", "0.0.0.0:53 -> fd00::2:5353/17 in fd00::/64"},
+		},
+		{
+			name:    "sctp",
+			entries: []portMapEntry{{HostPort: 9000, ContainerPort: 9000, Protocol: "sctp"}},
+			ips:     []string{"10.0.0.2/24"},
+			want:    []string{"<nil>:9000 -> 10.0.0.2:9000/132 in 10.0.0.0/24"},
+		},
+		{
+			name:    "host port out of range",
+			entries: []portMapEntry{{HostPort: 65536, ContainerPort: 80}},
+			ips:     []string{"10.0.0.2/24"},
+			wantErr: "invalid port mapping",
+		},
+		{
+			name:    "missing container port",
+			entries: []portMapEntry{{HostPort: 8080}},
+			ips:     []string{"10.0.0.2/24"},
+			wantErr: "invalid port mapping",
+		},
+		{
+			name:    "unsupported protocol",
+			entries: []portMapEntry{{HostPort: 8080, ContainerPort: 80, Protocol: "icmp"}},
+			ips:     []string{"10.0.0.2/24"},
+			wantErr: "unsupported host port protocol",
+		},
+		{
+			name:    "invalid host IP",
+			entries: []portMapEntry{{HostPort: 8080, ContainerPort: 80, HostIP: "node"}},
+			ips:     []string{"10.0.0.2/24"},
+			wantErr: "invalid host port IP",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mappings, err := portMappings(tt.entries, ipConfigs(t, tt.ips...))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("portMappings() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("portMappings() error = %v", err)
+			}
+			var got []string
+			for _, m := range mappings {
+				got = append(got, formatMapping(m))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("portMappings() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func formatMapping(m nft.PortMapping) string {
+	return fmt.Sprintf("%v:%d -> %v:%d/%d in %v", m.HostIP, m.HostPort, m.ContainerIP, m.ContainerPort, m.Protocol, m.ContainerNet)
+}
+
+func TestHostPortEndpoints(t *testing.T) {
+	podIP := [4]byte{10, 0, 0, 2}
+	tcp := uint8(unix.IPPROTO_TCP)
+	tests := []struct {
+		name     string
+		mappings []nft.PortMapping
+		want     map[bpf.HostPortEndpoint]bpf.HostPortEndpoint
+	}{
+		{
+			name: "host IP",
+			mappings: []nft.PortMapping{{
+				HostIP: net.ParseIP("192.168.1.1"), HostPort: 8080,
+				ContainerIP: net.ParseIP("10.0.0.2"), ContainerPort: 80, Protocol: tcp,
+			}},
+			want: map[bpf.HostPortEndpoint]bpf.HostPortEndpoint{
+				bpf.NewHostPortEndpoint([4]byte{192, 168, 1, 1}, 8080, tcp): bpf.NewHostPortEndpoint(podIP, 80, tcp),
+			},
+		},
+		{
+			name: "any local address without a host IP",
+			mappings: []nft.PortMapping{{
+				HostPort: 8080, ContainerIP: net.ParseIP("10.0.0.2"), ContainerPort: 80, Protocol: tcp,
+			}},
+			want: map[bpf.HostPortEndpoint]bpf.HostPortEndpoint{
+				bpf.NewHostPortEndpoint([4]byte{}, 8080, tcp): bpf.NewHostPortEndpoint(podIP, 80, tcp),
+			},
+		},
+		{
+			name: "any local address for an unspecified host IP",
+			mappings: []nft.PortMapping{{
+				HostIP: net.IPv4zero, HostPort: 8080,
+				ContainerIP: net.ParseIP("10.0.0.2"), ContainerPort: 80, Protocol: tcp,
+			}},
+			want: map[bpf.HostPortEndpoint]bpf.HostPortEndpoint{
+				bpf.NewHostPortEndpoint([4]byte{}, 8080, tcp): bpf.NewHostPortEndpoint(podIP, 80, tcp),
+			},
+		},
+		{
+			name: "IPv6 mappings are left to nftables",
+			mappings: []nft.PortMapping{{
+				HostIP: net.ParseIP("fd00::1"), HostPort: 8080,
+				ContainerIP: net.ParseIP("fd00::2"), ContainerPort: 80, Protocol: tcp,
+			}},
+			want: map[bpf.HostPortEndpoint]bpf.HostPortEndpoint{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hostPortEndpoints(tt.mappings); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("hostPortEndpoints() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
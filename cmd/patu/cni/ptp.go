@@ -0,0 +1,236 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/ipam"
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+)
+
+// Attachment modes, selected with mode. In bridge mode, the default, the host
+// veths are ports of the bridge. In ptp mode they are routed: the host has a
+// /32 route to every pod through its host veth, and pods reach the host
+// through a link-local gateway the host veth answers ARP and NDP for.
+const (
+	modeBridge = "bridge"
+	modePtp    = "ptp"
+)
+
+var (
+	ptpGatewayV4 = net.IPv4(169, 254, 1, 1)
+	ptpGatewayV6 = net.ParseIP("fe80::1")
+)
+
+func ptpGateway(addr net.IP) net.IP {
+	if addr.To4() != nil {
+		return ptpGatewayV4
+	}
+	return ptpGatewayV6
+}
+
+func hostRouteMask(addr net.IP) net.IPMask {
+	if addr.To4() != nil {
+		return net.CIDRMask(32, 32)
+	}
+	return net.CIDRMask(128, 128)
+}
+
+// setPtpGateways points the pod addresses and routes at the link-local
+// gateway, the host veth is the only next hop of the pod.
+func setPtpGateways(result *current.Result) {
+	for _, ipc := range result.IPs {
+		ipc.Gateway = ptpGateway(ipc.Address.IP)
+	}
+	for _, route := range result.Routes {
+		route.GW = ptpGateway(route.Dst.IP)
+	}
+}
+
+// configurePtpIface configures the container interface in its netns. The
+// subnet of the pod is routed through the gateway like the rest, so traffic
+// to pods of the same subnet goes through the host too.
+func configurePtpIface(ifName string, result *current.Result) error {
+	addrs := *result
+	addrs.Routes = nil
+	if err := ipam.ConfigureIface(ifName, &addrs); err != nil {
+		return err
+	}
+
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+	for _, ipc := range result.IPs {
+		subnet := &net.IPNet{
+			IP:   ipc.Address.IP.Mask(ipc.Address.Mask),
+			Mask: ipc.Address.Mask,
+		}
+		err := netlink.RouteDel(&netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Dst:       subnet,
+			Scope:     netlink.SCOPE_NOWHERE,
+		})
+		if err != nil && err != syscall.ESRCH {
+			return fmt.Errorf("failed to delete route to %v: %v", subnet, err)
+		}
+		for _, route := range []*netlink.Route{
+			{
+				LinkIndex: link.Attrs().Index,
+				Dst:       &net.IPNet{IP: ipc.Gateway, Mask: hostRouteMask(ipc.Gateway)},
+				Scope:     netlink.SCOPE_LINK,
+				Src:       ipc.Address.IP,
+			},
+			{
+				LinkIndex: link.Attrs().Index,
+				Dst:       subnet,
+				Gw:        ipc.Gateway,
+				Src:       ipc.Address.IP,
+			},
+		} {
+			if err := netlink.RouteReplace(route); err != nil {
+				return fmt.Errorf("failed to add route to %v: %v", route.Dst, err)
+			}
+		}
+	}
+	for _, r := range result.Routes {
+		route := &netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Dst:       &r.Dst,
+			Gw:        r.GW,
+		}
+		if err := netlink.RouteReplace(route); err != nil {
+			return fmt.Errorf("failed to add route '%v via %v dev %v': %v", r.Dst, r.GW, ifName, err)
+		}
+	}
+	return nil
+}
+
+// setupPtpHost routes the pod addresses to the host veth and makes it answer
+// for the gateway.
+func setupPtpHost(hostVeth netlink.Link, ips []*current.IPConfig) error {
+	name := hostVeth.Attrs().Name
+	for _, ipc := range ips {
+		if ipc.Address.IP.To4() != nil {
+			if _, err := sysctl.Sysctl(fmt.Sprintf("net/ipv4/conf/%s/proxy_arp", name), "1"); err != nil {
+				return fmt.Errorf("failed to enable proxy ARP on %q: %v", name, err)
+			}
+			_, _ = sysctl.Sysctl(fmt.Sprintf("net/ipv4/neigh/%s/proxy_delay", name), "0")
+			if err := enableIPForward(netlink.FAMILY_V4); err != nil {
+				return fmt.Errorf("failed to enable forwarding: %v", err)
+			}
+		} else {
+			if _, err := sysctl.Sysctl(fmt.Sprintf("net/ipv6/conf/%s/proxy_ndp", name), "1"); err != nil {
+				return fmt.Errorf("failed to enable proxy NDP on %q: %v", name, err)
+			}
+			err := netlink.NeighAdd(&netlink.Neigh{
+				LinkIndex: hostVeth.Attrs().Index,
+				Family:    netlink.FAMILY_V6,
+				Flags:     netlink.NTF_PROXY,
+				IP:        ptpGatewayV6,
+			})
+			if err != nil && err != syscall.EEXIST {
+				return fmt.Errorf("failed to add NDP proxy on %q: %v", name, err)
+			}
+			if err := enableIPForward(netlink.FAMILY_V6); err != nil {
+				return fmt.Errorf("failed to enable forwarding: %v", err)
+			}
+		}
+
+		route := &netlink.Route{
+			LinkIndex: hostVeth.Attrs().Index,
+			Dst:       &net.IPNet{IP: ipc.Address.IP, Mask: hostRouteMask(ipc.Address.IP)},
+			Scope:     netlink.SCOPE_LINK,
+		}
+		if err := netlink.RouteReplace(route); err != nil {
+			return fmt.Errorf("failed to add route to %v: %v", route.Dst, err)
+		}
+	}
+	return nil
+}
+
+// teardownPtpHost deletes the routes to the pod addresses that still point at
+// its host veth. They usually went away with the veth, but a route replaced
+// by a newer pod with the same address is left alone.
+func teardownPtpHost(hostVethIndex int, ips []string) error {
+	if hostVethIndex == 0 {
+		return nil
+	}
+	for _, addr := range ips {
+		ipn, err := types.ParseCIDR(addr)
+		if err != nil {
+			return err
+		}
+		err = netlink.RouteDel(&netlink.Route{
+			LinkIndex: hostVethIndex,
+			Dst:       &net.IPNet{IP: ipn.IP, Mask: hostRouteMask(ipn.IP)},
+			Scope:     netlink.SCOPE_LINK,
+		})
+		if err != nil && err != syscall.ESRCH && err != syscall.ENODEV {
+			return fmt.Errorf("failed to delete route to %s: %v", ipn.IP, err)
+		}
+	}
+	return nil
+}
+
+// checkPtpHost verifies the pod addresses are routed to the host veth and it
+// answers for the gateway.
+func checkPtpHost(hostVethName string, ips []*current.IPConfig) error {
+	hostVeth, err := netlink.LinkByName(hostVethName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", hostVethName, err)
+	}
+	if hostVeth.Attrs().MasterIndex != 0 {
+		return fmt.Errorf("host veth %s should not be attached to a bridge in ptp mode", hostVethName)
+	}
+	for _, ipc := range ips {
+		family := netlink.FAMILY_V6
+		if ipc.Address.IP.To4() != nil {
+			family = netlink.FAMILY_V4
+			value, err := sysctl.Sysctl(fmt.Sprintf("net/ipv4/conf/%s/proxy_arp", hostVethName))
+			if err != nil {
+				return err
+			}
+			if value != "1" {
+				return fmt.Errorf("proxy ARP is not enabled on %s", hostVethName)
+			}
+		}
+		dst := &net.IPNet{IP: ipc.Address.IP, Mask: hostRouteMask(ipc.Address.IP)}
+		routes, err := netlink.RouteListFiltered(family, &netlink.Route{Dst: dst}, netlink.RT_FILTER_DST)
+		if err != nil {
+			return fmt.Errorf("failed to list routes to %v: %v", dst, err)
+		}
+		found := false
+		for _, route := range routes {
+			if route.LinkIndex == hostVeth.Attrs().Index {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("route to %v through %s not found", dst, hostVethName)
+		}
+	}
+	return nil
+}
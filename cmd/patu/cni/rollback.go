@@ -0,0 +1,70 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/vishvananda/netlink"
+)
+
+// rollback records the steps cmdAdd has completed, so a failed ADD undoes
+// them in reverse order instead of leaking interfaces, addresses and rules.
+type rollback struct {
+	undo []func() error
+}
+
+// add records how to undo a step. It is called before the step runs when a
+// partially done step must be undone too, the undo functions tolerate what
+// they remove being absent.
+func (r *rollback) add(undo func() error) {
+	r.undo = append(r.undo, undo)
+}
+
+// run undoes the recorded steps, most recent first. Failures are reported on
+// stderr and don't stop the remaining steps, the runtime gets the error that
+// failed the ADD.
+func (r *rollback) run() {
+	for i := len(r.undo) - 1; i >= 0; i-- {
+		if err := r.undo[i](); err != nil {
+			fmt.Fprintf(os.Stderr, "rollback: %v\n", err)
+		}
+	}
+	r.undo = nil
+}
+
+// removeBridgeAddr removes a gateway address cmdAdd added to the bridge,
+// unless pods other than the one on hostVethName have been attached to the
+// bridge meanwhile and use it.
+func removeBridgeAddr(brName, hostVethName string, ipn *net.IPNet) error {
+	br, err := bridgeByName(brName)
+	if err != nil {
+		return err
+	}
+	links, err := netlink.LinkList()
+	if err != nil {
+		return fmt.Errorf("failed to list links: %v", err)
+	}
+	for _, link := range links {
+		if link.Attrs().MasterIndex == br.Attrs().Index && link.Attrs().Name != hostVethName {
+			return nil
+		}
+	}
+	return deleteAddr(br, ipn)
+}
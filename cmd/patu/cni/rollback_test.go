@@ -0,0 +1,63 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestRollback(t *testing.T) {
+	tests := []struct {
+		name    string
+		steps   []string
+		failing map[string]bool
+		want    []string
+	}{
+		{name: "no steps"},
+		{name: "reverse order", steps: []string{"veth", "addr", "masq"}, want: []string{"masq", "addr", "veth"}},
+		{name: "failed undo", steps: []string{"veth", "addr", "masq"}, failing: map[string]bool{"addr": true},
+			want: []string{"masq", "addr", "veth"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var r rollback
+			var undone []string
+			for _, step := range tt.steps {
+				step := step
+				r.add(func() error {
+					undone = append(undone, step)
+					if tt.failing[step] {
+						return errors.New("failed to undo " + step)
+					}
+					return nil
+				})
+			}
+			r.run()
+			if !reflect.DeepEqual(undone, tt.want) {
+				t.Errorf("run() undid %v, want %v", undone, tt.want)
+			}
+
+			// The steps are undone once
+			r.run()
+			if len(undone) != len(tt.want) {
+				t.Errorf("second run() undid %v, want %v", undone, tt.want)
+			}
+		})
+	}
+}
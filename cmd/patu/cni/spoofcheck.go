@@ -0,0 +1,66 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/redhat-et/patu/internal/nft"
+)
+
+// spoofCheckOwner tags the spoof check rules of an attachment.
+func spoofCheckOwner(n *NetConf, containerID, ifName string) string {
+	return fmt.Sprintf("%s/%s/%s", n.Name, containerID, ifName)
+}
+
+// spoofCheckAddrs returns the MAC and IPs the pod may send from, no IPs
+// leaving only the MAC checked.
+func spoofCheckAddrs(podMAC string, ips []*current.IPConfig) (net.HardwareAddr, []net.IP, error) {
+	mac, err := net.ParseMAC(podMAC)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid MAC address %q: %v", podMAC, err)
+	}
+	var addrs []net.IP
+	for _, ipc := range ips {
+		addrs = append(addrs, ipc.Address.IP)
+	}
+	return mac, addrs, nil
+}
+
+// setupSpoofCheck filters what the pod sends through its bridge port on the
+// MAC of its interface and the IPs from IPAM.
+func setupSpoofCheck(n *NetConf, containerID, ifName, hostVeth, podMAC string, ips []*current.IPConfig) error {
+	mac, addrs, err := spoofCheckAddrs(podMAC, ips)
+	if err != nil {
+		return err
+	}
+	return nft.AddSpoofCheck(spoofCheckOwner(n, containerID, ifName), hostVeth, mac, addrs)
+}
+
+func teardownSpoofCheck(n *NetConf, containerID, ifName string) error {
+	return nft.DelSpoofCheck(spoofCheckOwner(n, containerID, ifName))
+}
+
+func checkSpoofCheck(n *NetConf, containerID, ifName, podMAC string, ips []*current.IPConfig) error {
+	mac, addrs, err := spoofCheckAddrs(podMAC, ips)
+	if err != nil {
+		return err
+	}
+	return nft.CheckSpoofCheck(spoofCheckOwner(n, containerID, ifName), mac, addrs)
+}
@@ -0,0 +1,65 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+
+	"github.com/containernetworking/cni/pkg/invoke"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/redhat-et/patu/internal/bpf"
+	patuipam "github.com/redhat-et/patu/internal/ipam"
+)
+
+// Well known STATUS error code, not defined by the CNI library.
+const errPluginNotAvailable uint = 50
+
+// cmdStatus reports whether the plugin can serve ADD requests, which needs
+// the datapath loaded by patud and, in bridge mode, a usable bridge.
+func cmdStatus(args *skel.CmdArgs) error {
+	n, _, err := loadNetConf(args.StdinData, args.Args)
+	if err != nil {
+		return err
+	}
+
+	if err := bpf.CheckDatapath(); err != nil {
+		return types.NewError(errPluginNotAvailable, "patud datapath is not ready", err.Error())
+	}
+
+	// patud creates the bridge when it starts, so a runtime that waits for
+	// STATUS before starting pods gets there. In chained mode the interfaces
+	// are set up by the previous plugins, namespace bridges are created with
+	// the first pod of their namespace.
+	if n.Mode == modeBridge && !n.Chained && !n.BridgePerNamespace {
+		if _, err := bridgeByName(n.BrName); err != nil {
+			return types.NewError(errPluginNotAvailable, "bridge is not available", err.Error())
+		}
+	}
+
+	if n.IPAM.Type == patuipam.Type {
+		if _, err := patuipam.ReadPodCIDRs(n.DataDir); err != nil {
+			return types.NewError(errPluginNotAvailable, "pod CIDRs are not available", err.Error())
+		}
+	} else if n.IPAM.Type != "" {
+		err := invoke.DelegateStatus(context.TODO(), n.IPAM.Type, args.StdinData, nil)
+		if err != nil && !delegateUnsupported(err) {
+			return err
+		}
+	}
+	return nil
+}
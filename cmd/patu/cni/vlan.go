@@ -0,0 +1,273 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+)
+
+const (
+	// The VLAN ports join when vlan_filtering is enabled on the bridge
+	defaultVlanID = 1
+	maxVlanID     = 4094
+	// Interface names are limited to 15 bytes
+	maxIfNameLen = syscall.IFNAMSIZ - 1
+)
+
+// vlanTrunk is an entry of vlanTrunk in the CNI config, either a single VLAN
+// or a range of them.
+type vlanTrunk struct {
+	MinID *int `json:"minID,omitempty"`
+	MaxID *int `json:"maxID,omitempty"`
+	ID    *int `json:"id,omitempty"`
+}
+
+// trunkVlans validates the VLAN settings of the config and returns the trunk
+// VLANs, sorted and without duplicates.
+func trunkVlans(vlan int, trunks []*vlanTrunk) ([]int, error) {
+	if vlan < 0 || vlan > maxVlanID {
+		return nil, fmt.Errorf("invalid vlan %d", vlan)
+	}
+	seen := make(map[int]bool)
+	add := func(vid int) error {
+		if vid < 1 || vid > maxVlanID {
+			return fmt.Errorf("invalid vlanTrunk VLAN %d", vid)
+		}
+		if vid == vlan {
+			return fmt.Errorf("vlanTrunk contains the access VLAN %d", vid)
+		}
+		seen[vid] = true
+		return nil
+	}
+	for _, trunk := range trunks {
+		if trunk == nil {
+			continue
+		}
+		if trunk.ID != nil {
+			if err := add(*trunk.ID); err != nil {
+				return nil, err
+			}
+		}
+		if trunk.MinID == nil && trunk.MaxID == nil {
+			continue
+		}
+		if trunk.MinID == nil || trunk.MaxID == nil || *trunk.MinID > *trunk.MaxID {
+			return nil, fmt.Errorf("invalid vlanTrunk range, minID and maxID are both required")
+		}
+		for vid := *trunk.MinID; vid <= *trunk.MaxID; vid++ {
+			if err := add(vid); err != nil {
+				return nil, err
+			}
+		}
+	}
+	var vids []int
+	for vid := range seen {
+		vids = append(vids, vid)
+	}
+	sort.Ints(vids)
+	return vids, nil
+}
+
+func (n *NetConf) vlanEnabled() bool {
+	return n.Vlan != 0 || len(n.vlanTrunk) > 0
+}
+
+func gatewayVlanName(brName string, vlan int) string {
+	return fmt.Sprintf("%s.%d", brName, vlan)
+}
+
+func ensureVlanFiltering(br *netlink.Bridge) error {
+	if br.VlanFiltering != nil && *br.VlanFiltering {
+		return nil
+	}
+	if err := netlink.BridgeSetVlanFiltering(br, true); err != nil {
+		return fmt.Errorf("failed to enable VLAN filtering on %q: %v", br.Attrs().Name, err)
+	}
+	return nil
+}
+
+// setupPortVlans makes the host veth an access port of vlan, the trunk VLANs
+// reaching the pod tagged. Without an access VLAN, untagged frames stay in
+// the default VLAN.
+func setupPortVlans(hostVeth netlink.Link, vlan int, trunk []int) error {
+	name := hostVeth.Attrs().Name
+	if vlan != 0 {
+		// The default VLAN would still be sent to the pod untagged
+		err := netlink.BridgeVlanDel(hostVeth, defaultVlanID, true, true, false, true)
+		if err != nil && !errors.Is(err, syscall.ENOENT) {
+			return fmt.Errorf("failed to remove the default VLAN of %q: %v", name, err)
+		}
+		if err := netlink.BridgeVlanAdd(hostVeth, uint16(vlan), true, true, false, true); err != nil {
+			return fmt.Errorf("failed to add VLAN %d to %q: %v", vlan, name, err)
+		}
+	}
+	for _, vid := range trunk {
+		if err := netlink.BridgeVlanAdd(hostVeth, uint16(vid), false, false, false, true); err != nil {
+			return fmt.Errorf("failed to add trunk VLAN %d to %q: %v", vid, name, err)
+		}
+	}
+	return nil
+}
+
+// teardownPortVlans removes the VLANs of the pod from its host veth, which
+// may be gone already.
+func teardownPortVlans(hostVethIndex, vlan int, trunk []int) error {
+	hostVeth, err := netlink.LinkByIndex(hostVethIndex)
+	if err != nil {
+		return nil
+	}
+	vids := trunk
+	if vlan != 0 {
+		vids = append([]int{vlan}, trunk...)
+	}
+	for _, vid := range vids {
+		err := netlink.BridgeVlanDel(hostVeth, uint16(vid), false, false, false, true)
+		if err != nil && !errors.Is(err, syscall.ENOENT) && !errors.Is(err, syscall.ENODEV) {
+			return fmt.Errorf("failed to remove VLAN %d from %q: %v", vid, hostVeth.Attrs().Name, err)
+		}
+	}
+	return nil
+}
+
+// checkPortVlans verifies the VLAN membership of the host veth and that
+// filtering is enabled on its bridge.
+func checkPortVlans(br *netlink.Bridge, hostVethName string, vlan int, trunk []int) error {
+	if br.VlanFiltering == nil || !*br.VlanFiltering {
+		return fmt.Errorf("VLAN filtering is not enabled on %q", br.Attrs().Name)
+	}
+	hostVeth, err := netlink.LinkByName(hostVethName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", hostVethName, err)
+	}
+	vlans, err := netlink.BridgeVlanList()
+	if err != nil {
+		return fmt.Errorf("failed to list bridge VLANs: %v", err)
+	}
+	untagged := make(map[int]bool)
+	pvid := 0
+	for _, info := range vlans[int32(hostVeth.Attrs().Index)] {
+		untagged[int(info.Vid)] = info.EngressUntag()
+		if info.PortVID() {
+			pvid = int(info.Vid)
+		}
+	}
+
+	if vlan != 0 {
+		if pvid != vlan || !untagged[vlan] {
+			return fmt.Errorf("%q is not an untagged port of VLAN %d", hostVethName, vlan)
+		}
+	}
+	want := make(map[int]bool, len(trunk)+1)
+	for _, vid := range trunk {
+		want[vid] = true
+		if isUntagged, ok := untagged[vid]; !ok || isUntagged {
+			return fmt.Errorf("%q is not a tagged port of VLAN %d", hostVethName, vid)
+		}
+	}
+	if vlan != 0 {
+		want[vlan] = true
+		for vid := range untagged {
+			if !want[vid] {
+				return fmt.Errorf("%q is an unexpected member of VLAN %d", hostVethName, vid)
+			}
+		}
+	}
+	return nil
+}
+
+// ensureGatewayVlan returns the VLAN interface of the bridge the gateway
+// addresses of vlan are set on, creating it if necessary. The bridge itself
+// is a tagged member of the VLAN, so the interface gets its traffic.
+func ensureGatewayVlan(br *netlink.Bridge, vlan int) (netlink.Link, error) {
+	name := gatewayVlanName(br.Attrs().Name, vlan)
+	if err := netlink.BridgeVlanAdd(br, uint16(vlan), false, false, true, false); err != nil {
+		return nil, fmt.Errorf("failed to add VLAN %d to %q: %v", vlan, br.Attrs().Name, err)
+	}
+	link := &netlink.Vlan{
+		LinkAttrs: netlink.LinkAttrs{
+			Name:        name,
+			ParentIndex: br.Attrs().Index,
+		},
+		VlanId: vlan,
+	}
+	if err := netlink.LinkAdd(link); err != nil && err != syscall.EEXIST {
+		return nil, fmt.Errorf("could not add %q: %v", name, err)
+	}
+
+	l, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("could not lookup %q: %v", name, err)
+	}
+	gw, ok := l.(*netlink.Vlan)
+	if !ok || gw.VlanId != vlan || gw.Attrs().ParentIndex != br.Attrs().Index {
+		return nil, fmt.Errorf("%q already exists but is not VLAN %d of %q", name, vlan, br.Attrs().Name)
+	}
+
+	// we want to own the routes for this interface
+	_, _ = sysctl.Sysctl(fmt.Sprintf("net/ipv6/conf/%s/accept_ra", name), "0")
+
+	if err := netlink.LinkSetUp(gw); err != nil {
+		return nil, err
+	}
+	return gw, nil
+}
+
+// releaseGatewayVlan deletes the gateway interface of vlan, with its
+// addresses, once no port of the bridge but hostVethName is in the VLAN.
+func releaseGatewayVlan(brName string, vlan int, hostVethName string) error {
+	br, err := netlink.LinkByName(brName)
+	if err != nil {
+		return nil
+	}
+	links, err := netlink.LinkList()
+	if err != nil {
+		return fmt.Errorf("failed to list links: %v", err)
+	}
+	vlans, err := netlink.BridgeVlanList()
+	if err != nil {
+		return fmt.Errorf("failed to list bridge VLANs: %v", err)
+	}
+	for _, link := range links {
+		if link.Attrs().MasterIndex != br.Attrs().Index || link.Attrs().Name == hostVethName {
+			continue
+		}
+		for _, info := range vlans[int32(link.Attrs().Index)] {
+			if int(info.Vid) == vlan {
+				return nil
+			}
+		}
+	}
+
+	name := gatewayVlanName(brName, vlan)
+	if gw, err := netlink.LinkByName(name); err == nil {
+		if err := netlink.LinkDel(gw); err != nil {
+			return fmt.Errorf("failed to delete %q: %v", name, err)
+		}
+	}
+	err = netlink.BridgeVlanDel(br, uint16(vlan), false, false, true, false)
+	if err != nil && !errors.Is(err, syscall.ENOENT) {
+		return fmt.Errorf("failed to remove VLAN %d from %q: %v", vlan, brName, err)
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package flows
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/cilium/ebpf/ringbuf"
+	"github.com/redhat-et/patu/cmd/patu/daemon/kubehelper"
+	"github.com/redhat-et/patu/internal/bpf"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// Record is the JSON representation of a closed pod connection. The source
+// is the socket that sent the accounted data.
+type Record struct {
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	SrcIP    string    `json:"srcIP"`
+	SrcPort  uint16    `json:"srcPort"`
+	SrcPod   string    `json:"srcPod,omitempty"`
+	DstIP    string    `json:"dstIP"`
+	DstPort  uint16    `json:"dstPort"`
+	DstPod   string    `json:"dstPod,omitempty"`
+	Bytes    uint64    `json:"bytes"`
+	Messages uint64    `json:"messages"`
+}
+
+// Sink receives every flow record as a single JSON line.
+type Sink interface {
+	Write(line []byte) error
+	Close() error
+}
+
+// Exporter writes the flow records flushed by the datapath to its sinks.
+type Exporter struct {
+	resolver *kubehelper.PodResolver
+	sinks    []Sink
+}
+
+func NewExporter(resolver *kubehelper.PodResolver, sinks ...Sink) *Exporter {
+	return &Exporter{resolver: resolver, sinks: sinks}
+}
+
+// Run exports flow records until stopCh is closed, then closes the sinks.
+func (e *Exporter) Run(stopCh <-chan struct{}) {
+	defer func() {
+		for _, sink := range e.sinks {
+			sink.Close()
+		}
+	}()
+
+	reader, err := bpf.NewFlowReader()
+	if err != nil {
+		log.Errorf("Flow records disabled: %v", err)
+		return
+	}
+	go func() {
+		<-stopCh
+		reader.Close()
+	}()
+	e.resolver.WaitForSync(stopCh)
+	log.Infof("Flow record exporter started")
+
+	for {
+		flow, err := reader.Read()
+		if errors.Is(err, ringbuf.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Warnf("Failed to read flow record: %v", err)
+			continue
+		}
+
+		line, err := json.Marshal(e.record(flow))
+		if err != nil {
+			log.Warnf("Failed to encode flow record: %v", err)
+			continue
+		}
+		line = append(line, '\n')
+		for _, sink := range e.sinks {
+			if err := sink.Write(line); err != nil {
+				log.Warnf("Failed to write flow record: %v", err)
+			}
+		}
+	}
+}
+
+func (e *Exporter) record(flow *bpf.FlowRecord) *Record {
+	srcIP := net.IP(flow.Key.SrcIP[:])
+	dstIP := net.IP(flow.Key.DstIP[:])
+	return &Record{
+		Start:    monotonicToWall(flow.StartNs),
+		End:      monotonicToWall(flow.EndNs),
+		SrcIP:    srcIP.String(),
+		SrcPort:  bpf.HostPort(uint16(flow.Key.SrcPort)),
+		SrcPod:   e.podName(srcIP),
+		DstIP:    dstIP.String(),
+		DstPort:  bpf.HostPort(uint16(flow.Key.DstPort)),
+		DstPod:   e.podName(dstIP),
+		Bytes:    flow.Bytes,
+		Messages: flow.Msgs,
+	}
+}
+
+func (e *Exporter) podName(ip net.IP) string {
+	if pod := e.resolver.PodByIP(ip); pod != nil {
+		return pod.Namespace + "/" + pod.Name
+	}
+	return ""
+}
+
+// monotonicToWall converts a CLOCK_MONOTONIC timestamp taken by the datapath
+// to wall clock time.
+func monotonicToWall(ns uint64) time.Time {
+	var now unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &now); err != nil {
+		return time.Time{}
+	}
+	return time.Now().Add(-time.Duration(now.Nano() - int64(ns)))
+}
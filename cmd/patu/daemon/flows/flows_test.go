@@ -0,0 +1,126 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package flows
+
+import (
+	"testing"
+	"time"
+
+	"github.com/redhat-et/patu/cmd/patu/daemon/kubehelper"
+	"github.com/redhat-et/patu/internal/bpf"
+
+	"golang.org/x/sys/unix"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func testResolver(t *testing.T, pods ...*corev1.Pod) *kubehelper.PodResolver {
+	factory := informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0)
+	resolver, err := kubehelper.NewPodResolver(factory)
+	if err != nil {
+		t.Fatalf("NewPodResolver() error = %v", err)
+	}
+	indexer := factory.Core().V1().Pods().Informer().GetIndexer()
+	for _, pod := range pods {
+		if err := indexer.Add(pod); err != nil {
+			t.Fatalf("Failed to add pod %s: %v", pod.Name, err)
+		}
+	}
+	return resolver
+}
+
+func testPod(name, ip string, phase corev1.PodPhase) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+		Status:     corev1.PodStatus{Phase: phase, PodIPs: []corev1.PodIP{{IP: ip}}},
+	}
+}
+
+func TestRecord(t *testing.T) {
+	e := NewExporter(testResolver(t,
+		testPod("client", "10.200.0.5", corev1.PodRunning),
+		testPod("server", "10.200.0.6", corev1.PodRunning),
+		testPod("done", "10.200.0.7", corev1.PodSucceeded),
+	))
+	tests := []struct {
+		name  string
+		dstIP [4]byte
+		want  Record
+	}{
+		{
+			name:  "between pods",
+			dstIP: [4]byte{10, 200, 0, 6},
+			want: Record{
+				SrcIP: "10.200.0.5", SrcPort: 41734, SrcPod: "default/client",
+				DstIP: "10.200.0.6", DstPort: 8080, DstPod: "default/server",
+				Bytes: 5120, Messages: 5,
+			},
+		},
+		{
+			name:  "to an address outside the node",
+			dstIP: [4]byte{192, 0, 2, 1},
+			want: Record{
+				SrcIP: "10.200.0.5", SrcPort: 41734, SrcPod: "default/client",
+				DstIP: "192.0.2.1", DstPort: 8080,
+				Bytes: 5120, Messages: 5,
+			},
+		},
+		{
+			name:  "to the address of a completed pod",
+			dstIP: [4]byte{10, 200, 0, 7},
+			want: Record{
+				SrcIP: "10.200.0.5", SrcPort: 41734, SrcPod: "default/client",
+				DstIP: "10.200.0.7", DstPort: 8080,
+				Bytes: 5120, Messages: 5,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flow := &bpf.FlowRecord{
+				Key: bpf.SocketKey{
+					SrcIP: [4]byte{10, 200, 0, 5}, DstIP: tt.dstIP,
+					SrcPort: uint32(bpf.PolicyPort(41734)), DstPort: uint32(bpf.PolicyPort(8080)),
+				},
+				Bytes: 5120, Msgs: 5,
+			}
+			got := e.record(flow)
+			got.Start, got.End = time.Time{}, time.Time{}
+			if *got != tt.want {
+				t.Errorf("record() = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMonotonicToWall(t *testing.T) {
+	var now unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &now); err != nil {
+		t.Fatalf("ClockGettime() error = %v", err)
+	}
+	start := monotonicToWall(uint64(now.Nano() - int64(time.Second)))
+	end := monotonicToWall(uint64(now.Nano()))
+
+	if d := end.Sub(start); d < time.Second-100*time.Millisecond || d > time.Second+100*time.Millisecond {
+		t.Errorf("a connection of 1s lasted %v", d)
+	}
+	if d := time.Since(end); d < -100*time.Millisecond || d > 100*time.Millisecond {
+		t.Errorf("a connection that just ended ended %v ago", d)
+	}
+}
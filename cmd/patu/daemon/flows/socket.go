@@ -0,0 +1,117 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package flows
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Records queued for a client that doesn't keep up are dropped rather than
+// blocking the exporter.
+const clientQueueLen = 1024
+
+// SocketSink streams flow records to every client connected to a Unix
+// socket. Clients only receive the records exported while they are connected.
+type SocketSink struct {
+	listener net.Listener
+	lock     sync.Mutex
+	clients  map[net.Conn]chan []byte
+}
+
+func NewSocketSink(path string) (*SocketSink, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("Failed to create flow socket directory: %v", err)
+	}
+	// A socket left behind by a previous run would make Listen fail.
+	_ = os.Remove(path)
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to listen on flow socket %s: %v", path, err)
+	}
+	sink := &SocketSink{
+		listener: listener,
+		clients:  make(map[net.Conn]chan []byte),
+	}
+	go sink.accept()
+	return sink, nil
+}
+
+func (s *SocketSink) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		queue := make(chan []byte, clientQueueLen)
+		s.lock.Lock()
+		s.clients[conn] = queue
+		s.lock.Unlock()
+		go s.serve(conn, queue)
+	}
+}
+
+func (s *SocketSink) serve(conn net.Conn, queue chan []byte) {
+	defer s.remove(conn)
+	for line := range queue {
+		if _, err := conn.Write(line); err != nil {
+			log.Debugf("Flow socket client disconnected: %v", err)
+			return
+		}
+	}
+}
+
+func (s *SocketSink) remove(conn net.Conn) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if queue, ok := s.clients[conn]; ok {
+		delete(s.clients, conn)
+		close(queue)
+	}
+	conn.Close()
+}
+
+func (s *SocketSink) Write(line []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, queue := range s.clients {
+		select {
+		case queue <- line:
+		default:
+		}
+	}
+	return nil
+}
+
+func (s *SocketSink) Close() error {
+	err := s.listener.Close()
+	s.lock.Lock()
+	conns := make([]net.Conn, 0, len(s.clients))
+	for conn := range s.clients {
+		conns = append(conns, conn)
+	}
+	s.lock.Unlock()
+	for _, conn := range conns {
+		s.remove(conn)
+	}
+	return err
+}
@@ -0,0 +1,97 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package hostports
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/redhat-et/patu/internal/bpf"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+const retryInterval = 5 * time.Second
+
+// Run keeps the node addresses the datapath forwards host ports on in sync
+// with the interfaces of the node until stopCh is closed, so host ports
+// follow address changes such as DHCP renewals.
+func Run(stopCh <-chan struct{}) {
+	log.Infof("Host port address watcher started")
+	for {
+		if err := watch(stopCh); err != nil {
+			log.Errorf("Failed to sync the node addresses of host ports: %v", err)
+		}
+		select {
+		case <-stopCh:
+			return
+		case <-time.After(retryInterval):
+		}
+	}
+}
+
+func watch(stopCh <-chan struct{}) error {
+	updates := make(chan netlink.AddrUpdate, 16)
+	done := make(chan struct{})
+	defer close(done)
+	errs := make(chan error, 1)
+	// Subscribing before the first sync makes sure no change is missed
+	err := netlink.AddrSubscribeWithOptions(updates, done, netlink.AddrSubscribeOptions{
+		ErrorCallback: func(err error) {
+			select {
+			case errs <- err:
+			default:
+			}
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to subscribe to address updates: %v", err)
+	}
+	if err := sync(); err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-stopCh:
+			return nil
+		case err := <-errs:
+			return err
+		case _, ok := <-updates:
+			if !ok {
+				return fmt.Errorf("Address updates stopped")
+			}
+			if err := sync(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func sync() error {
+	addrs, err := netlink.AddrList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return fmt.Errorf("Failed to list addresses: %v", err)
+	}
+	var local [][4]byte
+	for _, addr := range addrs {
+		if key, ok := bpf.IPv4Key(addr.IP); ok {
+			local = append(local, key)
+		}
+	}
+	return bpf.SyncLocalAddrs(local)
+}
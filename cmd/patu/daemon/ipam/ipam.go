@@ -0,0 +1,131 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ipam
+
+import (
+	"net"
+	"time"
+
+	"github.com/redhat-et/patu/cmd/patu/daemon/kubehelper"
+	patuipam "github.com/redhat-et/patu/internal/ipam"
+
+	log "github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	reconcileInterval = time.Minute
+	// A pod's address shows up in its status some time after the CNI plugin
+	// allocated it. Younger allocations are never considered leaked.
+	allocationGracePeriod = 10 * time.Minute
+)
+
+// PublishPodCIDRs makes the pod CIDRs of the node available to the built-in
+// IPAM of the CNI plugin. It returns the IPv4 pod CIDR, which the datapath
+// uses as its pod subnet.
+func PublishPodCIDRs(client *kubernetes.Clientset, nodeName, dataDir string) (*net.IPNet, error) {
+	cidrs, err := kubehelper.GetNodePodCIDRs(client, nodeName)
+	if err != nil {
+		return nil, err
+	}
+	if err := patuipam.WritePodCIDRs(dataDir, cidrs); err != nil {
+		return nil, err
+	}
+	log.Infof("Pod CIDRs of node %s: %v", nodeName, cidrs)
+
+	for _, cidr := range cidrs {
+		if cidr.IP.To4() != nil {
+			return cidr, nil
+		}
+	}
+	return nil, nil
+}
+
+// Reconciler releases the addresses of the built-in IPAM that no pod on the
+// node uses anymore, left behind when the runtime never called DEL.
+type Reconciler struct {
+	podLister corelisters.PodLister
+	synced    cache.InformerSynced
+	dataDir   string
+}
+
+// NewReconciler registers the pod informer of localPods, which must only see
+// the pods of this node.
+func NewReconciler(localPods informers.SharedInformerFactory, dataDir string) *Reconciler {
+	podInformer := localPods.Core().V1().Pods()
+	return &Reconciler{
+		podLister: podInformer.Lister(),
+		synced:    podInformer.Informer().HasSynced,
+		dataDir:   dataDir,
+	}
+}
+
+// Run reconciles the allocations periodically until stopCh is closed. The
+// informer factory must have been started by the caller.
+func (r *Reconciler) Run(stopCh <-chan struct{}) {
+	if !cache.WaitForCacheSync(stopCh, r.synced) {
+		log.Errorf("Timed out waiting for the IPAM pod cache to sync")
+		return
+	}
+	wait.Until(func() {
+		if err := r.reconcile(); err != nil {
+			log.Errorf("Failed to reconcile IPAM allocations: %v", err)
+		}
+	}, reconcileInterval, stopCh)
+}
+
+func (r *Reconciler) reconcile() error {
+	pods, err := r.podLister.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	// Pods that terminated keep their address until the runtime tore down
+	// their sandbox, they are counted as well.
+	inUse := make(map[string]bool)
+	for _, pod := range pods {
+		for _, podIP := range pod.Status.PodIPs {
+			if ip := net.ParseIP(podIP.IP); ip != nil {
+				inUse[ip.String()] = true
+			}
+		}
+	}
+
+	store, err := patuipam.OpenStore(r.dataDir)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	allocations, err := store.Allocations()
+	if err != nil {
+		return err
+	}
+	for ip, a := range allocations {
+		if inUse[ip] || time.Since(a.Created) < allocationGracePeriod {
+			continue
+		}
+		if err := store.Release(ip); err != nil {
+			return err
+		}
+		log.Infof("Released address %s of container %s, no pod on the node uses it", ip, a.ContainerID)
+	}
+	return nil
+}
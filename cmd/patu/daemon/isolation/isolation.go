@@ -0,0 +1,133 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package isolation
+
+import (
+	"net"
+	"time"
+
+	"github.com/redhat-et/patu/cmd/patu/daemon/kubehelper"
+	"github.com/redhat-et/patu/internal/bpf"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+const retryInterval = 5 * time.Second
+
+// Controller keeps the pod namespace map in sync with the pods on this node,
+// so patu_sockops only redirects sockets between pods of the same namespace
+// when every namespace has its own bridge.
+type Controller struct {
+	podLister corelisters.PodLister
+	synced    cache.InformerSynced
+	addresses *kubehelper.PodAddresses
+	dirty     chan struct{}
+
+	// Namespace ids are never reused while patud runs, so a namespace that
+	// is recreated can't share an id with sockets of the former one.
+	namespaceIDs map[string]uint32
+	nextID       uint32
+}
+
+// NewController registers the pod informer of localPods, which must only see
+// the pods of this node. Pods are also synced as soon as addresses learns
+// about them, addresses may be nil.
+func NewController(localPods informers.SharedInformerFactory, addresses *kubehelper.PodAddresses) *Controller {
+	podInformer := localPods.Core().V1().Pods()
+	c := &Controller{
+		podLister:    podInformer.Lister(),
+		synced:       podInformer.Informer().HasSynced,
+		addresses:    addresses,
+		dirty:        make(chan struct{}, 1),
+		namespaceIDs: make(map[string]uint32),
+		nextID:       1,
+	}
+	podInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { c.enqueue() },
+		UpdateFunc: func(interface{}, interface{}) { c.enqueue() },
+		DeleteFunc: func(interface{}) { c.enqueue() },
+	})
+	addresses.OnChange(c.enqueue)
+	return c
+}
+
+func (c *Controller) enqueue() {
+	select {
+	case c.dirty <- struct{}{}:
+	default:
+	}
+}
+
+// Run syncs the pod namespace map until stopCh is closed. The informer
+// factory must have been started by the caller.
+func (c *Controller) Run(stopCh <-chan struct{}) {
+	if !cache.WaitForCacheSync(stopCh, c.synced) {
+		log.Errorf("Timed out waiting for the namespace isolation pod cache to sync")
+		return
+	}
+	log.Infof("Namespace isolation controller started")
+
+	c.enqueue()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-c.dirty:
+			if err := c.sync(); err != nil {
+				log.Errorf("Failed to sync pod namespaces: %v", err)
+				time.AfterFunc(retryInterval, c.enqueue)
+			}
+		}
+	}
+}
+
+func (c *Controller) sync() error {
+	pods, err := c.podLister.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+
+	namespaces := make(map[[4]byte]uint32)
+	for _, pod := range pods {
+		podIP := c.addresses.PodIP(pod)
+		if pod.Spec.HostNetwork || podIP == "" ||
+			pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		key, ok := bpf.IPv4Key(net.ParseIP(podIP))
+		if !ok {
+			continue
+		}
+		namespaces[key] = c.namespaceID(pod.Namespace)
+	}
+	return bpf.SyncPodNamespaces(namespaces)
+}
+
+func (c *Controller) namespaceID(namespace string) uint32 {
+	id, ok := c.namespaceIDs[namespace]
+	if !ok {
+		id = c.nextID
+		c.nextID++
+		c.namespaceIDs[namespace] = id
+	}
+	return id
+}
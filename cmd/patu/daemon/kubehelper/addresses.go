@@ -0,0 +1,97 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kubehelper
+
+import (
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// PodAddresses holds the addresses the CNI plugin reported for the pods of
+// this node. The plugin reports them as soon as the pod is wired up, well
+// before the kubelet publishes them in the pod status, so the controllers can
+// program the datapath for a new pod right away.
+type PodAddresses struct {
+	lock     sync.RWMutex
+	pods     map[types.NamespacedName]podAddress
+	handlers []func()
+}
+
+type podAddress struct {
+	containerID string
+	ips         []string
+}
+
+func NewPodAddresses() *PodAddresses {
+	return &PodAddresses{pods: make(map[types.NamespacedName]podAddress)}
+}
+
+// OnChange registers handler to be called after every change. It must be
+// called before the addresses are updated.
+func (a *PodAddresses) OnChange(handler func()) {
+	if a == nil {
+		return
+	}
+	a.handlers = append(a.handlers, handler)
+}
+
+// Set records the addresses of the sandbox containerID of pod.
+func (a *PodAddresses) Set(pod types.NamespacedName, containerID string, ips []string) {
+	a.lock.Lock()
+	a.pods[pod] = podAddress{containerID: containerID, ips: ips}
+	a.lock.Unlock()
+	a.notify()
+}
+
+// Delete forgets the addresses of pod if they belong to the sandbox
+// containerID, the pod may already have a new sandbox.
+func (a *PodAddresses) Delete(pod types.NamespacedName, containerID string) {
+	a.lock.Lock()
+	addr, ok := a.pods[pod]
+	deleted := ok && addr.containerID == containerID
+	if deleted {
+		delete(a.pods, pod)
+	}
+	a.lock.Unlock()
+	if deleted {
+		a.notify()
+	}
+}
+
+// PodIP returns the primary address of pod, from its status if the kubelet
+// published it already and from the CNI plugin otherwise. It returns an empty
+// string if neither knows about it.
+func (a *PodAddresses) PodIP(pod *corev1.Pod) string {
+	if pod.Status.PodIP != "" || a == nil {
+		return pod.Status.PodIP
+	}
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	addr, ok := a.pods[types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}]
+	if !ok || len(addr.ips) == 0 {
+		return ""
+	}
+	return addr.ips[0]
+}
+
+func (a *PodAddresses) notify() {
+	for _, handler := range a.handlers {
+		handler()
+	}
+}
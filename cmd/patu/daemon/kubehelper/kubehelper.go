@@ -21,22 +21,37 @@ import (
 	"encoding/json"
 	"fmt"
 	"net"
+	"os"
 
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
 )
 
 const (
 	patuNamespace  = "kube-system"
 	patuConfigMap  = "patu-cni-conf"
 	patuConfigFile = "patu-cni-conf.json"
+	nodeNameEnv    = "NODE_NAME"
+	// Keep in sync with the defaults of the CNI plugin
+	defaultBridge = "patux"
+	modeBridge    = "bridge"
 )
 
 type IPNet net.IPNet
 
 type CniConf struct {
-	IPAM IPAMConfig `json:"ipam,omitempty"`
+	Mode               string     `json:"mode,omitempty"`
+	Chained            bool       `json:"chained,omitempty"`
+	Bridge             string     `json:"bridge,omitempty"`
+	IPMasq             bool       `json:"ipMasq,omitempty"`
+	IPMasqBackend      string     `json:"ipMasqBackend,omitempty"`
+	BridgePerNamespace bool       `json:"bridgePerNamespace,omitempty"`
+	IPAM               IPAMConfig `json:"ipam,omitempty"`
 }
 
 type IPAMConfig struct {
@@ -64,30 +79,181 @@ func GetKubeClient() (clientset *kubernetes.Clientset) {
 	return
 }
 
-func GetSubnetFromConfig(clientset *kubernetes.Clientset) (net.IP, *net.IPNet, error) {
+func getCniConfig(clientset *kubernetes.Clientset) (*CniConf, error) {
 	configMap, err := clientset.CoreV1().ConfigMaps(patuNamespace).Get(context.TODO(), patuConfigMap, metav1.GetOptions{})
 	if err != nil {
 		panic(err.Error())
 	}
 	if configMap == nil {
-		return nil, nil, fmt.Errorf("ConfigMap %s not found in the namespace %s", patuConfigMap, patuNamespace)
-	} else {
-		var cmFile string
-		if value, ok := configMap.Data[patuConfigFile]; ok {
-			cmFile = value
-		}
+		return nil, fmt.Errorf("ConfigMap %s not found in the namespace %s", patuConfigMap, patuNamespace)
+	}
+	var cmFile string
+	if value, ok := configMap.Data[patuConfigFile]; ok {
+		cmFile = value
+	}
 
-		config := &CniConf{}
-		if err := json.Unmarshal([]byte(cmFile), config); err != nil {
-			return nil, nil, fmt.Errorf("Error in unmarshalling %v", err)
-		}
+	config := &CniConf{}
+	if err := json.Unmarshal([]byte(cmFile), config); err != nil {
+		return nil, fmt.Errorf("Error in unmarshalling %v", err)
+	}
+	return config, nil
+}
+
+func GetSubnetFromConfig(clientset *kubernetes.Clientset) (net.IP, *net.IPNet, error) {
+	config, err := getCniConfig(clientset)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(config.IPAM.Ranges) == 0 || len(config.IPAM.Ranges[0]) == 0 {
+		return nil, nil, fmt.Errorf("No IPAM range in ConfigMap %s", patuConfigMap)
+	}
+
+	//Currently patu supports only one range.
+	subnet := (config.IPAM.Ranges[0][0]).Subnet
+	ip, mask, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return ip, mask, fmt.Errorf("Failed to parse subnet CIDR %s", subnet)
+	}
+	return ip, mask, err
+}
+
+// GetIPAMTypeFromConfig returns the IPAM type of the patu CNI config.
+func GetIPAMTypeFromConfig(clientset *kubernetes.Clientset) (string, error) {
+	config, err := getCniConfig(clientset)
+	if err != nil {
+		return "", err
+	}
+	return config.IPAM.Type, nil
+}
+
+// GetIPMasqBackendFromConfig returns the IP masquerade backend of the patu
+// CNI config, empty if pod traffic is not masqueraded.
+func GetIPMasqBackendFromConfig(clientset *kubernetes.Clientset) (string, error) {
+	config, err := getCniConfig(clientset)
+	if err != nil || !config.IPMasq {
+		return "", err
+	}
+	return config.IPMasqBackend, nil
+}
+
+// GetBridgePerNamespaceFromConfig tells whether the patu CNI config attaches
+// the pods of every namespace to their own bridge.
+func GetBridgePerNamespaceFromConfig(clientset *kubernetes.Clientset) (bool, error) {
+	config, err := getCniConfig(clientset)
+	if err != nil {
+		return false, err
+	}
+	return config.BridgePerNamespace, nil
+}
+
+// GetBridgeFromConfig returns the bridge the patu CNI config attaches all the
+// pods of the node to, empty if the pods are not attached to a shared bridge.
+func GetBridgeFromConfig(clientset *kubernetes.Clientset) (string, error) {
+	config, err := getCniConfig(clientset)
+	if err != nil {
+		return "", err
+	}
+	if (config.Mode != "" && config.Mode != modeBridge) || config.Chained || config.BridgePerNamespace {
+		return "", nil
+	}
+	if config.Bridge == "" {
+		return defaultBridge, nil
+	}
+	return config.Bridge, nil
+}
 
-		//Currently patu supports only one range.
-		subnet := (config.IPAM.Ranges[0][0]).Subnet
-		ip, mask, err := net.ParseCIDR(subnet)
+// GetNodePodCIDRs returns the pod CIDRs the cluster assigned to nodeName.
+func GetNodePodCIDRs(clientset *kubernetes.Clientset, nodeName string) ([]*net.IPNet, error) {
+	node, err := clientset.CoreV1().Nodes().Get(context.TODO(), nodeName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get node %s: %v", nodeName, err)
+	}
+	podCIDRs := node.Spec.PodCIDRs
+	if len(podCIDRs) == 0 && node.Spec.PodCIDR != "" {
+		podCIDRs = []string{node.Spec.PodCIDR}
+	}
+	if len(podCIDRs) == 0 {
+		return nil, fmt.Errorf("Node %s has no pod CIDR assigned", nodeName)
+	}
+
+	var cidrs []*net.IPNet
+	for _, podCIDR := range podCIDRs {
+		_, cidr, err := net.ParseCIDR(podCIDR)
 		if err != nil {
-			return ip, mask, fmt.Errorf("Failed to parse subnet CIDR %s", subnet)
+			return nil, fmt.Errorf("Failed to parse pod CIDR %s of node %s", podCIDR, nodeName)
+		}
+		cidrs = append(cidrs, cidr)
+	}
+	return cidrs, nil
+}
+
+// GetNodeName returns the name of the node patud is running on, exposed to the
+// daemon through the downward API.
+func GetNodeName() (string, error) {
+	nodeName := os.Getenv(nodeNameEnv)
+	if nodeName == "" {
+		return "", fmt.Errorf("%s environment variable is not set", nodeNameEnv)
+	}
+	return nodeName, nil
+}
+
+// NewLocalPodInformerFactory returns an informer factory that only sees the
+// pods scheduled on nodeName. Cluster scoped resources must use a separate
+// factory because the field selector applies to every informer it creates.
+func NewLocalPodInformerFactory(clientset *kubernetes.Clientset, nodeName string) informers.SharedInformerFactory {
+	return informers.NewSharedInformerFactoryWithOptions(clientset, 0,
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("spec.nodeName", nodeName).String()
+		}))
+}
+
+const podIPIndex = "podIP"
+
+// PodResolver maps the addresses of the pods on this node back to the pods.
+type PodResolver struct {
+	indexer cache.Indexer
+	synced  cache.InformerSynced
+}
+
+// NewPodResolver indexes the pods of localPods by address. It must be called
+// before the factory is started.
+func NewPodResolver(localPods informers.SharedInformerFactory) (*PodResolver, error) {
+	informer := localPods.Core().V1().Pods().Informer()
+	err := informer.AddIndexers(cache.Indexers{
+		podIPIndex: func(obj interface{}) ([]string, error) {
+			pod, ok := obj.(*corev1.Pod)
+			if !ok || pod.Spec.HostNetwork {
+				return nil, nil
+			}
+			var ips []string
+			for _, podIP := range pod.Status.PodIPs {
+				ips = append(ips, podIP.IP)
+			}
+			return ips, nil
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to index pods by IP: %v", err)
+	}
+	return &PodResolver{indexer: informer.GetIndexer(), synced: informer.HasSynced}, nil
+}
+
+// WaitForSync blocks until the pod cache is populated or stopCh is closed.
+func (r *PodResolver) WaitForSync(stopCh <-chan struct{}) bool {
+	return cache.WaitForCacheSync(stopCh, r.synced)
+}
+
+// PodByIP returns the running pod using ip, or nil if none is known.
+func (r *PodResolver) PodByIP(ip net.IP) *corev1.Pod {
+	objs, err := r.indexer.ByIndex(podIPIndex, ip.String())
+	if err != nil {
+		return nil
+	}
+	for _, obj := range objs {
+		pod := obj.(*corev1.Pod)
+		if pod.Status.Phase != corev1.PodSucceeded && pod.Status.Phase != corev1.PodFailed {
+			return pod
 		}
-		return ip, mask, err
 	}
+	return nil
 }
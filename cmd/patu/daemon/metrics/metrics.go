@@ -0,0 +1,73 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+const namespace = "patu"
+
+var (
+	// PolicyAuditDenials counts the connections that would have been denied
+	// by a network policy in audit mode.
+	PolicyAuditDenials = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "policy",
+		Name:      "audit_denials_total",
+		Help:      "Connections that would have been denied by a network policy in audit mode.",
+	}, []string{"policy", "direction", "src_namespace", "src_pod", "dst_namespace", "dst_pod"})
+
+	// PolicyOverflows is the number of network policies whose rules don't
+	// fit in the policy maps.
+	PolicyOverflows = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "policy",
+		Name:      "overflows",
+		Help:      "Network policies whose rules don't fit in the policy maps and allow no connection.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(PolicyAuditDenials, PolicyOverflows)
+}
+
+// Serve exposes the registered metrics on address until stopCh is closed.
+func Serve(address string, stopCh <-chan struct{}) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	server := &http.Server{Addr: address, Handler: mux}
+
+	go func() {
+		<-stopCh
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(ctx)
+	}()
+
+	log.Infof("Serving metrics on %s", address)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Errorf("Metrics server failed: %v", err)
+	}
+}
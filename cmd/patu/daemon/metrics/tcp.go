@@ -0,0 +1,114 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package metrics
+
+import (
+	"math"
+	"net"
+
+	"github.com/redhat-et/patu/cmd/patu/daemon/kubehelper"
+	"github.com/redhat-et/patu/internal/bpf"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+var tcpLabels = []string{"src_namespace", "src_pod", "dst_namespace", "dst_pod"}
+
+// tcpCollector exposes the TCP telemetry aggregated by patu_sockops. The map
+// is read on every scrape, so nothing is kept in the daemon between scrapes.
+type tcpCollector struct {
+	resolver *kubehelper.PodResolver
+	rtt      *prometheus.Desc
+	retrans  *prometheus.Desc
+}
+
+// tcpSeries accumulates the entries that resolve to the same label values,
+// e.g. all the addresses outside of the node.
+type tcpSeries struct {
+	labels  []string
+	buckets map[float64]uint64
+	sum     float64
+	count   uint64
+	retrans uint64
+}
+
+// RegisterTCPCollector exposes the pod to pod TCP telemetry, with addresses
+// resolved to pods through resolver.
+func RegisterTCPCollector(resolver *kubehelper.PodResolver) error {
+	return prometheus.Register(&tcpCollector{
+		resolver: resolver,
+		rtt: prometheus.NewDesc(prometheus.BuildFQName(namespace, "tcp", "srtt_seconds"),
+			"Smoothed round trip time samples of the TCP connections between two pods.", tcpLabels, nil),
+		retrans: prometheus.NewDesc(prometheus.BuildFQName(namespace, "tcp", "retransmits_total"),
+			"Retransmitted segments of the TCP connections between two pods.", tcpLabels, nil),
+	})
+}
+
+func (c *tcpCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.rtt
+	ch <- c.retrans
+}
+
+func (c *tcpCollector) Collect(ch chan<- prometheus.Metric) {
+	entries, err := bpf.TCPStatsEntries()
+	if err != nil {
+		log.Warnf("Failed to read TCP telemetry: %v", err)
+		return
+	}
+
+	for _, s := range c.aggregate(entries) {
+		ch <- prometheus.MustNewConstHistogram(c.rtt, s.count, s.sum, s.buckets, s.labels...)
+		ch <- prometheus.MustNewConstMetric(c.retrans, prometheus.CounterValue, float64(s.retrans), s.labels...)
+	}
+}
+
+// aggregate sums the entries of the datapath into one series per pair of
+// pods, keyed by their label values.
+func (c *tcpCollector) aggregate(entries map[bpf.TCPStatsKey]bpf.TCPStats) map[string]*tcpSeries {
+	series := make(map[string]*tcpSeries)
+	for key, stats := range entries {
+		labels := append(c.podLabels(key.LocalIP), c.podLabels(key.RemoteIP)...)
+		id := labels[0] + "/" + labels[1] + "/" + labels[2] + "/" + labels[3]
+		s, ok := series[id]
+		if !ok {
+			s = &tcpSeries{labels: labels, buckets: make(map[float64]uint64)}
+			series[id] = s
+		}
+
+		// Prometheus buckets are cumulative, the datapath's are not. The
+		// last datapath bucket has no upper bound and only shows in count.
+		var cumulative uint64
+		for i := 0; i < bpf.TCPRTTBuckets-1; i++ {
+			cumulative += stats.RTTBuckets[i]
+			s.buckets[math.Ldexp(1, i)/1e6] += cumulative
+		}
+		s.sum += float64(stats.RTTSumUs) / 1e6
+		s.count += stats.RTTCount
+		s.retrans += stats.Retrans
+	}
+	return series
+}
+
+// podLabels returns the namespace and name of the pod using ip. Addresses
+// that don't belong to a pod of this node get empty labels.
+func (c *tcpCollector) podLabels(ip [4]byte) []string {
+	if pod := c.resolver.PodByIP(net.IP(ip[:])); pod != nil {
+		return []string{pod.Namespace, pod.Name}
+	}
+	return []string{"", ""}
+}
@@ -0,0 +1,145 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package metrics
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/redhat-et/patu/cmd/patu/daemon/kubehelper"
+	"github.com/redhat-et/patu/internal/bpf"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func testResolver(t *testing.T, pods ...*corev1.Pod) *kubehelper.PodResolver {
+	factory := informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0)
+	resolver, err := kubehelper.NewPodResolver(factory)
+	if err != nil {
+		t.Fatalf("NewPodResolver() error = %v", err)
+	}
+	indexer := factory.Core().V1().Pods().Informer().GetIndexer()
+	for _, pod := range pods {
+		if err := indexer.Add(pod); err != nil {
+			t.Fatalf("Failed to add pod %s: %v", pod.Name, err)
+		}
+	}
+	return resolver
+}
+
+func testPod(name, ip string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+		Status:     corev1.PodStatus{Phase: corev1.PodRunning, PodIPs: []corev1.PodIP{{IP: ip}}},
+	}
+}
+
+// rttBuckets returns the datapath buckets with count samples in each of the
+// given buckets.
+func rttBuckets(count uint64, buckets ...int) [bpf.TCPRTTBuckets]uint64 {
+	var rtt [bpf.TCPRTTBuckets]uint64
+	for _, i := range buckets {
+		rtt[i] += count
+	}
+	return rtt
+}
+
+// cumulativeBuckets returns the Prometheus buckets of samples below
+// 2^bucket microseconds.
+func cumulativeBuckets(samples map[int]uint64) map[float64]uint64 {
+	buckets := make(map[float64]uint64)
+	for i := 0; i < bpf.TCPRTTBuckets-1; i++ {
+		var cumulative uint64
+		for bucket, count := range samples {
+			if bucket <= i {
+				cumulative += count
+			}
+		}
+		buckets[math.Ldexp(1, i)/1e6] = cumulative
+	}
+	return buckets
+}
+
+func TestTCPAggregate(t *testing.T) {
+	c := &tcpCollector{resolver: testResolver(t, testPod("client", "10.200.0.5"), testPod("server", "10.200.0.6"))}
+	client := [4]byte{10, 200, 0, 5}
+	entries := map[bpf.TCPStatsKey]bpf.TCPStats{
+		{LocalIP: client, RemoteIP: [4]byte{10, 200, 0, 6}}: {
+			RTTBuckets: rttBuckets(1, 0, 10, 10, bpf.TCPRTTBuckets-1),
+			RTTSumUs:   3000, RTTCount: 4, Retrans: 2,
+		},
+		{LocalIP: client, RemoteIP: [4]byte{192, 0, 2, 1}}: {
+			RTTBuckets: rttBuckets(1, 10),
+			RTTSumUs:   1000, RTTCount: 1, Retrans: 1,
+		},
+		{LocalIP: client, RemoteIP: [4]byte{192, 0, 2, 2}}: {
+			RTTBuckets: rttBuckets(1, 12),
+			RTTSumUs:   4000, RTTCount: 1,
+		},
+	}
+	tests := []struct {
+		name string
+		id   string
+		want tcpSeries
+	}{
+		{
+			name: "between pods",
+			id:   "default/client/default/server",
+			want: tcpSeries{
+				labels:  []string{"default", "client", "default", "server"},
+				buckets: cumulativeBuckets(map[int]uint64{0: 1, 10: 2}),
+				sum:     0.003, count: 4, retrans: 2,
+			},
+		},
+		{
+			name: "addresses outside the node are summed",
+			id:   "default/client//",
+			want: tcpSeries{
+				labels:  []string{"default", "client", "", ""},
+				buckets: cumulativeBuckets(map[int]uint64{10: 1, 12: 1}),
+				sum:     0.005, count: 2, retrans: 1,
+			},
+		},
+	}
+
+	series := c.aggregate(entries)
+	if len(series) != len(tests) {
+		t.Errorf("aggregate() returned %d series, want %d", len(series), len(tests))
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := series[tt.id]
+			if !ok {
+				t.Fatalf("aggregate() has no series %q", tt.id)
+			}
+			if !reflect.DeepEqual(got.labels, tt.want.labels) {
+				t.Errorf("labels = %v, want %v", got.labels, tt.want.labels)
+			}
+			if !reflect.DeepEqual(got.buckets, tt.want.buckets) {
+				t.Errorf("buckets = %v, want %v", got.buckets, tt.want.buckets)
+			}
+			if math.Abs(got.sum-tt.want.sum) > 1e-9 || got.count != tt.want.count || got.retrans != tt.want.retrans {
+				t.Errorf("sum, count, retrans = %v, %d, %d, want %v, %d, %d",
+					got.sum, got.count, got.retrans, tt.want.sum, tt.want.count, tt.want.retrans)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package notifier
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/redhat-et/patu/cmd/patu/daemon/kubehelper"
+	"github.com/redhat-et/patu/internal/notify"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Server receives the pod attach and detach notifications of the CNI plugin
+// and records the pod addresses they carry.
+type Server struct {
+	notify.UnimplementedPodNotifierServer
+	addresses *kubehelper.PodAddresses
+	server    *grpc.Server
+}
+
+// Serve starts serving notifications on the Unix socket at path. The socket
+// is only accessible to root, like the CNI plugin.
+func Serve(path string, addresses *kubehelper.PodAddresses) (*Server, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("Failed to create notify socket directory: %v", err)
+	}
+	// A socket left behind by a previous run would make Listen fail.
+	_ = os.Remove(path)
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to listen on notify socket %s: %v", path, err)
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("Failed to restrict access to notify socket %s: %v", path, err)
+	}
+
+	s := &Server{addresses: addresses, server: grpc.NewServer()}
+	notify.RegisterPodNotifierServer(s.server, s)
+	go func() {
+		if err := s.server.Serve(listener); err != nil {
+			log.Errorf("Notify socket stopped serving: %v", err)
+		}
+	}()
+	log.Infof("Serving CNI notifications on %s", path)
+	return s, nil
+}
+
+func (s *Server) PodAttached(ctx context.Context, a *notify.PodAttachment) (*notify.NotifyResponse, error) {
+	log.Debugf("Pod %s/%s attached: container %s, %s on %s, ips %v",
+		a.PodNamespace, a.PodName, a.ContainerId, a.IfName, a.HostVeth, a.Ips)
+	if pod, ok := podName(a); ok {
+		s.addresses.Set(pod, a.ContainerId, a.Ips)
+	}
+	return &notify.NotifyResponse{}, nil
+}
+
+func (s *Server) PodDetached(ctx context.Context, a *notify.PodAttachment) (*notify.NotifyResponse, error) {
+	log.Debugf("Pod %s/%s detached: container %s, %s on %s",
+		a.PodNamespace, a.PodName, a.ContainerId, a.IfName, a.HostVeth)
+	if pod, ok := podName(a); ok {
+		s.addresses.Delete(pod, a.ContainerId)
+	}
+	return &notify.NotifyResponse{}, nil
+}
+
+// Stop closes the socket and waits for the pending notifications.
+func (s *Server) Stop() {
+	s.server.GracefulStop()
+}
+
+// podName returns the pod of the attachment. Runtimes that are not driven by
+// the kubelet don't pass it, such attachments can't be matched to a pod.
+func podName(a *notify.PodAttachment) (types.NamespacedName, bool) {
+	if a.PodNamespace == "" || a.PodName == "" {
+		return types.NamespacedName{}, false
+	}
+	return types.NamespacedName{Namespace: a.PodNamespace, Name: a.PodName}, true
+}
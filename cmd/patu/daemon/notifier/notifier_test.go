@@ -0,0 +1,87 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package notifier
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/redhat-et/patu/cmd/patu/daemon/kubehelper"
+	"github.com/redhat-et/patu/internal/notify"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestNotifications(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "patu", "patud.sock")
+	addresses := kubehelper.NewPodAddresses()
+	changes := 0
+	addresses.OnChange(func() { changes++ })
+	s, err := Serve(path, addresses)
+	if err != nil {
+		t.Fatalf("Serve() error = %v", err)
+	}
+	defer s.Stop()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Failed to stat the notify socket: %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("notify socket mode = %o, want 600", perm)
+	}
+
+	web := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"}}
+	attachment := func(containerID, namespace, name string) *notify.PodAttachment {
+		return &notify.PodAttachment{
+			ContainerId: containerID, IfName: "eth0", HostVeth: "veth0123456789a",
+			PodNamespace: namespace, PodName: name, Ips: []string{"10.200.0.5", "fd00::5"},
+		}
+	}
+	tests := []struct {
+		name        string
+		attached    bool
+		attachment  *notify.PodAttachment
+		wantIP      string
+		wantChanges int
+	}{
+		{name: "attach", attached: true, attachment: attachment("c1", "default", "web"), wantIP: "10.200.0.5", wantChanges: 1},
+		{name: "attach outside of a pod", attached: true, attachment: attachment("c2", "", ""), wantIP: "10.200.0.5", wantChanges: 1},
+		{name: "detach a previous sandbox", attachment: attachment("c0", "default", "web"), wantIP: "10.200.0.5", wantChanges: 1},
+		{name: "detach", attachment: attachment("c1", "default", "web"), wantChanges: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			notifyFunc := notify.Detached
+			if tt.attached {
+				notifyFunc = notify.Attached
+			}
+			if err := notifyFunc(path, time.Second, tt.attachment); err != nil {
+				t.Fatalf("notify error = %v", err)
+			}
+			if got := addresses.PodIP(web); got != tt.wantIP {
+				t.Errorf("PodIP() = %q, want %q", got, tt.wantIP)
+			}
+			if changes != tt.wantChanges {
+				t.Errorf("%d changes, want %d", changes, tt.wantChanges)
+			}
+		})
+	}
+}
@@ -17,6 +17,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"os"
@@ -25,12 +26,25 @@ import (
 	"strings"
 	"syscall"
 
+	"github.com/redhat-et/patu/cmd/patu/daemon/flows"
+	"github.com/redhat-et/patu/cmd/patu/daemon/hostports"
+	"github.com/redhat-et/patu/cmd/patu/daemon/ipam"
+	"github.com/redhat-et/patu/cmd/patu/daemon/isolation"
 	"github.com/redhat-et/patu/cmd/patu/daemon/kubehelper"
+	"github.com/redhat-et/patu/cmd/patu/daemon/metrics"
+	"github.com/redhat-et/patu/cmd/patu/daemon/notifier"
+	"github.com/redhat-et/patu/cmd/patu/daemon/policy"
+	"github.com/redhat-et/patu/cmd/patu/daemon/snat"
+	"github.com/redhat-et/patu/cmd/patu/daemon/tuning"
+	"github.com/redhat-et/patu/cmd/patu/daemon/xdp"
 	"github.com/redhat-et/patu/configs"
 	"github.com/redhat-et/patu/internal/bpf"
+	patuipam "github.com/redhat-et/patu/internal/ipam"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/vishvananda/netlink"
+	"k8s.io/client-go/informers"
 )
 
 
@@ -62,10 +76,30 @@ var rootCmd = &cobra.Command{
 		}
 
 		var subnetIp net.IP
-		if client := kubehelper.GetKubeClient(); client == nil {
+		var podNet *net.IPNet
+		client := kubehelper.GetKubeClient()
+		if client == nil {
 			return fmt.Errorf("Failed to get kube client.")
+		}
+		nodeName, err := kubehelper.GetNodeName()
+		if err != nil {
+			return err
+		}
+		ipamType, err := kubehelper.GetIPAMTypeFromConfig(client)
+		if err != nil {
+			return err
+		}
+		if ipamType == patuipam.Type {
+			podCIDR, err := ipam.PublishPodCIDRs(client, nodeName, configs.CNIDataDir)
+			if err != nil {
+				return err
+			}
+			if podCIDR != nil {
+				subnetIp = podCIDR.IP
+				podNet = podCIDR
+			}
 		} else {
-			subnetIp, _, _= kubehelper.GetSubnetFromConfig(client)
+			subnetIp, podNet, _= kubehelper.GetSubnetFromConfig(client)
 		}
 		
 		if subnetIp != nil {
@@ -80,9 +114,93 @@ var rootCmd = &cobra.Command{
 			return fmt.Errorf(err.Error());
 		}
 
+		masqBackend, err := kubehelper.GetIPMasqBackendFromConfig(client)
+		if err != nil {
+			return err
+		}
+		if masqBackend == snat.Backend {
+			clusterNet, err := snat.ClusterNet(configs.ClusterCIDR, podNet)
+			if err != nil {
+				return err
+			}
+			if err = snat.Setup(podNet, clusterNet); err != nil {
+				return err
+			}
+		}
+		if configs.XDPMode != "" {
+			detachXDP, err := xdp.Setup(configs.XDPUplink, configs.XDPMode)
+			if err != nil {
+				return err
+			}
+			defer detachXDP()
+		}
+
+		stopCh := make(chan struct{})
+		localPods := kubehelper.NewLocalPodInformerFactory(client, nodeName)
+		cluster := informers.NewSharedInformerFactory(client, 0)
+		resolver, err := kubehelper.NewPodResolver(localPods)
+		if err != nil {
+			return err
+		}
+		var addresses *kubehelper.PodAddresses
+		if configs.NotifySocket != "" {
+			addresses = kubehelper.NewPodAddresses()
+		}
+
+		if configs.NetworkPolicy {
+			policyController := policy.NewController(cluster, nodeName, addresses, configs.PolicyAudit)
+			go policyController.Run(stopCh)
+			go policyController.RunAudit(stopCh)
+		}
+		if ipamType == patuipam.Type {
+			go ipam.NewReconciler(localPods, configs.CNIDataDir).Run(stopCh)
+		}
+		go hostports.Run(stopCh)
+		if configs.TCPTuning {
+			go tuning.NewController(localPods, addresses).Run(stopCh)
+		}
+		bridge, err := kubehelper.GetBridgeFromConfig(client)
+		if err != nil {
+			return err
+		}
+		if bridge != "" {
+			if err = setupBridge(bridge); err != nil {
+				return err
+			}
+		}
+		bridgePerNamespace, err := kubehelper.GetBridgePerNamespaceFromConfig(client)
+		if err != nil {
+			return err
+		}
+		if bridgePerNamespace {
+			go isolation.NewController(localPods, addresses).Run(stopCh)
+		}
+		if err = startFlowExporter(resolver, stopCh); err != nil {
+			return err
+		}
+		if configs.TCPTelemetry {
+			if err = startTCPTelemetry(resolver); err != nil {
+				return err
+			}
+		}
+		// The controllers above subscribed to the addresses already
+		if addresses != nil {
+			server, err := notifier.Serve(configs.NotifySocket, addresses)
+			if err != nil {
+				return err
+			}
+			defer server.Stop()
+		}
+
+		// Informers requested by the controllers above are started here
+		localPods.Start(stopCh)
+		cluster.Start(stopCh)
+		go metrics.Serve(configs.MetricsAddress, stopCh)
+
 		ch := make(chan os.Signal, 1)
 		signal.Notify(ch, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGINT)
 		<-ch
+		close(stopCh)
 	
 		if err = bpf.UnloadBpfProg(); err != nil {
 			return fmt.Errorf(err.Error());
@@ -95,6 +213,61 @@ var rootCmd = &cobra.Command{
 	},
 }
 
+// startFlowExporter enables flow accounting in the datapath if any flow record
+// output is configured.
+func startFlowExporter(resolver *kubehelper.PodResolver, stopCh <-chan struct{}) error {
+	var sinks []flows.Sink
+	if configs.FlowLog != "" {
+		sink, err := flows.NewFileSink(configs.FlowLog, configs.FlowLogMaxSize, configs.FlowLogMaxBackups)
+		if err != nil {
+			return err
+		}
+		sinks = append(sinks, sink)
+	}
+	if configs.FlowSocket != "" {
+		sink, err := flows.NewSocketSink(configs.FlowSocket)
+		if err != nil {
+			return err
+		}
+		sinks = append(sinks, sink)
+	}
+	if len(sinks) == 0 {
+		return nil
+	}
+
+	if err := bpf.EnableFlowRecords(); err != nil {
+		return err
+	}
+	go flows.NewExporter(resolver, sinks...).Run(stopCh)
+	return nil
+}
+
+// startTCPTelemetry enables the RTT and retransmission callbacks for pod
+// sockets and exposes their statistics as metrics.
+func startTCPTelemetry(resolver *kubehelper.PodResolver) error {
+	if err := metrics.RegisterTCPCollector(resolver); err != nil {
+		return err
+	}
+	return bpf.EnableTCPTelemetry()
+}
+
+// setupBridge creates the bridge the CNI plugin attaches the pods to, which its
+// STATUS requires before the runtime starts the first pod. The plugin
+// completes the configuration of the bridge when it attaches a pod.
+func setupBridge(name string) error {
+	bridge := &netlink.Bridge{
+		LinkAttrs: netlink.LinkAttrs{
+			Name: name,
+			// Leave the default txqueuelen to the kernel, like the plugin
+			TxQLen: -1,
+		},
+	}
+	if err := netlink.LinkAdd(bridge); err != nil && !errors.Is(err, syscall.EEXIST) {
+		return fmt.Errorf("Failed to add bridge %s: %v", name, err)
+	}
+	return nil
+}
+
 func execute() {
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Println(err)
@@ -123,6 +296,20 @@ func init() {
 	//Flags supported by patu app.
 	rootCmd.PersistentFlags().BoolVarP(&configs.Debug, "debug", "d", false, "Enable/Disable debug mode")
 	rootCmd.PersistentFlags().BoolVarP(&configs.Compile, "compile", "c", false, "Enable/Disable eBPF program compilation")
+	rootCmd.PersistentFlags().BoolVar(&configs.NetworkPolicy, "network-policy", false, "Enable/Disable NetworkPolicy enforcement, which watches the pods, namespaces and network policies of the whole cluster")
+	rootCmd.PersistentFlags().BoolVar(&configs.PolicyAudit, "policy-audit", false, "Report network policy denials instead of enforcing them in all namespaces")
+	rootCmd.PersistentFlags().StringVar(&configs.MetricsAddress, "metrics-address", ":9199", "Address to serve Prometheus metrics on")
+	rootCmd.PersistentFlags().StringVar(&configs.FlowLog, "flow-log", "", "File to write per connection flow records to as JSON lines")
+	rootCmd.PersistentFlags().IntVar(&configs.FlowLogMaxSize, "flow-log-max-size", 10, "Size in megabytes at which the flow log is rotated")
+	rootCmd.PersistentFlags().IntVar(&configs.FlowLogMaxBackups, "flow-log-max-backups", 3, "Number of rotated flow logs to keep")
+	rootCmd.PersistentFlags().StringVar(&configs.FlowSocket, "flow-socket", "", "Unix socket to stream per connection flow records on")
+	rootCmd.PersistentFlags().BoolVar(&configs.TCPTelemetry, "tcp-telemetry", false, "Export RTT and retransmission metrics of pod TCP connections")
+	rootCmd.PersistentFlags().BoolVar(&configs.TCPTuning, "tcp-tuning", true, "Enable/Disable per pod TCP tuning from pod annotations")
+	rootCmd.PersistentFlags().StringVar(&configs.ClusterCIDR, "cluster-cidr", "", "Pod network of the cluster, not masqueraded by the eBPF SNAT. Defaults to the /16 of the pod subnet")
+	rootCmd.PersistentFlags().StringVar(&configs.XDPMode, "xdp", "", "Steer traffic to local pods with XDP on the uplink, in native or generic mode. Disabled if empty")
+	rootCmd.PersistentFlags().StringVar(&configs.XDPUplink, "xdp-uplink", "", "Interface to attach XDP to. Defaults to the interface of the IPv4 default route")
+	rootCmd.PersistentFlags().StringVar(&configs.NotifySocket, "notify-socket", "/var/run/patu/patud.sock", "Unix socket the CNI plugin notifies pod attachments on, must match the notifySocket of the CNI config. Disabled if empty")
+	rootCmd.PersistentFlags().StringVar(&configs.CNIDataDir, "cni-data-dir", "/var/lib/cni/patu", "Directory the CNI plugin keeps its state in, must match the dataDir of the CNI config")
 }
 
 func main() {
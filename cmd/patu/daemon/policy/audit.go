@@ -0,0 +1,140 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/cilium/ebpf/ringbuf"
+	"github.com/redhat-et/patu/cmd/patu/daemon/metrics"
+	"github.com/redhat-et/patu/internal/bpf"
+
+	log "github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Would-be denials are aggregated and logged once per interval, so a client
+// retrying in a loop doesn't flood the daemon log.
+const auditLogInterval = 30 * time.Second
+
+// auditKey identifies a would-be denial in the aggregated audit log. The
+// client port is left out, it changes with every connection.
+type auditKey struct {
+	policy    string
+	direction string
+	src       string
+	dst       string
+	dstPort   uint16
+}
+
+// RunAudit reads the would-be denials of pods in audit mode from the datapath
+// until stopCh is closed. Every event is counted in the policy audit metric
+// and logged in aggregated form.
+func (c *Controller) RunAudit(stopCh <-chan struct{}) {
+	reader, err := bpf.NewPolicyAuditReader()
+	if err != nil {
+		log.Errorf("Policy audit disabled: %v", err)
+		return
+	}
+
+	events := make(chan *bpf.PolicyAuditEvent)
+	go func() {
+		defer close(events)
+		for {
+			event, err := reader.Read()
+			if errors.Is(err, ringbuf.ErrClosed) {
+				return
+			}
+			if err != nil {
+				log.Warnf("Failed to read policy audit event: %v", err)
+				continue
+			}
+			events <- event
+		}
+	}()
+
+	ticker := time.NewTicker(auditLogInterval)
+	defer ticker.Stop()
+	pending := make(map[auditKey]int)
+	for {
+		select {
+		case <-stopCh:
+			reader.Close()
+			for range events {
+			}
+			logAudit(pending)
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			pending[c.recordAudit(event)]++
+		case <-ticker.C:
+			logAudit(pending)
+			pending = make(map[auditKey]int)
+		}
+	}
+}
+
+func (c *Controller) recordAudit(event *bpf.PolicyAuditEvent) auditKey {
+	c.namesLock.RLock()
+	src, srcKnown := c.podNames[event.SrcIP]
+	dst, dstKnown := c.podNames[event.DstIP]
+	policy := c.policyNames[event.PolicyID]
+	c.namesLock.RUnlock()
+
+	if policy == "" {
+		policy = fmt.Sprintf("%d", event.PolicyID)
+	}
+	direction := "ingress"
+	if event.Direction == bpf.PolicyEgress {
+		direction = "egress"
+	}
+
+	metrics.PolicyAuditDenials.WithLabelValues(policy, direction,
+		src.Namespace, src.Name, dst.Namespace, dst.Name).Inc()
+
+	return auditKey{
+		policy:    policy,
+		direction: direction,
+		src:       endpointName(event.SrcIP, src, srcKnown),
+		dst:       endpointName(event.DstIP, dst, dstKnown),
+		dstPort:   bpf.HostPort(event.DstPort),
+	}
+}
+
+func endpointName(ip [4]byte, pod types.NamespacedName, known bool) string {
+	if known {
+		return fmt.Sprintf("%s(%s)", pod, net.IP(ip[:]))
+	}
+	return net.IP(ip[:]).String()
+}
+
+func logAudit(pending map[auditKey]int) {
+	for key, count := range pending {
+		log.WithFields(log.Fields{
+			"policy":    key.policy,
+			"direction": key.direction,
+			"src":       key.src,
+			"dst":       fmt.Sprintf("%s:%d", key.dst, key.dstPort),
+			"count":     count,
+		}).Warn("Network policy would deny connection")
+	}
+}
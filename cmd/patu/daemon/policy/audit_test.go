@@ -0,0 +1,167 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package policy
+
+import (
+	"testing"
+
+	"github.com/redhat-et/patu/internal/bpf"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func testNamespaces(namespaces ...*corev1.Namespace) corelisters.NamespaceLister {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, namespace := range namespaces {
+		indexer.Add(namespace)
+	}
+	return corelisters.NewNamespaceLister(indexer)
+}
+
+func auditNamespace(name, audit string) *corev1.Namespace {
+	namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}}
+	if audit != "" {
+		namespace.Annotations = map[string]string{AuditAnnotation: audit}
+	}
+	return namespace
+}
+
+func TestAuditMode(t *testing.T) {
+	namespaces := testNamespaces(
+		auditNamespace("audited", "true"),
+		auditNamespace("enforced", "false"),
+		auditNamespace("default", ""),
+	)
+	tests := []struct {
+		name      string
+		audit     bool
+		namespace string
+		want      bool
+	}{
+		{name: "annotated namespace", namespace: "audited", want: true},
+		{name: "annotation set to false", namespace: "enforced"},
+		{name: "namespace without annotation", namespace: "default"},
+		{name: "unknown namespace", namespace: "missing"},
+		{name: "all namespaces", audit: true, namespace: "default", want: true},
+		{name: "all namespaces overrides the annotation", audit: true, namespace: "enforced", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Controller{namespaceLister: namespaces, audit: tt.audit}
+			if got := c.auditMode(tt.namespace); got != tt.want {
+				t.Errorf("auditMode(%q) = %v, want %v", tt.namespace, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompilePolicyAudit(t *testing.T) {
+	c := &Controller{
+		nodeName:        "node1",
+		namespaceLister: testNamespaces(auditNamespace("audited", "true"), auditNamespace("default", "")),
+		policyIDs:       map[string]uint32{"audited/deny": 1, "default/deny": 2},
+	}
+	var endpoints []podIdentity
+	for i, namespace := range []string{"audited", "default"} {
+		endpoint := testEndpoint(namespace, "web", "10.0.0.2", uint32(256+i), nil)
+		endpoint.pod.Spec.NodeName = "node1"
+		endpoints = append(endpoints, endpoint)
+	}
+
+	state := bpf.NewPolicyState()
+	for _, namespace := range []string{"audited", "default"} {
+		policy := &networkingv1.NetworkPolicy{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "deny"},
+			Spec:       networkingv1.NetworkPolicySpec{PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress}},
+		}
+		if !c.compilePolicy(policy, endpoints, state) {
+			t.Fatalf("compilePolicy(%s) overflowed", policyKey(policy))
+		}
+	}
+
+	want := map[uint32]bpf.PolicyIsolation{
+		256: {IngressPolicyID: 1, Audit: 1},
+		257: {IngressPolicyID: 2},
+	}
+	for identity, isolation := range want {
+		if got := state.Isolation[identity]; got != isolation {
+			t.Errorf("isolation of identity %d = %+v, want %+v", identity, got, isolation)
+		}
+	}
+}
+
+func TestRecordAudit(t *testing.T) {
+	c := &Controller{
+		podNames: map[[4]byte]types.NamespacedName{
+			{10, 0, 0, 2}: {Namespace: "default", Name: "client"},
+			{10, 0, 0, 3}: {Namespace: "default", Name: "server"},
+		},
+		policyNames: map[uint32]string{1: "default/deny"},
+	}
+	tests := []struct {
+		name  string
+		event bpf.PolicyAuditEvent
+		want  auditKey
+	}{
+		{
+			name: "ingress between known pods",
+			event: bpf.PolicyAuditEvent{
+				SrcIP: [4]byte{10, 0, 0, 2}, DstIP: [4]byte{10, 0, 0, 3},
+				SrcPort: bpf.PolicyPort(41734), DstPort: bpf.PolicyPort(8080),
+				PolicyID: 1, Direction: bpf.PolicyIngress,
+			},
+			want: auditKey{
+				policy: "default/deny", direction: "ingress",
+				src: "default/client(10.0.0.2)", dst: "default/server(10.0.0.3)", dstPort: 8080,
+			},
+		},
+		{
+			name: "egress to an address outside the cluster",
+			event: bpf.PolicyAuditEvent{
+				SrcIP: [4]byte{10, 0, 0, 2}, DstIP: [4]byte{192, 0, 2, 1},
+				DstPort: bpf.PolicyPort(443), PolicyID: 1, Direction: bpf.PolicyEgress,
+			},
+			want: auditKey{
+				policy: "default/deny", direction: "egress",
+				src: "default/client(10.0.0.2)", dst: "192.0.2.1", dstPort: 443,
+			},
+		},
+		{
+			name: "policy deleted since the event",
+			event: bpf.PolicyAuditEvent{
+				SrcIP: [4]byte{10, 0, 0, 2}, DstIP: [4]byte{10, 0, 0, 3},
+				DstPort: bpf.PolicyPort(80), PolicyID: 7, Direction: bpf.PolicyIngress,
+			},
+			want: auditKey{
+				policy: "7", direction: "ingress",
+				src: "default/client(10.0.0.2)", dst: "default/server(10.0.0.3)", dstPort: 80,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := c.recordAudit(&tt.event); got != tt.want {
+				t.Errorf("recordAudit() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,518 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package policy
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/redhat-et/patu/cmd/patu/daemon/kubehelper"
+	"github.com/redhat-et/patu/cmd/patu/daemon/metrics"
+	"github.com/redhat-et/patu/internal/bpf"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/informers"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	networkinglisters "k8s.io/client-go/listers/networking/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// Namespaces annotated with this key set to "true" are in policy audit
+	// mode, their pods' would-be denials are reported instead of enforced.
+	AuditAnnotation = "patu.io/policy-audit"
+
+	retryInterval = 5 * time.Second
+)
+
+// Controller compiles the NetworkPolicy objects that select pods on this node
+// into the datapath policy maps. The connect4 and sockops programs consult
+// these maps before a connection is accepted for socket redirection. Peers are
+// resolved against all pods of the cluster, so that rules selecting pods on
+// other nodes match their addresses.
+type Controller struct {
+	nodeName        string
+	podLister       corelisters.PodLister
+	namespaceLister corelisters.NamespaceLister
+	policyLister    networkinglisters.NetworkPolicyLister
+	synced          []cache.InformerSynced
+	addresses       *kubehelper.PodAddresses
+	dirty           chan struct{}
+	audit           bool
+
+	identities   map[types.UID]uint32
+	nextIdentity uint32
+	policyIDs    map[string]uint32
+	nextPolicyID uint32
+
+	// Names of the pods and policies known to the datapath, used to report
+	// audit events. They are replaced on every sync.
+	namesLock   sync.RWMutex
+	podNames    map[[4]byte]types.NamespacedName
+	policyNames map[uint32]string
+}
+
+// NewController registers the pod, namespace and network policy informers the
+// controller needs on cluster, which must see the resources of the whole
+// cluster. The pods of nodeName are the ones policies are enforced for. Pods
+// are also synced as soon as addresses learns about them, addresses may be
+// nil. If audit is set, all namespaces are in policy audit mode.
+func NewController(cluster informers.SharedInformerFactory, nodeName string, addresses *kubehelper.PodAddresses, audit bool) *Controller {
+	podInformer := cluster.Core().V1().Pods()
+	namespaceInformer := cluster.Core().V1().Namespaces()
+	policyInformer := cluster.Networking().V1().NetworkPolicies()
+
+	c := &Controller{
+		nodeName:        nodeName,
+		podLister:       podInformer.Lister(),
+		namespaceLister: namespaceInformer.Lister(),
+		policyLister:    policyInformer.Lister(),
+		synced: []cache.InformerSynced{
+			podInformer.Informer().HasSynced,
+			namespaceInformer.Informer().HasSynced,
+			policyInformer.Informer().HasSynced,
+		},
+		addresses:    addresses,
+		dirty:        make(chan struct{}, 1),
+		audit:        audit,
+		identities:   make(map[types.UID]uint32),
+		nextIdentity: bpf.PodIdentityMin,
+		policyIDs:    make(map[string]uint32),
+		nextPolicyID: 1,
+	}
+
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { c.enqueue() },
+		UpdateFunc: func(interface{}, interface{}) { c.enqueue() },
+		DeleteFunc: func(interface{}) { c.enqueue() },
+	}
+	podInformer.Informer().AddEventHandler(handler)
+	namespaceInformer.Informer().AddEventHandler(handler)
+	policyInformer.Informer().AddEventHandler(handler)
+	addresses.OnChange(c.enqueue)
+	return c
+}
+
+// enqueue requests a full recompilation. Events arriving while a sync is
+// already pending are coalesced into it.
+func (c *Controller) enqueue() {
+	select {
+	case c.dirty <- struct{}{}:
+	default:
+	}
+}
+
+// Run syncs the policy maps until stopCh is closed. The informer factories
+// must have been started by the caller.
+func (c *Controller) Run(stopCh <-chan struct{}) {
+	if !cache.WaitForCacheSync(stopCh, c.synced...) {
+		log.Errorf("Timed out waiting for network policy caches to sync")
+		return
+	}
+	log.Infof("Network policy controller started")
+
+	c.enqueue()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-c.dirty:
+			if err := c.sync(); err != nil {
+				log.Errorf("Failed to sync network policies: %v", err)
+				time.AfterFunc(retryInterval, c.enqueue)
+			}
+		}
+	}
+}
+
+func (c *Controller) sync() error {
+	pods, err := c.podLister.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	policies, err := c.policyLister.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	// Policies are walked in a stable order so that the policy id reported
+	// for an isolated pod doesn't change between syncs.
+	sort.Slice(policies, func(i, j int) bool {
+		return policyKey(policies[i]) < policyKey(policies[j])
+	})
+
+	state := bpf.NewPolicyState()
+	endpoints := c.updateIdentities(pods, state)
+	c.updatePolicyIDs(policies)
+
+	overflowed := 0
+	for _, policy := range policies {
+		if !c.compilePolicy(policy, endpoints, state) {
+			overflowed++
+		}
+	}
+	metrics.PolicyOverflows.Set(float64(overflowed))
+
+	if err := bpf.SyncPolicyState(state); err != nil {
+		return err
+	}
+	c.updateNames(endpoints)
+	log.Debugf("Synced %d network policies, %d pod identities, %d rules",
+		len(policies), len(state.Identities), len(state.Rules))
+	return nil
+}
+
+// podIdentity is a pod of the cluster that takes part in policy enforcement,
+// either as a target on this node or as a peer.
+type podIdentity struct {
+	pod      *corev1.Pod
+	ip       net.IP
+	identity uint32
+}
+
+// updateIdentities assigns an identity to every pod with an address and
+// releases the identities of pods that are gone.
+func (c *Controller) updateIdentities(pods []*corev1.Pod, state *bpf.PolicyState) []podIdentity {
+	var endpoints []podIdentity
+	seen := make(map[types.UID]bool, len(pods))
+	for _, pod := range pods {
+		podIP := c.addresses.PodIP(pod)
+		if pod.Spec.HostNetwork || podIP == "" ||
+			pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		ip := net.ParseIP(podIP)
+		key, ok := bpf.IPv4Key(ip)
+		if !ok {
+			continue
+		}
+
+		identity, ok := c.identities[pod.UID]
+		if !ok {
+			identity = c.nextIdentity
+			c.nextIdentity++
+			c.identities[pod.UID] = identity
+		}
+		seen[pod.UID] = true
+		state.Identities[key] = identity
+		endpoints = append(endpoints, podIdentity{pod: pod, ip: ip, identity: identity})
+	}
+	for uid := range c.identities {
+		if !seen[uid] {
+			delete(c.identities, uid)
+		}
+	}
+	return endpoints
+}
+
+func (c *Controller) updateNames(endpoints []podIdentity) {
+	podNames := make(map[[4]byte]types.NamespacedName, len(endpoints))
+	for _, pod := range endpoints {
+		key, _ := bpf.IPv4Key(pod.ip)
+		podNames[key] = types.NamespacedName{Namespace: pod.pod.Namespace, Name: pod.pod.Name}
+	}
+	policyNames := make(map[uint32]string, len(c.policyIDs))
+	for name, id := range c.policyIDs {
+		policyNames[id] = name
+	}
+
+	c.namesLock.Lock()
+	defer c.namesLock.Unlock()
+	c.podNames = podNames
+	c.policyNames = policyNames
+}
+
+func (c *Controller) updatePolicyIDs(policies []*networkingv1.NetworkPolicy) {
+	seen := make(map[string]bool, len(policies))
+	for _, policy := range policies {
+		key := policyKey(policy)
+		if _, ok := c.policyIDs[key]; !ok {
+			c.policyIDs[key] = c.nextPolicyID
+			c.nextPolicyID++
+		}
+		seen[key] = true
+	}
+	for key := range c.policyIDs {
+		if !seen[key] {
+			delete(c.policyIDs, key)
+		}
+	}
+}
+
+// compilePolicy adds the isolation and rules of policy to state. The rules are
+// dropped if they don't fit in the policy maps along with the ones compiled
+// already, the pods the policy isolates are then denied the connections it
+// allows. It returns false in that case.
+func (c *Controller) compilePolicy(policy *networkingv1.NetworkPolicy, endpoints []podIdentity, state *bpf.PolicyState) bool {
+	policyID := c.policyIDs[policyKey(policy)]
+	selector, err := metav1.LabelSelectorAsSelector(&policy.Spec.PodSelector)
+	if err != nil {
+		log.Warnf("Skipping network policy %s: %v", policyKey(policy), err)
+		return true
+	}
+
+	rules := make(map[bpf.PolicyKey]bpf.PolicyValue)
+	ports := make(map[bpf.PolicyPortKey]bpf.PolicyValue)
+	ingress, egress := policyTypes(policy)
+	for _, target := range endpoints {
+		// Pods of other nodes are isolated by the patud of their node.
+		if target.pod.Spec.NodeName != c.nodeName {
+			continue
+		}
+		if target.pod.Namespace != policy.Namespace || !selector.Matches(labels.Set(target.pod.Labels)) {
+			continue
+		}
+
+		isolation := state.Isolation[target.identity]
+		if c.auditMode(target.pod.Namespace) {
+			isolation.Audit = 1
+		}
+		if ingress {
+			if isolation.IngressPolicyID == 0 {
+				isolation.IngressPolicyID = policyID
+			}
+			for _, rule := range policy.Spec.Ingress {
+				peers := c.resolvePeers(policy, rule.From, endpoints)
+				for _, port := range resolvePorts(rule.Ports, target.pod) {
+					for _, peer := range peers {
+						rules[bpf.NewPolicyKey(target.identity, peer.identity, bpf.PolicyIngress, port)] = bpf.PolicyValue{PolicyID: policyID}
+					}
+					if len(peers) > 0 {
+						ports[bpf.NewPolicyPortKey(target.identity, port)] = bpf.PolicyValue{PolicyID: policyID}
+					}
+				}
+			}
+		}
+		if egress {
+			if isolation.EgressPolicyID == 0 {
+				isolation.EgressPolicyID = policyID
+			}
+			for _, rule := range policy.Spec.Egress {
+				for _, peer := range c.resolvePeers(policy, rule.To, endpoints) {
+					// Named ports of an egress rule refer to the peer's
+					// container ports.
+					for _, port := range resolvePorts(rule.Ports, peer.pod) {
+						rules[bpf.NewPolicyKey(target.identity, peer.identity, bpf.PolicyEgress, port)] = bpf.PolicyValue{PolicyID: policyID}
+					}
+				}
+			}
+		}
+		state.Isolation[target.identity] = isolation
+	}
+
+	newRules, newPorts := 0, 0
+	for key := range rules {
+		if _, ok := state.Rules[key]; !ok {
+			newRules++
+		}
+	}
+	for key := range ports {
+		if _, ok := state.Ports[key]; !ok {
+			newPorts++
+		}
+	}
+	if len(state.Rules)+newRules > bpf.MaxPolicyEntries || len(state.Ports)+newPorts > bpf.MaxPolicyEntries {
+		log.Warnf("Network policy %s needs more rules than the policy maps hold and allows no connection", policyKey(policy))
+		return false
+	}
+	for key, value := range rules {
+		state.Rules[key] = value
+	}
+	for key, value := range ports {
+		state.Ports[key] = value
+	}
+	return true
+}
+
+// resolvePeers returns the identities a rule's peers map to. An empty peer
+// list matches everything. Every pod of the cluster has an identity of its
+// own, other addresses are treated as the WORLD identity.
+func (c *Controller) resolvePeers(policy *networkingv1.NetworkPolicy, peers []networkingv1.NetworkPolicyPeer, endpoints []podIdentity) []podIdentity {
+	if len(peers) == 0 {
+		return []podIdentity{{identity: bpf.IdentityAny}}
+	}
+
+	var resolved []podIdentity
+	seen := make(map[uint32]bool)
+	add := func(peer podIdentity) {
+		if !seen[peer.identity] {
+			seen[peer.identity] = true
+			resolved = append(resolved, peer)
+		}
+	}
+
+	for _, peer := range peers {
+		if peer.IPBlock != nil {
+			_, cidr, err := net.ParseCIDR(peer.IPBlock.CIDR)
+			if err != nil {
+				log.Warnf("Network policy %s has an invalid ipBlock %q", policyKey(policy), peer.IPBlock.CIDR)
+				continue
+			}
+			for _, pod := range endpoints {
+				if cidr.Contains(pod.ip) && !inExcept(pod.ip, peer.IPBlock.Except) {
+					add(pod)
+				}
+			}
+			// Addresses outside of the cluster's pods can't be told apart
+			// in the datapath, an ipBlock allows all of them.
+			add(podIdentity{identity: bpf.IdentityWorld})
+			continue
+		}
+
+		podSelector := labels.Everything()
+		if peer.PodSelector != nil {
+			selector, err := metav1.LabelSelectorAsSelector(peer.PodSelector)
+			if err != nil {
+				log.Warnf("Network policy %s has an invalid pod selector: %v", policyKey(policy), err)
+				continue
+			}
+			podSelector = selector
+		}
+		var namespaceSelector labels.Selector
+		if peer.NamespaceSelector != nil {
+			selector, err := metav1.LabelSelectorAsSelector(peer.NamespaceSelector)
+			if err != nil {
+				log.Warnf("Network policy %s has an invalid namespace selector: %v", policyKey(policy), err)
+				continue
+			}
+			namespaceSelector = selector
+		}
+
+		for _, pod := range endpoints {
+			if namespaceSelector == nil {
+				if pod.pod.Namespace != policy.Namespace {
+					continue
+				}
+			} else if !c.namespaceMatches(pod.pod.Namespace, namespaceSelector) {
+				continue
+			}
+			if podSelector.Matches(labels.Set(pod.pod.Labels)) {
+				add(pod)
+			}
+		}
+	}
+	return resolved
+}
+
+func (c *Controller) auditMode(name string) bool {
+	if c.audit {
+		return true
+	}
+	namespace, err := c.namespaceLister.Get(name)
+	if err != nil {
+		return false
+	}
+	return namespace.Annotations[AuditAnnotation] == "true"
+}
+
+func (c *Controller) namespaceMatches(name string, selector labels.Selector) bool {
+	namespace, err := c.namespaceLister.Get(name)
+	if err != nil {
+		return false
+	}
+	return selector.Matches(labels.Set(namespace.Labels))
+}
+
+// resolvePorts returns the TCP ports of a rule as the port prefixes of the
+// datapath. Named ports are looked up in pod, they are skipped if pod is
+// unknown or doesn't expose them.
+func resolvePorts(ports []networkingv1.NetworkPolicyPort, pod *corev1.Pod) []bpf.PortPrefix {
+	if len(ports) == 0 {
+		return []bpf.PortPrefix{bpf.AnyPort}
+	}
+
+	var resolved []bpf.PortPrefix
+	for _, port := range ports {
+		// Enforcement happens at the socket layer on TCP connections only.
+		if port.Protocol != nil && *port.Protocol != corev1.ProtocolTCP {
+			continue
+		}
+		if port.Port == nil {
+			return []bpf.PortPrefix{bpf.AnyPort}
+		}
+
+		var number int32
+		if port.Port.Type == intstr.String {
+			number = namedPort(pod, port.Port.StrVal)
+			if number == 0 {
+				continue
+			}
+		} else {
+			number = port.Port.IntVal
+		}
+
+		endPort := number
+		if port.EndPort != nil && *port.EndPort > number {
+			endPort = *port.EndPort
+		}
+		resolved = append(resolved, bpf.PortPrefixes(uint16(number), uint16(endPort))...)
+	}
+	return resolved
+}
+
+func namedPort(pod *corev1.Pod, name string) int32 {
+	if pod == nil {
+		return 0
+	}
+	for _, container := range pod.Spec.Containers {
+		for _, port := range container.Ports {
+			if port.Name == name && port.Protocol == corev1.ProtocolTCP {
+				return port.ContainerPort
+			}
+		}
+	}
+	return 0
+}
+
+func inExcept(ip net.IP, except []string) bool {
+	for _, cidr := range except {
+		if _, ipNet, err := net.ParseCIDR(cidr); err == nil && ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// policyTypes returns whether the policy isolates the selected pods for
+// ingress and egress, applying the API defaults when policyTypes is not set.
+func policyTypes(policy *networkingv1.NetworkPolicy) (bool, bool) {
+	if len(policy.Spec.PolicyTypes) == 0 {
+		return true, len(policy.Spec.Egress) > 0
+	}
+	var ingress, egress bool
+	for _, policyType := range policy.Spec.PolicyTypes {
+		switch policyType {
+		case networkingv1.PolicyTypeIngress:
+			ingress = true
+		case networkingv1.PolicyTypeEgress:
+			egress = true
+		}
+	}
+	return ingress, egress
+}
+
+func policyKey(policy *networkingv1.NetworkPolicy) string {
+	return fmt.Sprintf("%s/%s", policy.Namespace, policy.Name)
+}
@@ -0,0 +1,150 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package policy
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/redhat-et/patu/internal/bpf"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func tcpPort(port intstr.IntOrString, endPort *int32) networkingv1.NetworkPolicyPort {
+	protocol := corev1.ProtocolTCP
+	return networkingv1.NetworkPolicyPort{Protocol: &protocol, Port: &port, EndPort: endPort}
+}
+
+func policyPorts(ports ...uint16) []bpf.PortPrefix {
+	var resolved []bpf.PortPrefix
+	for _, port := range ports {
+		resolved = append(resolved, bpf.PortPrefix{Port: port, Bits: 16})
+	}
+	return resolved
+}
+
+func TestResolvePorts(t *testing.T) {
+	udp := corev1.ProtocolUDP
+	endPort := func(port int32) *int32 { return &port }
+	pod := &corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{{
+		Ports: []corev1.ContainerPort{
+			{Name: "http", ContainerPort: 8080, Protocol: corev1.ProtocolTCP},
+			{Name: "dns", ContainerPort: 53, Protocol: corev1.ProtocolUDP},
+		},
+	}}}}
+	tests := []struct {
+		name  string
+		ports []networkingv1.NetworkPolicyPort
+		pod   *corev1.Pod
+		want  []bpf.PortPrefix
+	}{
+		{name: "no ports", want: []bpf.PortPrefix{bpf.AnyPort}},
+		{name: "numbered port", ports: []networkingv1.NetworkPolicyPort{tcpPort(intstr.FromInt(80), nil)}, want: policyPorts(80)},
+		{name: "protocol defaults to TCP", ports: []networkingv1.NetworkPolicyPort{{Port: &intstr.IntOrString{IntVal: 80}}}, want: policyPorts(80)},
+		{name: "any port", ports: []networkingv1.NetworkPolicyPort{{}}, want: []bpf.PortPrefix{bpf.AnyPort}},
+		{name: "UDP is not enforced", ports: []networkingv1.NetworkPolicyPort{{Protocol: &udp}}},
+		{name: "named port", ports: []networkingv1.NetworkPolicyPort{tcpPort(intstr.FromString("http"), nil)}, pod: pod, want: policyPorts(8080)},
+		{name: "named UDP port", ports: []networkingv1.NetworkPolicyPort{tcpPort(intstr.FromString("dns"), nil)}, pod: pod},
+		{name: "named port of an unknown pod", ports: []networkingv1.NetworkPolicyPort{tcpPort(intstr.FromString("http"), nil)}},
+		{name: "port range", ports: []networkingv1.NetworkPolicyPort{tcpPort(intstr.FromInt(80), endPort(83))}, want: []bpf.PortPrefix{{Port: 80, Bits: 14}}},
+		{name: "empty port range", ports: []networkingv1.NetworkPolicyPort{tcpPort(intstr.FromInt(80), endPort(79))}, want: policyPorts(80)},
+		{name: "unprivileged ports", ports: []networkingv1.NetworkPolicyPort{tcpPort(intstr.FromInt(1024), endPort(65535))}, want: []bpf.PortPrefix{
+			{Port: 1024, Bits: 6}, {Port: 2048, Bits: 5}, {Port: 4096, Bits: 4}, {Port: 8192, Bits: 3}, {Port: 16384, Bits: 2}, {Port: 32768, Bits: 1},
+		}},
+		{name: "port range next to a port", ports: []networkingv1.NetworkPolicyPort{
+			tcpPort(intstr.FromInt(8080), endPort(8081)), tcpPort(intstr.FromInt(443), nil),
+		}, want: []bpf.PortPrefix{{Port: 8080, Bits: 15}, {Port: 443, Bits: 16}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := resolvePorts(tt.ports, tt.pod); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("resolvePorts() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func testEndpoint(namespace, name, ip string, identity uint32, labels map[string]string) podIdentity {
+	return podIdentity{
+		pod:      &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Labels: labels}},
+		ip:       net.ParseIP(ip),
+		identity: identity,
+	}
+}
+
+func TestResolvePeers(t *testing.T) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for name, team := range map[string]string{"default": "a", "other": "b"} {
+		indexer.Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{"team": team}}})
+	}
+	c := &Controller{namespaceLister: corelisters.NewNamespaceLister(indexer)}
+
+	endpoints := []podIdentity{
+		testEndpoint("default", "web", "10.0.0.2", 256, map[string]string{"app": "web"}),
+		testEndpoint("default", "db", "10.0.1.2", 257, map[string]string{"app": "db"}),
+		testEndpoint("other", "web", "10.0.2.2", 258, map[string]string{"app": "web"}),
+	}
+	tests := []struct {
+		name  string
+		peers []networkingv1.NetworkPolicyPeer
+		want  []uint32
+	}{
+		{name: "no peers", want: []uint32{bpf.IdentityAny}},
+		{name: "pod selector in the policy namespace", peers: []networkingv1.NetworkPolicyPeer{
+			{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}}},
+		}, want: []uint32{256}},
+		{name: "empty pod selector", peers: []networkingv1.NetworkPolicyPeer{
+			{PodSelector: &metav1.LabelSelector{}},
+		}, want: []uint32{256, 257}},
+		{name: "namespace selector", peers: []networkingv1.NetworkPolicyPeer{
+			{NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "b"}}},
+		}, want: []uint32{258}},
+		{name: "namespace and pod selector", peers: []networkingv1.NetworkPolicyPeer{{
+			NamespaceSelector: &metav1.LabelSelector{},
+			PodSelector:       &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+		}}, want: []uint32{256, 258}},
+		{name: "ipBlock", peers: []networkingv1.NetworkPolicyPeer{
+			{IPBlock: &networkingv1.IPBlock{CIDR: "10.0.0.0/23", Except: []string{"10.0.1.0/24"}}},
+		}, want: []uint32{256, bpf.IdentityWorld}},
+		{name: "invalid ipBlock", peers: []networkingv1.NetworkPolicyPeer{
+			{IPBlock: &networkingv1.IPBlock{CIDR: "10.0.0.0"}},
+		}},
+		{name: "peers are resolved once", peers: []networkingv1.NetworkPolicyPeer{
+			{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}}},
+			{IPBlock: &networkingv1.IPBlock{CIDR: "10.0.0.0/24"}},
+		}, want: []uint32{256, bpf.IdentityWorld}},
+	}
+	policy := &networkingv1.NetworkPolicy{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "test"}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []uint32
+			for _, peer := range c.resolvePeers(policy, tt.peers, endpoints) {
+				got = append(got, peer.identity)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("resolvePeers() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package snat
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/redhat-et/patu/cmd/patu/daemon/uplink"
+	"github.com/redhat-et/patu/internal/bpf"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Backend is the ipMasqBackend of the CNI config selecting the eBPF SNAT.
+const Backend = "ebpf"
+
+// Setup masquerades the traffic of the pods in podNet leaving clusterNet to
+// the address of the uplink, the interface of the IPv4 default route. The
+// CNI plugin falls back to its other masquerade backends until then.
+func Setup(podNet, clusterNet *net.IPNet) error {
+	link, nodeIP, err := uplink.Find()
+	if err != nil {
+		return err
+	}
+	if err := bpf.AttachSNAT(link); err != nil {
+		return err
+	}
+
+	if err := bpf.ConfigureSNAT(config(nodeIP, podNet, clusterNet)); err != nil {
+		return err
+	}
+	log.Infof("Masquerading pods of %s to %s on %s", podNet, nodeIP, link.Attrs().Name)
+	return nil
+}
+
+// config returns the datapath configuration masquerading podNet to nodeIP.
+func config(nodeIP net.IP, podNet, clusterNet *net.IPNet) bpf.SNATConfig {
+	cfg := bpf.SNATConfig{PortMin: bpf.SNATPortMin, PortMax: bpf.SNATPortMax}
+	copy(cfg.NodeIP[:], nodeIP.To4())
+	copy(cfg.PodNet[:], podNet.IP.Mask(podNet.Mask).To4())
+	copy(cfg.PodMask[:], net.IP(podNet.Mask).To4())
+	copy(cfg.ClusterNet[:], clusterNet.IP.Mask(clusterNet.Mask).To4())
+	copy(cfg.ClusterMask[:], net.IP(clusterNet.Mask).To4())
+	return cfg
+}
+
+// ClusterNet returns the network the pods reach without masquerade, cidr if
+// set, otherwise the /16 of the pod network the datapath treats as pod
+// traffic.
+func ClusterNet(cidr string, podNet *net.IPNet) (*net.IPNet, error) {
+	if cidr != "" {
+		_, clusterNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid cluster CIDR %s: %v", cidr, err)
+		}
+		return clusterNet, nil
+	}
+	mask := net.CIDRMask(16, 32)
+	return &net.IPNet{IP: podNet.IP.Mask(mask), Mask: mask}, nil
+}
@@ -0,0 +1,85 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package snat
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/redhat-et/patu/internal/bpf"
+)
+
+func mustCIDR(t *testing.T, cidr string) *net.IPNet {
+	t.Helper()
+	ip, ipn, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Keep the host part, the callers mask the networks themselves.
+	ipn.IP = ip.To4()
+	return ipn
+}
+
+func TestClusterNet(t *testing.T) {
+	tests := []struct {
+		name    string
+		cidr    string
+		podNet  string
+		want    string
+		wantErr string
+	}{
+		{name: "default", podNet: "10.200.3.0/24", want: "10.200.0.0/16"},
+		{name: "pod network wider than the default", podNet: "10.128.0.0/9", want: "10.128.0.0/16"},
+		{name: "cluster CIDR", cidr: "10.0.0.0/8", podNet: "10.200.3.0/24", want: "10.0.0.0/8"},
+		{name: "cluster CIDR with a host part", cidr: "10.200.3.1/14", podNet: "10.200.3.0/24", want: "10.200.0.0/14"},
+		{name: "invalid cluster CIDR", cidr: "10.0.0.0", podNet: "10.200.3.0/24", wantErr: "Invalid cluster CIDR 10.0.0.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ClusterNet(tt.cidr, mustCIDR(t, tt.podNet))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("ClusterNet() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ClusterNet() error = %v", err)
+			}
+			if got.String() != tt.want {
+				t.Errorf("ClusterNet() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfig(t *testing.T) {
+	got := config(net.ParseIP("192.168.122.229"), mustCIDR(t, "10.200.3.1/24"), mustCIDR(t, "10.200.0.0/16"))
+	want := bpf.SNATConfig{
+		NodeIP:      [4]byte{192, 168, 122, 229},
+		PodNet:      [4]byte{10, 200, 3, 0},
+		PodMask:     [4]byte{255, 255, 255, 0},
+		ClusterNet:  [4]byte{10, 200, 0, 0},
+		ClusterMask: [4]byte{255, 255, 0, 0},
+		PortMin:     bpf.SNATPortMin,
+		PortMax:     bpf.SNATPortMax,
+	}
+	if got != want {
+		t.Errorf("config() = %+v, want %+v", got, want)
+	}
+}
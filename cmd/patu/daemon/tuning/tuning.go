@@ -0,0 +1,190 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tuning
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/redhat-et/patu/cmd/patu/daemon/kubehelper"
+	"github.com/redhat-et/patu/internal/bpf"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Pod annotations patu_sockops applies to the pod's TCP sockets.
+const (
+	CongestionAnnotation        = "patu.io/tcp-congestion"
+	InitialCwndAnnotation       = "patu.io/tcp-initial-cwnd"
+	RTOMinAnnotation            = "patu.io/tcp-rto-min"
+	KeepaliveIdleAnnotation     = "patu.io/tcp-keepalive-idle"
+	KeepaliveIntervalAnnotation = "patu.io/tcp-keepalive-interval"
+	KeepaliveCountAnnotation    = "patu.io/tcp-keepalive-count"
+)
+
+const retryInterval = 5 * time.Second
+
+// Controller keeps the TCP tuning map in sync with the annotations of the
+// pods on this node.
+type Controller struct {
+	podLister corelisters.PodLister
+	synced    cache.InformerSynced
+	addresses *kubehelper.PodAddresses
+	dirty     chan struct{}
+}
+
+// NewController registers the pod informer of localPods, which must only see
+// the pods of this node. Pods are also synced as soon as addresses learns
+// about them, addresses may be nil.
+func NewController(localPods informers.SharedInformerFactory, addresses *kubehelper.PodAddresses) *Controller {
+	podInformer := localPods.Core().V1().Pods()
+	c := &Controller{
+		podLister: podInformer.Lister(),
+		synced:    podInformer.Informer().HasSynced,
+		addresses: addresses,
+		dirty:     make(chan struct{}, 1),
+	}
+	podInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { c.enqueue() },
+		UpdateFunc: func(interface{}, interface{}) { c.enqueue() },
+		DeleteFunc: func(interface{}) { c.enqueue() },
+	})
+	addresses.OnChange(c.enqueue)
+	return c
+}
+
+func (c *Controller) enqueue() {
+	select {
+	case c.dirty <- struct{}{}:
+	default:
+	}
+}
+
+// Run syncs the TCP tuning map until stopCh is closed. The informer factory
+// must have been started by the caller.
+func (c *Controller) Run(stopCh <-chan struct{}) {
+	if !cache.WaitForCacheSync(stopCh, c.synced) {
+		log.Errorf("Timed out waiting for the TCP tuning pod cache to sync")
+		return
+	}
+	log.Infof("TCP tuning controller started")
+
+	c.enqueue()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-c.dirty:
+			if err := c.sync(); err != nil {
+				log.Errorf("Failed to sync TCP tuning: %v", err)
+				time.AfterFunc(retryInterval, c.enqueue)
+			}
+		}
+	}
+}
+
+func (c *Controller) sync() error {
+	pods, err := c.podLister.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+
+	tuning := make(map[[4]byte]bpf.TCPTuning)
+	for _, pod := range pods {
+		podIP := c.addresses.PodIP(pod)
+		if pod.Spec.HostNetwork || podIP == "" ||
+			pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		key, ok := bpf.IPv4Key(net.ParseIP(podIP))
+		if !ok {
+			continue
+		}
+		if settings, ok := podTuning(pod); ok {
+			tuning[key] = settings
+		}
+	}
+	return bpf.SyncTCPTuning(tuning)
+}
+
+// podTuning parses the TCP tuning annotations of pod. Invalid values are
+// logged and skipped, the other settings still apply.
+func podTuning(pod *corev1.Pod) (bpf.TCPTuning, bool) {
+	var tuning bpf.TCPTuning
+	var found bool
+
+	parse := func(annotation string, parser func(string) (uint32, error), out *uint32) {
+		value, ok := pod.Annotations[annotation]
+		if !ok {
+			return
+		}
+		parsed, err := parser(value)
+		if err != nil {
+			log.Warnf("Ignoring annotation %s of pod %s/%s: %v", annotation, pod.Namespace, pod.Name, err)
+			return
+		}
+		*out = parsed
+		found = true
+	}
+
+	if name, ok := pod.Annotations[CongestionAnnotation]; ok {
+		if name == "" || len(name) >= bpf.TCPCongestionNameMax {
+			log.Warnf("Ignoring annotation %s of pod %s/%s: invalid congestion control %q",
+				CongestionAnnotation, pod.Namespace, pod.Name, name)
+		} else {
+			copy(tuning.Congestion[:], name)
+			found = true
+		}
+	}
+	parse(InitialCwndAnnotation, parseCount, &tuning.InitCwnd)
+	parse(RTOMinAnnotation, parseMicroseconds, &tuning.RTOMinUs)
+	parse(KeepaliveIdleAnnotation, parseSeconds, &tuning.KeepaliveIdle)
+	parse(KeepaliveIntervalAnnotation, parseSeconds, &tuning.KeepaliveIntvl)
+	parse(KeepaliveCountAnnotation, parseCount, &tuning.KeepaliveCnt)
+	return tuning, found
+}
+
+func parseCount(value string) (uint32, error) {
+	count, err := strconv.ParseUint(value, 10, 31)
+	if err != nil || count == 0 {
+		return 0, fmt.Errorf("%q is not a positive integer", value)
+	}
+	return uint32(count), nil
+}
+
+func parseMicroseconds(value string) (uint32, error) {
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration < time.Microsecond || duration.Microseconds() > int64(^uint32(0)>>1) {
+		return 0, fmt.Errorf("%q is not a valid duration", value)
+	}
+	return uint32(duration.Microseconds()), nil
+}
+
+func parseSeconds(value string) (uint32, error) {
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration < time.Second || duration.Seconds() > float64(^uint32(0)>>1) {
+		return 0, fmt.Errorf("%q is not a valid duration of at least one second", value)
+	}
+	return uint32(duration.Seconds()), nil
+}
@@ -0,0 +1,127 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tuning
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/redhat-et/patu/internal/bpf"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func congestion(name string) [bpf.TCPCongestionNameMax]byte {
+	var out [bpf.TCPCongestionNameMax]byte
+	copy(out[:], name)
+	return out
+}
+
+func TestPodTuning(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        bpf.TCPTuning
+		wantFound   bool
+	}{
+		{name: "no annotations"},
+		{name: "unrelated annotations", annotations: map[string]string{"example.com/tcp": "1"}},
+		{
+			name: "all settings",
+			annotations: map[string]string{
+				CongestionAnnotation:        "bbr",
+				InitialCwndAnnotation:       "20",
+				RTOMinAnnotation:            "50ms",
+				KeepaliveIdleAnnotation:     "30s",
+				KeepaliveIntervalAnnotation: "10s",
+				KeepaliveCountAnnotation:    "3",
+			},
+			want: bpf.TCPTuning{
+				Congestion: congestion("bbr"), InitCwnd: 20, RTOMinUs: 50000,
+				KeepaliveIdle: 30, KeepaliveIntvl: 10, KeepaliveCnt: 3,
+			},
+			wantFound: true,
+		},
+		{
+			name:        "invalid values are skipped",
+			annotations: map[string]string{InitialCwndAnnotation: "twenty", RTOMinAnnotation: "200ms"},
+			want:        bpf.TCPTuning{RTOMinUs: 200000},
+			wantFound:   true,
+		},
+		{name: "only invalid values", annotations: map[string]string{KeepaliveCountAnnotation: "0"}},
+		{name: "empty congestion control", annotations: map[string]string{CongestionAnnotation: ""}},
+		{
+			name:        "congestion control name too long",
+			annotations: map[string]string{CongestionAnnotation: strings.Repeat("x", bpf.TCPCongestionNameMax)},
+		},
+		{
+			name:        "longest congestion control name",
+			annotations: map[string]string{CongestionAnnotation: strings.Repeat("x", bpf.TCPCongestionNameMax-1)},
+			want:        bpf.TCPTuning{Congestion: congestion(strings.Repeat("x", bpf.TCPCongestionNameMax-1))},
+			wantFound:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web", Annotations: tt.annotations}}
+			got, found := podTuning(pod)
+			if got != tt.want || found != tt.wantFound {
+				t.Errorf("podTuning() = %+v, %v, want %+v, %v", got, found, tt.want, tt.wantFound)
+			}
+		})
+	}
+}
+
+func TestParseTuningValues(t *testing.T) {
+	tests := []struct {
+		name    string
+		parser  func(string) (uint32, error)
+		value   string
+		want    uint32
+		wantErr string
+	}{
+		{name: "count", parser: parseCount, value: "3", want: 3},
+		{name: "zero count", parser: parseCount, value: "0", wantErr: "not a positive integer"},
+		{name: "negative count", parser: parseCount, value: "-1", wantErr: "not a positive integer"},
+		{name: "count out of range", parser: parseCount, value: "2147483648", wantErr: "not a positive integer"},
+		{name: "microseconds", parser: parseMicroseconds, value: "1.5ms", want: 1500},
+		{name: "below a microsecond", parser: parseMicroseconds, value: "500ns", wantErr: "not a valid duration"},
+		{name: "duration without unit", parser: parseMicroseconds, value: "50", wantErr: "not a valid duration"},
+		{name: "seconds", parser: parseSeconds, value: "2m", want: 120},
+		{name: "seconds are truncated", parser: parseSeconds, value: "1500ms", want: 1},
+		{name: "below a second", parser: parseSeconds, value: "999ms", wantErr: "at least one second"},
+		{name: "seconds out of range", parser: parseSeconds, value: "596524h", wantErr: "at least one second"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.parser(tt.value)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parse(%q) error = %v, want %q", tt.value, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parse(%q) error = %v", tt.value, err)
+			}
+			if got != tt.want {
+				t.Errorf("parse(%q) = %d, want %d", tt.value, got, tt.want)
+			}
+		})
+	}
+}
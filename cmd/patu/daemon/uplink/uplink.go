@@ -0,0 +1,52 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package uplink
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+)
+
+// Find returns the uplink, the interface of the IPv4 default route, and its
+// address.
+func Find() (netlink.Link, net.IP, error) {
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to list routes: %v", err)
+	}
+	for _, route := range routes {
+		if route.Dst != nil || route.LinkIndex == 0 {
+			continue
+		}
+		link, err := netlink.LinkByIndex(route.LinkIndex)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Failed to get uplink %d: %v", route.LinkIndex, err)
+		}
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Failed to list addresses of %s: %v", link.Attrs().Name, err)
+		}
+		for _, addr := range addrs {
+			if addr.IP.IsGlobalUnicast() {
+				return link, addr.IP, nil
+			}
+		}
+	}
+	return nil, nil, fmt.Errorf("No uplink with an IPv4 default route found")
+}
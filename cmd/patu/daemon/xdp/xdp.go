@@ -0,0 +1,54 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xdp
+
+import (
+	"fmt"
+
+	"github.com/redhat-et/patu/cmd/patu/daemon/uplink"
+	"github.com/redhat-et/patu/internal/bpf"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+// Setup attaches the XDP ingress fast path to the interface named ifName, or
+// to the uplink if empty. Packets from outside the node to local pods are
+// steered to their host veths, the other packets go on to the stack. The
+// returned function detaches it.
+func Setup(ifName, mode string) (func(), error) {
+	var link netlink.Link
+	var err error
+	if ifName != "" {
+		link, err = netlink.LinkByName(ifName)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to get XDP interface %s: %v", ifName, err)
+		}
+	} else if link, _, err = uplink.Find(); err != nil {
+		return nil, err
+	}
+
+	if err := bpf.AttachXDP(link, mode); err != nil {
+		return nil, err
+	}
+	log.Infof("Steering pod traffic with XDP on %s in %s mode", link.Attrs().Name, mode)
+	return func() {
+		if err := bpf.DetachXDP(link, mode); err != nil {
+			log.Warnf("%v", err)
+		}
+	}, nil
+}
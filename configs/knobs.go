@@ -18,8 +18,49 @@ package configs
 var (
 	Debug		= false
 	Compile 	= false
+	NetworkPolicy	= false
+	PolicyAudit	= false
+	MetricsAddress	= ":9199"
+	FlowLog		= ""
+	FlowLogMaxSize	= 10
+	FlowLogMaxBackups = 3
+	FlowSocket	= ""
+	TCPTelemetry	= false
+	TCPTuning	= true
+	CNIDataDir	= "/var/lib/cni/patu"
+	ClusterCIDR	= ""
+	XDPMode		= ""
+	XDPUplink	= ""
+	NotifySocket	= "/var/run/patu/patud.sock"
 )
 
 const (
+	SockopsProgFsMount = "/sys/fs/bpf/sockops"
+	SkMsgProgFsMount = "/sys/fs/bpf/skmsg"
 	ConfigMapFsMount = "/sys/fs/bpf/cni_config_map"
-)
\ No newline at end of file
+	SockopsRedirMapFsMount = "/sys/fs/bpf/sockops_redir_map"
+	PodIdentityMapFsMount = "/sys/fs/bpf/pod_identity_map"
+	PolicyIsolationMapFsMount = "/sys/fs/bpf/policy_isolation_map"
+	PolicyMapFsMount = "/sys/fs/bpf/policy_map"
+	PolicyPortMapFsMount = "/sys/fs/bpf/policy_port_map"
+	PolicyAuditEventsFsMount = "/sys/fs/bpf/policy_audit_events"
+	FlowEventsFsMount = "/sys/fs/bpf/flow_events"
+	TCPStatsMapFsMount = "/sys/fs/bpf/tcp_stats_map"
+	TCPTuningMapFsMount = "/sys/fs/bpf/tcp_tuning_map"
+	HostPortMapFsMount = "/sys/fs/bpf/hostport_map"
+	LocalAddrMapFsMount = "/sys/fs/bpf/local_addr_map"
+	BwEgressProgFsMount = "/sys/fs/bpf/bw_egress"
+	BwIngressProgFsMount = "/sys/fs/bpf/bw_ingress"
+	BwUplinkProgFsMount = "/sys/fs/bpf/bw_uplink"
+	EndpointMapFsMount = "/sys/fs/bpf/endpoint_map"
+	BandwidthMapFsMount = "/sys/fs/bpf/bandwidth_map"
+	BandwidthPodMapFsMount = "/sys/fs/bpf/bandwidth_pod_map"
+	SnatEgressProgFsMount = "/sys/fs/bpf/snat_egress"
+	SnatIngressProgFsMount = "/sys/fs/bpf/snat_ingress"
+	SnatConfigMapFsMount = "/sys/fs/bpf/snat_config_map"
+	FastPathEgressProgFsMount = "/sys/fs/bpf/fastpath_egress"
+	FastPathIngressProgFsMount = "/sys/fs/bpf/fastpath_ingress"
+	XdpProgFsMount = "/sys/fs/bpf/xdp"
+	PolicyIngressProgFsMount = "/sys/fs/bpf/policy_ingress"
+	PodNamespaceMapFsMount = "/sys/fs/bpf/pod_namespace_map"
+)
@@ -0,0 +1,195 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package bpf
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/cilium/ebpf"
+	"github.com/redhat-et/patu/configs"
+	"github.com/vishvananda/netlink"
+)
+
+// PodBandwidth mirrors struct pod_bandwidth. Rates are in bytes per second
+// and bursts in bytes, MasqNet and MasqMask the subnet of a pod masqueraded
+// by netfilter. The remaining fields are the datapath's state.
+type PodBandwidth struct {
+	EgressRate    uint64
+	EgressBurst   uint64
+	IngressRate   uint64
+	IngressBurst  uint64
+	EgressNextNs  uint64
+	IngressTokens uint64
+	IngressLastNs uint64
+	MasqNet       [4]byte
+	MasqMask      [4]byte
+}
+
+// Limits returns the bandwidth without the datapath's state.
+func (b PodBandwidth) Limits() PodBandwidth {
+	return PodBandwidth{
+		EgressRate:   b.EgressRate,
+		EgressBurst:  b.EgressBurst,
+		IngressRate:  b.IngressRate,
+		IngressBurst: b.IngressBurst,
+		MasqNet:      b.MasqNet,
+		MasqMask:     b.MasqMask,
+	}
+}
+
+const bandwidthFilterName = "patu-bandwidth"
+
+// AttachBandwidth attaches the bandwidth programs to the host veth of a pod,
+// the egress policer on its TC ingress and the ingress policer on its TC
+// egress.
+func AttachBandwidth(hostVeth netlink.Link) error {
+	if err := ensureClsact(hostVeth); err != nil {
+		return err
+	}
+	if err := attachTC(hostVeth, configs.BwEgressProgFsMount, netlink.HANDLE_MIN_INGRESS,
+		bandwidthFilterName, bandwidthFilterPriority); err != nil {
+		return err
+	}
+	return attachTC(hostVeth, configs.BwIngressProgFsMount, netlink.HANDLE_MIN_EGRESS,
+		bandwidthFilterName, bandwidthFilterPriority)
+}
+
+// BandwidthAttached reports whether both bandwidth programs are attached to
+// the host veth.
+func BandwidthAttached(hostVeth netlink.Link) (bool, error) {
+	for _, parent := range []uint32{netlink.HANDLE_MIN_INGRESS, netlink.HANDLE_MIN_EGRESS} {
+		attached, err := tcAttached(hostVeth, parent, bandwidthFilterName)
+		if err != nil || !attached {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// AttachBandwidthUplink attaches the egress shaper to the TC egress of the
+// uplink, ahead of the SNAT programs which hide the pod address.
+func AttachBandwidthUplink(uplink netlink.Link) error {
+	if err := ensureClsact(uplink); err != nil {
+		return err
+	}
+	return attachTC(uplink, configs.BwUplinkProgFsMount, netlink.HANDLE_MIN_EGRESS,
+		bandwidthFilterName, bandwidthFilterPriority)
+}
+
+// BandwidthUplinkAttached reports whether the egress shaper is attached to
+// the uplink.
+func BandwidthUplinkAttached(uplink netlink.Link) (bool, error) {
+	return tcAttached(uplink, netlink.HANDLE_MIN_EGRESS, bandwidthFilterName)
+}
+
+// SetPodBandwidth sets the bandwidth limits of the pod behind the host veth.
+// The uplink shaper and sk_msg find them by the addresses of the pod.
+func SetPodBandwidth(ifindex uint32, podIPs [][4]byte, limits PodBandwidth) error {
+	bandwidthMap, err := getPinnedMap(configs.BandwidthMapFsMount)
+	if err != nil {
+		return err
+	}
+	defer bandwidthMap.Close()
+	podMap, err := getPinnedMap(configs.BandwidthPodMapFsMount)
+	if err != nil {
+		return err
+	}
+	defer podMap.Close()
+
+	if err := bandwidthMap.Put(ifindex, limits.Limits()); err != nil {
+		return fmt.Errorf("Failed to update map %s with key %d. Error = %v", configs.BandwidthMapFsMount, ifindex, err)
+	}
+	for _, ip := range podIPs {
+		if err := podMap.Put(ip, ifindex); err != nil {
+			return fmt.Errorf("Failed to update map %s with key %v. Error = %v", configs.BandwidthPodMapFsMount, ip, err)
+		}
+	}
+	return nil
+}
+
+// DelPodBandwidth removes the bandwidth limits of the pod behind the host
+// veth, or of the pod with the given addresses if the ifindex is unknown.
+func DelPodBandwidth(ifindex uint32, podIPs [][4]byte) error {
+	bandwidthMap, err := getPinnedMap(configs.BandwidthMapFsMount)
+	if err != nil {
+		return err
+	}
+	defer bandwidthMap.Close()
+	podMap, err := getPinnedMap(configs.BandwidthPodMapFsMount)
+	if err != nil {
+		return err
+	}
+	defer podMap.Close()
+
+	ifindexes := []uint32{}
+	if ifindex != 0 {
+		ifindexes = append(ifindexes, ifindex)
+	}
+	for _, ip := range podIPs {
+		var podIfindex uint32
+		if err := podMap.Lookup(ip, &podIfindex); err != nil {
+			if errors.Is(err, ebpf.ErrKeyNotExist) {
+				continue
+			}
+			return fmt.Errorf("Failed to lookup key %v in map %s. Error = %v", ip, configs.BandwidthPodMapFsMount, err)
+		}
+		// The address may have been handed to another pod since.
+		if ifindex != 0 && podIfindex != ifindex {
+			continue
+		}
+		ifindexes = append(ifindexes, podIfindex)
+		if err := podMap.Delete(ip); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return fmt.Errorf("Failed to delete key %v from map %s. Error = %v", ip, configs.BandwidthPodMapFsMount, err)
+		}
+	}
+	for _, index := range ifindexes {
+		if err := bandwidthMap.Delete(index); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return fmt.Errorf("Failed to delete key %d from map %s. Error = %v", index, configs.BandwidthMapFsMount, err)
+		}
+	}
+	return nil
+}
+
+// LookupPodBandwidth returns the bandwidth limits of the pod behind the host
+// veth, and checks they are keyed by each of the addresses of the pod.
+func LookupPodBandwidth(ifindex uint32, podIPs [][4]byte) (PodBandwidth, error) {
+	var bandwidth PodBandwidth
+	bandwidthMap, err := getPinnedMap(configs.BandwidthMapFsMount)
+	if err != nil {
+		return bandwidth, err
+	}
+	defer bandwidthMap.Close()
+	podMap, err := getPinnedMap(configs.BandwidthPodMapFsMount)
+	if err != nil {
+		return bandwidth, err
+	}
+	defer podMap.Close()
+
+	if err := bandwidthMap.Lookup(ifindex, &bandwidth); err != nil {
+		return bandwidth, fmt.Errorf("Host veth %d has no bandwidth limits in map %s: %v", ifindex, configs.BandwidthMapFsMount, err)
+	}
+	for _, ip := range podIPs {
+		var podIfindex uint32
+		if err := podMap.Lookup(ip, &podIfindex); err != nil {
+			return bandwidth, fmt.Errorf("Pod address %v has no bandwidth limits in map %s: %v", ip, configs.BandwidthPodMapFsMount, err)
+		}
+		if podIfindex != ifindex {
+			return bandwidth, fmt.Errorf("Pod address %v has the bandwidth limits of host veth %d in map %s", ip, podIfindex, configs.BandwidthPodMapFsMount)
+		}
+	}
+	return bandwidth.Limits(), nil
+}
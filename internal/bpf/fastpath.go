@@ -0,0 +1,138 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package bpf
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/cilium/ebpf"
+	"github.com/redhat-et/patu/configs"
+	"github.com/vishvananda/netlink"
+)
+
+// Endpoint mirrors struct endpoint.
+type Endpoint struct {
+	Ifindex uint32
+	MAC     [6]byte
+	HostMAC [6]byte
+}
+
+// NewEndpoint returns the endpoint of the pod behind the host veth.
+func NewEndpoint(hostVeth netlink.Link, podMAC net.HardwareAddr) Endpoint {
+	ep := Endpoint{Ifindex: uint32(hostVeth.Attrs().Index)}
+	copy(ep.MAC[:], podMAC)
+	copy(ep.HostMAC[:], hostVeth.Attrs().HardwareAddr)
+	return ep
+}
+
+const fastPathFilterName = "patu-fastpath"
+
+// FastPathLoaded reports whether patud loaded the fast path programs.
+func FastPathLoaded() bool {
+	for _, path := range []string{configs.FastPathEgressProgFsMount, configs.FastPathIngressProgFsMount} {
+		prog, err := ebpf.LoadPinnedProgram(path, &ebpf.LoadPinOptions{ReadOnly: true})
+		if err != nil {
+			return false
+		}
+		prog.Close()
+	}
+	return true
+}
+
+// AttachFastPath attaches the fast path programs to the host veth of a pod.
+// The one on its TC ingress hands the packets of the pod to other local pods,
+// the one on its TC egress tells it which flows the stack handles.
+func AttachFastPath(hostVeth netlink.Link) error {
+	if err := ensureClsact(hostVeth); err != nil {
+		return err
+	}
+	if err := attachTC(hostVeth, configs.FastPathEgressProgFsMount, netlink.HANDLE_MIN_INGRESS,
+		fastPathFilterName, fastPathFilterPriority); err != nil {
+		return err
+	}
+	return attachTC(hostVeth, configs.FastPathIngressProgFsMount, netlink.HANDLE_MIN_EGRESS,
+		fastPathFilterName, fastPathFilterPriority)
+}
+
+// FastPathAttached reports whether both fast path programs are attached to
+// the host veth.
+func FastPathAttached(hostVeth netlink.Link) (bool, error) {
+	for _, parent := range []uint32{netlink.HANDLE_MIN_INGRESS, netlink.HANDLE_MIN_EGRESS} {
+		attached, err := tcAttached(hostVeth, parent, fastPathFilterName)
+		if err != nil || !attached {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// SetEndpoint makes the pod with the given addresses known to the datapath.
+func SetEndpoint(podIPs [][4]byte, ep Endpoint) error {
+	endpointMap, err := getPinnedMap(configs.EndpointMapFsMount)
+	if err != nil {
+		return err
+	}
+	defer endpointMap.Close()
+	for _, ip := range podIPs {
+		if err := endpointMap.Put(ip, ep); err != nil {
+			return fmt.Errorf("Failed to update map %s with key %v. Error = %v", configs.EndpointMapFsMount, ip, err)
+		}
+	}
+	return nil
+}
+
+// DelEndpoint removes the pod with the given addresses from the datapath. An
+// address already taken over by the host veth of another pod is left alone,
+// unless ifindex is 0.
+func DelEndpoint(ifindex uint32, podIPs [][4]byte) error {
+	endpointMap, err := getPinnedMap(configs.EndpointMapFsMount)
+	if err != nil {
+		return err
+	}
+	defer endpointMap.Close()
+	for _, ip := range podIPs {
+		var ep Endpoint
+		if err := endpointMap.Lookup(ip, &ep); err != nil {
+			if errors.Is(err, ebpf.ErrKeyNotExist) {
+				continue
+			}
+			return fmt.Errorf("Failed to lookup key %v in map %s. Error = %v", ip, configs.EndpointMapFsMount, err)
+		}
+		if ifindex != 0 && ep.Ifindex != ifindex {
+			continue
+		}
+		if err := endpointMap.Delete(ip); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return fmt.Errorf("Failed to delete key %v from map %s. Error = %v", ip, configs.EndpointMapFsMount, err)
+		}
+	}
+	return nil
+}
+
+// LookupEndpoint returns the endpoint of the pod with the given address.
+func LookupEndpoint(podIP [4]byte) (Endpoint, error) {
+	var ep Endpoint
+	endpointMap, err := getPinnedMap(configs.EndpointMapFsMount)
+	if err != nil {
+		return ep, err
+	}
+	defer endpointMap.Close()
+	if err := endpointMap.Lookup(podIP, &ep); err != nil {
+		return ep, fmt.Errorf("Pod %v has no endpoint in map %s: %v", net.IP(podIP[:]), configs.EndpointMapFsMount, err)
+	}
+	return ep, nil
+}
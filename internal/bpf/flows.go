@@ -0,0 +1,66 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package bpf
+
+import (
+	"github.com/redhat-et/patu/configs"
+)
+
+// SocketKey mirrors struct socket_key. Addresses and ports are in network
+// order, ports in the low 16 bits.
+type SocketKey struct {
+	SrcIP   [4]byte
+	DstIP   [4]byte
+	SrcPort uint32
+	DstPort uint32
+}
+
+// FlowRecord mirrors struct flow_record. It accounts the data one pod socket
+// sent over its lifetime. Times are CLOCK_MONOTONIC nanoseconds.
+type FlowRecord struct {
+	Key     SocketKey
+	StartNs uint64
+	EndNs   uint64
+	Bytes   uint64
+	Msgs    uint64
+}
+
+// FlowReader reads the records the datapath flushes when a socket closes.
+type FlowReader struct {
+	reader *eventReader
+}
+
+func NewFlowReader() (*FlowReader, error) {
+	reader, err := newEventReader(configs.FlowEventsFsMount)
+	if err != nil {
+		return nil, err
+	}
+	return &FlowReader{reader: reader}, nil
+}
+
+// Read blocks until the next record is available. It returns
+// ringbuf.ErrClosed once the reader is closed.
+func (r *FlowReader) Read() (*FlowRecord, error) {
+	record := &FlowRecord{}
+	if err := r.reader.read(record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+func (r *FlowReader) Close() error {
+	return r.reader.close()
+}
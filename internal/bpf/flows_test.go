@@ -0,0 +1,84 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bpf
+
+import (
+	"strings"
+	"testing"
+)
+
+// flowSample lays out a struct flow_record the way the datapath writes it to
+// the ring buffer.
+func flowSample(srcIP, dstIP [4]byte, srcPort, dstPort uint16, start, end, bytes, msgs uint64) []byte {
+	sample := make([]byte, 48)
+	copy(sample[0:], srcIP[:])
+	copy(sample[4:], dstIP[:])
+	nativeEndian.PutUint32(sample[8:], uint32(PolicyPort(srcPort)))
+	nativeEndian.PutUint32(sample[12:], uint32(PolicyPort(dstPort)))
+	nativeEndian.PutUint64(sample[16:], start)
+	nativeEndian.PutUint64(sample[24:], end)
+	nativeEndian.PutUint64(sample[32:], bytes)
+	nativeEndian.PutUint64(sample[40:], msgs)
+	return sample
+}
+
+func TestDecodeFlowRecord(t *testing.T) {
+	tests := []struct {
+		name    string
+		sample  []byte
+		want    FlowRecord
+		wantErr string
+	}{
+		{
+			name:   "record",
+			sample: flowSample([4]byte{10, 200, 0, 5}, [4]byte{10, 200, 0, 6}, 41734, 8080, 1000, 2500, 5120, 5),
+			want: FlowRecord{
+				Key: SocketKey{
+					SrcIP: [4]byte{10, 200, 0, 5}, DstIP: [4]byte{10, 200, 0, 6},
+					SrcPort: uint32(PolicyPort(41734)), DstPort: uint32(PolicyPort(8080)),
+				},
+				StartNs: 1000, EndNs: 2500, Bytes: 5120, Msgs: 5,
+			},
+		},
+		{
+			name:    "truncated record",
+			sample:  flowSample([4]byte{10, 200, 0, 5}, [4]byte{10, 200, 0, 6}, 41734, 8080, 1000, 2500, 5120, 5)[:40],
+			wantErr: "Failed to decode *bpf.FlowRecord",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got FlowRecord
+			err := decodeEvent(tt.sample, &got)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("decodeEvent() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decodeEvent() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("decodeEvent() = %+v, want %+v", got, tt.want)
+			}
+			if port := HostPort(uint16(got.Key.DstPort)); port != 8080 {
+				t.Errorf("destination port = %d, want 8080", port)
+			}
+		})
+	}
+}
@@ -16,12 +16,18 @@
 package bpf
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
+	"reflect"
 	"strings"
+	"unsafe"
 
 	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/ringbuf"
 	"github.com/redhat-et/patu/configs"
 )
 
@@ -29,6 +35,16 @@ const (
 	progPath = "./bpf"
 )
 
+// nativeEndian is the byte order cilium/ebpf uses to marshal map keys and
+// values, needed to lay out fields the datapath keeps in network order.
+var nativeEndian binary.ByteOrder = func() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
 func compileEbpfProg(debug bool) error {
 	cmd := exec.Command("make", "compile")
 	cmd.Dir = progPath
@@ -152,11 +168,11 @@ func unloadBpfMaps() error {
 }
 
 func getPinnedMap(mapMountPath string) (*ebpf.Map, error) {
-	configMap, err := ebpf.LoadPinnedMap(configs.ConfigMapFsMount, &ebpf.LoadPinOptions{})
+	pinnedMap, err := ebpf.LoadPinnedMap(mapMountPath, &ebpf.LoadPinOptions{})
 	if err != nil {
-		return nil, fmt.Errorf("Error loading config map %s : %v", configs.ConfigMapFsMount, err)
+		return nil, fmt.Errorf("Error loading pinned map %s : %v", mapMountPath, err)
 	}
-	return configMap, nil
+	return pinnedMap, nil
 }
 
 func updateConfigMap(mapMountPath string, mapKey uint32, mapValue []byte) error {
@@ -165,9 +181,102 @@ func updateConfigMap(mapMountPath string, mapKey uint32, mapValue []byte) error
 		return fmt.Errorf("Failed to get pinned config map %s", mapMountPath)
 
 	} else {
+		defer configMap.Close()
 		if err := configMap.Update(mapKey, mapValue, ebpf.UpdateAny); err != nil {
 			return fmt.Errorf("Failed to updated config map with key %d, value %x. Error = %v", mapKey, mapValue, err)
 		}
 	}
 	return nil
 }
+
+// enableConfigFlag turns on a datapath feature. Flags are stored in the last
+// word of the 16 byte config value.
+func enableConfigFlag(key int) error {
+	value := make([]byte, 16)
+	nativeEndian.PutUint32(value[12:], 1)
+	return updateConfigMap(configs.ConfigMapFsMount, uint32(key), value)
+}
+
+// syncPinnedMap makes the pinned map hold exactly the desired entries. Entries
+// are updated in place rather than flushing the map, so the datapath never
+// sees a partially populated map. Stale entries are deleted first, so a full
+// map makes room for the new ones. keyOut must point to a value of the map's
+// key type and is used to walk the existing entries.
+func syncPinnedMap(mapMountPath string, desired map[interface{}]interface{}, keyOut interface{}) error {
+	pinnedMap, err := getPinnedMap(mapMountPath)
+	if err != nil {
+		return err
+	}
+	defer pinnedMap.Close()
+
+	if len(desired) > int(pinnedMap.MaxEntries()) {
+		return fmt.Errorf("Map %s holds at most %d entries, %d are needed", mapMountPath, pinnedMap.MaxEntries(), len(desired))
+	}
+
+	var stale []interface{}
+	var value []byte
+	iter := pinnedMap.Iterate()
+	for iter.Next(keyOut, &value) {
+		key := reflect.ValueOf(keyOut).Elem().Interface()
+		if _, ok := desired[key]; !ok {
+			stale = append(stale, key)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return fmt.Errorf("Failed to iterate map %s : %v", mapMountPath, err)
+	}
+
+	for _, key := range stale {
+		if err := pinnedMap.Delete(key); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return fmt.Errorf("Failed to delete key %v from map %s. Error = %v", key, mapMountPath, err)
+		}
+	}
+	for key, value := range desired {
+		if err := pinnedMap.Put(key, value); err != nil {
+			return fmt.Errorf("Failed to update map %s with key %v. Error = %v", mapMountPath, key, err)
+		}
+	}
+	return nil
+}
+
+// eventReader decodes the records a datapath program writes to a pinned ring
+// buffer.
+type eventReader struct {
+	reader *ringbuf.Reader
+}
+
+func newEventReader(mapMountPath string) (*eventReader, error) {
+	events, err := getPinnedMap(mapMountPath)
+	if err != nil {
+		return nil, err
+	}
+	defer events.Close()
+
+	reader, err := ringbuf.NewReader(events)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open ring buffer %s : %v", mapMountPath, err)
+	}
+	return &eventReader{reader: reader}, nil
+}
+
+// read blocks until the next record is available and decodes it into event,
+// which must point to a struct mirroring the datapath record.
+func (r *eventReader) read(event interface{}) error {
+	record, err := r.reader.Read()
+	if err != nil {
+		return err
+	}
+	return decodeEvent(record.RawSample, event)
+}
+
+// decodeEvent decodes a record written by a datapath program into event.
+func decodeEvent(sample []byte, event interface{}) error {
+	if err := binary.Read(bytes.NewReader(sample), nativeEndian, event); err != nil {
+		return fmt.Errorf("Failed to decode %T: %v", event, err)
+	}
+	return nil
+}
+
+func (r *eventReader) close() error {
+	return r.reader.Close()
+}
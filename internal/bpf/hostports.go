@@ -0,0 +1,119 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package bpf
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/cilium/ebpf"
+	"github.com/redhat-et/patu/configs"
+)
+
+// HostPortEndpoint mirrors struct hostport_endpoint.
+type HostPortEndpoint struct {
+	IP    [4]byte
+	Port  uint16
+	Proto uint8
+	Pad   uint8
+}
+
+// NewHostPortEndpoint builds an endpoint in the datapath representation.
+func NewHostPortEndpoint(ip [4]byte, port uint16, proto uint8) HostPortEndpoint {
+	return HostPortEndpoint{IP: ip, Port: PolicyPort(port), Proto: proto}
+}
+
+// HostPortsAvailable reports whether patud loaded the host port map, i.e.
+// whether host ports can be translated at the socket layer.
+func HostPortsAvailable() bool {
+	hostPortMap, err := getPinnedMap(configs.HostPortMapFsMount)
+	if err != nil {
+		return false
+	}
+	hostPortMap.Close()
+	return true
+}
+
+// AddHostPorts forwards the host ports to their pod endpoints.
+func AddHostPorts(hostPorts map[HostPortEndpoint]HostPortEndpoint) error {
+	hostPortMap, err := getPinnedMap(configs.HostPortMapFsMount)
+	if err != nil {
+		return err
+	}
+	defer hostPortMap.Close()
+	for hostPort, backend := range hostPorts {
+		if err := hostPortMap.Put(hostPort, backend); err != nil {
+			return fmt.Errorf("Failed to update map %s with key %v. Error = %v", configs.HostPortMapFsMount, hostPort, err)
+		}
+	}
+	return nil
+}
+
+// DelHostPorts removes the host ports forwarded to any of the pod addresses.
+func DelHostPorts(podIPs [][4]byte) error {
+	hostPortMap, err := getPinnedMap(configs.HostPortMapFsMount)
+	if err != nil {
+		return err
+	}
+	defer hostPortMap.Close()
+
+	owned := make(map[[4]byte]bool, len(podIPs))
+	for _, ip := range podIPs {
+		owned[ip] = true
+	}
+	var stale []HostPortEndpoint
+	var hostPort, backend HostPortEndpoint
+	iter := hostPortMap.Iterate()
+	for iter.Next(&hostPort, &backend) {
+		if owned[backend.IP] {
+			stale = append(stale, hostPort)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return fmt.Errorf("Failed to iterate map %s : %v", configs.HostPortMapFsMount, err)
+	}
+	for _, key := range stale {
+		if err := hostPortMap.Delete(key); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return fmt.Errorf("Failed to delete key %v from map %s. Error = %v", key, configs.HostPortMapFsMount, err)
+		}
+	}
+	return nil
+}
+
+// LookupHostPort returns the pod endpoint a host port is forwarded to.
+func LookupHostPort(hostPort HostPortEndpoint) (HostPortEndpoint, error) {
+	var backend HostPortEndpoint
+	hostPortMap, err := getPinnedMap(configs.HostPortMapFsMount)
+	if err != nil {
+		return backend, err
+	}
+	defer hostPortMap.Close()
+	if err := hostPortMap.Lookup(hostPort, &backend); err != nil {
+		return backend, fmt.Errorf("Host port %v is not in map %s: %v", hostPort, configs.HostPortMapFsMount, err)
+	}
+	return backend, nil
+}
+
+// SyncLocalAddrs replaces the content of the local address map with the IPv4
+// addresses of the node, the ones host ports without a host IP are forwarded
+// on.
+func SyncLocalAddrs(addrs [][4]byte) error {
+	desired := make(map[interface{}]interface{}, len(addrs))
+	for _, addr := range addrs {
+		desired[addr] = uint8(1)
+	}
+	return syncPinnedMap(configs.LocalAddrMapFsMount, desired, &[4]byte{})
+}
@@ -0,0 +1,30 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package bpf
+
+import (
+	"github.com/redhat-et/patu/configs"
+)
+
+// SyncPodNamespaces replaces the content of the pod namespace map with the
+// namespace ids of the given pod addresses.
+func SyncPodNamespaces(namespaces map[[4]byte]uint32) error {
+	desired := make(map[interface{}]interface{}, len(namespaces))
+	for key, value := range namespaces {
+		desired[key] = value
+	}
+	return syncPinnedMap(configs.PodNamespaceMapFsMount, desired, &[4]byte{})
+}
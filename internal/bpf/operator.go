@@ -16,15 +16,23 @@
 package bpf
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	"os"
+	"strings"
 
+	"github.com/cilium/ebpf"
 	"github.com/redhat-et/patu/configs"
 )
 
+// Keys of cni_config_map, keep in sync with enum cni_config_key.
 const (
 	SUBNET_IP int = iota
+	CIDR
 	DEBUG
+	FLOW_RECORDS
+	TCP_TELEMETRY
 )
 
 func CompileEbpfProg() error {
@@ -96,4 +104,111 @@ func UpdateMapWithCidrConfig(ip net.IP) error {
 		return err
 	}
 	return nil
-}
\ No newline at end of file
+}
+
+// CheckDatapath verifies that patud has loaded the datapath programs and
+// configured the pod subnet, without which pods get no acceleration.
+func CheckDatapath() error {
+	for _, path := range []string{configs.SockopsProgFsMount, configs.SkMsgProgFsMount} {
+		prog, err := ebpf.LoadPinnedProgram(path, &ebpf.LoadPinOptions{ReadOnly: true})
+		if err != nil {
+			return fmt.Errorf("eBPF program %s is not loaded: %v", path, err)
+		}
+		prog.Close()
+	}
+
+	configMap, err := getPinnedMap(configs.ConfigMapFsMount)
+	if err != nil {
+		return err
+	}
+	defer configMap.Close()
+	var subnet [16]byte
+	if err := configMap.Lookup(uint32(SUBNET_IP), &subnet); err != nil || subnet == [16]byte{} {
+		return fmt.Errorf("Pod subnet is not configured in %s", configs.ConfigMapFsMount)
+	}
+	return nil
+}
+
+// PodSubnet returns the subnet whose connections the datapath accelerates. It
+// is the /16 of the configured subnet IP, keep in sync with in_subnet_range.
+func PodSubnet() (*net.IPNet, error) {
+	configMap, err := getPinnedMap(configs.ConfigMapFsMount)
+	if err != nil {
+		return nil, err
+	}
+	defer configMap.Close()
+	var subnet [16]byte
+	if err := configMap.Lookup(uint32(SUBNET_IP), &subnet); err != nil || subnet == [16]byte{} {
+		return nil, fmt.Errorf("Pod subnet is not configured in %s", configs.ConfigMapFsMount)
+	}
+	mask := net.CIDRMask(16, 32)
+	return &net.IPNet{IP: net.IP(subnet[:4]).Mask(mask), Mask: mask}, nil
+}
+
+// CheckSockopsAttached verifies the pinned sockops program is in effect on the
+// cgroup v2 hierarchy, without it no pod connection is accelerated.
+func CheckSockopsAttached() error {
+	id, err := pinnedProgramID(configs.SockopsProgFsMount)
+	if err != nil {
+		return err
+	}
+	mounts, err := cgroup2Mounts()
+	if err != nil {
+		return err
+	}
+	if len(mounts) == 0 {
+		return fmt.Errorf("No cgroup v2 hierarchy is mounted")
+	}
+	for _, mount := range mounts {
+		cgroup, err := os.Open(mount)
+		if err != nil {
+			return fmt.Errorf("Failed to open cgroup %s: %v", mount, err)
+		}
+		ids, err := queryPrograms(int(cgroup.Fd()), ebpf.AttachCGroupSockOps, bpfFQueryEffective)
+		cgroup.Close()
+		if err != nil {
+			return fmt.Errorf("Failed to query the programs of cgroup %s: %v", mount, err)
+		}
+		if containsID(ids, id) {
+			return nil
+		}
+	}
+	return fmt.Errorf("eBPF program %s is not attached to cgroup %s",
+		configs.SockopsProgFsMount, strings.Join(mounts, ", "))
+}
+
+// CheckSkMsgAttached verifies the pinned sk_msg program is attached to the
+// socket map, without it the sockets added by sockops are not redirected.
+// Kernels before 6.0 can't list the programs of a socket map, the check
+// passes there.
+func CheckSkMsgAttached() error {
+	id, err := pinnedProgramID(configs.SkMsgProgFsMount)
+	if err != nil {
+		return err
+	}
+	redirMap, err := getPinnedMap(configs.SockopsRedirMapFsMount)
+	if err != nil {
+		return err
+	}
+	defer redirMap.Close()
+	ids, err := queryPrograms(redirMap.FD(), ebpf.AttachSkMsgVerdict, 0)
+	if errors.Is(err, errQueryNotSupported) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to query the programs of %s: %v", configs.SockopsRedirMapFsMount, err)
+	}
+	if !containsID(ids, id) {
+		return fmt.Errorf("eBPF program %s is not attached to %s",
+			configs.SkMsgProgFsMount, configs.SockopsRedirMapFsMount)
+	}
+	return nil
+}
+
+func EnableFlowRecords() error {
+	return enableConfigFlag(FLOW_RECORDS)
+}
+
+func EnableTCPTelemetry() error {
+	return enableConfigFlag(TCP_TELEMETRY)
+}
@@ -0,0 +1,278 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package bpf
+
+import (
+	"encoding/binary"
+	"net"
+
+	"github.com/cilium/ebpf"
+	"github.com/redhat-et/patu/configs"
+	"github.com/vishvananda/netlink"
+)
+
+// Reserved identities, keep in sync with bpf/include/helpers/helpers.h
+const (
+	IdentityAny    uint32 = 0
+	IdentityWorld  uint32 = 1
+	PodIdentityMin uint32 = 256
+)
+
+const (
+	PolicyIngress uint8 = iota + 1
+	PolicyEgress
+)
+
+// Bits of the policy keys matched in full ahead of the port, keep in sync with
+// POLICY_KEY_PREFIXLEN and POLICY_PORT_KEY_PREFIXLEN.
+const (
+	policyKeyPortOffset     = 80
+	policyPortKeyPortOffset = 32
+)
+
+// MaxPolicyEntries is the capacity of the policy maps, MAX_ENTRIES.
+const MaxPolicyEntries = 65535
+
+// PolicyKey mirrors struct policy_key.
+type PolicyKey struct {
+	Prefixlen    uint32
+	Identity     uint32
+	PeerIdentity uint32
+	Direction    uint8
+	Pad          uint8
+	Port         uint16
+}
+
+// NewPolicyKey returns the key of a rule allowing peer to connect to the
+// ports of prefix.
+func NewPolicyKey(identity, peer uint32, direction uint8, prefix PortPrefix) PolicyKey {
+	return PolicyKey{
+		Prefixlen:    policyKeyPortOffset + uint32(prefix.Bits),
+		Identity:     identity,
+		PeerIdentity: peer,
+		Direction:    direction,
+		Port:         PolicyPort(prefix.Port),
+	}
+}
+
+// PolicyValue mirrors struct policy_value.
+type PolicyValue struct {
+	PolicyID uint32
+}
+
+// PolicyPortKey mirrors struct policy_port_key.
+type PolicyPortKey struct {
+	Prefixlen uint32
+	Identity  uint32
+	Port      uint16
+}
+
+// NewPolicyPortKey returns the key of the ports of prefix of an ingress
+// isolated pod.
+func NewPolicyPortKey(identity uint32, prefix PortPrefix) PolicyPortKey {
+	return PolicyPortKey{
+		Prefixlen: policyPortKeyPortOffset + uint32(prefix.Bits),
+		Identity:  identity,
+		Port:      PolicyPort(prefix.Port),
+	}
+}
+
+// PortPrefix is a range of ports sharing their first Bits bits, the ones of
+// Port. A prefix of 0 bits matches any port.
+type PortPrefix struct {
+	Port uint16
+	Bits uint8
+}
+
+// AnyPort is the prefix matching every port.
+var AnyPort = PortPrefix{}
+
+// PortPrefixes returns the fewest prefixes covering the ports first to last.
+func PortPrefixes(first, last uint16) []PortPrefix {
+	var prefixes []PortPrefix
+	for port := uint32(first); port <= uint32(last); {
+		// Widen the prefix as long as port is aligned on it and it doesn't
+		// go past last.
+		bits := 16
+		for bits > 0 {
+			size := uint32(1) << (17 - bits)
+			if port%size != 0 || port+size-1 > uint32(last) {
+				break
+			}
+			bits--
+		}
+		prefixes = append(prefixes, PortPrefix{Port: uint16(port), Bits: uint8(bits)})
+		port += 1 << (16 - bits)
+	}
+	return prefixes
+}
+
+// PolicyIsolation mirrors struct policy_isolation.
+type PolicyIsolation struct {
+	IngressPolicyID uint32
+	EgressPolicyID  uint32
+	Audit           uint32
+}
+
+// PolicyAuditEvent mirrors struct policy_audit_event.
+type PolicyAuditEvent struct {
+	SrcIP     [4]byte
+	DstIP     [4]byte
+	SrcPort   uint16
+	DstPort   uint16
+	PolicyID  uint32
+	Direction uint8
+	Pad1      uint8
+	Pad2      uint16
+}
+
+// PolicyState is the complete content of the policy maps. It is compiled from
+// the NetworkPolicy objects by patud and written to the datapath as a whole.
+type PolicyState struct {
+	Identities map[[4]byte]uint32
+	Isolation  map[uint32]PolicyIsolation
+	Rules      map[PolicyKey]PolicyValue
+	Ports      map[PolicyPortKey]PolicyValue
+}
+
+func NewPolicyState() *PolicyState {
+	return &PolicyState{
+		Identities: make(map[[4]byte]uint32),
+		Isolation:  make(map[uint32]PolicyIsolation),
+		Rules:      make(map[PolicyKey]PolicyValue),
+		Ports:      make(map[PolicyPortKey]PolicyValue),
+	}
+}
+
+// PolicyPort converts a port number to the network order representation used
+// by the datapath.
+func PolicyPort(port uint16) uint16 {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], port)
+	return nativeEndian.Uint16(b[:])
+}
+
+// HostPort converts a port in the datapath's network order representation
+// back to a port number.
+func HostPort(port uint16) uint16 {
+	var b [2]byte
+	nativeEndian.PutUint16(b[:], port)
+	return binary.BigEndian.Uint16(b[:])
+}
+
+// IPv4Key converts an IPv4 address to the network order representation used
+// as a map key by the datapath.
+func IPv4Key(ip net.IP) ([4]byte, bool) {
+	var key [4]byte
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return key, false
+	}
+	copy(key[:], ip4)
+	return key, true
+}
+
+// SyncPolicyState replaces the content of the policy maps with state. Allow
+// rules are written before identities and isolation, so a newly isolated pod
+// never sees its allowed peers denied.
+func SyncPolicyState(state *PolicyState) error {
+	rules := make(map[interface{}]interface{}, len(state.Rules))
+	for key, value := range state.Rules {
+		rules[key] = value
+	}
+	if err := syncPinnedMap(configs.PolicyMapFsMount, rules, &PolicyKey{}); err != nil {
+		return err
+	}
+
+	ports := make(map[interface{}]interface{}, len(state.Ports))
+	for key, value := range state.Ports {
+		ports[key] = value
+	}
+	if err := syncPinnedMap(configs.PolicyPortMapFsMount, ports, &PolicyPortKey{}); err != nil {
+		return err
+	}
+
+	identities := make(map[interface{}]interface{}, len(state.Identities))
+	for key, value := range state.Identities {
+		identities[key] = value
+	}
+	if err := syncPinnedMap(configs.PodIdentityMapFsMount, identities, &[4]byte{}); err != nil {
+		return err
+	}
+
+	isolation := make(map[interface{}]interface{}, len(state.Isolation))
+	for key, value := range state.Isolation {
+		isolation[key] = value
+	}
+	return syncPinnedMap(configs.PolicyIsolationMapFsMount, isolation, new(uint32))
+}
+
+const policyFilterName = "patu-policy"
+
+// PolicyIngressLoaded reports whether patud loaded the ingress policy program.
+func PolicyIngressLoaded() bool {
+	prog, err := ebpf.LoadPinnedProgram(configs.PolicyIngressProgFsMount, &ebpf.LoadPinOptions{ReadOnly: true})
+	if err != nil {
+		return false
+	}
+	prog.Close()
+	return true
+}
+
+// AttachPolicyIngress attaches the ingress policy program to the TC egress of
+// the host veth of a pod. It drops the connection requests to the pod that
+// its ingress policies deny, from local pods and remote clients alike.
+func AttachPolicyIngress(hostVeth netlink.Link) error {
+	if err := ensureClsact(hostVeth); err != nil {
+		return err
+	}
+	return attachTC(hostVeth, configs.PolicyIngressProgFsMount, netlink.HANDLE_MIN_EGRESS,
+		policyFilterName, policyFilterPriority)
+}
+
+// PolicyIngressAttached reports whether the ingress policy program is attached
+// to the host veth.
+func PolicyIngressAttached(hostVeth netlink.Link) (bool, error) {
+	return tcAttached(hostVeth, netlink.HANDLE_MIN_EGRESS, policyFilterName)
+}
+
+// PolicyAuditReader reads the would-be denials reported by the datapath for
+// pods in policy audit mode.
+type PolicyAuditReader struct {
+	reader *eventReader
+}
+
+func NewPolicyAuditReader() (*PolicyAuditReader, error) {
+	reader, err := newEventReader(configs.PolicyAuditEventsFsMount)
+	if err != nil {
+		return nil, err
+	}
+	return &PolicyAuditReader{reader: reader}, nil
+}
+
+// Read blocks until the next event is available. It returns ringbuf.ErrClosed
+// once the reader is closed.
+func (r *PolicyAuditReader) Read() (*PolicyAuditEvent, error) {
+	event := &PolicyAuditEvent{}
+	if err := r.reader.read(event); err != nil {
+		return nil, err
+	}
+	return event, nil
+}
+
+func (r *PolicyAuditReader) Close() error {
+	return r.reader.close()
+}
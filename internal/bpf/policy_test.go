@@ -0,0 +1,83 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bpf
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPortPrefixes(t *testing.T) {
+	tests := []struct {
+		name        string
+		first, last uint16
+		want        []PortPrefix
+	}{
+		{name: "single port", first: 80, last: 80, want: []PortPrefix{{Port: 80, Bits: 16}}},
+		{name: "aligned range", first: 8080, last: 8087, want: []PortPrefix{{Port: 8080, Bits: 13}}},
+		{name: "unaligned range", first: 79, last: 82, want: []PortPrefix{{Port: 79, Bits: 16}, {Port: 80, Bits: 15}, {Port: 82, Bits: 16}}},
+		{name: "every port", first: 0, last: 65535, want: []PortPrefix{AnyPort}},
+		{name: "last port", first: 65535, last: 65535, want: []PortPrefix{{Port: 65535, Bits: 16}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := PortPrefixes(tt.first, tt.last); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("PortPrefixes(%d, %d) = %v, want %v", tt.first, tt.last, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPortPrefixesCover(t *testing.T) {
+	for _, r := range [][2]uint16{{1, 65535}, {1024, 65535}, {3, 1000}, {30000, 32767}} {
+		covered := make(map[uint32]int)
+		prefixes := PortPrefixes(r[0], r[1])
+		for _, prefix := range prefixes {
+			size := uint32(1) << (16 - prefix.Bits)
+			if uint32(prefix.Port)%size != 0 {
+				t.Errorf("PortPrefixes(%d, %d) has the unaligned prefix %v", r[0], r[1], prefix)
+			}
+			for port := uint32(prefix.Port); port < uint32(prefix.Port)+size; port++ {
+				covered[port]++
+			}
+		}
+		if len(prefixes) > 30 {
+			t.Errorf("PortPrefixes(%d, %d) = %d prefixes, want at most 30", r[0], r[1], len(prefixes))
+		}
+		for port := uint32(0); port <= 65535; port++ {
+			want := 0
+			if port >= uint32(r[0]) && port <= uint32(r[1]) {
+				want = 1
+			}
+			if covered[port] != want {
+				t.Fatalf("PortPrefixes(%d, %d) covers port %d %d times, want %d", r[0], r[1], port, covered[port], want)
+			}
+		}
+	}
+}
+
+func TestPolicyKeys(t *testing.T) {
+	prefix := PortPrefix{Port: 8080, Bits: 15}
+	key := NewPolicyKey(256, 257, PolicyIngress, prefix)
+	if key.Prefixlen != 95 || key.Port != PolicyPort(8080) {
+		t.Errorf("NewPolicyKey() = %+v, want a prefix length of 95 and port 8080", key)
+	}
+	portKey := NewPolicyPortKey(256, AnyPort)
+	if portKey.Prefixlen != 32 || portKey.Port != 0 {
+		t.Errorf("NewPolicyPortKey() = %+v, want a prefix length of 32 and port 0", portKey)
+	}
+}
@@ -0,0 +1,127 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package bpf
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"unsafe"
+
+	"github.com/cilium/ebpf"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	bpfProgQuery       = 16
+	bpfFQueryEffective = 1 << 0
+)
+
+// progQueryAttr mirrors the BPF_PROG_QUERY part of union bpf_attr.
+type progQueryAttr struct {
+	targetFd    uint32
+	attachType  uint32
+	queryFlags  uint32
+	attachFlags uint32
+	progIDs     uint64
+	progCnt     uint32
+	_           uint32
+}
+
+// errQueryNotSupported is returned by queryPrograms when the kernel can't
+// list the programs attached to the target, e.g. to a sockmap before 6.0.
+var errQueryNotSupported = errors.New("program query not supported")
+
+// queryPrograms lists the ids of the programs attached to the target fd with
+// attachType.
+func queryPrograms(target int, attachType ebpf.AttachType, flags uint32) ([]ebpf.ProgramID, error) {
+	attr := progQueryAttr{
+		targetFd:   uint32(target),
+		attachType: uint32(attachType),
+		queryFlags: flags,
+	}
+	if err := progQuery(&attr); err != nil {
+		return nil, err
+	}
+	if attr.progCnt == 0 {
+		return nil, nil
+	}
+	ids := make([]ebpf.ProgramID, attr.progCnt)
+	attr.progIDs = uint64(uintptr(unsafe.Pointer(&ids[0])))
+	if err := progQuery(&attr); err != nil {
+		return nil, err
+	}
+	return ids[:attr.progCnt], nil
+}
+
+func progQuery(attr *progQueryAttr) error {
+	_, _, errno := unix.Syscall(unix.SYS_BPF, bpfProgQuery, uintptr(unsafe.Pointer(attr)), unsafe.Sizeof(*attr))
+	switch errno {
+	case 0:
+		return nil
+	case unix.EINVAL, unix.EOPNOTSUPP:
+		return errQueryNotSupported
+	default:
+		return errno
+	}
+}
+
+// pinnedProgramID returns the id of the program pinned at path.
+func pinnedProgramID(path string) (ebpf.ProgramID, error) {
+	prog, err := ebpf.LoadPinnedProgram(path, &ebpf.LoadPinOptions{ReadOnly: true})
+	if err != nil {
+		return 0, fmt.Errorf("eBPF program %s is not loaded: %v", path, err)
+	}
+	defer prog.Close()
+	info, err := prog.Info()
+	if err != nil {
+		return 0, fmt.Errorf("Failed to get info of eBPF program %s: %v", path, err)
+	}
+	id, ok := info.ID()
+	if !ok {
+		return 0, fmt.Errorf("Failed to get id of eBPF program %s", path)
+	}
+	return id, nil
+}
+
+// cgroup2Mounts lists the mount points of the cgroup v2 hierarchy.
+func cgroup2Mounts() ([]string, error) {
+	f, err := os.Open("/proc/self/mounts")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read mounts: %v", err)
+	}
+	defer f.Close()
+	var mounts []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 3 && fields[2] == "cgroup2" {
+			mounts = append(mounts, fields[1])
+		}
+	}
+	return mounts, scanner.Err()
+}
+
+func containsID(ids []ebpf.ProgramID, id ebpf.ProgramID) bool {
+	for _, found := range ids {
+		if found == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,85 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package bpf
+
+import (
+	"fmt"
+
+	"github.com/redhat-et/patu/configs"
+	"github.com/vishvananda/netlink"
+)
+
+// Node ports used for masqueraded connections, above the default ephemeral
+// port range of the node's own sockets.
+const (
+	SNATPortMin uint16 = 61000
+	SNATPortMax uint16 = 65535
+)
+
+const snatFilterName = "patu-snat"
+
+// SNATConfig mirrors struct snat_config. Addresses are in network order.
+type SNATConfig struct {
+	NodeIP      [4]byte
+	PodNet      [4]byte
+	PodMask     [4]byte
+	ClusterNet  [4]byte
+	ClusterMask [4]byte
+	PortMin     uint16
+	PortMax     uint16
+}
+
+// AttachSNAT attaches the SNAT programs to the TC hooks of the uplink.
+func AttachSNAT(uplink netlink.Link) error {
+	if err := ensureClsact(uplink); err != nil {
+		return err
+	}
+	if err := attachTC(uplink, configs.SnatEgressProgFsMount, netlink.HANDLE_MIN_EGRESS,
+		snatFilterName, snatFilterPriority); err != nil {
+		return err
+	}
+	return attachTC(uplink, configs.SnatIngressProgFsMount, netlink.HANDLE_MIN_INGRESS,
+		snatFilterName, snatFilterPriority)
+}
+
+// ConfigureSNAT enables the SNAT programs, which let all packets through
+// untouched until then.
+func ConfigureSNAT(cfg SNATConfig) error {
+	configMap, err := getPinnedMap(configs.SnatConfigMapFsMount)
+	if err != nil {
+		return err
+	}
+	defer configMap.Close()
+	if err := configMap.Put(uint32(0), cfg); err != nil {
+		return fmt.Errorf("Failed to update map %s. Error = %v", configs.SnatConfigMapFsMount, err)
+	}
+	return nil
+}
+
+// SNATEnabled reports whether patud has enabled the eBPF SNAT of pod
+// traffic.
+func SNATEnabled() bool {
+	configMap, err := getPinnedMap(configs.SnatConfigMapFsMount)
+	if err != nil {
+		return false
+	}
+	defer configMap.Close()
+	var cfg SNATConfig
+	if err := configMap.Lookup(uint32(0), &cfg); err != nil {
+		return false
+	}
+	return cfg.NodeIP != [4]byte{}
+}
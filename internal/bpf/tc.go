@@ -0,0 +1,90 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package bpf
+
+import (
+	"fmt"
+
+	"github.com/cilium/ebpf"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// TC filter priorities, filters of different features share the hooks of a
+// link. The policy filter comes first, so denied packets are not charged to
+// the bandwidth of the pod.
+const (
+	policyFilterPriority    uint16 = 1
+	bandwidthFilterPriority uint16 = 2
+	snatFilterPriority      uint16 = 3
+	fastPathFilterPriority  uint16 = 4
+)
+
+func ensureClsact(link netlink.Link) error {
+	qdisc := &netlink.GenericQdisc{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+			Parent:    netlink.HANDLE_CLSACT,
+		},
+		QdiscType: "clsact",
+	}
+	if err := netlink.QdiscReplace(qdisc); err != nil {
+		return fmt.Errorf("Failed to add clsact qdisc to %s: %v", link.Attrs().Name, err)
+	}
+	return nil
+}
+
+// attachTC attaches a pinned classifier to the TC ingress or egress of the
+// link, parent being netlink.HANDLE_MIN_INGRESS or HANDLE_MIN_EGRESS. The
+// clsact qdisc must be in place.
+func attachTC(link netlink.Link, progPath string, parent uint32, name string, priority uint16) error {
+	prog, err := ebpf.LoadPinnedProgram(progPath, &ebpf.LoadPinOptions{ReadOnly: true})
+	if err != nil {
+		return fmt.Errorf("eBPF program %s is not loaded: %v", progPath, err)
+	}
+	defer prog.Close()
+	filter := &netlink.BpfFilter{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: link.Attrs().Index,
+			Parent:    parent,
+			Handle:    netlink.MakeHandle(0, 1),
+			Protocol:  unix.ETH_P_ALL,
+			Priority:  priority,
+		},
+		Fd:           prog.FD(),
+		Name:         name,
+		DirectAction: true,
+	}
+	if err := netlink.FilterReplace(filter); err != nil {
+		return fmt.Errorf("Failed to attach %s to %s: %v", progPath, link.Attrs().Name, err)
+	}
+	return nil
+}
+
+// tcAttached reports whether a classifier named name is attached to the hook.
+func tcAttached(link netlink.Link, parent uint32, name string) (bool, error) {
+	filters, err := netlink.FilterList(link, parent)
+	if err != nil {
+		return false, fmt.Errorf("Failed to list filters of %s: %v", link.Attrs().Name, err)
+	}
+	for _, filter := range filters {
+		if bpfFilter, ok := filter.(*netlink.BpfFilter); ok && bpfFilter.Name == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
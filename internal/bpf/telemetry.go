@@ -0,0 +1,103 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package bpf
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/cilium/ebpf"
+	"github.com/redhat-et/patu/configs"
+)
+
+// TCPRTTBuckets is the number of RTT histogram buckets, keep in sync with
+// TCP_RTT_BUCKETS. Bucket i counts samples below 2^i microseconds, the last
+// bucket counts everything above.
+const TCPRTTBuckets = 24
+
+// TCPStatsKey mirrors struct tcp_stats_key.
+type TCPStatsKey struct {
+	LocalIP  [4]byte
+	RemoteIP [4]byte
+}
+
+// TCPStats mirrors struct tcp_stats.
+type TCPStats struct {
+	RTTBuckets [TCPRTTBuckets]uint64
+	RTTSumUs   uint64
+	RTTCount   uint64
+	Retrans    uint64
+}
+
+// TCPStatsEntries returns the TCP telemetry the datapath aggregated per pair
+// of addresses.
+func TCPStatsEntries() (map[TCPStatsKey]TCPStats, error) {
+	statsMap, err := getPinnedMap(configs.TCPStatsMapFsMount)
+	if err != nil {
+		return nil, err
+	}
+	defer statsMap.Close()
+
+	entries := make(map[TCPStatsKey]TCPStats)
+	var key TCPStatsKey
+	var stats TCPStats
+	iter := statsMap.Iterate()
+	for iter.Next(&key, &stats) {
+		entries[key] = stats
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("Failed to iterate map %s : %v", configs.TCPStatsMapFsMount, err)
+	}
+	return entries, nil
+}
+
+// DelTCPStats removes the telemetry of the connections from and to the given
+// addresses, so a pod reusing one of them doesn't inherit the statistics of
+// the previous one. Nothing is done if patud has not loaded the map.
+func DelTCPStats(podIPs [][4]byte) error {
+	statsMap, err := ebpf.LoadPinnedMap(configs.TCPStatsMapFsMount, &ebpf.LoadPinOptions{})
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Error loading pinned map %s : %v", configs.TCPStatsMapFsMount, err)
+	}
+	defer statsMap.Close()
+
+	addrs := make(map[[4]byte]bool, len(podIPs))
+	for _, ip := range podIPs {
+		addrs[ip] = true
+	}
+	var stale []TCPStatsKey
+	var key TCPStatsKey
+	var stats TCPStats
+	iter := statsMap.Iterate()
+	for iter.Next(&key, &stats) {
+		if addrs[key.LocalIP] || addrs[key.RemoteIP] {
+			stale = append(stale, key)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return fmt.Errorf("Failed to iterate map %s : %v", configs.TCPStatsMapFsMount, err)
+	}
+	for _, key := range stale {
+		if err := statsMap.Delete(key); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return fmt.Errorf("Failed to delete key %v from map %s. Error = %v", key, configs.TCPStatsMapFsMount, err)
+		}
+	}
+	return nil
+}
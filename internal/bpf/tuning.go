@@ -0,0 +1,44 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package bpf
+
+import (
+	"github.com/redhat-et/patu/configs"
+)
+
+// TCPCongestionNameMax is the size of the congestion control name, including
+// the terminating NUL. Keep in sync with TCP_CA_NAME_MAX.
+const TCPCongestionNameMax = 16
+
+// TCPTuning mirrors struct tcp_tuning.
+type TCPTuning struct {
+	Congestion     [TCPCongestionNameMax]byte
+	InitCwnd       uint32
+	RTOMinUs       uint32
+	KeepaliveIdle  uint32
+	KeepaliveIntvl uint32
+	KeepaliveCnt   uint32
+}
+
+// SyncTCPTuning replaces the content of the TCP tuning map with the settings
+// of the given pod addresses.
+func SyncTCPTuning(tuning map[[4]byte]TCPTuning) error {
+	desired := make(map[interface{}]interface{}, len(tuning))
+	for key, value := range tuning {
+		desired[key] = value
+	}
+	return syncPinnedMap(configs.TCPTuningMapFsMount, desired, &[4]byte{})
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package bpf
+
+import (
+	"fmt"
+
+	"github.com/cilium/ebpf"
+	"github.com/redhat-et/patu/configs"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// XDP attach modes. Native XDP runs in the driver of the NIC, generic XDP
+// runs on any interface, veths included, after the socket buffer is
+// allocated.
+const (
+	XDPModeNative  = "native"
+	XDPModeGeneric = "generic"
+)
+
+func xdpFlags(mode string) (int, error) {
+	switch mode {
+	case XDPModeNative:
+		return nl.XDP_FLAGS_DRV_MODE, nil
+	case XDPModeGeneric:
+		return nl.XDP_FLAGS_SKB_MODE, nil
+	}
+	return 0, fmt.Errorf("Unknown XDP mode %q, expected %s or %s", mode, XDPModeNative, XDPModeGeneric)
+}
+
+// AttachXDP attaches the XDP program to the uplink, replacing any program
+// already attached in the same mode.
+func AttachXDP(link netlink.Link, mode string) error {
+	flags, err := xdpFlags(mode)
+	if err != nil {
+		return err
+	}
+	prog, err := ebpf.LoadPinnedProgram(configs.XdpProgFsMount, &ebpf.LoadPinOptions{ReadOnly: true})
+	if err != nil {
+		return fmt.Errorf("eBPF program %s is not loaded: %v", configs.XdpProgFsMount, err)
+	}
+	defer prog.Close()
+	if err := netlink.LinkSetXdpFdWithFlags(link, prog.FD(), flags); err != nil {
+		return fmt.Errorf("Failed to attach %s to %s in %s mode: %v", configs.XdpProgFsMount, link.Attrs().Name, mode, err)
+	}
+	return nil
+}
+
+// DetachXDP detaches the XDP program from the uplink. The program would
+// otherwise keep the datapath maps of the previous patud alive.
+func DetachXDP(link netlink.Link, mode string) error {
+	flags, err := xdpFlags(mode)
+	if err != nil {
+		return err
+	}
+	if err := netlink.LinkSetXdpFdWithFlags(link, -1, flags); err != nil {
+		return fmt.Errorf("Failed to detach XDP from %s: %v", link.Attrs().Name, err)
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bpf
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/vishvananda/netlink/nl"
+)
+
+func TestXDPFlags(t *testing.T) {
+	tests := []struct {
+		mode    string
+		want    int
+		wantErr string
+	}{
+		{mode: XDPModeNative, want: nl.XDP_FLAGS_DRV_MODE},
+		{mode: XDPModeGeneric, want: nl.XDP_FLAGS_SKB_MODE},
+		{mode: "offload", wantErr: `Unknown XDP mode "offload", expected native or generic`},
+		{mode: "", wantErr: `Unknown XDP mode ""`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			got, err := xdpFlags(tt.mode)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("xdpFlags(%q) error = %v, want %q", tt.mode, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("xdpFlags(%q) error = %v", tt.mode, err)
+			}
+			if got != tt.want {
+				t.Errorf("xdpFlags(%q) = %#x, want %#x", tt.mode, got, tt.want)
+			}
+		})
+	}
+}
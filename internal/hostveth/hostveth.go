@@ -0,0 +1,57 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+// Package hostveth names the host end of pod veths after the container and
+// labels it with the pod, so operators, patud and CLI tooling can map the
+// interfaces, their ifindexes and the datapath entries keyed by them back to
+// pods without querying the runtime.
+package hostveth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+const (
+	// NetworkManager ignores interfaces named veth*. The hash fills the 15
+	// bytes of an interface name, random veth names only have 8 hex digits.
+	namePrefix = "veth"
+	hashLen    = 11
+)
+
+// Name returns the host veth name of the container interface ifName. The
+// interface is part of the hash, a container may have several.
+func Name(containerID, ifName string) string {
+	sum := sha256.Sum256([]byte(containerID + "/" + ifName))
+	return namePrefix + hex.EncodeToString(sum[:])[:hashLen]
+}
+
+// Alias returns the alias of a host veth, namespace/pod/containerID. The
+// namespace and pod are empty for containers not run by the kubelet.
+func Alias(namespace, pod, containerID string) string {
+	return fmt.Sprintf("%s/%s/%s", namespace, pod, containerID)
+}
+
+// ParseAlias returns the pod and container of a host veth alias, ok is false
+// if the interface wasn't labeled by Patu CNI.
+func ParseAlias(alias string) (namespace, pod, containerID string, ok bool) {
+	parts := strings.Split(alias, "/")
+	if len(parts) != 3 || parts[2] == "" {
+		return "", "", "", false
+	}
+	return parts[0], parts[1], parts[2], true
+}
@@ -0,0 +1,89 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package hostveth
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestName(t *testing.T) {
+	tests := []struct {
+		name        string
+		containerID string
+		ifName      string
+	}{
+		{name: "short container ID", containerID: "abc", ifName: "eth0"},
+		{name: "full container ID", containerID: strings.Repeat("0123456789abcdef", 4), ifName: "eth0"},
+		{name: "second interface", containerID: "abc", ifName: "net1"},
+	}
+	seen := make(map[string]string)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Name(tt.containerID, tt.ifName)
+			if len(got) != 15 || !strings.HasPrefix(got, namePrefix) {
+				t.Errorf("Name() = %q, want 15 bytes with the %q prefix", got, namePrefix)
+			}
+			if again := Name(tt.containerID, tt.ifName); again != got {
+				t.Errorf("Name() = %q then %q, want a stable name", got, again)
+			}
+			if other, ok := seen[got]; ok {
+				t.Errorf("Name() = %q, same as %s", got, other)
+			}
+			seen[got] = tt.name
+		})
+	}
+}
+
+func TestAlias(t *testing.T) {
+	tests := []struct {
+		name        string
+		alias       string
+		namespace   string
+		pod         string
+		containerID string
+		ok          bool
+	}{
+		{
+			name:        "pod",
+			alias:       Alias("default", "web", "abc"),
+			namespace:   "default",
+			pod:         "web",
+			containerID: "abc",
+			ok:          true,
+		},
+		{
+			name:        "container without a pod",
+			alias:       Alias("", "", "abc"),
+			containerID: "abc",
+			ok:          true,
+		},
+		{name: "empty", alias: ""},
+		{name: "not labeled by patu", alias: "uplink"},
+		{name: "missing container", alias: "default/web/"},
+		{name: "too many parts", alias: "default/web/abc/def"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			namespace, pod, containerID, ok := ParseAlias(tt.alias)
+			if namespace != tt.namespace || pod != tt.pod || containerID != tt.containerID || ok != tt.ok {
+				t.Errorf("ParseAlias(%q) = %q, %q, %q, %v, want %q, %q, %q, %v", tt.alias,
+					namespace, pod, containerID, ok, tt.namespace, tt.pod, tt.containerID, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,173 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package ipam implements patu's built-in IPAM. patud publishes the pod CIDRs
+// of its node and the CNI plugin allocates pod addresses from them.
+package ipam
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/ip"
+)
+
+// Type is the IPAM type selecting the built-in IPAM in the CNI config.
+const Type = "patu"
+
+// Allocate assigns the container interface of network an address from every
+// pod CIDR. A requested address is used for the pod CIDR containing it, the
+// others get the next free address. Addresses the interface already holds are
+// returned again, so a repeated ADD doesn't leak addresses.
+func (s *Store) Allocate(cidrs []*net.IPNet, network, containerID, ifName string, requested []net.IP) ([]*current.IPConfig, error) {
+	allocations, err := s.Allocations()
+	if err != nil {
+		return nil, err
+	}
+	bootID := currentBootID()
+
+	assigned := make(map[int]net.IP)
+	for _, req := range requested {
+		idx := -1
+		for i, cidr := range cidrs {
+			if cidr.Contains(req) {
+				idx = i
+				break
+			}
+		}
+		if idx < 0 {
+			return nil, fmt.Errorf("requested address %s is not in the pod CIDRs %v", req, cidrs)
+		}
+		if _, ok := assigned[idx]; ok {
+			return nil, fmt.Errorf("more than one address requested from pod CIDR %s", cidrs[idx])
+		}
+		if err := checkRequested(cidrs[idx], req, allocations, network, containerID, ifName, bootID); err != nil {
+			return nil, err
+		}
+		if v4 := req.To4(); v4 != nil {
+			req = v4
+		}
+		assigned[idx] = req
+	}
+
+	var ips []*current.IPConfig
+	for i, cidr := range cidrs {
+		addr, ok := assigned[i]
+		if !ok {
+			addr = owned(allocations, cidr, network, containerID, ifName)
+		}
+		if addr == nil {
+			if addr, err = s.nextFree(cidr, allocations, bootID); err != nil {
+				return nil, err
+			}
+		}
+		// Drop what the interface held before, its address may have changed
+		// with the request.
+		if prev := owned(allocations, cidr, network, containerID, ifName); prev != nil && !prev.Equal(addr) {
+			if err := s.Release(prev.String()); err != nil {
+				return nil, err
+			}
+		}
+		err = s.reserve(addr, &Allocation{
+			Network:     network,
+			ContainerID: containerID,
+			IfName:      ifName,
+			BootID:      bootID,
+			Created:     time.Now(),
+		})
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			s.setLastReserved(cidr, addr)
+		}
+		ips = append(ips, &current.IPConfig{
+			Address: net.IPNet{IP: addr, Mask: cidr.Mask},
+			Gateway: Gateway(cidr),
+		})
+	}
+	return ips, nil
+}
+
+// checkRequested verifies that a requested address can be assigned to the
+// container interface.
+func checkRequested(cidr *net.IPNet, req net.IP, allocations map[string]*Allocation, network, containerID, ifName, bootID string) error {
+	if req.Equal(cidr.IP.Mask(cidr.Mask)) || req.Equal(Gateway(cidr)) || req.Equal(lastIP(cidr)) {
+		return fmt.Errorf("requested address %s is reserved in pod CIDR %s", req, cidr)
+	}
+	a, taken := allocations[req.String()]
+	if taken && !a.stale(bootID) && !a.ownedBy(network, containerID, ifName) {
+		return fmt.Errorf("requested address %s is already allocated to container %s", req, a.ContainerID)
+	}
+	return nil
+}
+
+func owned(allocations map[string]*Allocation, cidr *net.IPNet, network, containerID, ifName string) net.IP {
+	for addr, a := range allocations {
+		ip := net.ParseIP(addr)
+		if a.ownedBy(network, containerID, ifName) && cidr.Contains(ip) {
+			return ip
+		}
+	}
+	return nil
+}
+
+// nextFree walks the CIDR round robin from the last reserved address, so a
+// released address isn't handed out again right away. The network address,
+// the gateway and the last address of the CIDR are never allocated.
+func (s *Store) nextFree(cidr *net.IPNet, allocations map[string]*Allocation, bootID string) (net.IP, error) {
+	first := ip.NextIP(Gateway(cidr))
+	last := lastIP(cidr)
+	if ip.Cmp(first, last) >= 0 {
+		return nil, fmt.Errorf("pod CIDR %s is too small", cidr)
+	}
+
+	start := s.lastReserved(cidr)
+	if start == nil || ip.Cmp(start, first) < 0 || ip.Cmp(start, last) >= 0 {
+		start = ip.PrevIP(first)
+	}
+	candidate := start
+	for {
+		candidate = ip.NextIP(candidate)
+		if ip.Cmp(candidate, last) >= 0 {
+			candidate = first
+		}
+		a, taken := allocations[candidate.String()]
+		if !taken || a.stale(bootID) {
+			return candidate, nil
+		}
+		if candidate.Equal(start) || (ip.Cmp(start, first) < 0 && candidate.Equal(ip.PrevIP(last))) {
+			return nil, fmt.Errorf("no free address left in pod CIDR %s", cidr)
+		}
+	}
+}
+
+// Gateway returns the address the bridge uses as the pods' gateway, the
+// first address of the CIDR.
+func Gateway(cidr *net.IPNet) net.IP {
+	return ip.NextIP(cidr.IP.Mask(cidr.Mask))
+}
+
+func lastIP(cidr *net.IPNet) net.IP {
+	network := cidr.IP.Mask(cidr.Mask)
+	last := make(net.IP, len(network))
+	for i := range network {
+		last[i] = network[i] | ^cidr.Mask[i]
+	}
+	return last
+}
@@ -0,0 +1,234 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ipam
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func mustCIDR(t *testing.T, s string) *net.IPNet {
+	t.Helper()
+	_, cidr, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cidr
+}
+
+func openTestStore(t *testing.T) *Store {
+	t.Helper()
+	s, err := OpenStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+type allocateCall struct {
+	network     string
+	containerID string
+	ifName      string
+	requested   string
+}
+
+func (c allocateCall) do(s *Store, cidr *net.IPNet) (string, error) {
+	var requested []net.IP
+	if c.requested != "" {
+		requested = append(requested, net.ParseIP(c.requested))
+	}
+	ips, err := s.Allocate([]*net.IPNet{cidr}, c.network, c.containerID, c.ifName, requested)
+	if err != nil {
+		return "", err
+	}
+	return ips[0].Address.IP.String(), nil
+}
+
+func TestAllocate(t *testing.T) {
+	pod := allocateCall{network: "patu", containerID: "c1", ifName: "eth0"}
+	tests := []struct {
+		name    string
+		cidr    string
+		before  []allocateCall
+		call    allocateCall
+		want    string
+		wantErr string
+	}{
+		{
+			name: "first address after the gateway",
+			cidr: "10.0.0.0/24",
+			call: pod,
+			want: "10.0.0.2",
+		},
+		{
+			name:   "next address",
+			cidr:   "10.0.0.0/24",
+			before: []allocateCall{{network: "patu", containerID: "c0", ifName: "eth0"}},
+			call:   pod,
+			want:   "10.0.0.3",
+		},
+		{
+			name:   "repeated ADD keeps the address",
+			cidr:   "10.0.0.0/24",
+			before: []allocateCall{pod},
+			call:   pod,
+			want:   "10.0.0.2",
+		},
+		{
+			name:   "other interface of the container",
+			cidr:   "10.0.0.0/24",
+			before: []allocateCall{pod},
+			call:   allocateCall{network: "patu", containerID: "c1", ifName: "net1"},
+			want:   "10.0.0.3",
+		},
+		{
+			name:   "same interface on another network",
+			cidr:   "10.0.0.0/24",
+			before: []allocateCall{pod},
+			call:   allocateCall{network: "other", containerID: "c1", ifName: "eth0"},
+			want:   "10.0.0.3",
+		},
+		{
+			name: "requested address",
+			cidr: "10.0.0.0/24",
+			call: allocateCall{network: "patu", containerID: "c1", ifName: "eth0", requested: "10.0.0.42"},
+			want: "10.0.0.42",
+		},
+		{
+			name:   "requested address replaces the previous one",
+			cidr:   "10.0.0.0/24",
+			before: []allocateCall{pod},
+			call:   allocateCall{network: "patu", containerID: "c1", ifName: "eth0", requested: "10.0.0.42"},
+			want:   "10.0.0.42",
+		},
+		{
+			name:    "requested address outside the pod CIDRs",
+			cidr:    "10.0.0.0/24",
+			call:    allocateCall{network: "patu", containerID: "c1", ifName: "eth0", requested: "10.0.1.2"},
+			wantErr: "is not in the pod CIDRs",
+		},
+		{
+			name:    "requested gateway",
+			cidr:    "10.0.0.0/24",
+			call:    allocateCall{network: "patu", containerID: "c1", ifName: "eth0", requested: "10.0.0.1"},
+			wantErr: "is reserved",
+		},
+		{
+			name:    "requested broadcast address",
+			cidr:    "10.0.0.0/24",
+			call:    allocateCall{network: "patu", containerID: "c1", ifName: "eth0", requested: "10.0.0.255"},
+			wantErr: "is reserved",
+		},
+		{
+			name:    "requested address of another container",
+			cidr:    "10.0.0.0/24",
+			before:  []allocateCall{{network: "patu", containerID: "c0", ifName: "eth0", requested: "10.0.0.42"}},
+			call:    allocateCall{network: "patu", containerID: "c1", ifName: "eth0", requested: "10.0.0.42"},
+			wantErr: "already allocated to container c0",
+		},
+		{
+			name:    "requested address of another network",
+			cidr:    "10.0.0.0/24",
+			before:  []allocateCall{{network: "other", containerID: "c1", ifName: "eth0", requested: "10.0.0.42"}},
+			call:    allocateCall{network: "patu", containerID: "c1", ifName: "eth0", requested: "10.0.0.42"},
+			wantErr: "already allocated to container c1",
+		},
+		{
+			name:    "pod CIDR exhausted",
+			cidr:    "10.0.0.0/30",
+			before:  []allocateCall{{network: "patu", containerID: "c0", ifName: "eth0"}},
+			call:    pod,
+			wantErr: "no free address left",
+		},
+		{
+			name:    "pod CIDR too small",
+			cidr:    "10.0.0.0/31",
+			call:    pod,
+			wantErr: "is too small",
+		},
+		{
+			name: "IPv6",
+			cidr: "fd00::/64",
+			call: pod,
+			want: "fd00::2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := openTestStore(t)
+			cidr := mustCIDR(t, tt.cidr)
+			for _, c := range tt.before {
+				if _, err := c.do(s, cidr); err != nil {
+					t.Fatalf("allocation before the test failed: %v", err)
+				}
+			}
+			got, err := tt.call.do(s, cidr)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Allocate() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Allocate() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Allocate() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReleaseOwner(t *testing.T) {
+	tests := []struct {
+		name    string
+		network string
+		want    []string
+	}{
+		{name: "own network", network: "patu", want: []string{"10.0.0.3"}},
+		{name: "other network", network: "other", want: []string{"10.0.0.2"}},
+		{name: "unknown network", network: "none", want: []string{"10.0.0.2", "10.0.0.3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := openTestStore(t)
+			cidr := mustCIDR(t, "10.0.0.0/24")
+			for _, network := range []string{"patu", "other"} {
+				if _, err := (allocateCall{network: network, containerID: "c1", ifName: "eth0"}).do(s, cidr); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := s.ReleaseOwner(tt.network, "c1", "eth0"); err != nil {
+				t.Fatalf("ReleaseOwner() error = %v", err)
+			}
+			allocations, err := s.Allocations()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(allocations) != len(tt.want) {
+				t.Fatalf("%d allocations left, want %v", len(allocations), tt.want)
+			}
+			for _, addr := range tt.want {
+				if _, ok := allocations[addr]; !ok {
+					t.Errorf("allocation of %s was released", addr)
+				}
+			}
+		})
+	}
+}
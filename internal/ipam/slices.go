@@ -0,0 +1,170 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ipam
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const slicesFile = "namespace-slices.json"
+
+// NamespaceSlices returns the slices of cidrs assigned to namespace, one per
+// pod CIDR, assigning free slices first. IPv4 slices have the prefix length
+// ones, IPv6 slices as many host bits as the IPv4 ones. The first slice of
+// every pod CIDR is left out, its first address is the gateway of the shared
+// bridge.
+func (s *Store) NamespaceSlices(cidrs []*net.IPNet, namespace string, ones int) ([]*net.IPNet, error) {
+	assigned, err := s.readSlices()
+	if err != nil {
+		return nil, err
+	}
+	hostBits := 32 - ones
+
+	var slices []*net.IPNet
+	changed := false
+	for _, cidr := range cidrs {
+		cidrOnes, bits := cidr.Mask.Size()
+		sliceOnes := bits - hostBits
+		if sliceOnes <= cidrOnes {
+			return nil, fmt.Errorf("pod CIDR %s is too small for /%d namespace slices", cidr, sliceOnes)
+		}
+
+		var slice *net.IPNet
+		for key, owner := range assigned {
+			_, candidate, err := net.ParseCIDR(key)
+			if err == nil && owner == namespace && cidr.Contains(candidate.IP) {
+				slice = candidate
+				break
+			}
+		}
+		if slice == nil {
+			count := new(big.Int).Lsh(big.NewInt(1), uint(sliceOnes-cidrOnes))
+			for i := big.NewInt(1); i.Cmp(count) < 0; i.Add(i, big.NewInt(1)) {
+				candidate := nthSlice(cidr, sliceOnes, i)
+				if _, taken := assigned[candidate.String()]; !taken {
+					slice = candidate
+					break
+				}
+			}
+			if slice == nil {
+				return nil, fmt.Errorf("no free namespace slice left in pod CIDR %s", cidr)
+			}
+			assigned[slice.String()] = namespace
+			changed = true
+		}
+		slices = append(slices, slice)
+	}
+	if changed {
+		if err := s.writeSlices(assigned); err != nil {
+			return nil, err
+		}
+	}
+	return slices, nil
+}
+
+// SliceNamespaces returns the namespaces slices are assigned to.
+func (s *Store) SliceNamespaces() ([]string, error) {
+	assigned, err := s.readSlices()
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var namespaces []string
+	for _, namespace := range assigned {
+		if !seen[namespace] {
+			seen[namespace] = true
+			namespaces = append(namespaces, namespace)
+		}
+	}
+	sort.Strings(namespaces)
+	return namespaces, nil
+}
+
+// ReleaseNamespaceSlices frees the slices of namespace. It fails if addresses
+// are still allocated in them.
+func (s *Store) ReleaseNamespaceSlices(namespace string) error {
+	assigned, err := s.readSlices()
+	if err != nil {
+		return err
+	}
+	allocations, err := s.Allocations()
+	if err != nil {
+		return err
+	}
+	bootID := currentBootID()
+	for key, owner := range assigned {
+		if owner != namespace {
+			continue
+		}
+		_, slice, err := net.ParseCIDR(key)
+		if err != nil {
+			delete(assigned, key)
+			continue
+		}
+		for addr, a := range allocations {
+			if slice.Contains(net.ParseIP(addr)) && !a.stale(bootID) {
+				return fmt.Errorf("namespace slice %s is still in use by container %s", slice, a.ContainerID)
+			}
+		}
+		delete(assigned, key)
+	}
+	return s.writeSlices(assigned)
+}
+
+// nthSlice returns the slice of cidr with prefix length ones at index i.
+func nthSlice(cidr *net.IPNet, ones int, i *big.Int) *net.IPNet {
+	_, bits := cidr.Mask.Size()
+	network := cidr.IP.Mask(cidr.Mask)
+	offset := new(big.Int).Lsh(i, uint(bits-ones))
+	value := new(big.Int).Add(new(big.Int).SetBytes(network), offset)
+	ip := make(net.IP, len(network))
+	value.FillBytes(ip)
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(ones, bits)}
+}
+
+func (s *Store) readSlices() (map[string]string, error) {
+	assigned := make(map[string]string)
+	data, err := os.ReadFile(filepath.Join(s.dir, slicesFile))
+	if os.IsNotExist(err) {
+		return assigned, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read namespace slices: %v", err)
+	}
+	if err := json.Unmarshal(data, &assigned); err != nil {
+		return nil, fmt.Errorf("failed to decode namespace slices: %v", err)
+	}
+	return assigned, nil
+}
+
+func (s *Store) writeSlices(assigned map[string]string) error {
+	data, err := json.Marshal(assigned)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(s.dir, slicesFile)
+	if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+		return fmt.Errorf("failed to write namespace slices: %v", err)
+	}
+	return os.Rename(path+".tmp", path)
+}
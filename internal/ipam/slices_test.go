@@ -0,0 +1,160 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ipam
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestNamespaceSlices(t *testing.T) {
+	tests := []struct {
+		name      string
+		cidrs     []string
+		ones      int
+		before    []string
+		namespace string
+		want      []string
+		wantErr   string
+	}{
+		{
+			name:      "first slice is left to the shared bridge",
+			cidrs:     []string{"10.0.0.0/24"},
+			ones:      26,
+			namespace: "a",
+			want:      []string{"10.0.0.64/26"},
+		},
+		{
+			name:      "next free slice",
+			cidrs:     []string{"10.0.0.0/24"},
+			ones:      26,
+			before:    []string{"a"},
+			namespace: "b",
+			want:      []string{"10.0.0.128/26"},
+		},
+		{
+			name:      "namespace keeps its slice",
+			cidrs:     []string{"10.0.0.0/24"},
+			ones:      26,
+			before:    []string{"a", "b"},
+			namespace: "a",
+			want:      []string{"10.0.0.64/26"},
+		},
+		{
+			name:      "dual stack slices have the same host bits",
+			cidrs:     []string{"10.0.0.0/24", "fd00::/64"},
+			ones:      26,
+			namespace: "a",
+			want:      []string{"10.0.0.64/26", "fd00::40/122"},
+		},
+		{
+			name:      "no free slice left",
+			cidrs:     []string{"10.0.0.0/24"},
+			ones:      25,
+			before:    []string{"a"},
+			namespace: "b",
+			wantErr:   "no free namespace slice left",
+		},
+		{
+			name:      "slices as large as the pod CIDR",
+			cidrs:     []string{"10.0.0.0/24"},
+			ones:      24,
+			namespace: "a",
+			wantErr:   "is too small",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := openTestStore(t)
+			var cidrs []*net.IPNet
+			for _, cidr := range tt.cidrs {
+				cidrs = append(cidrs, mustCIDR(t, cidr))
+			}
+			for _, namespace := range tt.before {
+				if _, err := s.NamespaceSlices(cidrs, namespace, tt.ones); err != nil {
+					t.Fatalf("slices of %s before the test: %v", namespace, err)
+				}
+			}
+			slices, err := s.NamespaceSlices(cidrs, tt.namespace, tt.ones)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("NamespaceSlices() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NamespaceSlices() error = %v", err)
+			}
+			var got []string
+			for _, slice := range slices {
+				got = append(got, slice.String())
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("NamespaceSlices() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReleaseNamespaceSlices(t *testing.T) {
+	tests := []struct {
+		name       string
+		allocate   bool
+		wantErr    string
+		wantRemain []string
+	}{
+		{name: "unused slices", wantRemain: []string{"b"}},
+		{name: "slice in use", allocate: true, wantErr: "is still in use by container c1", wantRemain: []string{"a", "b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := openTestStore(t)
+			cidrs := []*net.IPNet{mustCIDR(t, "10.0.0.0/24")}
+			var slice *net.IPNet
+			for _, namespace := range []string{"a", "b"} {
+				slices, err := s.NamespaceSlices(cidrs, namespace, 26)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if namespace == "a" {
+					slice = slices[0]
+				}
+			}
+			if tt.allocate {
+				if _, err := s.Allocate([]*net.IPNet{slice}, "patu", "c1", "eth0", nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := s.ReleaseNamespaceSlices("a")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("ReleaseNamespaceSlices() error = %v, want %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("ReleaseNamespaceSlices() error = %v", err)
+			}
+			namespaces, err := s.SliceNamespaces()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(namespaces, ",") != strings.Join(tt.wantRemain, ",") {
+				t.Errorf("SliceNamespaces() = %v, want %v", namespaces, tt.wantRemain)
+			}
+		})
+	}
+}
@@ -0,0 +1,242 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ipam
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	storeDir     = "ipam"
+	lockFile     = "lock"
+	lastPrefix   = "last_reserved_ip."
+	podCIDRsFile = "pod-cidrs.json"
+	bootIDPath   = "/proc/sys/kernel/random/boot_id"
+)
+
+// Allocation records the owner of an address. It is stored in a file named
+// after the address. The store is shared by all the networks using the
+// built-in IPAM with the same data directory, so an address is owned by a
+// container interface of a network.
+type Allocation struct {
+	Network     string    `json:"network"`
+	ContainerID string    `json:"containerID"`
+	IfName      string    `json:"ifName"`
+	BootID      string    `json:"bootID,omitempty"`
+	Created     time.Time `json:"created"`
+}
+
+func (a *Allocation) ownedBy(network, containerID, ifName string) bool {
+	return a.Network == network && a.ContainerID == containerID && a.IfName == ifName
+}
+
+// stale reports whether the allocation was made before the node rebooted, in
+// which case its container is gone.
+func (a *Allocation) stale(bootID string) bool {
+	return a.BootID != "" && bootID != "" && a.BootID != bootID
+}
+
+// Store keeps the address allocations of the node on disk, so they survive
+// restarts of both the runtime and the node. It holds an exclusive lock until
+// closed, which serializes the CNI plugin invocations and patud.
+type Store struct {
+	dir  string
+	lock *os.File
+}
+
+func OpenStore(dataDir string) (*Store, error) {
+	dir := filepath.Join(dataDir, storeDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create %q: %v", dir, err)
+	}
+	lock, err := os.OpenFile(filepath.Join(dir, lockFile), os.O_RDONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open IPAM lock: %v", err)
+	}
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		lock.Close()
+		return nil, fmt.Errorf("failed to lock IPAM store: %v", err)
+	}
+	return &Store{dir: dir, lock: lock}, nil
+}
+
+func (s *Store) Close() error {
+	_ = syscall.Flock(int(s.lock.Fd()), syscall.LOCK_UN)
+	return s.lock.Close()
+}
+
+// Allocations returns the allocations of the store keyed by address.
+func (s *Store) Allocations() (map[string]*Allocation, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list IPAM store: %v", err)
+	}
+	allocations := make(map[string]*Allocation)
+	for _, entry := range entries {
+		if entry.IsDir() || net.ParseIP(entry.Name()) == nil {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(s.dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read allocation of %s: %v", entry.Name(), err)
+		}
+		a := &Allocation{}
+		if err := json.Unmarshal(data, a); err != nil {
+			return nil, fmt.Errorf("failed to decode allocation of %s: %v", entry.Name(), err)
+		}
+		allocations[entry.Name()] = a
+	}
+	return allocations, nil
+}
+
+func (s *Store) reserve(ip net.IP, a *Allocation) error {
+	data, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(s.dir, ip.String())
+	if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+		return fmt.Errorf("failed to reserve %s: %v", ip, err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		os.Remove(path + ".tmp")
+		return fmt.Errorf("failed to reserve %s: %v", ip, err)
+	}
+	return nil
+}
+
+// Release frees a single address.
+func (s *Store) Release(ip string) error {
+	err := os.Remove(filepath.Join(s.dir, ip))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to release %s: %v", ip, err)
+	}
+	return nil
+}
+
+// ReleaseOwner frees all the addresses of a container interface of network.
+// Releasing addresses that are already free is not an error, DEL may be
+// repeated.
+func (s *Store) ReleaseOwner(network, containerID, ifName string) error {
+	allocations, err := s.Allocations()
+	if err != nil {
+		return err
+	}
+	for ip, a := range allocations {
+		if a.ownedBy(network, containerID, ifName) {
+			if err := s.Release(ip); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Owned returns the addresses held by a container interface of network.
+func (s *Store) Owned(network, containerID, ifName string) ([]net.IP, error) {
+	allocations, err := s.Allocations()
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	for ip, a := range allocations {
+		if a.ownedBy(network, containerID, ifName) {
+			ips = append(ips, net.ParseIP(ip))
+		}
+	}
+	return ips, nil
+}
+
+func (s *Store) lastReservedPath(subnet *net.IPNet) string {
+	return filepath.Join(s.dir, lastPrefix+strings.ReplaceAll(subnet.String(), "/", "_"))
+}
+
+func (s *Store) lastReserved(subnet *net.IPNet) net.IP {
+	data, err := os.ReadFile(s.lastReservedPath(subnet))
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(strings.TrimSpace(string(data)))
+	if ip == nil || !subnet.Contains(ip) {
+		return nil
+	}
+	return ip
+}
+
+func (s *Store) setLastReserved(subnet *net.IPNet, ip net.IP) {
+	// Only a hint for the next allocation, losing it is harmless.
+	_ = os.WriteFile(s.lastReservedPath(subnet), []byte(ip.String()), 0600)
+}
+
+// WritePodCIDRs publishes the pod CIDRs of the node to the CNI plugin.
+func WritePodCIDRs(dataDir string, cidrs []*net.IPNet) error {
+	var values []string
+	for _, cidr := range cidrs {
+		values = append(values, cidr.String())
+	}
+	data, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		return fmt.Errorf("failed to create %q: %v", dataDir, err)
+	}
+	path := filepath.Join(dataDir, podCIDRsFile)
+	if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+		return fmt.Errorf("failed to write pod CIDRs: %v", err)
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// ReadPodCIDRs returns the pod CIDRs published by patud.
+func ReadPodCIDRs(dataDir string) ([]*net.IPNet, error) {
+	data, err := os.ReadFile(filepath.Join(dataDir, podCIDRsFile))
+	if err != nil {
+		return nil, fmt.Errorf("pod CIDRs of the node are not known, is patud running? %v", err)
+	}
+	var values []string
+	if err := json.Unmarshal(data, &values); err != nil {
+		return nil, fmt.Errorf("failed to decode pod CIDRs: %v", err)
+	}
+	var cidrs []*net.IPNet
+	for _, value := range values {
+		_, cidr, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pod CIDR %q: %v", value, err)
+		}
+		cidrs = append(cidrs, cidr)
+	}
+	if len(cidrs) == 0 {
+		return nil, fmt.Errorf("no pod CIDR is assigned to the node")
+	}
+	return cidrs, nil
+}
+
+func currentBootID() string {
+	data, err := os.ReadFile(bootIDPath)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
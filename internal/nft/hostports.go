@@ -0,0 +1,189 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nft
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+)
+
+const (
+	hostPortsChain     = "hostports"
+	preroutingChain    = "hostports-prerouting"
+	outputChain        = "hostports-output"
+	hostPortsMasqChain = "hostports-masq"
+)
+
+// PortMapping forwards a port of the node to a port of a pod. An unspecified
+// HostIP forwards the port on every local address.
+type PortMapping struct {
+	HostIP        net.IP
+	HostPort      uint16
+	ContainerIP   net.IP
+	ContainerNet  *net.IPNet
+	ContainerPort uint16
+	Protocol      uint8
+}
+
+// hostPortChains returns the chains of the host port rules of a family. The
+// base chains only jump to the per-mapping rules for local destinations.
+func hostPortChains(table *nftables.Table) (hostPorts, prerouting, output, masq *nftables.Chain) {
+	hostPorts = &nftables.Chain{Name: hostPortsChain, Table: table}
+	prerouting = &nftables.Chain{Name: preroutingChain, Table: table, Type: nftables.ChainTypeNAT,
+		Hooknum: nftables.ChainHookPrerouting, Priority: nftables.ChainPriorityNATDest}
+	output = &nftables.Chain{Name: outputChain, Table: table, Type: nftables.ChainTypeNAT,
+		Hooknum: nftables.ChainHookOutput, Priority: nftables.ChainPriorityNATDest}
+	masq = &nftables.Chain{Name: hostPortsMasqChain, Table: table, Type: nftables.ChainTypeNAT,
+		Hooknum: nftables.ChainHookPostrouting, Priority: nftables.ChainPriorityNATSource}
+	return
+}
+
+// AddHostPorts adds the DNAT rules of the mappings, tagged with owner. A pod
+// reaching its own host port through the node is masqueraded, so the reply
+// goes back through the node too.
+func AddHostPorts(owner string, mappings []PortMapping) error {
+	if len(mappings) == 0 {
+		return nil
+	}
+	unlock, err := lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	conn, err := newConn()
+	if err != nil {
+		return err
+	}
+
+	byFamily := make(map[family][]PortMapping)
+	for _, m := range mappings {
+		f := familyOf(m.ContainerIP)
+		byFamily[f] = append(byFamily[f], m)
+	}
+	for f, mappings := range byFamily {
+		table := f.ensureTable(conn)
+		hostPorts, prerouting, output, masq := hostPortChains(table)
+		for _, chain := range []*nftables.Chain{hostPorts, prerouting, output, masq} {
+			conn.AddChain(chain)
+		}
+		if err := conn.Flush(); err != nil {
+			return fmt.Errorf("failed to create host port chains: %v", err)
+		}
+		for _, chain := range []*nftables.Chain{prerouting, output} {
+			if err := ensureJump(conn, chain, hostPortsChain, matchLocalDaddr()...); err != nil {
+				return err
+			}
+		}
+		for _, m := range mappings {
+			conn.AddRule(&nftables.Rule{Table: table, Chain: hostPorts, Exprs: dnatExprs(f, m), UserData: comment(owner)})
+			conn.AddRule(&nftables.Rule{Table: table, Chain: masq, Exprs: masqExprs(f, m), UserData: comment(owner)})
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("failed to add host port rules of %s: %v", owner, err)
+	}
+	return nil
+}
+
+func dnatExprs(f family, m PortMapping) []expr.Any {
+	var exprs []expr.Any
+	if m.HostIP != nil && !m.HostIP.IsUnspecified() {
+		exprs = append(exprs, matchAddr(f.daddrOffset, f.addr(m.HostIP))...)
+	}
+	exprs = append(exprs, matchL4Proto(m.Protocol)...)
+	exprs = append(exprs, matchDport(m.HostPort)...)
+	return append(exprs,
+		&expr.Immediate{Register: 1, Data: f.addr(m.ContainerIP)},
+		&expr.Immediate{Register: 2, Data: binaryutil.BigEndian.PutUint16(m.ContainerPort)},
+		&expr.NAT{Type: expr.NATTypeDestNAT, Family: f.nfproto, RegAddrMin: 1, RegProtoMin: 2},
+	)
+}
+
+func masqExprs(f family, m PortMapping) []expr.Any {
+	var exprs []expr.Any
+	if m.ContainerNet != nil {
+		exprs = append(exprs, matchPrefix(f.saddrOffset, m.ContainerNet, f)...)
+	}
+	exprs = append(exprs, matchAddr(f.daddrOffset, f.addr(m.ContainerIP))...)
+	exprs = append(exprs, matchL4Proto(m.Protocol)...)
+	exprs = append(exprs, matchDport(m.ContainerPort)...)
+	exprs = append(exprs, matchDNATed()...)
+	return append(exprs, &expr.Masq{})
+}
+
+// DelHostPorts removes the rules tagged with owner. The chains are left in
+// place for the other pods.
+func DelHostPorts(owner string) error {
+	conn, err := newConn()
+	if err != nil {
+		return err
+	}
+	for _, f := range []family{ipv4, ipv6} {
+		table, err := findTable(conn, f)
+		if err != nil {
+			return err
+		}
+		if table == nil {
+			continue
+		}
+		hostPorts, _, _, masq := hostPortChains(table)
+		for _, chain := range []*nftables.Chain{hostPorts, masq} {
+			if _, err := delRulesOf(conn, chain, owner); err != nil {
+				return err
+			}
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("failed to delete host port rules of %s: %v", owner, err)
+	}
+	return nil
+}
+
+// CheckHostPorts verifies that every mapping of owner has its DNAT rule.
+func CheckHostPorts(owner string, mappings []PortMapping) error {
+	conn, err := newConn()
+	if err != nil {
+		return err
+	}
+	expected := make(map[family]int)
+	for _, m := range mappings {
+		expected[familyOf(m.ContainerIP)]++
+	}
+	for _, f := range []family{ipv4, ipv6} {
+		table, err := findTable(conn, f)
+		if err != nil {
+			return err
+		}
+		found := 0
+		if table != nil {
+			hostPorts, _, _, _ := hostPortChains(table)
+			rules, err := rulesOf(conn, hostPorts, owner)
+			if err != nil {
+				return err
+			}
+			found = len(rules)
+		}
+		if found != expected[f] {
+			return fmt.Errorf("expected %d host port rules of %s, found %d", expected[f], owner, found)
+		}
+	}
+	return nil
+}
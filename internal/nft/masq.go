@@ -0,0 +1,203 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nft
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+const (
+	masqChainName = "masquerade"
+	masqSetName   = "masq-addrs"
+
+	// Tags of the rules shared by all masqueraded pods.
+	masqRuleTag      = "masquerade"
+	multicastRuleTag = "multicast"
+)
+
+func masqChain(table *nftables.Table) *nftables.Chain {
+	return &nftables.Chain{Name: masqChainName, Table: table, Type: nftables.ChainTypeNAT,
+		Hooknum: nftables.ChainHookPostrouting, Priority: nftables.ChainPriorityNATSource}
+}
+
+func masqSet(table *nftables.Table, f family) *nftables.Set {
+	return &nftables.Set{Table: table, Name: masqSetName, KeyType: f.addrType}
+}
+
+// AddMasquerade masquerades the traffic of a pod address leaving its network.
+// The pod addresses are elements of a set matched by a single masquerade
+// rule, the network of each CNI config is excluded by a rule of its own.
+func AddMasquerade(network string, ipn *net.IPNet) error {
+	unlock, err := lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	conn, err := newConn()
+	if err != nil {
+		return err
+	}
+
+	f := familyOf(ipn.IP)
+	table := f.ensureTable(conn)
+	chain := conn.AddChain(masqChain(table))
+	set := masqSet(table, f)
+	if err := conn.AddSet(set, nil); err != nil {
+		return fmt.Errorf("failed to create set %s: %v", masqSetName, err)
+	}
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("failed to create masquerade chain: %v", err)
+	}
+	if set, err = conn.GetSetByName(table, masqSetName); err != nil {
+		return fmt.Errorf("failed to get set %s: %v", masqSetName, err)
+	}
+
+	// The exclusions are inserted at the top of the chain, ahead of the
+	// masquerade rule appended at the end.
+	exclusions, masq := masqRules(network, ipn, set)
+	for _, rule := range exclusions {
+		found, err := hasRule(conn, chain, rule.tag)
+		if err != nil {
+			return err
+		}
+		if !found {
+			conn.InsertRule(&nftables.Rule{Table: table, Chain: chain, UserData: comment(rule.tag), Exprs: rule.exprs})
+		}
+	}
+	found, err := hasRule(conn, chain, masq.tag)
+	if err != nil {
+		return err
+	}
+	if !found {
+		conn.AddRule(&nftables.Rule{Table: table, Chain: chain, UserData: comment(masq.tag), Exprs: masq.exprs})
+	}
+
+	if err := conn.SetAddElements(set, []nftables.SetElement{{Key: f.addr(ipn.IP)}}); err != nil {
+		return fmt.Errorf("failed to add %s to set %s: %v", ipn.IP, masqSetName, err)
+	}
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("failed to masquerade %s: %v", ipn.IP, err)
+	}
+	return nil
+}
+
+// masqRule is a rule of the masquerade chain and the tag it is found by.
+type masqRule struct {
+	tag   string
+	exprs []expr.Any
+}
+
+// masqRules returns the rules masquerading the addresses of set, which hold
+// ipn: the exclusions of the traffic to the network of ipn and to multicast
+// groups, and the masquerade rule itself.
+func masqRules(network string, ipn *net.IPNet, set *nftables.Set) (exclusions []masqRule, masq masqRule) {
+	f := familyOf(ipn.IP)
+	subnet := &net.IPNet{IP: ipn.IP.Mask(ipn.Mask), Mask: ipn.Mask}
+	for _, rule := range []masqRule{
+		{networkTag(network, ipn), matchPrefix(f.daddrOffset, subnet, f)},
+		{multicastRuleTag, matchPrefix(f.daddrOffset, f.multicast, f)},
+	} {
+		exprs := append(matchInSet(f.saddrOffset, set, f), rule.exprs...)
+		rule.exprs = append(exprs, &expr.Verdict{Kind: expr.VerdictReturn})
+		exclusions = append(exclusions, rule)
+	}
+	masq = masqRule{masqRuleTag, append(matchInSet(f.saddrOffset, set, f), &expr.Masq{})}
+	return exclusions, masq
+}
+
+func networkTag(network string, ipn *net.IPNet) string {
+	return fmt.Sprintf("%s %s", network, &net.IPNet{IP: ipn.IP.Mask(ipn.Mask), Mask: ipn.Mask})
+}
+
+// DelMasquerade stops masquerading the traffic of a pod address.
+func DelMasquerade(ip net.IP) error {
+	conn, err := newConn()
+	if err != nil {
+		return err
+	}
+	f := familyOf(ip)
+	set, err := findMasqSet(conn, f)
+	if err != nil || set == nil {
+		return err
+	}
+	if err := conn.SetDeleteElements(set, []nftables.SetElement{{Key: f.addr(ip)}}); err != nil {
+		return fmt.Errorf("failed to delete %s from set %s: %v", ip, masqSetName, err)
+	}
+	if err := conn.Flush(); err != nil && !isNotExist(err) {
+		return fmt.Errorf("failed to delete %s from set %s: %v", ip, masqSetName, err)
+	}
+	return nil
+}
+
+// CheckMasquerade verifies that the traffic of a pod address is masqueraded.
+func CheckMasquerade(network string, ipn *net.IPNet) error {
+	conn, err := newConn()
+	if err != nil {
+		return err
+	}
+	f := familyOf(ipn.IP)
+	set, err := findMasqSet(conn, f)
+	if err != nil {
+		return err
+	}
+	if set == nil {
+		return fmt.Errorf("nftables set %s is missing", masqSetName)
+	}
+	chain := masqChain(set.Table)
+	for _, tag := range []string{networkTag(network, ipn), masqRuleTag} {
+		found, err := hasRule(conn, chain, tag)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("nftables rule %q is missing from chain %s", tag, masqChainName)
+		}
+	}
+	elements, err := conn.GetSetElements(set)
+	if err != nil {
+		return fmt.Errorf("failed to list set %s: %v", masqSetName, err)
+	}
+	for _, element := range elements {
+		if net.IP(element.Key).Equal(ipn.IP) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is not masqueraded", ipn.IP)
+}
+
+// findMasqSet returns the set of masqueraded addresses of the family, or nil
+// if there is none.
+func findMasqSet(conn *nftables.Conn, f family) (*nftables.Set, error) {
+	table, err := findTable(conn, f)
+	if err != nil || table == nil {
+		return nil, err
+	}
+	sets, err := conn.GetSets(table)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list nftables sets: %v", err)
+	}
+	for _, set := range sets {
+		if set.Name == masqSetName {
+			return set, nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,118 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nft
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+// evalMasqRules runs the rules of the masquerade chain on an IP packet whose
+// source is in set if inSet is true. It returns the tag of the first rule
+// matching the packet, or an empty string if none does.
+func evalMasqRules(t *testing.T, rules []masqRule, packet []byte, inSet bool) string {
+	t.Helper()
+	for _, rule := range rules {
+		var reg []byte
+		matched := true
+		for _, e := range rule.exprs {
+			switch e := e.(type) {
+			case *expr.Payload:
+				reg = append([]byte(nil), packet[e.Offset:e.Offset+e.Len]...)
+			case *expr.Bitwise:
+				for i := range reg {
+					reg[i] = reg[i]&e.Mask[i] ^ e.Xor[i]
+				}
+			case *expr.Cmp:
+				if (e.Op == expr.CmpOpEq) != bytes.Equal(reg, e.Data) {
+					matched = false
+				}
+			case *expr.Lookup:
+				if e.SetName != masqSetName {
+					t.Fatalf("rule %q looks up set %q", rule.tag, e.SetName)
+				}
+				matched = inSet
+			case *expr.Verdict:
+				if e.Kind != expr.VerdictReturn {
+					t.Fatalf("rule %q has verdict %v", rule.tag, e.Kind)
+				}
+				return rule.tag
+			case *expr.Masq:
+				return rule.tag
+			default:
+				t.Fatalf("unexpected expression %T", e)
+			}
+			if !matched {
+				break
+			}
+		}
+	}
+	return ""
+}
+
+func ipPacket(saddr, daddr net.IP) []byte {
+	if saddr.To4() != nil {
+		packet := make([]byte, 20)
+		copy(packet[12:], saddr.To4())
+		copy(packet[16:], daddr.To4())
+		return packet
+	}
+	packet := make([]byte, 40)
+	copy(packet[8:], saddr.To16())
+	copy(packet[24:], daddr.To16())
+	return packet
+}
+
+func TestMasqRules(t *testing.T) {
+	tests := []struct {
+		name   string
+		pod    string
+		daddr  string
+		notSet bool
+		want   string
+	}{
+		{name: "IPv4 leaving the network", pod: "10.200.0.5/24", daddr: "192.0.2.1", want: masqRuleTag},
+		{name: "IPv4 within the network", pod: "10.200.0.5/24", daddr: "10.200.0.9", want: "patu 10.200.0.0/24"},
+		{name: "IPv4 next to the network", pod: "10.200.0.5/24", daddr: "10.200.1.9", want: masqRuleTag},
+		{name: "IPv4 multicast", pod: "10.200.0.5/24", daddr: "224.0.0.251", want: multicastRuleTag},
+		{name: "IPv4 of an address not masqueraded", pod: "10.200.0.5/24", daddr: "192.0.2.1", notSet: true},
+		{name: "IPv6 leaving the network", pod: "fd00::5/64", daddr: "2001:db8::1", want: masqRuleTag},
+		{name: "IPv6 within the network", pod: "fd00::5/64", daddr: "fd00::9", want: "patu fd00::/64"},
+		{name: "IPv6 multicast", pod: "fd00::5/64", daddr: "ff02::fb", want: multicastRuleTag},
+		{name: "IPv6 of an address not masqueraded", pod: "fd00::5/64", daddr: "2001:db8::1", notSet: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip, ipn, err := net.ParseCIDR(tt.pod)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ipn.IP = ip
+			set := masqSet(&nftables.Table{Name: TableName}, familyOf(ip))
+			exclusions, masq := masqRules("patu", ipn, set)
+
+			packet := ipPacket(ip, net.ParseIP(tt.daddr))
+			if got := evalMasqRules(t, append(exclusions, masq), packet, !tt.notSet); got != tt.want {
+				t.Errorf("packet to %s matched rule %q, want %q", tt.daddr, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,247 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+// Package nft programs the nftables rules of patu through netlink, without
+// depending on the nft or iptables binaries being installed on the node.
+package nft
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/google/nftables/userdata"
+	"golang.org/x/sys/unix"
+)
+
+// TableName is the name of the patu table in the ip and ip6 families.
+const TableName = "patu"
+
+// lockPath is flocked while the rules shared by the pods are checked and
+// added, the CNI plugin runs concurrently for different pods.
+const lockPath = "/run/patu-nftables.lock"
+
+// family holds what differs between the IPv4 and IPv6 rules.
+type family struct {
+	table       nftables.TableFamily
+	nfproto     uint32
+	saddrOffset uint32
+	daddrOffset uint32
+	addrLen     uint32
+	addrType    nftables.SetDatatype
+	multicast   *net.IPNet
+}
+
+var (
+	ipv4 = family{nftables.TableFamilyIPv4, unix.NFPROTO_IPV4, 12, 16, net.IPv4len,
+		nftables.TypeIPAddr, &net.IPNet{IP: net.IPv4(224, 0, 0, 0), Mask: net.CIDRMask(4, 32)}}
+	ipv6 = family{nftables.TableFamilyIPv6, unix.NFPROTO_IPV6, 8, 24, net.IPv6len,
+		nftables.TypeIP6Addr, &net.IPNet{IP: net.ParseIP("ff00::"), Mask: net.CIDRMask(8, 128)}}
+)
+
+func familyOf(ip net.IP) family {
+	if ip.To4() != nil {
+		return ipv4
+	}
+	return ipv6
+}
+
+// addr returns ip in the length the family's rules compare it with.
+func (f family) addr(ip net.IP) []byte {
+	if f.addrLen == net.IPv4len {
+		return ip.To4()
+	}
+	return ip.To16()
+}
+
+func (f family) ensureTable(conn *nftables.Conn) *nftables.Table {
+	return conn.AddTable(&nftables.Table{Family: f.table, Name: TableName})
+}
+
+func lock() (func(), error) {
+	f, err := os.OpenFile(lockPath, os.O_RDONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %q: %v", lockPath, err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to lock %q: %v", lockPath, err)
+	}
+	return func() {
+		_ = syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+func newConn() (*nftables.Conn, error) {
+	conn, err := nftables.New()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open nftables connection: %v", err)
+	}
+	return conn, nil
+}
+
+// findTable returns the patu table of the family, or nil if there is none.
+func findTable(conn *nftables.Conn, f family) (*nftables.Table, error) {
+	tables, err := conn.ListTablesOfFamily(f.table)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list nftables tables: %v", err)
+	}
+	for _, table := range tables {
+		if table.Name == TableName {
+			return table, nil
+		}
+	}
+	return nil, nil
+}
+
+// ensureJump adds a rule jumping to target to the base chain, unless the
+// chain already has one.
+func ensureJump(conn *nftables.Conn, chain *nftables.Chain, target string, match ...expr.Any) error {
+	rules, err := conn.GetRules(chain.Table, chain)
+	if err != nil {
+		return fmt.Errorf("failed to list rules of chain %s: %v", chain.Name, err)
+	}
+	for _, rule := range rules {
+		for _, e := range rule.Exprs {
+			if v, ok := e.(*expr.Verdict); ok && v.Kind == expr.VerdictJump && v.Chain == target {
+				return nil
+			}
+		}
+	}
+	conn.AddRule(&nftables.Rule{
+		Table: chain.Table,
+		Chain: chain,
+		Exprs: append(match, &expr.Verdict{Kind: expr.VerdictJump, Chain: target}),
+	})
+	return nil
+}
+
+// hasRule reports whether the chain has a rule tagged with tag.
+func hasRule(conn *nftables.Conn, chain *nftables.Chain, tag string) (bool, error) {
+	rules, err := rulesOf(conn, chain, tag)
+	return len(rules) > 0, err
+}
+
+// delRulesOf removes the rules of a chain tagged with owner.
+func delRulesOf(conn *nftables.Conn, chain *nftables.Chain, owner string) (int, error) {
+	rules, err := rulesOf(conn, chain, owner)
+	if err != nil {
+		return 0, err
+	}
+	for _, rule := range rules {
+		if err := conn.DelRule(rule); err != nil {
+			return 0, fmt.Errorf("failed to delete rule of chain %s: %v", chain.Name, err)
+		}
+	}
+	return len(rules), nil
+}
+
+// rulesOf returns the rules of a chain tagged with owner. A missing table or
+// chain has no rules.
+func rulesOf(conn *nftables.Conn, chain *nftables.Chain, owner string) ([]*nftables.Rule, error) {
+	rules, err := conn.GetRules(chain.Table, chain)
+	if err != nil {
+		if isNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to list rules of chain %s: %v", chain.Name, err)
+	}
+	var owned []*nftables.Rule
+	for _, rule := range rules {
+		if comment, ok := userdata.GetString(rule.UserData, userdata.TypeComment); ok && comment == owner {
+			owned = append(owned, rule)
+		}
+	}
+	return owned, nil
+}
+
+func isNotExist(err error) bool {
+	return errors.Is(err, unix.ENOENT)
+}
+
+func comment(owner string) []byte {
+	return userdata.AppendString(nil, userdata.TypeComment, owner)
+}
+
+// Expressions used to build the rules, all of them use register 1 unless
+// stated otherwise.
+
+func matchAddr(offset uint32, addr []byte) []expr.Any {
+	return []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: uint32(len(addr))},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: addr},
+	}
+}
+
+func matchPrefix(offset uint32, prefix *net.IPNet, f family) []expr.Any {
+	return []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: f.addrLen},
+		&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: f.addrLen, Mask: f.addr(net.IP(prefix.Mask)), Xor: make([]byte, f.addrLen)},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: f.addr(prefix.IP.Mask(prefix.Mask))},
+	}
+}
+
+func matchNotPrefix(offset uint32, prefix *net.IPNet, f family) []expr.Any {
+	exprs := matchPrefix(offset, prefix, f)
+	exprs[len(exprs)-1].(*expr.Cmp).Op = expr.CmpOpNeq
+	return exprs
+}
+
+func matchInSet(offset uint32, set *nftables.Set, f family) []expr.Any {
+	return []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: f.addrLen},
+		&expr.Lookup{SourceRegister: 1, SetName: set.Name, SetID: set.ID},
+	}
+}
+
+func matchL4Proto(proto uint8) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{proto}},
+	}
+}
+
+func matchDport(port uint16) []expr.Any {
+	return []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(port)},
+	}
+}
+
+func matchLocalDaddr() []expr.Any {
+	return []expr.Any{
+		&expr.Fib{Register: 1, FlagDADDR: true, ResultADDRTYPE: true},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(unix.RTN_LOCAL)},
+	}
+}
+
+// matchDNATed matches the connections whose destination was translated.
+func matchDNATed() []expr.Any {
+	return []expr.Any{
+		&expr.Ct{Register: 1, Key: expr.CtKeySTATUS},
+		&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4,
+			Mask: binaryutil.NativeEndian.PutUint32(ipsDstNAT), Xor: make([]byte, 4)},
+		&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: make([]byte, 4)},
+	}
+}
+
+// IPS_DST_NAT of enum ip_conntrack_status.
+const ipsDstNAT = 1 << 5
@@ -0,0 +1,247 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nft
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	spoofCheckChain       = "spoofcheck"
+	spoofCheckChainPrefix = "spoofcheck-"
+
+	// Offsets in the Ethernet header and of the sender in the ARP header.
+	etherSaddrOffset = 6
+	etherTypeOffset  = 12
+	arpShaOffset     = 8
+	arpSpaOffset     = 14
+)
+
+// The NF_BR_PRI_NAT_DST_BRIDGED priority, the frames are checked ahead of
+// the other bridge hooks.
+var bridgePriorityFirst = nftables.ChainPriorityRef(-300)
+
+var ipv6LinkLocal = &net.IPNet{IP: net.ParseIP("fe80::"), Mask: net.CIDRMask(10, 128)}
+
+func bridgeTable() *nftables.Table {
+	return &nftables.Table{Family: nftables.TableFamilyBridge, Name: TableName}
+}
+
+// spoofCheckChains returns the base chain of the patu bridge table, jumping
+// to the chain of the pod for the frames its bridge port receives.
+func spoofCheckChains(table *nftables.Table, owner string) (base, pod *nftables.Chain) {
+	base = &nftables.Chain{Name: spoofCheckChain, Table: table, Type: nftables.ChainTypeFilter,
+		Hooknum: nftables.ChainHookPrerouting, Priority: bridgePriorityFirst}
+	pod = &nftables.Chain{Name: spoofCheckChainPrefix + owner, Table: table}
+	return
+}
+
+// AddSpoofCheck drops the frames the bridge port ifName receives from
+// another MAC than mac and, unless ips is empty, the IP and ARP packets from
+// other addresses than ips. IPv6 link-local and unspecified sources are
+// allowed for neighbor discovery, and the unspecified IPv4 sender for ARP
+// probes. Frames of other types, VLAN tagged ones included, are only checked
+// for their MAC. The rules are tagged with owner.
+func AddSpoofCheck(owner, ifName string, mac net.HardwareAddr, ips []net.IP) error {
+	unlock, err := lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	conn, err := newConn()
+	if err != nil {
+		return err
+	}
+
+	table := conn.AddTable(bridgeTable())
+	base, pod := spoofCheckChains(table, owner)
+	conn.AddChain(base)
+	conn.AddChain(pod)
+	// The chain may be left over by an ADD that failed
+	conn.FlushChain(pod)
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("failed to create spoof check chains: %v", err)
+	}
+
+	for _, exprs := range spoofCheckRules(mac, ips) {
+		conn.AddRule(&nftables.Rule{Table: table, Chain: pod, Exprs: exprs, UserData: comment(owner)})
+	}
+	found, err := hasRule(conn, base, owner)
+	if err != nil {
+		return err
+	}
+	if !found {
+		conn.AddRule(&nftables.Rule{Table: table, Chain: base, UserData: comment(owner),
+			Exprs: append(matchIifName(ifName), &expr.Verdict{Kind: expr.VerdictJump, Chain: pod.Name})})
+	}
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("failed to add spoof check rules of %s: %v", owner, err)
+	}
+	return nil
+}
+
+func spoofCheckRules(mac net.HardwareAddr, ips []net.IP) [][]expr.Any {
+	drop := &expr.Verdict{Kind: expr.VerdictDrop}
+	accept := &expr.Verdict{Kind: expr.VerdictAccept}
+	rules := [][]expr.Any{
+		append(matchLLAddr(etherSaddrOffset, expr.CmpOpNeq, mac), drop),
+		append(append(matchEtherType(unix.ETH_P_ARP),
+			matchNetworkPayload(arpShaOffset, expr.CmpOpNeq, mac)...), drop),
+	}
+	if len(ips) == 0 {
+		return rules
+	}
+
+	v4 := []net.IP{net.IPv4zero}
+	v6 := []net.IP{net.IPv6unspecified}
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	for _, ip := range v4 {
+		rules = append(rules, append(append(matchEtherType(unix.ETH_P_ARP),
+			matchAddr(arpSpaOffset, ipv4.addr(ip))...), accept))
+	}
+	rules = append(rules, append(matchEtherType(unix.ETH_P_ARP), drop))
+	for _, ip := range v4[1:] {
+		rules = append(rules, append(append(matchEtherType(unix.ETH_P_IP),
+			matchAddr(ipv4.saddrOffset, ipv4.addr(ip))...), accept))
+	}
+	rules = append(rules, append(matchEtherType(unix.ETH_P_IP), drop))
+	for _, ip := range v6 {
+		rules = append(rules, append(append(matchEtherType(unix.ETH_P_IPV6),
+			matchAddr(ipv6.saddrOffset, ipv6.addr(ip))...), accept))
+	}
+	rules = append(rules, append(append(matchEtherType(unix.ETH_P_IPV6),
+		matchPrefix(ipv6.saddrOffset, ipv6LinkLocal, ipv6)...), accept))
+	return append(rules, append(matchEtherType(unix.ETH_P_IPV6), drop))
+}
+
+// DelSpoofCheck removes the spoof check of owner.
+func DelSpoofCheck(owner string) error {
+	conn, err := newConn()
+	if err != nil {
+		return err
+	}
+	table, pod, err := findSpoofCheck(conn, owner)
+	if err != nil || table == nil {
+		return err
+	}
+	base, _ := spoofCheckChains(table, owner)
+	if _, err := delRulesOf(conn, base, owner); err != nil {
+		return err
+	}
+	if pod != nil {
+		conn.FlushChain(pod)
+		conn.DelChain(pod)
+	}
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("failed to delete spoof check rules of %s: %v", owner, err)
+	}
+	return nil
+}
+
+// CheckSpoofCheck verifies that the spoof check of owner is in place.
+func CheckSpoofCheck(owner string, mac net.HardwareAddr, ips []net.IP) error {
+	conn, err := newConn()
+	if err != nil {
+		return err
+	}
+	table, pod, err := findSpoofCheck(conn, owner)
+	if err != nil {
+		return err
+	}
+	if table == nil || pod == nil {
+		return fmt.Errorf("spoof check chain of %s not found", owner)
+	}
+	base, _ := spoofCheckChains(table, owner)
+	found, err := hasRule(conn, base, owner)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("spoof check of %s is not applied to its bridge port", owner)
+	}
+	rules, err := rulesOf(conn, pod, owner)
+	if err != nil {
+		return err
+	}
+	if expected := len(spoofCheckRules(mac, ips)); len(rules) != expected {
+		return fmt.Errorf("expected %d spoof check rules of %s, found %d", expected, owner, len(rules))
+	}
+	return nil
+}
+
+// findSpoofCheck returns the patu bridge table and the chain of owner, nil if
+// they don't exist.
+func findSpoofCheck(conn *nftables.Conn, owner string) (*nftables.Table, *nftables.Chain, error) {
+	chains, err := conn.ListChainsOfTableFamily(nftables.TableFamilyBridge)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list nftables chains: %v", err)
+	}
+	var table *nftables.Table
+	var pod *nftables.Chain
+	for _, chain := range chains {
+		if chain.Table.Name != TableName {
+			continue
+		}
+		table = chain.Table
+		if chain.Name == spoofCheckChainPrefix+owner {
+			pod = chain
+		}
+	}
+	return table, pod, nil
+}
+
+func matchIifName(name string) []expr.Any {
+	ifName := make([]byte, unix.IFNAMSIZ)
+	copy(ifName, name)
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ifName},
+	}
+}
+
+func matchEtherType(etherType uint16) []expr.Any {
+	return []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseLLHeader, Offset: etherTypeOffset, Len: 2},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(etherType)},
+	}
+}
+
+func matchLLAddr(offset uint32, op expr.CmpOp, data []byte) []expr.Any {
+	return []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseLLHeader, Offset: offset, Len: uint32(len(data))},
+		&expr.Cmp{Op: op, Register: 1, Data: data},
+	}
+}
+
+func matchNetworkPayload(offset uint32, op expr.CmpOp, data []byte) []expr.Any {
+	return []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: uint32(len(data))},
+		&expr.Cmp{Op: op, Register: 1, Data: data},
+	}
+}
@@ -0,0 +1,132 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nft
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// evalRules runs the rules of a chain on an Ethernet frame and returns the
+// verdict of the first rule matching it, accept if none does.
+func evalRules(t *testing.T, rules [][]expr.Any, frame []byte) expr.VerdictKind {
+	t.Helper()
+	for _, rule := range rules {
+		var reg []byte
+		matched := true
+		for _, e := range rule {
+			switch e := e.(type) {
+			case *expr.Payload:
+				offset := int(e.Offset)
+				if e.Base == expr.PayloadBaseNetworkHeader {
+					offset += 14
+				}
+				if offset+int(e.Len) > len(frame) {
+					matched = false
+					break
+				}
+				reg = append([]byte(nil), frame[offset:offset+int(e.Len)]...)
+			case *expr.Bitwise:
+				for i := range reg {
+					reg[i] = reg[i]&e.Mask[i] ^ e.Xor[i]
+				}
+			case *expr.Cmp:
+				equal := bytes.Equal(reg, e.Data)
+				if (e.Op == expr.CmpOpEq) != equal {
+					matched = false
+				}
+			case *expr.Verdict:
+				return e.Kind
+			default:
+				t.Fatalf("unexpected expression %T", e)
+			}
+			if !matched {
+				break
+			}
+		}
+	}
+	return expr.VerdictAccept
+}
+
+func ethFrame(src net.HardwareAddr, etherType uint16, payload []byte) []byte {
+	frame := make([]byte, 14)
+	copy(frame[6:], src)
+	binary.BigEndian.PutUint16(frame[12:], etherType)
+	return append(frame, payload...)
+}
+
+func arpFrame(src, sha net.HardwareAddr, spa net.IP) []byte {
+	arp := make([]byte, 28)
+	copy(arp[8:], sha)
+	copy(arp[14:], spa.To4())
+	return ethFrame(src, unix.ETH_P_ARP, arp)
+}
+
+func ipv4Frame(src net.HardwareAddr, saddr net.IP) []byte {
+	ip := make([]byte, 20)
+	copy(ip[12:], saddr.To4())
+	return ethFrame(src, unix.ETH_P_IP, ip)
+}
+
+func ipv6Frame(src net.HardwareAddr, saddr net.IP) []byte {
+	ip := make([]byte, 40)
+	copy(ip[8:], saddr.To16())
+	return ethFrame(src, unix.ETH_P_IPV6, ip)
+}
+
+func TestSpoofCheckRules(t *testing.T) {
+	podMAC, _ := net.ParseMAC("02:00:00:00:00:01")
+	otherMAC, _ := net.ParseMAC("02:00:00:00:00:02")
+	podIPs := []net.IP{net.ParseIP("10.0.0.2"), net.ParseIP("fd00::2")}
+	drop, accept := expr.VerdictDrop, expr.VerdictAccept
+	tests := []struct {
+		name  string
+		ips   []net.IP
+		frame []byte
+		want  expr.VerdictKind
+	}{
+		{"IPv4 from the pod", podIPs, ipv4Frame(podMAC, net.ParseIP("10.0.0.2")), accept},
+		{"IPv4 from another address", podIPs, ipv4Frame(podMAC, net.ParseIP("10.0.0.3")), drop},
+		{"IPv4 from the unspecified address", podIPs, ipv4Frame(podMAC, net.IPv4zero), drop},
+		{"IPv4 from another MAC", podIPs, ipv4Frame(otherMAC, net.ParseIP("10.0.0.2")), drop},
+		{"ARP from the pod", podIPs, arpFrame(podMAC, podMAC, net.ParseIP("10.0.0.2")), accept},
+		{"ARP probe", podIPs, arpFrame(podMAC, podMAC, net.IPv4zero), accept},
+		{"ARP for another address", podIPs, arpFrame(podMAC, podMAC, net.ParseIP("10.0.0.3")), drop},
+		{"ARP for another MAC", podIPs, arpFrame(podMAC, otherMAC, net.ParseIP("10.0.0.2")), drop},
+		{"IPv6 from the pod", podIPs, ipv6Frame(podMAC, net.ParseIP("fd00::2")), accept},
+		{"IPv6 from a link-local address", podIPs, ipv6Frame(podMAC, net.ParseIP("fe80::1")), accept},
+		{"IPv6 from the unspecified address", podIPs, ipv6Frame(podMAC, net.IPv6unspecified), accept},
+		{"IPv6 from another address", podIPs, ipv6Frame(podMAC, net.ParseIP("fd00::3")), drop},
+		{"VLAN tagged from the pod", podIPs, ethFrame(podMAC, unix.ETH_P_8021Q, make([]byte, 24)), accept},
+		{"VLAN tagged from another MAC", podIPs, ethFrame(otherMAC, unix.ETH_P_8021Q, make([]byte, 24)), drop},
+		{"without IPAM, IPv4 from any address", nil, ipv4Frame(podMAC, net.ParseIP("10.0.0.3")), accept},
+		{"without IPAM, IPv4 from another MAC", nil, ipv4Frame(otherMAC, net.ParseIP("10.0.0.3")), drop},
+		{"without IPAM, ARP for another MAC", nil, arpFrame(podMAC, otherMAC, net.ParseIP("10.0.0.3")), drop},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := evalRules(t, spoofCheckRules(podMAC, tt.ips), tt.frame); got != tt.want {
+				t.Errorf("verdict = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+/*
+ * Copyright © 2022 Authors of Patu
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative notify.proto
+
+// Package notify is the local API the CNI plugin uses to tell patud about pod
+// attachments as they happen.
+package notify
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// Attached tells the patud listening on the Unix socket at path that a pod
+// was attached. It gives up after timeout.
+func Attached(path string, timeout time.Duration, a *PodAttachment) error {
+	return call(path, timeout, a, PodNotifierClient.PodAttached)
+}
+
+// Detached tells the patud listening on the Unix socket at path that a pod
+// was detached. It gives up after timeout.
+func Detached(path string, timeout time.Duration, a *PodAttachment) error {
+	return call(path, timeout, a, PodNotifierClient.PodDetached)
+}
+
+type notifyFunc func(PodNotifierClient, context.Context, *PodAttachment, ...grpc.CallOption) (*NotifyResponse, error)
+
+func call(path string, timeout time.Duration, a *PodAttachment, fn notifyFunc) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, "unix:"+path,
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %v", path, err)
+	}
+	defer conn.Close()
+	if _, err := fn(NewPodNotifierClient(conn), ctx, a); err != nil {
+		return fmt.Errorf("failed to notify patud: %v", err)
+	}
+	return nil
+}
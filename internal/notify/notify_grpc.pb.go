@@ -0,0 +1,161 @@
+//
+// Copyright © 2022 Authors of Patu
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             v4.24.4
+// source: notify.proto
+
+package notify
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	PodNotifier_PodAttached_FullMethodName = "/patu.notify.v1.PodNotifier/PodAttached"
+	PodNotifier_PodDetached_FullMethodName = "/patu.notify.v1.PodNotifier/PodDetached"
+)
+
+// PodNotifierClient is the client API for PodNotifier service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type PodNotifierClient interface {
+	PodAttached(ctx context.Context, in *PodAttachment, opts ...grpc.CallOption) (*NotifyResponse, error)
+	PodDetached(ctx context.Context, in *PodAttachment, opts ...grpc.CallOption) (*NotifyResponse, error)
+}
+
+type podNotifierClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewPodNotifierClient(cc grpc.ClientConnInterface) PodNotifierClient {
+	return &podNotifierClient{cc}
+}
+
+func (c *podNotifierClient) PodAttached(ctx context.Context, in *PodAttachment, opts ...grpc.CallOption) (*NotifyResponse, error) {
+	out := new(NotifyResponse)
+	err := c.cc.Invoke(ctx, PodNotifier_PodAttached_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *podNotifierClient) PodDetached(ctx context.Context, in *PodAttachment, opts ...grpc.CallOption) (*NotifyResponse, error) {
+	out := new(NotifyResponse)
+	err := c.cc.Invoke(ctx, PodNotifier_PodDetached_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// PodNotifierServer is the server API for PodNotifier service.
+// All implementations must embed UnimplementedPodNotifierServer
+// for forward compatibility
+type PodNotifierServer interface {
+	PodAttached(context.Context, *PodAttachment) (*NotifyResponse, error)
+	PodDetached(context.Context, *PodAttachment) (*NotifyResponse, error)
+	mustEmbedUnimplementedPodNotifierServer()
+}
+
+// UnimplementedPodNotifierServer must be embedded to have forward compatible implementations.
+type UnimplementedPodNotifierServer struct {
+}
+
+func (UnimplementedPodNotifierServer) PodAttached(context.Context, *PodAttachment) (*NotifyResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PodAttached not implemented")
+}
+func (UnimplementedPodNotifierServer) PodDetached(context.Context, *PodAttachment) (*NotifyResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PodDetached not implemented")
+}
+func (UnimplementedPodNotifierServer) mustEmbedUnimplementedPodNotifierServer() {}
+
+// UnsafePodNotifierServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to PodNotifierServer will
+// result in compilation errors.
+type UnsafePodNotifierServer interface {
+	mustEmbedUnimplementedPodNotifierServer()
+}
+
+func RegisterPodNotifierServer(s grpc.ServiceRegistrar, srv PodNotifierServer) {
+	s.RegisterService(&PodNotifier_ServiceDesc, srv)
+}
+
+func _PodNotifier_PodAttached_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PodAttachment)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PodNotifierServer).PodAttached(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: PodNotifier_PodAttached_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PodNotifierServer).PodAttached(ctx, req.(*PodAttachment))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _PodNotifier_PodDetached_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PodAttachment)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PodNotifierServer).PodDetached(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: PodNotifier_PodDetached_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PodNotifierServer).PodDetached(ctx, req.(*PodAttachment))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// PodNotifier_ServiceDesc is the grpc.ServiceDesc for PodNotifier service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var PodNotifier_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "patu.notify.v1.PodNotifier",
+	HandlerType: (*PodNotifierServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "PodAttached",
+			Handler:    _PodNotifier_PodAttached_Handler,
+		},
+		{
+			MethodName: "PodDetached",
+			Handler:    _PodNotifier_PodDetached_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "notify.proto",
+}
@@ -6,5 +6,5 @@ echo "Patu pod name is : "$PATU_POD
 kubectl exec -it $PATU_POD -c patu -n kube-system -- ls -lrt ./bpf/
 kubectl cp ../bpf kube-system/$PATU_POD:/cni/ -c patu
 kubectl exec -it $PATU_POD -c patu -n kube-system -- ls -lrt ./bpf/
-kubectl exec -it $PATU_POD -c patu -n kube-system -- make -C bpf detach-sk-msg detach-sockops unload-sk-msg unload-sockops
-kubectl exec -it $PATU_POD -c patu -n kube-system -- make -C bpf load-sockops load-sk-msg attach-sockops attach-sk-msg
\ No newline at end of file
+kubectl exec -it $PATU_POD -c patu -n kube-system -- make -C bpf detach-getpeername4 detach-connect4 detach-sk-msg detach-sockops unload-xdp unload-fastpath-ingress unload-fastpath-egress unload-snat-ingress unload-snat-egress unload-bw-uplink unload-bw-ingress unload-bw-egress unload-getpeername4 unload-connect4 unload-sk-msg unload-sockops
+kubectl exec -it $PATU_POD -c patu -n kube-system -- make -C bpf load-sockops load-sk-msg load-connect4 load-getpeername4 load-bw-egress load-bw-ingress load-bw-uplink load-snat-egress load-snat-ingress load-fastpath-egress load-fastpath-ingress load-xdp attach-sockops attach-sk-msg attach-connect4 attach-getpeername4
\ No newline at end of file